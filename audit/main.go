@@ -0,0 +1,175 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"os/signal"
+	"path"
+	"strings"
+	"time"
+
+	"cloud.google.com/go/storage"
+	"github.com/dlorenc/gcs-manifest/pkg/manifest"
+)
+
+var (
+	full         = flag.Bool("full", false, "download every object in full and recompute its sha256; required, as it is the only kind of audit")
+	manifestPath = flag.String("manifest", "", "manifest to audit against, gs:// or local; defaults to manifest.json under the prefix")
+	reportPath   = flag.String("report", "audit-report.json", "file to write the audit report to, and to resume from with --resume")
+	resume       = flag.Bool("resume", false, "resume the interrupted audit in --report instead of starting over")
+	maxBandwidth = flag.String("max-bandwidth", "", "cap on the download rate across all objects, e.g. 50MiB/s; unlimited if unset")
+	parallelism  = flag.Int("parallelism", manifest.DefaultParallelism(), "how many objects to download at once")
+	publicKeys   = stringsFlag{}
+
+	kmsKey    = flag.String("kms-key", "", "Cloud KMS key version to sign the finished report with, projects/*/locations/*/keyRings/*/cryptoKeys/*/cryptoKeyVersions/*")
+	certChain = flag.String("cert-chain", "", "optional PEM file of the signing key's certificate and its chain, leaf first, to record in the signature bundle")
+
+	encryptionKey = flag.String("encryption-key", "", "base64 AES-256 customer-supplied key (CSEK) the files were uploaded with")
+
+	useProfile = manifest.ProfileFlag(flag.CommandLine)
+)
+
+// stringsFlag collects a repeatable string flag.
+type stringsFlag []string
+
+func (s *stringsFlag) String() string { return strings.Join(*s, ",") }
+
+func (s *stringsFlag) Set(v string) error {
+	*s = append(*s, v)
+	return nil
+}
+
+func main() {
+	flag.Var(&publicKeys, "verify-signature", "PEM public key the manifest's detached signature must verify with (repeatable)")
+	flag.Usage = func() {
+		fmt.Fprintf(os.Stderr, "usage: %s --full [flags] gs://bucket/path\n", os.Args[0])
+		fmt.Fprintf(os.Stderr, "\nDownloads every object a manifest references and compares its recomputed sha256 with the recorded one, writing a report of each, signed with --kms-key.\n\n")
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+	if err := useProfile(); err != nil {
+		log.Fatal(err)
+	}
+	if flag.NArg() != 1 {
+		flag.Usage()
+		os.Exit(2)
+	}
+	if !*full {
+		log.Fatal("audit needs --full; for a check against the checksums GCS reports, use verify")
+	}
+	dst := flag.Arg(0)
+	uri := *manifestPath
+	if uri == "" {
+		bucketName, prefix := manifest.ParsePrefix(dst)
+		uri = "gs://" + path.Join(bucketName, prefix, manifest.Name)
+	}
+
+	opts := []manifest.Option{
+		manifest.WithLog(os.Stderr),
+		manifest.WithParallelism(*parallelism),
+	}
+	if *maxBandwidth != "" {
+		bps, err := parseBandwidth(*maxBandwidth)
+		if err != nil {
+			log.Fatal(err)
+		}
+		opts = append(opts, manifest.WithMaxBandwidth(bps))
+	}
+	if *encryptionKey != "" {
+		key, err := manifest.ParseEncryptionKey(*encryptionKey)
+		if err != nil {
+			log.Fatal(err)
+		}
+		opts = append(opts, manifest.WithEncryptionKey(key))
+	}
+	for _, k := range publicKeys {
+		pub, err := manifest.LoadPublicKey(k)
+		if err != nil {
+			log.Fatal(err)
+		}
+		opts = append(opts, manifest.WithPublicKey(pub))
+	}
+
+	// An interrupted audit saves what it has done so far for --resume.
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	interrupt := make(chan os.Signal, 1)
+	signal.Notify(interrupt, os.Interrupt)
+	go func() {
+		<-interrupt
+		cancel()
+	}()
+	if *kmsKey != "" {
+		signer, err := manifest.NewKMSSigner(ctx, *kmsKey)
+		if err != nil {
+			log.Fatal(err)
+		}
+		opts = append(opts, manifest.WithSigner(signer))
+		if *certChain != "" {
+			b, err := ioutil.ReadFile(*certChain)
+			if err != nil {
+				log.Fatal(err)
+			}
+			certs, err := manifest.ParseCertChain(b)
+			if err != nil {
+				log.Fatalf("--cert-chain %s: %v", *certChain, err)
+			}
+			opts = append(opts, manifest.WithCertChain(certs))
+		}
+	}
+	client, err := storage.NewClient(ctx)
+	if err != nil {
+		log.Fatalf("Failed to create new GCS client: %v", err)
+	}
+	opts = append(opts, manifest.WithClient(client))
+	v, err := manifest.NewVerifier(ctx, opts...)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	m, err := v.ReadManifest(ctx, uri)
+	if err != nil {
+		log.Fatalf("Failed to read manifest: %v", err)
+	}
+	b, err := manifest.ReadBytes(ctx, client, uri)
+	if err != nil {
+		log.Fatalf("Failed to read manifest: %v", err)
+	}
+	digest, err := manifest.Digest(bytes.NewReader(b))
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	a := &manifest.AuditReport{Dst: dst, Manifest: uri, ManifestDigest: digest, Started: time.Now().UTC()}
+	if *resume {
+		if a, err = manifest.LoadAuditReport(*reportPath); err != nil {
+			log.Fatalf("Failed to read audit report: %v", err)
+		}
+		if a.Dst != dst || a.ManifestDigest != digest {
+			log.Fatalf("%s is an audit of %s with manifest %s, not of %s with manifest %s", *reportPath, a.Dst, a.ManifestDigest, dst, digest)
+		}
+		a.Finished = time.Time{}
+	}
+	if err := v.Audit(ctx, m, dst, a, *reportPath); err != nil {
+		fmt.Fprintln(os.Stderr, "Finish with: audit --full --resume --report", *reportPath, dst)
+		log.Fatal(err)
+	}
+
+	var failed, total int64
+	for _, e := range a.Files {
+		total += e.Bytes
+		if !e.OK {
+			failed++
+			fmt.Printf("FAILED: %s: %s\n", e.Path, e.Error)
+		}
+	}
+	fmt.Fprintf(os.Stderr, "Audited %d files, %d bytes: %d failed. Report written to %s\n", len(a.Files), total, failed, *reportPath)
+	if !a.OK() {
+		os.Exit(1)
+	}
+}
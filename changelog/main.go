@@ -0,0 +1,108 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	htmltemplate "html/template"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"text/template"
+
+	"github.com/dlorenc/gcs-manifest/pkg/manifest"
+)
+
+var (
+	templatePath = flag.String("template", "", "template to render the changelog with; .html/.htm templates are rendered as HTML")
+)
+
+const defaultTemplate = `## Changes
+{{- if .Added}}
+
+### Added
+{{range .Added}}
+- ` + "`{{.Path}}`" + ` ({{.Digest}}, {{.Size}} bytes)
+{{- end}}
+{{- end}}
+{{- if .Removed}}
+
+### Removed
+{{range .Removed}}
+- ` + "`{{.Path}}`" + ` ({{.Digest}}, {{.Size}} bytes)
+{{- end}}
+{{- end}}
+{{- if .Changed}}
+
+### Changed
+{{range .Changed}}
+- ` + "`{{.Path}}`" + ` ({{.OldDigest}} -> {{.NewDigest}}, {{.OldSize}} -> {{.NewSize}} bytes)
+{{- end}}
+{{- end}}
+`
+
+// Changelog is the data passed to the template: the manifest.Diff of the
+// two manifests, with Modified as Changed.
+type Changelog struct {
+	Old     string
+	New     string
+	Added   []manifest.Entry
+	Removed []manifest.Entry
+	Changed []manifest.Modification
+}
+
+type executor interface {
+	Execute(w io.Writer, data interface{}) error
+}
+
+func main() {
+	flag.Usage = func() {
+		fmt.Fprintf(os.Stderr, "usage: %s [--template tmpl.md] old.json new.json\n", os.Args[0])
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+	if flag.NArg() != 2 {
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	ctx := context.Background()
+	oldMfst, err := manifest.Read(ctx, nil, flag.Arg(0))
+	if err != nil {
+		log.Fatal(err)
+	}
+	newMfst, err := manifest.Read(ctx, nil, flag.Arg(1))
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	tmpl, err := loadTemplate(*templatePath)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	d := manifest.Diff(oldMfst, newMfst)
+	cl := &Changelog{Old: flag.Arg(0), New: flag.Arg(1), Added: d.Added, Removed: d.Removed, Changed: d.Modified}
+	if err := tmpl.Execute(os.Stdout, cl); err != nil {
+		log.Fatal(err)
+	}
+}
+
+func loadTemplate(path string) (executor, error) {
+	if path == "" {
+		return template.New("changelog").Parse(defaultTemplate)
+	}
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".html", ".htm":
+		return htmltemplate.New(filepath.Base(path)).Parse(string(b))
+	default:
+		return template.New(filepath.Base(path)).Parse(string(b))
+	}
+}
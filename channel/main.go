@@ -0,0 +1,71 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"time"
+
+	"cloud.google.com/go/storage"
+	"github.com/dlorenc/gcs-manifest/pkg/manifest"
+)
+
+var (
+	channel = flag.String("channel", "", "channel to publish to, promote to or show, such as stable or beta")
+	from    = flag.String("from", "", "channel to promote from")
+	dir     = flag.String("channels", "", "gs:// directory the channels are kept in; defaults to gs://<bucket>/"+manifest.ChannelDir+" for publish")
+
+	useProfile = manifest.ProfileFlag(flag.CommandLine)
+)
+
+func main() {
+	flag.Usage = func() {
+		fmt.Fprintf(os.Stderr, "usage: %s --channel name publish gs://bucket/path\n", os.Args[0])
+		fmt.Fprintf(os.Stderr, "       %s --channels gs://bucket/channels --channel name --from name promote\n", os.Args[0])
+		fmt.Fprintf(os.Stderr, "       %s --channels gs://bucket/channels --channel name show\n", os.Args[0])
+		fmt.Fprintf(os.Stderr, "\nPoints a channel at the manifest published to a path, or at the manifest another channel points to, or shows what it points to.\n\n")
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+	if err := useProfile(); err != nil {
+		log.Fatal(err)
+	}
+	if *channel == "" || flag.NArg() < 1 {
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	ctx := context.Background()
+	client, err := storage.NewClient(ctx)
+	if err != nil {
+		log.Fatalf("Failed to create new GCS client: %v", err)
+	}
+
+	var c *manifest.Channel
+	switch cmd := flag.Arg(0); {
+	case cmd == "publish" && flag.NArg() == 2:
+		if *dir == "" {
+			if *dir, err = manifest.DefaultChannelDir(flag.Arg(1)); err != nil {
+				log.Fatal(err)
+			}
+		}
+		c, err = manifest.PublishChannel(ctx, client, manifest.ChannelURI(*dir, *channel), flag.Arg(1))
+	case cmd == "promote" && flag.NArg() == 1 && *from != "" && *dir != "":
+		c, err = manifest.PromoteChannel(ctx, client, manifest.ChannelURI(*dir, *channel), manifest.ChannelURI(*dir, *from))
+	case cmd == "show" && flag.NArg() == 1 && *dir != "":
+		c, err = manifest.ReadChannel(ctx, client, manifest.ChannelURI(*dir, *channel))
+	default:
+		flag.Usage()
+		os.Exit(2)
+	}
+	if err != nil {
+		log.Fatal(err)
+	}
+	fmt.Printf("%s: %s#%d %s", *channel, c.Manifest, c.Generation, c.Digest)
+	if c.From != "" {
+		fmt.Printf(", promoted from %s", c.From)
+	}
+	fmt.Printf(", updated %s\n", c.Updated.Format(time.RFC3339))
+}
@@ -0,0 +1,186 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"text/template"
+	"time"
+
+	"cloud.google.com/go/storage"
+	"github.com/dlorenc/gcs-manifest/pkg/manifest"
+	"google.golang.org/api/iterator"
+)
+
+// commands are the tools completions are generated for. Their flags aren't
+// listed here: the scripts ask each tool for its -h output when completing,
+// so they can't fall out of date.
+var commands = []string{
+	"audit", "changelog", "channel", "completion", "diff", "download", "export", "export-sbom", "fetch", "hash", "import",
+	"inventory", "prune", "repair", "runs", "serve", "sign-urls", "touch-metadata", "transfer-job", "upload", "verify",
+	"verify-remote",
+}
+
+var (
+	project  = flag.String("project", "", "project whose buckets to list for gs:// completion; defaults to $GOOGLE_CLOUD_PROJECT or $CLOUDSDK_CORE_PROJECT")
+	cacheTTL = flag.Duration("cache-ttl", time.Hour, "how long the list of buckets is cached for")
+
+	useProfile = manifest.ProfileFlag(flag.CommandLine)
+)
+
+func main() {
+	flag.Usage = func() {
+		fmt.Fprintf(os.Stderr, "usage: %s [flags] bash|zsh|fish|buckets\n", os.Args[0])
+		fmt.Fprintf(os.Stderr, "\nPrints a completion script for the given shell; for example, in ~/.bashrc:\n\n\tsource <(%s bash)\n\n", os.Args[0])
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+	if err := useProfile(); err != nil {
+		log.Fatal(err)
+	}
+	if flag.NArg() != 1 {
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	switch shell := flag.Arg(0); shell {
+	case "bash", "zsh", "fish":
+		data := struct {
+			Self     string
+			Commands string
+		}{filepath.Base(os.Args[0]), strings.Join(commands, " ")}
+		if err := scripts.ExecuteTemplate(os.Stdout, shell, data); err != nil {
+			log.Fatal(err)
+		}
+	case "buckets":
+		// The scripts call this on every gs:// completion and discard
+		// anything on stderr.
+		names, err := buckets()
+		if err != nil {
+			log.Fatal(err)
+		}
+		for _, n := range names {
+			fmt.Printf("gs://%s/\n", n)
+		}
+	default:
+		flag.Usage()
+		os.Exit(2)
+	}
+}
+
+// buckets returns the project's bucket names, from the cache if it is
+// fresh enough: listing them takes long enough to be noticeable at a
+// prompt.
+func buckets() ([]string, error) {
+	p := *project
+	if p == "" {
+		p = os.Getenv("GOOGLE_CLOUD_PROJECT")
+	}
+	if p == "" {
+		p = os.Getenv("CLOUDSDK_CORE_PROJECT")
+	}
+	if p == "" {
+		return nil, fmt.Errorf("no project: set --project or $GOOGLE_CLOUD_PROJECT")
+	}
+
+	dir, err := os.UserCacheDir()
+	if err != nil {
+		return nil, err
+	}
+	cache := filepath.Join(dir, "gcs-manifest", "buckets-"+p)
+	if fi, err := os.Stat(cache); err == nil && time.Since(fi.ModTime()) < *cacheTTL {
+		b, err := ioutil.ReadFile(cache)
+		if err != nil {
+			return nil, err
+		}
+		return strings.Fields(string(b)), nil
+	}
+
+	ctx := context.Background()
+	client, err := storage.NewClient(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("creating GCS client: %v", err)
+	}
+	var names []string
+	it := client.Buckets(ctx, p)
+	for {
+		attrs, err := it.Next()
+		if err == iterator.Done {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("listing buckets in %s: %v", p, err)
+		}
+		names = append(names, attrs.Name)
+	}
+	// A cache that can't be written just means listing again next time.
+	if err := os.MkdirAll(filepath.Dir(cache), 0755); err == nil {
+		ioutil.WriteFile(cache, []byte(strings.Join(names, "\n")+"\n"), 0644)
+	}
+	return names, nil
+}
+
+// In every shell, a word starting with gs:// completes to bucket names, one
+// starting with - to the command's flags, the values of --manifest and
+// --policy to local .json files, and anything else to local paths.
+var scripts = template.Must(template.New("").Parse(`
+{{define "bash"}}# bash completion for gcs-manifest tools; generated by {{.Self}} bash.
+_gcs_manifest_complete() {
+	# COMP_WORDS splits gs://bucket at the colon, so take the word from
+	# the line instead.
+	local line="${COMP_LINE:0:COMP_POINT}"
+	local cur="${line##* }"
+	local prev="${COMP_WORDS[COMP_CWORD-1]}"
+	case "$cur" in
+	gs://*)
+		COMPREPLY=($(compgen -W "$({{.Self}} buckets 2>/dev/null)" -- "$cur"))
+		# Readline only replaces the part of the word after the colon.
+		COMPREPLY=("${COMPREPLY[@]#*:}")
+		compopt -o nospace 2>/dev/null
+		return
+		;;
+	-*)
+		COMPREPLY=($(compgen -W "$("${COMP_WORDS[0]}" -h 2>&1 | sed -n 's/^  -\([^ ]*\).*/--\1/p')" -- "$cur"))
+		return
+		;;
+	esac
+	case "$prev" in
+	-manifest|--manifest|-policy|--policy)
+		COMPREPLY=($(compgen -f -X '!*.json' -- "$cur") $(compgen -d -- "$cur"))
+		return
+		;;
+	esac
+	COMPREPLY=($(compgen -f -- "$cur"))
+}
+complete -o filenames -F _gcs_manifest_complete {{.Commands}}
+{{end}}
+{{define "zsh"}}# zsh completion for gcs-manifest tools; generated by {{.Self}} zsh.
+autoload -U +X bashcompinit && bashcompinit
+{{template "bash" .}}{{end}}
+{{define "fish"}}# fish completion for gcs-manifest tools; generated by {{.Self}} fish.
+function __gcs_manifest_complete
+	set -l tokens (commandline -opc)
+	set -l cur (commandline -ct)
+	switch $cur
+	case 'gs://*'
+		{{.Self}} buckets 2>/dev/null
+	case '-*'
+		$tokens[1] -h 2>&1 | string replace -rf '^  -(\S+).*' -- '--$1'
+	case '*'
+		switch $tokens[-1]
+		case -manifest --manifest -policy --policy
+			__fish_complete_suffix .json
+		case '*'
+			__fish_complete_path $cur
+		end
+	end
+end
+for cmd in {{.Commands}}
+	complete -c $cmd -f -a '(__gcs_manifest_complete)'
+end
+{{end}}`))
@@ -0,0 +1,152 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"cloud.google.com/go/storage"
+	"github.com/dlorenc/gcs-manifest/pkg/manifest"
+	"google.golang.org/api/iterator"
+)
+
+var (
+	local  = flag.String("local", "", "local directory to compare")
+	remote = flag.String("remote", "", "GCS prefix to compare against, e.g. gs://bucket/prefix")
+	asJSON = flag.Bool("json", false, "print manifest differences as JSON")
+
+	useProfile = manifest.ProfileFlag(flag.CommandLine)
+)
+
+var castagnoli = crc32.MakeTable(crc32.Castagnoli)
+
+func main() {
+	flag.Usage = func() {
+		fmt.Fprintf(os.Stderr, "usage: %s [--json] manifestA manifestB|localdir\n       %s --local dir --remote gs://bucket/prefix\n", os.Args[0], os.Args[0])
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+	if err := useProfile(); err != nil {
+		log.Fatal(err)
+	}
+	if flag.NArg() == 2 {
+		diffManifests(flag.Arg(0), flag.Arg(1))
+		return
+	}
+	if *local == "" || *remote == "" {
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	localSums, err := hashLocal(*local)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	ctx := context.Background()
+	client, err := storage.NewClient(ctx)
+	if err != nil {
+		log.Fatalf("Failed to create new GCS client: %v", err)
+	}
+	remoteSums, err := listRemote(ctx, client, *remote)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	if n := printDiff(localSums, remoteSums); n > 0 {
+		os.Exit(1)
+	}
+}
+
+// printDiff writes one line per differing path, "+" for local-only, "-"
+// for remote-only and "M" for content changes, and returns the count.
+func printDiff(localSums, remoteSums map[string]uint32) int {
+	paths := map[string]bool{}
+	for p := range localSums {
+		paths[p] = true
+	}
+	for p := range remoteSums {
+		paths[p] = true
+	}
+	sorted := make([]string, 0, len(paths))
+	for p := range paths {
+		sorted = append(sorted, p)
+	}
+	sort.Strings(sorted)
+
+	n := 0
+	for _, p := range sorted {
+		l, inLocal := localSums[p]
+		r, inRemote := remoteSums[p]
+		switch {
+		case !inRemote:
+			fmt.Println("+", p)
+		case !inLocal:
+			fmt.Println("-", p)
+		case l != r:
+			fmt.Println("M", p)
+		default:
+			continue
+		}
+		n++
+	}
+	return n
+}
+
+// hashLocal returns the CRC32C of every regular file under root, keyed by
+// slash-separated path relative to root.
+func hashLocal(root string) (map[string]uint32, error) {
+	sums := map[string]uint32{}
+	err := filepath.Walk(root, func(path string, fi os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if !fi.Mode().IsRegular() {
+			return nil
+		}
+		relPath, err := filepath.Rel(root, path)
+		if err != nil {
+			return err
+		}
+		f, err := os.Open(path)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		h := crc32.New(castagnoli)
+		if _, err := io.Copy(h, f); err != nil {
+			return err
+		}
+		sums[filepath.ToSlash(relPath)] = h.Sum32()
+		return nil
+	})
+	return sums, err
+}
+
+// listRemote returns the CRC32C GCS reports for every object under uri,
+// keyed by name relative to the prefix.
+func listRemote(ctx context.Context, client *storage.Client, uri string) (map[string]uint32, error) {
+	bucketName, prefix := manifest.ParsePrefix(uri)
+	if prefix != "" && !strings.HasSuffix(prefix, "/") {
+		prefix += "/"
+	}
+	sums := map[string]uint32{}
+	it := client.Bucket(bucketName).Objects(ctx, &storage.Query{Prefix: prefix})
+	for {
+		attrs, err := it.Next()
+		if err == iterator.Done {
+			return sums, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		sums[strings.TrimPrefix(attrs.Name, prefix)] = attrs.CRC32C
+	}
+}
@@ -0,0 +1,72 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+
+	"cloud.google.com/go/storage"
+	"github.com/dlorenc/gcs-manifest/pkg/manifest"
+)
+
+// diffManifests compares manifest a with b, which is either another
+// manifest or a local directory to hash. Like the CRC32C comparison, it
+// exits 1 if anything differs.
+func diffManifests(a, b string) {
+	ctx := context.Background()
+	var client *storage.Client
+	if strings.HasPrefix(a, "gs://") || strings.HasPrefix(b, "gs://") {
+		var err error
+		if client, err = storage.NewClient(ctx); err != nil {
+			log.Fatalf("Failed to create new GCS client: %v", err)
+		}
+	}
+
+	from, err := manifest.Read(ctx, client, a)
+	if err != nil {
+		log.Fatal(err)
+	}
+	var to *manifest.Manifest
+	if fi, err := os.Stat(b); err == nil && fi.IsDir() {
+		// Only record the directory's symlinks if the manifest was
+		// uploaded recording them too.
+		var opts []manifest.Option
+		for _, e := range from.Files {
+			if e.Link != "" {
+				opts = append(opts, manifest.WithPreserveLinks())
+				break
+			}
+		}
+		to, err = manifest.FromDir(b, opts...)
+		if err != nil {
+			log.Fatal(err)
+		}
+	} else if to, err = manifest.Read(ctx, client, b); err != nil {
+		log.Fatal(err)
+	}
+
+	c := manifest.Diff(from, to)
+	if *asJSON {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		if err := enc.Encode(c); err != nil {
+			log.Fatal(err)
+		}
+	} else {
+		for _, e := range c.Added {
+			fmt.Printf("+ %s (%s)\n", e.Path, e.Digest)
+		}
+		for _, e := range c.Removed {
+			fmt.Printf("- %s (%s)\n", e.Path, e.Digest)
+		}
+		for _, m := range c.Modified {
+			fmt.Printf("M %s (%s -> %s)\n", m.Path, m.OldDigest, m.NewDigest)
+		}
+	}
+	if !c.Empty() {
+		os.Exit(1)
+	}
+}
@@ -0,0 +1,292 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/dlorenc/gcs-manifest/pkg/manifest"
+)
+
+var (
+	manifestPath = flag.String("manifest", "", "manifest to restore: a gs://, s3:// or file:// URI, or a local file")
+	src          = flag.String("src", "", "gs://, s3:// or file:// path the manifest's files live under; defaults to the manifest's directory")
+	dst          = flag.String("dst", ".", "local directory to restore into")
+	tarPath      = flag.String("tar", "", "stream the files as a tar archive to this file, or - for stdout, instead of restoring them into --dst, checking each one's digest before writing it; a file that doesn't match leaves no archive behind, or an unfinished one on stdout; gs:// only")
+	publicKeys   = stringsFlag{}
+	policyPath   = flag.String("policy", "", "verification policy file the manifest must satisfy; nothing is downloaded otherwise")
+	parallelism  = flag.Int("parallelism", manifest.DefaultParallelism(), "how many objects, or batches of small ones, to download at once")
+	readAhead    = flag.Int64("read-ahead", manifest.DefaultReadAhead, "how many bytes of small objects to buffer in memory while fetching them in batches; 0 fetches every object on its own")
+
+	channel = flag.String("channel", "", "gs:// channel pointer, e.g. gs://bucket/channels/stable.json, to download the manifest of instead of --manifest")
+	poll    = flag.Duration("poll", 0, "with --channel, keep checking the pointer this often and download each new manifest it points to; 0 downloads once")
+	hook    = flag.String("hook", "", "with --channel, a command to run with sh -c after each download, with $GCS_MANIFEST_CHANNEL, $GCS_MANIFEST, $GCS_MANIFEST_DIGEST and $GCS_MANIFEST_DST set")
+
+	resume         = flag.Bool("resume", false, "keep files already in --dst that match their digests, from an interrupted download, instead of fetching them again")
+	retries        = flag.Int("retries", 3, "how many times to retry opening each object, with exponential backoff")
+	maxBandwidth   = flag.String("max-bandwidth", "", "cap on the download rate across all files, e.g. 50MiB/s; unlimited if unset")
+	maxRequestRate = flag.Float64("max-requests-per-second", 0, "cap on object operations started a second across all files; 0 means no limit")
+
+	planRetrieval = flag.Bool("plan-retrieval", false, "before downloading from gs://, look up the storage class of every object and report the files and bytes in each, what reading them costs and, with --max-bandwidth, how long until the last is available")
+	maxCost       = flag.Float64("max-retrieval-cost", 0, "with --plan-retrieval, abort before downloading anything if reading the objects is estimated to cost more than this in USD; 0 means no limit")
+	pricesPath    = flag.String("prices", "", "JSON file mapping storage classes to {classB, retrievalGB} prices in USD to plan retrievals with, instead of US multi-region list prices")
+
+	keepEncoding = flag.Bool("keep-encoding", false, "restore objects uploaded with --compress still compressed, checked against their stored digest, instead of decompressing them and checking the original file's")
+
+	encryptionKey = flag.String("encryption-key", "", "base64 AES-256 customer-supplied key (CSEK) the files were uploaded with; gs:// only")
+
+	useProfile = manifest.ProfileFlag(flag.CommandLine)
+)
+
+// stringsFlag collects a repeatable string flag.
+type stringsFlag []string
+
+func (s *stringsFlag) String() string { return strings.Join(*s, ",") }
+
+func (s *stringsFlag) Set(v string) error {
+	*s = append(*s, v)
+	return nil
+}
+
+func main() {
+	flag.Var(&publicKeys, "verify-signature", "PEM public key the manifest's detached signature must verify with; nothing is downloaded otherwise (repeatable, e.g. the old and new keys during a rotation)")
+	flag.Parse()
+	if err := useProfile(); err != nil {
+		log.Fatal(err)
+	}
+	if (*manifestPath == "") == (*channel == "") {
+		log.Fatal("one of --manifest or --channel is required")
+	}
+	if *tarPath != "" && (*channel != "" || *resume) {
+		log.Fatal("--tar can't be used with --channel or --resume")
+	}
+	if *channel != "" && *src != "" {
+		log.Fatal("--src can't be used with --channel: files are downloaded from the directory of the manifest the channel points to")
+	}
+	if *src == "" && *channel == "" {
+		if !strings.HasPrefix(*manifestPath, "gs://") && !manifest.IsStorageURI(*manifestPath) {
+			log.Fatal("--src is required with a local manifest")
+		}
+		if strings.HasPrefix(*manifestPath, "gs://") {
+			*src = manifest.ManifestRoot(*manifestPath)
+		} else {
+			*src = (*manifestPath)[:strings.LastIndex(*manifestPath, "/")]
+		}
+	}
+
+	opts := []manifest.Option{
+		manifest.WithLog(os.Stderr),
+		manifest.WithParallelism(*parallelism),
+		manifest.WithReadAhead(*readAhead),
+		manifest.WithRetries(*retries),
+		manifest.WithMaxRequestRate(*maxRequestRate),
+	}
+	if *maxCost > 0 && !*planRetrieval {
+		log.Fatal("--max-retrieval-cost needs --plan-retrieval")
+	}
+	if *resume {
+		opts = append(opts, manifest.WithResume())
+	}
+	if *maxBandwidth != "" {
+		bps, err := parseBandwidth(*maxBandwidth)
+		if err != nil {
+			log.Fatal(err)
+		}
+		opts = append(opts, manifest.WithMaxBandwidth(bps))
+	}
+	if *keepEncoding {
+		opts = append(opts, manifest.WithKeepEncoding())
+	}
+	if *encryptionKey != "" {
+		key, err := manifest.ParseEncryptionKey(*encryptionKey)
+		if err != nil {
+			log.Fatal(err)
+		}
+		opts = append(opts, manifest.WithEncryptionKey(key))
+	}
+	for _, k := range publicKeys {
+		pub, err := manifest.LoadPublicKey(k)
+		if err != nil {
+			log.Fatal(err)
+		}
+		opts = append(opts, manifest.WithPublicKey(pub))
+	}
+	if *policyPath != "" {
+		p, err := manifest.LoadPolicy(*policyPath)
+		if err != nil {
+			log.Fatal(err)
+		}
+		popts, err := p.Options()
+		if err != nil {
+			log.Fatal(err)
+		}
+		opts = append(opts, popts...)
+	}
+
+	ctx := context.Background()
+	if *channel != "" {
+		follow(ctx, opts)
+		return
+	}
+	if manifest.IsStorageURI(*src) {
+		if *encryptionKey != "" || *planRetrieval || *tarPath != "" {
+			log.Fatal("--encryption-key, --plan-retrieval and --tar are only supported for gs:// sources")
+		}
+		st, err := manifest.OpenStorage(ctx, *src, nil)
+		if err != nil {
+			log.Fatal(err)
+		}
+		m, err := manifest.ReadManifest(ctx, *manifestPath, opts...)
+		if err != nil {
+			log.Fatalf("Failed to read manifest: %v", err)
+		}
+		warnPartial(*manifestPath, m)
+		if err := manifest.DownloadFrom(ctx, st, m, *dst, opts...); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+	d, err := manifest.NewDownloader(ctx, opts...)
+	if err != nil {
+		log.Fatal(err)
+	}
+	m, err := d.ReadManifest(ctx, *manifestPath)
+	if err != nil {
+		log.Fatalf("Failed to read manifest: %v", err)
+	}
+	warnPartial(*manifestPath, m)
+	if err := checkRetrieval(ctx, d, m, *src); err != nil {
+		log.Fatal(err)
+	}
+	if *tarPath != "" {
+		if err := writeTar(ctx, d, m); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+	if err := d.Download(ctx, m, *src, *dst); err != nil {
+		log.Fatal(err)
+	}
+}
+
+// writeTar streams the files of m to --tar. A file is written under a
+// temporary name in the same directory and renamed into place once the
+// archive is complete, so a failed download leaves nothing behind.
+func writeTar(ctx context.Context, d *manifest.Downloader, m *manifest.Manifest) error {
+	if *tarPath == "-" {
+		return d.DownloadTar(ctx, m, *src, os.Stdout)
+	}
+	f, err := ioutil.TempFile(filepath.Dir(*tarPath), "."+filepath.Base(*tarPath)+".")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+	if err := f.Chmod(0644); err != nil {
+		f.Close()
+		return err
+	}
+	if err := d.DownloadTar(ctx, m, *src, f); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	return os.Rename(f.Name(), *tarPath)
+}
+
+// checkRetrieval reports, for --plan-retrieval, what downloading m from src
+// would read from each storage class and cost, and fails if that is over
+// --max-retrieval-cost.
+func checkRetrieval(ctx context.Context, d *manifest.Downloader, m *manifest.Manifest, src string) error {
+	if !*planRetrieval {
+		return nil
+	}
+	prices := manifest.DefaultPrices
+	if *pricesPath != "" {
+		var err error
+		if prices, err = manifest.LoadPrices(*pricesPath); err != nil {
+			return err
+		}
+	}
+	r, err := d.PlanRetrieval(ctx, m, src, *dst, prices)
+	if err != nil {
+		return fmt.Errorf("planning retrieval: %v", err)
+	}
+	for _, class := range r.Classes() {
+		fmt.Fprintf(os.Stderr, "%s: %d files, %d bytes\n", class, r.Files[class], r.Bytes[class])
+	}
+	fmt.Fprintf(os.Stderr, "Estimated retrieval cost: $%.4f\n", r.Cost)
+	if r.Time > 0 {
+		fmt.Fprintf(os.Stderr, "Estimated time until every file is available: %v\n", r.Time.Round(time.Second))
+	}
+	if *maxCost > 0 && r.Cost > *maxCost {
+		return fmt.Errorf("estimated retrieval cost $%.4f is over --max-retrieval-cost $%.4f; nothing was downloaded", r.Cost, *maxCost)
+	}
+	return nil
+}
+
+// warnPartial says up front, before anything is downloaded, when the
+// manifest is partial; the download then fails once the rest is fetched.
+func warnPartial(uri string, m *manifest.Manifest) {
+	if !m.Partial() {
+		return
+	}
+	fmt.Fprintf(os.Stderr, "WARNING: %s is PARTIAL: %d files failed to upload and can't be downloaded:\n", uri, len(m.Missing))
+	for _, p := range m.Missing {
+		fmt.Fprintln(os.Stderr, "  missing:", p)
+	}
+}
+
+// follow downloads the manifest --channel points to, and with --poll every
+// new one it is pointed to, running --hook after each download.
+func follow(ctx context.Context, opts []manifest.Option) {
+	if !strings.HasPrefix(*channel, "gs://") {
+		log.Fatal("--channel must be a gs:// URI")
+	}
+	d, err := manifest.NewDownloader(ctx, opts...)
+	if err != nil {
+		log.Fatal(err)
+	}
+	err = d.Follow(ctx, *channel, *poll, func(c *manifest.Channel, m *manifest.Manifest) error {
+		warnPartial(c.Manifest, m)
+		if err := checkRetrieval(ctx, d, m, manifest.ManifestRoot(c.Manifest)); err != nil {
+			return err
+		}
+		if err := d.Download(ctx, m, manifest.ManifestRoot(c.Manifest), *dst); err != nil {
+			return err
+		}
+		fmt.Fprintf(os.Stderr, "Downloaded %s#%d to %s\n", c.Manifest, c.Generation, *dst)
+		return runHook(c)
+	})
+	if err != nil {
+		log.Fatal(err)
+	}
+}
+
+// runHook runs --hook, if given, after c's manifest was downloaded.
+func runHook(c *manifest.Channel) error {
+	if *hook == "" {
+		return nil
+	}
+	cmd := exec.Command("sh", "-c", *hook)
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	cmd.Env = append(os.Environ(),
+		"GCS_MANIFEST_CHANNEL="+*channel,
+		"GCS_MANIFEST="+c.Manifest,
+		"GCS_MANIFEST_DIGEST="+c.Digest,
+		"GCS_MANIFEST_DST="+*dst,
+	)
+	if err := cmd.Run(); err != nil {
+		return fmt.Errorf("--hook: %v", err)
+	}
+	return nil
+}
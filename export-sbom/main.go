@@ -0,0 +1,225 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/dlorenc/gcs-manifest/pkg/manifest"
+)
+
+var (
+	manifestPath = flag.String("manifest", "manifest.json", "local path of the manifest to convert")
+	format       = flag.String("format", "spdx", "SBOM format to emit: spdx or cyclonedx")
+	name         = flag.String("name", "gcs-manifest", "name of the SBOM document")
+)
+
+const toolName = "gcs-manifest"
+
+// sizeProperty names the CycloneDX property recording a file's size in
+// bytes, and missingProperty the one naming a file a partial manifest
+// lacks.
+const (
+	sizeProperty    = toolName + ":size"
+	missingProperty = toolName + ":missing"
+)
+
+// emptyDigest is the digest of an empty file, the one file whose size of 0
+// is known even in version 1 manifests, which don't record sizes.
+const emptyDigest = "sha256:e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855"
+
+type spdxDocument struct {
+	SPDXVersion       string           `json:"spdxVersion"`
+	DataLicense       string           `json:"dataLicense"`
+	SPDXID            string           `json:"SPDXID"`
+	Name              string           `json:"name"`
+	DocumentNamespace string           `json:"documentNamespace"`
+	CreationInfo      spdxCreationInfo `json:"creationInfo"`
+	// Comment lists the files a partial manifest lacks.
+	Comment string     `json:"comment,omitempty"`
+	Files   []spdxFile `json:"files"`
+}
+
+type spdxCreationInfo struct {
+	Created  string   `json:"created"`
+	Creators []string `json:"creators"`
+}
+
+type spdxFile struct {
+	FileName         string         `json:"fileName"`
+	SPDXID           string         `json:"SPDXID"`
+	Checksums        []spdxChecksum `json:"checksums"`
+	LicenseConcluded string         `json:"licenseConcluded"`
+	CopyrightText    string         `json:"copyrightText"`
+	// Comment carries the file's size, if known, which SPDX has no field
+	// for.
+	Comment string `json:"comment,omitempty"`
+}
+
+type spdxChecksum struct {
+	Algorithm     string `json:"algorithm"`
+	ChecksumValue string `json:"checksumValue"`
+}
+
+type cdxBOM struct {
+	BOMFormat    string         `json:"bomFormat"`
+	SpecVersion  string         `json:"specVersion"`
+	SerialNumber string         `json:"serialNumber"`
+	Version      int            `json:"version"`
+	Metadata     cdxMetadata    `json:"metadata"`
+	Components   []cdxComponent `json:"components"`
+}
+
+type cdxMetadata struct {
+	Timestamp string    `json:"timestamp"`
+	Tools     []cdxTool `json:"tools"`
+	// Properties names the files a partial manifest lacks, each as
+	// missingProperty.
+	Properties []cdxProperty `json:"properties,omitempty"`
+}
+
+type cdxTool struct {
+	Name string `json:"name"`
+}
+
+type cdxComponent struct {
+	Type   string    `json:"type"`
+	Name   string    `json:"name"`
+	Hashes []cdxHash `json:"hashes"`
+	// Properties carries the file's size, if known, which CycloneDX has no
+	// field for, as sizeProperty.
+	Properties []cdxProperty `json:"properties,omitempty"`
+}
+
+type cdxProperty struct {
+	Name  string `json:"name"`
+	Value string `json:"value"`
+}
+
+type cdxHash struct {
+	Alg     string `json:"alg"`
+	Content string `json:"content"`
+}
+
+func main() {
+	flag.Parse()
+
+	m, err := manifest.Read(context.Background(), nil, *manifestPath)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if m.Partial() {
+		fmt.Fprintf(os.Stderr, "WARNING: %s is PARTIAL: %d files failed to upload and are only listed as missing\n", *manifestPath, len(m.Missing))
+	}
+
+	id, err := uuid()
+	if err != nil {
+		log.Fatal(err)
+	}
+	now := time.Now().UTC().Format(time.RFC3339)
+
+	var doc interface{}
+	switch *format {
+	case "spdx":
+		doc = toSPDX(m, id, now)
+	case "cyclonedx":
+		doc = toCycloneDX(m, id, now)
+	default:
+		log.Fatalf("unknown format: %s", *format)
+	}
+
+	enc := json.NewEncoder(os.Stdout)
+	enc.SetIndent("", "  ")
+	if err := enc.Encode(doc); err != nil {
+		log.Fatal(err)
+	}
+}
+
+func toSPDX(m *manifest.Manifest, id, now string) *spdxDocument {
+	doc := &spdxDocument{
+		SPDXVersion:       "SPDX-2.2",
+		DataLicense:       "CC0-1.0",
+		SPDXID:            "SPDXRef-DOCUMENT",
+		Name:              *name,
+		DocumentNamespace: fmt.Sprintf("https://github.com/dlorenc/gcs-manifest/spdx/%s-%s", *name, id),
+		CreationInfo: spdxCreationInfo{
+			Created:  now,
+			Creators: []string{"Tool: " + toolName},
+		},
+	}
+	if m.Partial() {
+		doc.Comment = fmt.Sprintf("partial: %d files failed to upload and aren't listed: %s", len(m.Missing), strings.Join(m.Missing, ", "))
+	}
+	for i, p := range m.Paths() {
+		f := spdxFile{
+			FileName: "./" + strings.TrimPrefix(p, "/"),
+			SPDXID:   fmt.Sprintf("SPDXRef-File-%d", i),
+			Checksums: []spdxChecksum{{
+				Algorithm:     "SHA256",
+				ChecksumValue: strings.TrimPrefix(m.Files[p].Digest, "sha256:"),
+			}},
+			LicenseConcluded: "NOASSERTION",
+			CopyrightText:    "NOASSERTION",
+		}
+		if size, ok := sizeOf(m.Files[p]); ok {
+			f.Comment = fmt.Sprintf("size: %d bytes", size)
+		}
+		doc.Files = append(doc.Files, f)
+	}
+	return doc
+}
+
+func toCycloneDX(m *manifest.Manifest, id, now string) *cdxBOM {
+	bom := &cdxBOM{
+		BOMFormat:    "CycloneDX",
+		SpecVersion:  "1.4",
+		SerialNumber: "urn:uuid:" + id,
+		Version:      1,
+		Metadata: cdxMetadata{
+			Timestamp: now,
+			Tools:     []cdxTool{{Name: toolName}},
+		},
+	}
+	for _, p := range m.Missing {
+		bom.Metadata.Properties = append(bom.Metadata.Properties, cdxProperty{Name: missingProperty, Value: p})
+	}
+	for _, p := range m.Paths() {
+		c := cdxComponent{
+			Type: "file",
+			Name: p,
+			Hashes: []cdxHash{{
+				Alg:     "SHA-256",
+				Content: strings.TrimPrefix(m.Files[p].Digest, "sha256:"),
+			}},
+		}
+		if size, ok := sizeOf(m.Files[p]); ok {
+			c.Properties = []cdxProperty{{Name: sizeProperty, Value: strconv.FormatInt(size, 10)}}
+		}
+		bom.Components = append(bom.Components, c)
+	}
+	return bom
+}
+
+// sizeOf returns e's size, unless it is unknown: version 1 manifests don't
+// record sizes, so theirs are 0 even for files that aren't empty.
+func sizeOf(e manifest.Entry) (int64, bool) {
+	return e.Size, e.Size != 0 || e.Digest == emptyDigest
+}
+
+// uuid returns a random (version 4) UUID.
+func uuid() (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	b[6] = (b[6] & 0x0f) | 0x40
+	b[8] = (b[8] & 0x3f) | 0x80
+	return fmt.Sprintf("%x-%x-%x-%x-%x", b[0:4], b[4:6], b[6:8], b[8:10], b[10:]), nil
+}
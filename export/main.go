@@ -0,0 +1,92 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+
+	"cloud.google.com/go/storage"
+	"github.com/dlorenc/gcs-manifest/pkg/manifest"
+)
+
+var (
+	manifestPath = flag.String("manifest", "", "manifest to export, gs:// or local")
+	src          = flag.String("src", "", "gs:// path the manifest's files were uploaded to; defaults to the manifest's directory for a gs:// --manifest")
+	to           = flag.String("to", "", "local directory to write the bundle to")
+	parallelism  = flag.Int("parallelism", manifest.DefaultParallelism(), "how many files to download at once")
+	publicKeys   = stringsFlag{}
+
+	encryptionKey = flag.String("encryption-key", "", "base64 AES-256 customer-supplied key (CSEK) the files were uploaded with")
+
+	useProfile = manifest.ProfileFlag(flag.CommandLine)
+)
+
+// stringsFlag collects a repeatable string flag.
+type stringsFlag []string
+
+func (s *stringsFlag) String() string { return strings.Join(*s, ",") }
+
+func (s *stringsFlag) Set(v string) error {
+	*s = append(*s, v)
+	return nil
+}
+
+func main() {
+	flag.Var(&publicKeys, "verify-signature", "PEM public key the manifest's detached signature must verify with before anything is exported (repeatable)")
+	flag.Usage = func() {
+		fmt.Fprintf(os.Stderr, "usage: %s --manifest gs://bucket/path/manifest.json --to bundle/\n", os.Args[0])
+		fmt.Fprintf(os.Stderr, "\nDownloads and checks every file of a manifest into a portable bundle, with the manifest, its signature and a script to check the files offline; import uploads it again.\n\n")
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+	if err := useProfile(); err != nil {
+		log.Fatal(err)
+	}
+	if *manifestPath == "" || *to == "" || flag.NArg() != 0 {
+		flag.Usage()
+		os.Exit(2)
+	}
+	if *src == "" {
+		if !strings.HasPrefix(*manifestPath, "gs://") {
+			log.Fatal("--src is required with a local manifest")
+		}
+		*src = manifest.ManifestRoot(*manifestPath)
+	}
+
+	ctx := context.Background()
+	client, err := storage.NewClient(ctx)
+	if err != nil {
+		log.Fatalf("Failed to create new GCS client: %v", err)
+	}
+	opts := []manifest.Option{
+		manifest.WithClient(client),
+		manifest.WithLog(os.Stderr),
+		manifest.WithParallelism(*parallelism),
+	}
+	if *encryptionKey != "" {
+		key, err := manifest.ParseEncryptionKey(*encryptionKey)
+		if err != nil {
+			log.Fatal(err)
+		}
+		opts = append(opts, manifest.WithEncryptionKey(key))
+	}
+	for _, k := range publicKeys {
+		pub, err := manifest.LoadPublicKey(k)
+		if err != nil {
+			log.Fatal(err)
+		}
+		opts = append(opts, manifest.WithPublicKey(pub))
+	}
+	d, err := manifest.NewDownloader(ctx, opts...)
+	if err != nil {
+		log.Fatal(err)
+	}
+	m, err := d.Export(ctx, *manifestPath, *src, *to)
+	if err != nil {
+		log.Fatal(err)
+	}
+	fmt.Fprintf(os.Stderr, "Exported %d files to %s; check them with %s/%s\n", len(m.Files), *to, strings.TrimSuffix(*to, "/"), manifest.ExportScript)
+}
@@ -0,0 +1,58 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+
+	"cloud.google.com/go/storage"
+	"github.com/dlorenc/gcs-manifest/pkg/manifest"
+)
+
+var (
+	lockfilePath = flag.String("lockfile", "", "path to a lockfile written by upload --lockfile")
+	dst          = flag.String("dst", ".", "local directory to download into")
+
+	useProfile = manifest.ProfileFlag(flag.CommandLine)
+)
+
+func main() {
+	flag.Parse()
+	if err := useProfile(); err != nil {
+		log.Fatal(err)
+	}
+	if *lockfilePath == "" {
+		log.Fatal("--lockfile is required")
+	}
+	f, err := os.Open(*lockfilePath)
+	if err != nil {
+		log.Fatal(err)
+	}
+	entries, err := manifest.ParseLockfile(f)
+	f.Close()
+	if err != nil {
+		log.Fatalf("%s: %v", *lockfilePath, err)
+	}
+
+	ctx := context.Background()
+	client, err := storage.NewClient(ctx)
+	if err != nil {
+		log.Fatalf("Failed to create new GCS client: %v", err)
+	}
+
+	for _, e := range entries {
+		fmt.Fprintln(os.Stderr, "Fetching:", e.Path)
+		dest, err := manifest.LocalPath(*dst, e.Path)
+		if err != nil {
+			log.Fatal(err)
+		}
+		// Download exactly the pinned generation, verified against the
+		// lockfile's digest.
+		obj := client.Bucket(e.Bucket).Object(e.Object).Generation(e.Generation)
+		if err := manifest.DownloadObject(ctx, obj, e.Digest, dest); err != nil {
+			log.Fatalf("%s: %v", e.Path, err)
+		}
+	}
+}
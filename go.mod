@@ -2,4 +2,11 @@ module github.com/dlorenc/gcs-manifest
 
 go 1.14
 
-require cloud.google.com/go/storage v1.10.0
+require (
+	cloud.google.com/go v0.57.0
+	cloud.google.com/go/storage v1.10.0
+	github.com/golang/protobuf v1.4.2
+	golang.org/x/oauth2 v0.0.0-20200107190931-bf48bf16ab8d
+	google.golang.org/api v0.28.0
+	google.golang.org/protobuf v1.24.0
+)
@@ -0,0 +1,53 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+
+	"github.com/dlorenc/gcs-manifest/pkg/manifest"
+)
+
+var (
+	crcOnly   = flag.Bool("c", false, "only compute the CRC32C, like gsutil hash -c")
+	md5Only   = flag.Bool("m", false, "only compute the MD5, like gsutil hash -m")
+	hexFormat = flag.Bool("hex", false, "print checksums in hex rather than base64, like gsutil hash -h")
+)
+
+func main() {
+	flag.Usage = func() {
+		fmt.Fprintf(os.Stderr, "usage: %s [flags] file|dir...\n", os.Args[0])
+		fmt.Fprintf(os.Stderr, "\nPrints the checksums of local files in the format of gsutil hash, for use with verify --gsutil-hashes. Directories are hashed recursively.\n\n")
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+	if flag.NArg() == 0 {
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	for _, arg := range flag.Args() {
+		err := filepath.Walk(arg, func(p string, fi os.FileInfo, err error) error {
+			if err != nil || !fi.Mode().IsRegular() {
+				return err
+			}
+			h, err := manifest.HashFileGsutil(p)
+			if err != nil {
+				return err
+			}
+			// Given both, gsutil computes both, as it does given neither.
+			if *crcOnly && !*md5Only {
+				h.MD5 = ""
+			}
+			if *md5Only && !*crcOnly {
+				h.CRC32C = ""
+			}
+			return manifest.WriteGsutilHashes(os.Stdout, []manifest.GsutilHash{h}, *hexFormat)
+		})
+		if err != nil {
+			log.Fatal(err)
+		}
+	}
+}
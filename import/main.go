@@ -0,0 +1,67 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+
+	"cloud.google.com/go/storage"
+	"github.com/dlorenc/gcs-manifest/pkg/manifest"
+)
+
+var (
+	from        = flag.String("from", "", "local directory of a bundle made by export")
+	dst         = flag.String("dst", "", "gs:// path to upload the bundle's files and manifest to")
+	parallelism = flag.Int("parallelism", manifest.DefaultParallelism(), "how many files to upload at once")
+	retries     = flag.Int("retries", 3, "how many times to retry each failed file upload, with exponential backoff")
+
+	encryptionKey = flag.String("encryption-key", "", "base64 AES-256 customer-supplied key (CSEK) the files were uploaded with, needed to store them encrypted with it again")
+
+	useProfile = manifest.ProfileFlag(flag.CommandLine)
+)
+
+func main() {
+	flag.Usage = func() {
+		fmt.Fprintf(os.Stderr, "usage: %s --from bundle/ --dst gs://bucket/path\n", os.Args[0])
+		fmt.Fprintf(os.Stderr, "\nUploads a bundle made by export, checking every file, and publishes its manifest and signature unchanged.\n\n")
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+	if err := useProfile(); err != nil {
+		log.Fatal(err)
+	}
+	if *from == "" || *dst == "" || flag.NArg() != 0 {
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	ctx := context.Background()
+	client, err := storage.NewClient(ctx)
+	if err != nil {
+		log.Fatalf("Failed to create new GCS client: %v", err)
+	}
+	opts := []manifest.Option{
+		manifest.WithClient(client),
+		manifest.WithLog(os.Stderr),
+		manifest.WithParallelism(*parallelism),
+		manifest.WithRetries(*retries),
+	}
+	if *encryptionKey != "" {
+		key, err := manifest.ParseEncryptionKey(*encryptionKey)
+		if err != nil {
+			log.Fatal(err)
+		}
+		opts = append(opts, manifest.WithEncryptionKey(key))
+	}
+	u, err := manifest.NewUploader(ctx, opts...)
+	if err != nil {
+		log.Fatal(err)
+	}
+	m, err := u.Import(ctx, *from, *dst)
+	if err != nil {
+		log.Fatal(err)
+	}
+	fmt.Fprintf(os.Stderr, "Imported %d files to %s\n", len(m.Files), *dst)
+}
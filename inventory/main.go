@@ -0,0 +1,75 @@
+package main
+
+import (
+	"context"
+	"encoding/hex"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"time"
+
+	"cloud.google.com/go/storage"
+	"github.com/dlorenc/gcs-manifest/pkg/manifest"
+	"google.golang.org/api/iterator"
+)
+
+var useProfile = manifest.ProfileFlag(flag.CommandLine)
+
+// entry is one line of the NDJSON inventory.
+type entry struct {
+	Name         string    `json:"name"`
+	Size         int64     `json:"size"`
+	CRC32C       string    `json:"crc32c"`
+	MD5          string    `json:"md5,omitempty"`
+	Generation   int64     `json:"generation"`
+	StorageClass string    `json:"storageClass"`
+	Updated      time.Time `json:"updated"`
+}
+
+func main() {
+	flag.Usage = func() {
+		fmt.Fprintf(os.Stderr, "usage: %s [flags] gs://bucket/prefix\n", os.Args[0])
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+	if err := useProfile(); err != nil {
+		log.Fatal(err)
+	}
+	if flag.NArg() != 1 {
+		flag.Usage()
+		os.Exit(2)
+	}
+	bucketName, prefix := manifest.ParsePrefix(flag.Arg(0))
+
+	ctx := context.Background()
+	client, err := storage.NewClient(ctx)
+	if err != nil {
+		log.Fatalf("Failed to create new GCS client: %v", err)
+	}
+
+	enc := json.NewEncoder(os.Stdout)
+	it := client.Bucket(bucketName).Objects(ctx, &storage.Query{Prefix: prefix})
+	for n := 0; ; n++ {
+		attrs, err := it.Next()
+		if err == iterator.Done {
+			fmt.Fprintf(os.Stderr, "Listed %d objects\n", n)
+			break
+		}
+		if err != nil {
+			log.Fatalf("Failed to list gs://%s/%s: %v", bucketName, prefix, err)
+		}
+		if err := enc.Encode(entry{
+			Name:         attrs.Name,
+			Size:         attrs.Size,
+			CRC32C:       fmt.Sprintf("%08x", attrs.CRC32C),
+			MD5:          hex.EncodeToString(attrs.MD5),
+			Generation:   attrs.Generation,
+			StorageClass: attrs.StorageClass,
+			Updated:      attrs.Updated,
+		}); err != nil {
+			log.Fatal(err)
+		}
+	}
+}
@@ -0,0 +1,157 @@
+package manifest
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"path"
+	"strings"
+	"sync"
+	"time"
+
+	"cloud.google.com/go/storage"
+)
+
+// Appender publishes files to a destination one at a time, as a
+// long-running producer makes them, rather than as a finished directory.
+// Each file is streamed straight to its object, and the manifest,
+// covering every file added so far and those already published, is
+// written again at most every interval and on Close; each write replaces
+// the last in one step, so readers only ever see a complete manifest. An
+// Appender is safe for concurrent use.
+type Appender struct {
+	u        *Uploader
+	dst      string
+	bucket   *storage.BucketHandle
+	gcsPath  string
+	interval time.Duration
+
+	mu        sync.Mutex
+	m         *Manifest
+	dirty     bool
+	published time.Time
+	// publishing serializes manifest writes, which are slow, without
+	// holding up Add.
+	publishing sync.Mutex
+}
+
+// NewAppender returns an Appender to the gs:// path dst, carrying over the
+// files of the manifest already published there, if any. The manifest is
+// written again at most every interval; with an interval of 0, after
+// every file.
+func (u *Uploader) NewAppender(ctx context.Context, dst string, interval time.Duration) (*Appender, error) {
+	if u.replicas != nil {
+		return nil, fmt.Errorf("replicas aren't supported when appending")
+	}
+	bucketName, gcsPath, err := ParseURI(dst)
+	if err != nil {
+		return nil, err
+	}
+	m := New()
+	b, err := ReadBytes(ctx, u.client, "gs://"+path.Join(bucketName, gcsPath, Name))
+	switch {
+	case err == nil:
+		if m, err = Parse(b); err != nil {
+			return nil, fmt.Errorf("parsing the manifest at %s: %v", dst, err)
+		}
+	case err != storage.ErrObjectNotExist:
+		return nil, err
+	}
+	return &Appender{
+		u:         u,
+		dst:       dst,
+		bucket:    u.client.Bucket(bucketName),
+		gcsPath:   gcsPath,
+		interval:  interval,
+		m:         m,
+		published: time.Now(),
+	}, nil
+}
+
+// Add streams r to the destination as the file at p, replacing any file
+// already there, and records it for the next manifest, which it writes if
+// the interval has passed since the last. The file only appears in the
+// manifest once it is stored and checked, and if it can't be, no manifest
+// lists it. A manifest that fails to publish is only logged: the file is
+// still recorded, and the manifest is tried again by the next Add or by
+// Close.
+func (a *Appender) Add(ctx context.Context, p string, r io.Reader) (File, error) {
+	if path.IsAbs(p) || path.Clean(p) != p || p == "." || p == ".." || strings.HasPrefix(p, "../") || isManifestFile(p) {
+		return File{}, fmt.Errorf("can't add a file at %q", p)
+	}
+	name := a.u.objectFor(p)
+	file, err := a.u.send(ctx, a.bucket.Object(path.Join(a.gcsPath, name)), p, r, nil, "", ioutil.Discard)
+	if err != nil {
+		return File{}, fmt.Errorf("%s: %v", p, err)
+	}
+	now := time.Now()
+	file.Path = p
+	file.ModTime = now.UTC()
+	file.Expires = a.u.expiryOf(p, now)
+	if name != p {
+		file.Object = name
+	}
+	fmt.Fprintln(a.u.log, "Added:", p)
+
+	a.mu.Lock()
+	a.m.Add(file.Entry())
+	a.m.Missing = without(a.m.Missing, p)
+	a.dirty = true
+	due := time.Since(a.published) >= a.interval
+	a.mu.Unlock()
+	if due {
+		if err := a.Publish(ctx); err != nil {
+			fmt.Fprintf(a.u.log, "Failed to publish the manifest of %s: %v\n", a.dst, err)
+		}
+	}
+	return file, nil
+}
+
+// Publish writes the manifest of everything added so far, if anything was
+// added since it was last written.
+func (a *Appender) Publish(ctx context.Context) error {
+	a.publishing.Lock()
+	defer a.publishing.Unlock()
+	a.mu.Lock()
+	if !a.dirty {
+		a.mu.Unlock()
+		return nil
+	}
+	m := New()
+	for p, e := range a.m.Files {
+		m.Files[p] = e
+	}
+	m.Missing = append([]string(nil), a.m.Missing...)
+	a.dirty = false
+	a.mu.Unlock()
+
+	if err := a.u.WriteManifest(ctx, a.dst, Name, m); err != nil {
+		a.mu.Lock()
+		a.dirty = true
+		a.mu.Unlock()
+		return err
+	}
+	a.mu.Lock()
+	a.published = time.Now()
+	a.mu.Unlock()
+	fmt.Fprintf(a.u.log, "Published the manifest of %s with %d files\n", a.dst, len(m.Files))
+	return nil
+}
+
+// Close publishes the manifest of any files added since it was last
+// written. The Appender can still be used afterwards.
+func (a *Appender) Close(ctx context.Context) error {
+	return a.Publish(ctx)
+}
+
+// without returns paths without p.
+func without(paths []string, p string) []string {
+	var rest []string
+	for _, q := range paths {
+		if q != p {
+			rest = append(rest, q)
+		}
+	}
+	return rest
+}
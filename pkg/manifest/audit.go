@@ -0,0 +1,217 @@
+package manifest
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"path"
+	"sort"
+	"sync"
+	"time"
+
+	"cloud.google.com/go/storage"
+)
+
+// AuditEntry is one file of an audit: the digest its manifest records and
+// the one recomputed from the whole of its object.
+type AuditEntry struct {
+	Path       string    `json:"path"`
+	Object     string    `json:"object"`
+	Generation int64     `json:"generation,omitempty"`
+	Recorded   string    `json:"recorded"`
+	Computed   string    `json:"computed,omitempty"`
+	Bytes      int64     `json:"bytes"`
+	OK         bool      `json:"ok"`
+	Error      string    `json:"error,omitempty"`
+	Checked    time.Time `json:"checked"`
+}
+
+// AuditReport is the record of an audit of the files published to Dst
+// under the manifest at Manifest, whose digest was ManifestDigest.
+type AuditReport struct {
+	Dst            string       `json:"dst"`
+	Manifest       string       `json:"manifest"`
+	ManifestDigest string       `json:"manifestDigest"`
+	Started        time.Time    `json:"started"`
+	Finished       time.Time    `json:"finished,omitempty"`
+	Files          []AuditEntry `json:"files"`
+}
+
+// OK reports whether the audit finished and every file in it checked out.
+func (a *AuditReport) OK() bool {
+	if a.Finished.IsZero() {
+		return false
+	}
+	for _, e := range a.Files {
+		if !e.OK {
+			return false
+		}
+	}
+	return true
+}
+
+// LoadAuditReport reads a report saved by Verifier.Audit, to resume it.
+func LoadAuditReport(path string) (*AuditReport, error) {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	a := &AuditReport{}
+	if err := json.Unmarshal(b, a); err != nil {
+		return nil, fmt.Errorf("parsing %s: %v", path, err)
+	}
+	return a, nil
+}
+
+// Audit downloads every object that m references under the gs:// path dst
+// in full, whatever checksum GCS reports for it, and compares its sha256
+// with the digest m records, adding an entry for each file to a. Files a
+// already has entries for, from an interrupted audit, aren't downloaded
+// again, unless they couldn't be downloaded then. Unless reportPath is
+// empty, a is saved there at most every checkpointInterval and when Audit
+// returns, and with WithSigner the finished report is signed there too,
+// with the signature and bundle next to it as for a manifest.
+func (v *Verifier) Audit(ctx context.Context, m *Manifest, dst string, a *AuditReport, reportPath string) error {
+	bucketName, prefix := ParsePrefix(dst)
+
+	done := map[string]bool{}
+	kept := a.Files[:0]
+	for _, e := range a.Files {
+		if e.Computed != "" {
+			done[e.Path] = true
+			kept = append(kept, e)
+		}
+	}
+	a.Files = kept
+	var toCheck []string
+	for _, p := range m.Paths() {
+		if m.Files[p].Link == "" && !done[p] {
+			toCheck = append(toCheck, p)
+		}
+	}
+	fmt.Fprintf(v.log, "%d files already audited, %d to go\n", len(done), len(toCheck))
+
+	var (
+		mu    sync.Mutex
+		saved = time.Now()
+		wg    sync.WaitGroup
+	)
+	jobs := make(chan string)
+	for i := 0; i < v.parallelism; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for p := range jobs {
+				e := v.audit(ctx, bucketName, path.Join(prefix, m.Files[p].ObjectName()), p, m.Files[p])
+				mu.Lock()
+				a.Files = append(a.Files, e)
+				if reportPath != "" && time.Since(saved) >= checkpointInterval {
+					saved = time.Now()
+					if err := v.saveAudit(ctx, a, reportPath); err != nil {
+						fmt.Fprintf(v.log, "Failed to save audit report %s: %v\n", reportPath, err)
+					}
+				}
+				mu.Unlock()
+			}
+		}()
+	}
+	var err error
+	for _, p := range toCheck {
+		if err = ctx.Err(); err != nil {
+			break
+		}
+		jobs <- p
+	}
+	close(jobs)
+	wg.Wait()
+
+	sort.Slice(a.Files, func(i, j int) bool { return a.Files[i].Path < a.Files[j].Path })
+	if err == nil {
+		a.Finished = time.Now().UTC()
+	}
+	if reportPath == "" {
+		return err
+	}
+	if serr := v.saveAudit(ctx, a, reportPath); serr != nil {
+		return serr
+	}
+	return err
+}
+
+// audit downloads object, the one holding e, and checks it against e.
+func (v *Verifier) audit(ctx context.Context, bucketName, object, p string, e Entry) AuditEntry {
+	ae := AuditEntry{Path: p, Object: "gs://" + path.Join(bucketName, object), Recorded: e.Digest}
+	err := func() error {
+		if err := v.pace(ctx); err != nil {
+			return err
+		}
+		obj := v.encrypted(v.client.Bucket(bucketName).Object(object))
+		attrs, err := obj.Attrs(ctx)
+		if err == storage.ErrObjectNotExist {
+			return fmt.Errorf("object not found")
+		}
+		if err != nil {
+			return err
+		}
+		ae.Generation = attrs.Generation
+		fmt.Fprintln(v.log, "Auditing:", object)
+		r, err := obj.Generation(attrs.Generation).NewReader(ctx)
+		if err != nil {
+			return err
+		}
+		defer r.Close()
+		c := &countingReader{r: v.throttle(ctx, r)}
+		d, err := Digest(c)
+		if err != nil {
+			return err
+		}
+		ae.Bytes, ae.Computed = c.n, d
+		if d != e.Digest {
+			return fmt.Errorf("digest mismatch")
+		}
+		return nil
+	}()
+	ae.OK = err == nil
+	if err != nil {
+		ae.Error = err.Error()
+	}
+	ae.Checked = time.Now().UTC()
+	return ae
+}
+
+// saveAudit writes a to path, signing it if it is finished and there is a
+// Signer.
+func (v *Verifier) saveAudit(ctx context.Context, a *AuditReport, path string) error {
+	b, err := json.MarshalIndent(a, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := writeFileAtomic(path, append(b, '\n')); err != nil {
+		return err
+	}
+	if v.signer == nil || a.Finished.IsZero() {
+		return nil
+	}
+	sig, bundle, err := v.sign(ctx, append(b, '\n'))
+	if err != nil {
+		return fmt.Errorf("signing audit report: %v", err)
+	}
+	if err := writeFileAtomic(path+SignatureSuffix, sig); err != nil {
+		return err
+	}
+	return writeFileAtomic(path+BundleSuffix, bundle)
+}
+
+// countingReader counts the bytes read through it.
+type countingReader struct {
+	r io.Reader
+	n int64
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.n += int64(n)
+	return n, err
+}
@@ -0,0 +1,83 @@
+package manifest
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// BucketDefaults are the defaults a command takes for one bucket, keyed by
+// flag name without the dashes. A value is a JSON string, number or
+// boolean, or for a repeatable flag, an array of them.
+type BucketDefaults map[string]json.RawMessage
+
+// BucketConfigPath returns where the defaults for each bucket are kept
+// unless a command is told otherwise: buckets.json in gcs-manifest under
+// the user's config directory.
+func BucketConfigPath() (string, error) {
+	dir, err := os.UserConfigDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(dir, "gcs-manifest", "buckets.json"), nil
+}
+
+// LoadBucketConfig reads a JSON object mapping bucket names to their
+// BucketDefaults, such as
+//
+//	{"archive-bucket": {"storage-class": "ARCHIVE", "parallelism": 4}}
+func LoadBucketConfig(path string) (map[string]BucketDefaults, error) {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	config := map[string]BucketDefaults{}
+	if err := json.Unmarshal(b, &config); err != nil {
+		return nil, fmt.Errorf("parsing %s: %v", path, err)
+	}
+	return config, nil
+}
+
+// Apply sets the flags of fs that d has defaults for, unless they were set
+// on the command line, so that what is given explicitly still wins. Only
+// the flags named in allowed may have defaults, so that a config file
+// can't redirect what a command does, only tune it; a default for any
+// other flag is an error, as is one for a flag fs doesn't have, so that a
+// misspelt one isn't silently ignored.
+func (d BucketDefaults) Apply(fs *flag.FlagSet, allowed []string) error {
+	set := map[string]bool{}
+	fs.Visit(func(f *flag.Flag) { set[f.Name] = true })
+	ok := map[string]bool{}
+	for _, name := range allowed {
+		ok[name] = true
+	}
+	for name, raw := range d {
+		if fs.Lookup(name) == nil {
+			return fmt.Errorf("no flag --%s", name)
+		}
+		if !ok[name] {
+			return fmt.Errorf("--%s can't be set per bucket", name)
+		}
+		if set[name] {
+			continue
+		}
+		var values []json.RawMessage
+		if err := json.Unmarshal(raw, &values); err != nil {
+			values = []json.RawMessage{raw}
+		}
+		for _, v := range values {
+			var s string
+			if err := json.Unmarshal(v, &s); err != nil {
+				s = strings.TrimSpace(string(v))
+			}
+			if err := fs.Set(name, s); err != nil {
+				return fmt.Errorf("--%s: %v", name, err)
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,47 @@
+package manifest
+
+import (
+	"context"
+	"strings"
+
+	"cloud.google.com/go/storage"
+)
+
+// casPrefix is where WithContentAddressed stores objects, relative to the
+// destination.
+const casPrefix = "blobs/sha256/"
+
+// casObject returns the name, relative to the destination, that contents
+// with the given digest are stored under by WithContentAddressed.
+func casObject(digest string) string {
+	return casPrefix + strings.TrimPrefix(digest, "sha256:")
+}
+
+// existingBlob returns the File for obj, a content-addressed object, if it
+// is already stored with the given size and CRC32C, and encrypted as enc
+// says if enc isn't nil, or nil if the contents need uploading: because it
+// doesn't exist, or because what is there isn't what its name says, which
+// the upload then replaces. The caller fills in the rest of the File.
+func existingBlob(ctx context.Context, obj *storage.ObjectHandle, size int64, crc uint32, enc *Encryption) (*File, error) {
+	attrs, err := obj.Attrs(ctx)
+	if err == storage.ErrObjectNotExist {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if attrs.Size != size || attrs.CRC32C != crc || attrs.ContentEncoding != "" {
+		return nil, nil
+	}
+	if enc != nil && checkEncryption(enc, attrs) != nil {
+		return nil, nil
+	}
+	return &File{
+		Size:        attrs.Size,
+		ContentType: attrs.ContentType,
+		CRC32C:      FormatCRC32C(attrs.CRC32C),
+		Generation:  attrs.Generation,
+		Encryption:  encryptionOf(attrs),
+		Existing:    true,
+	}, nil
+}
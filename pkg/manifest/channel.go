@@ -0,0 +1,228 @@
+package manifest
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"path"
+	"strings"
+	"time"
+
+	"cloud.google.com/go/storage"
+)
+
+// ChannelDir is the directory, at the root of the bucket a manifest is
+// published to, that channels are kept in unless told otherwise.
+const ChannelDir = "channels"
+
+// Channel is a named pointer, such as stable or beta, to one generation of
+// a published manifest, so that consumers can follow a release track
+// without knowing where or when each release was published. It is stored
+// as JSON in <dir>/<name>.json.
+type Channel struct {
+	// Manifest is the gs:// URI of the manifest, and Generation and Digest
+	// those of the object when the channel was pointed at it.
+	Manifest   string `json:"manifest"`
+	Generation int64  `json:"generation"`
+	Digest     string `json:"digest"`
+	// From is the channel this one was promoted from, if any.
+	From    string    `json:"from,omitempty"`
+	Updated time.Time `json:"updated"`
+}
+
+// ChannelURI returns the URI of the pointer of the channel name in the
+// gs:// directory dir.
+func ChannelURI(dir, name string) string {
+	return strings.TrimSuffix(dir, "/") + "/" + name + ".json"
+}
+
+// DefaultChannelDir returns the channel directory for manifests published
+// under the gs:// URI dst: ChannelDir at the root of its bucket.
+func DefaultChannelDir(dst string) (string, error) {
+	bucketName, _, err := ParseURI(dst)
+	if err != nil {
+		return "", err
+	}
+	return "gs://" + bucketName + "/" + ChannelDir, nil
+}
+
+// ReadChannel reads the channel pointer at the gs:// URI uri.
+func ReadChannel(ctx context.Context, client *storage.Client, uri string) (*Channel, error) {
+	c, err := readChannel(ctx, client, uri)
+	if err == storage.ErrObjectNotExist {
+		return nil, fmt.Errorf("channel %s doesn't exist", uri)
+	}
+	return c, err
+}
+
+// readChannel is ReadChannel, but returns storage.ErrObjectNotExist as is.
+func readChannel(ctx context.Context, client *storage.Client, uri string) (*Channel, error) {
+	bucketName, name, err := ParseURI(uri)
+	if err != nil {
+		return nil, err
+	}
+	r, err := client.Bucket(bucketName).Object(name).NewReader(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+	b, err := ioutil.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+	c := &Channel{}
+	if err := json.Unmarshal(b, c); err != nil {
+		return nil, fmt.Errorf("parsing %s: %v", uri, err)
+	}
+	return c, nil
+}
+
+// ReadManifest returns the bytes of the manifest generation c points to,
+// after checking them against c's digest.
+func (c *Channel) ReadManifest(ctx context.Context, client *storage.Client) ([]byte, error) {
+	bucketName, name, err := ParseURI(c.Manifest)
+	if err != nil {
+		return nil, err
+	}
+	r, err := client.Bucket(bucketName).Object(name).Generation(c.Generation).NewReader(ctx)
+	if err == storage.ErrObjectNotExist {
+		return nil, fmt.Errorf("generation %d of %s no longer exists", c.Generation, c.Manifest)
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+	b, err := ioutil.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+	if got := digestBytes(b); got != c.Digest {
+		return nil, fmt.Errorf("%s#%d: digest mismatch: channel has %s, got %s", c.Manifest, c.Generation, c.Digest, got)
+	}
+	return b, nil
+}
+
+// PublishChannel points the channel at uri to the manifest at the gs:// URI
+// manifestURI as it is now. The manifest is given as the directory it was
+// published to or as the manifest object itself, which may be one
+// published by its digest.
+func PublishChannel(ctx context.Context, client *storage.Client, uri, manifestURI string) (*Channel, error) {
+	if !isManifestFile(path.Base(manifestURI)) && !isHashedManifest(manifestURI) {
+		manifestURI = strings.TrimSuffix(manifestURI, "/") + "/" + Name
+	}
+	bucketName, name, err := ParseURI(manifestURI)
+	if err != nil {
+		return nil, err
+	}
+	r, err := client.Bucket(bucketName).Object(name).NewReader(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("reading %s: %v", manifestURI, err)
+	}
+	defer r.Close()
+	b, err := ioutil.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := Parse(b); err != nil {
+		return nil, fmt.Errorf("parsing %s: %v", manifestURI, err)
+	}
+	c := &Channel{
+		Manifest:   "gs://" + bucketName + "/" + name,
+		Generation: r.Attrs.Generation,
+		Digest:     digestBytes(b),
+	}
+	return c, setChannel(ctx, client, uri, c)
+}
+
+// PromoteChannel points the channel at uri to the manifest that the channel
+// at from points to.
+func PromoteChannel(ctx context.Context, client *storage.Client, uri, from string) (*Channel, error) {
+	src, err := ReadChannel(ctx, client, from)
+	if err != nil {
+		return nil, err
+	}
+	c := &Channel{
+		Manifest:   src.Manifest,
+		Generation: src.Generation,
+		Digest:     src.Digest,
+		From:       strings.TrimSuffix(path.Base(from), ".json"),
+	}
+	return c, setChannel(ctx, client, uri, c)
+}
+
+// setChannel writes c to the pointer at uri with UpdatePointer, so that
+// two concurrent updates are applied one after the other rather than
+// racing, and the channel ends up pointing where the later one said.
+func setChannel(ctx context.Context, client *storage.Client, uri string, c *Channel) error {
+	_, err := UpdatePointer(ctx, client, uri, "application/json", func(current []byte) ([]byte, error) {
+		// Pointing a channel where it already points changes nothing, so
+		// that controllers agreeing on a release don't keep rewriting it.
+		old := &Channel{}
+		if current != nil && json.Unmarshal(current, old) == nil && old.Manifest == c.Manifest && old.Generation == c.Generation && old.Digest == c.Digest && old.From == c.From {
+			*c = *old
+			return current, nil
+		}
+		c.Updated = time.Now().UTC()
+		b, err := json.MarshalIndent(c, "", "  ")
+		if err != nil {
+			return nil, err
+		}
+		return append(b, '\n'), nil
+	})
+	return err
+}
+
+// ReadChannel reads the manifest c points to, checking it against c's
+// digest and then as ReadManifest does.
+func (d *Downloader) ReadChannel(ctx context.Context, c *Channel) (*Manifest, error) {
+	b, err := c.ReadManifest(ctx, d.client)
+	if err != nil {
+		return nil, err
+	}
+	return d.verified(ctx, c.Manifest, b)
+}
+
+// Follow watches the channel pointer at uri, as a pull-based deployment
+// agent would. It reads the pointer at once and then every interval and,
+// whenever it points somewhere new, reads and verifies the manifest with
+// ReadChannel and calls changed with it. A pointer or manifest that can't
+// be read or verified, or a call to changed that fails, is logged and
+// tried again at the next interval. With an interval of 0, Follow reads
+// the pointer only once and returns any such error. Otherwise it returns
+// when ctx is done.
+func (d *Downloader) Follow(ctx context.Context, uri string, interval time.Duration, changed func(*Channel, *Manifest) error) error {
+	var current Channel
+	for {
+		err := func() error {
+			c, err := ReadChannel(ctx, d.client, uri)
+			if err != nil {
+				return err
+			}
+			if c.Manifest == current.Manifest && c.Generation == current.Generation && c.Digest == current.Digest {
+				return nil
+			}
+			fmt.Fprintf(d.log, "Channel %s points to %s#%d\n", uri, c.Manifest, c.Generation)
+			m, err := d.ReadChannel(ctx, c)
+			if err != nil {
+				return err
+			}
+			if err := changed(c, m); err != nil {
+				return err
+			}
+			current = *c
+			return nil
+		}()
+		if interval == 0 {
+			return err
+		}
+		if err != nil {
+			fmt.Fprintf(d.log, "Following %s: %v\n", uri, err)
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(interval):
+		}
+	}
+}
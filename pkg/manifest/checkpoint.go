@@ -0,0 +1,178 @@
+package manifest
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// checkpointInterval is how often, at most, an upload rewrites its
+// checkpoint as files finish.
+const checkpointInterval = 5 * time.Second
+
+// Checkpoint is what WithCheckpoint saves of an upload in progress: its
+// destination and the files it has finished so far.
+type Checkpoint struct {
+	Dst   string           `json:"dst"`
+	Files []checkpointFile `json:"files"`
+}
+
+// checkpointFile is a finished File: its manifest entry plus what the
+// manifest doesn't record.
+type checkpointFile struct {
+	Entry
+	Source     string `json:"source"`
+	Generation int64  `json:"generation,omitempty"`
+}
+
+// Finished returns the files the checkpointed upload had finished.
+func (c *Checkpoint) Finished() []File {
+	var files []File
+	for _, f := range c.Files {
+		e := f.Entry
+		files = append(files, File{
+			Path:            e.Path,
+			Source:          f.Source,
+			Digest:          e.Digest,
+			Size:            e.Size,
+			ContentType:     e.ContentType,
+			CRC32C:          e.CRC32C,
+			ModTime:         e.ModTime,
+			Generation:      f.Generation,
+			Encryption:      e.Encryption,
+			ContentEncoding: e.ContentEncoding,
+			StoredSize:      e.StoredSize,
+			StoredDigest:    e.StoredDigest,
+			Object:          e.Object,
+			Mode:            e.Mode,
+			Link:            e.Link,
+			Parts:           e.Parts,
+			Expires:         e.Expires,
+		})
+	}
+	return files
+}
+
+// LoadCheckpoint reads a checkpoint written under WithCheckpoint.
+func LoadCheckpoint(path string) (*Checkpoint, error) {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	c := &Checkpoint{}
+	if err := json.Unmarshal(b, c); err != nil {
+		return nil, fmt.Errorf("parsing %s: %v", path, err)
+	}
+	return c, nil
+}
+
+// Resume splits sources into those still to upload and the files c says
+// are already uploaded, for passing to UploadSources as prior. A file
+// counts as uploaded only if it still has the size, modification time,
+// mode and link target it was uploaded with.
+func (u *Uploader) Resume(sources []Source, c *Checkpoint) ([]Source, []File) {
+	done := map[string]File{}
+	for _, f := range c.Finished() {
+		done[f.Path] = f
+	}
+	var (
+		remaining []Source
+		prior     []File
+	)
+	for _, s := range sources {
+		if f, ok := done[s.RelPath]; ok && f.Source == s.Path && !isRemote(s.Path) && u.unchanged(s, f) {
+			prior = append(prior, f)
+			continue
+		}
+		remaining = append(remaining, s)
+	}
+	return remaining, prior
+}
+
+// checkpointer saves an upload's finished files to a checkpoint file as
+// they finish, at most every checkpointInterval.
+type checkpointer struct {
+	path string
+	o    *options
+
+	mu      sync.Mutex
+	c       Checkpoint
+	written time.Time
+}
+
+// startCheckpoint begins checkpointing an upload to dst that starts with
+// prior already done, if WithCheckpoint was given.
+func (o *options) startCheckpoint(dst string, prior []File) *checkpointer {
+	if o.checkpoint == "" {
+		return nil
+	}
+	cp := &checkpointer{path: o.checkpoint, o: o, c: Checkpoint{Dst: dst, Files: []checkpointFile{}}, written: time.Now()}
+	for _, f := range prior {
+		cp.c.Files = append(cp.c.Files, checkpointFile{Entry: f.Entry(), Source: f.Source, Generation: f.Generation})
+	}
+	return cp
+}
+
+// add records f as finished.
+func (cp *checkpointer) add(f File) {
+	if cp == nil {
+		return
+	}
+	cp.mu.Lock()
+	defer cp.mu.Unlock()
+	cp.c.Files = append(cp.c.Files, checkpointFile{Entry: f.Entry(), Source: f.Source, Generation: f.Generation})
+	if time.Since(cp.written) >= checkpointInterval {
+		cp.write()
+	}
+}
+
+// close writes the final checkpoint of an upload that failed, or removes
+// it once the manifest of one that succeeded is published.
+func (cp *checkpointer) close(published bool) {
+	if cp == nil {
+		return
+	}
+	cp.mu.Lock()
+	defer cp.mu.Unlock()
+	if published {
+		if err := os.Remove(cp.path); err != nil && !os.IsNotExist(err) {
+			fmt.Fprintf(cp.o.log, "Failed to remove checkpoint %s: %v\n", cp.path, err)
+		}
+		return
+	}
+	cp.write()
+}
+
+// write replaces the checkpoint file, through a temporary file so that a
+// crash mid-write leaves the previous one. Failing to write it is only
+// logged: the upload itself can go on.
+func (cp *checkpointer) write() {
+	cp.written = time.Now()
+	b, err := json.Marshal(cp.c)
+	if err == nil {
+		err = writeFileAtomic(cp.path, b)
+	}
+	if err != nil {
+		fmt.Fprintf(cp.o.log, "Failed to write checkpoint %s: %v\n", cp.path, err)
+	}
+}
+
+func writeFileAtomic(path string, b []byte) error {
+	tmp, err := ioutil.TempFile(filepath.Dir(path), "."+filepath.Base(path)+"-")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(b); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
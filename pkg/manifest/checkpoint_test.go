@@ -0,0 +1,132 @@
+package manifest
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestCheckpointRoundTrip(t *testing.T) {
+	dir, err := ioutil.TempDir("", "checkpoint")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "checkpoint.json")
+	now := time.Date(2030, 1, 2, 3, 4, 5, 0, time.UTC)
+	prior := File{Path: "a", Source: "/src/a", Digest: "sha256:aa", Size: 1, ModTime: now, Generation: 1}
+	added := File{Path: "b", Source: "/src/b", Digest: "sha256:bb", Size: 2, ModTime: now, Generation: 2, Parts: []Part{{Size: 2, CRC32C: "00000002", Digest: "sha256:02"}}}
+
+	for _, tc := range []struct {
+		name      string
+		published bool
+	}{{
+		name: "failed run keeps its checkpoint",
+	}, {
+		name:      "published run removes it",
+		published: true,
+	}} {
+		t.Run(tc.name, func(t *testing.T) {
+			o := newOptions([]Option{WithCheckpoint(path)})
+			cp := o.startCheckpoint("gs://b/release", []File{prior})
+			cp.add(added)
+			cp.close(tc.published)
+
+			c, err := LoadCheckpoint(path)
+			if tc.published {
+				if !os.IsNotExist(err) {
+					t.Fatalf("LoadCheckpoint: %v, want the checkpoint removed", err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if c.Dst != "gs://b/release" {
+				t.Errorf("Dst = %s, want gs://b/release", c.Dst)
+			}
+			if got, want := c.Finished(), []File{prior, added}; !reflect.DeepEqual(got, want) {
+				t.Errorf("Finished() = %+v, want %+v", got, want)
+			}
+		})
+	}
+}
+
+func TestResume(t *testing.T) {
+	dir, err := ioutil.TempDir("", "resume")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	src := filepath.Join(dir, "a")
+	if err := ioutil.WriteFile(src, []byte("alpha"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	fi, err := os.Stat(src)
+	if err != nil {
+		t.Fatal(err)
+	}
+	done := File{Path: "a", Source: src, Digest: "sha256:aa", Size: fi.Size(), ModTime: fi.ModTime().UTC()}
+	resized, touched, moved := done, done, done
+	resized.Size++
+	touched.ModTime = touched.ModTime.Add(time.Second)
+	moved.Source = filepath.Join(dir, "elsewhere")
+	link := File{Path: "l", Source: filepath.Join(dir, "l"), Digest: linkDigest("a"), Link: "a"}
+
+	for _, tc := range []struct {
+		name     string
+		source   Source
+		finished []File
+		resumed  bool
+	}{{
+		name:     "unchanged",
+		source:   Source{Path: src, RelPath: "a"},
+		finished: []File{done},
+		resumed:  true,
+	}, {
+		name:   "not finished",
+		source: Source{Path: src, RelPath: "a"},
+	}, {
+		name:     "size changed",
+		source:   Source{Path: src, RelPath: "a"},
+		finished: []File{resized},
+	}, {
+		name:     "modification time changed",
+		source:   Source{Path: src, RelPath: "a"},
+		finished: []File{touched},
+	}, {
+		name:     "read from elsewhere",
+		source:   Source{Path: src, RelPath: "a"},
+		finished: []File{moved},
+	}, {
+		name:     "symlink unchanged",
+		source:   Source{Path: link.Source, RelPath: "l", Link: "a"},
+		finished: []File{link},
+		resumed:  true,
+	}, {
+		name:     "symlink retargeted",
+		source:   Source{Path: link.Source, RelPath: "l", Link: "b"},
+		finished: []File{link},
+	}} {
+		t.Run(tc.name, func(t *testing.T) {
+			c := &Checkpoint{Dst: "gs://b/release"}
+			for _, f := range tc.finished {
+				c.Files = append(c.Files, checkpointFile{Entry: f.Entry(), Source: f.Source, Generation: f.Generation})
+			}
+			u := &Uploader{options: newOptions(nil)}
+			remaining, prior := u.Resume([]Source{tc.source}, c)
+			if tc.resumed {
+				if len(remaining) != 0 || len(prior) != 1 || prior[0].Path != tc.source.RelPath {
+					t.Errorf("Resume() = %v, %v; want %s already uploaded", remaining, prior, tc.source.RelPath)
+				}
+				return
+			}
+			if len(prior) != 0 || !reflect.DeepEqual(remaining, []Source{tc.source}) {
+				t.Errorf("Resume() = %v, %v; want %s still to upload", remaining, prior, tc.source.RelPath)
+			}
+		})
+	}
+}
@@ -0,0 +1,175 @@
+package manifest
+
+import (
+	"bufio"
+	"context"
+	"crypto/sha256"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"strconv"
+
+	"cloud.google.com/go/storage"
+)
+
+// maxParts is the most objects GCS composes in one request.
+const maxParts = 32
+
+// Part is one part of a file uploaded as a composite object. Parts are in
+// order, each starting where the one before it ended, so that a range of
+// the object can be checked on its own.
+type Part struct {
+	Size int64 `json:"size"`
+	// CRC32C is the part's checksum as 8 hex digits, as GCS checked it
+	// when the part was uploaded.
+	CRC32C string `json:"crc32c"`
+	Digest string `json:"digest"`
+}
+
+// partName returns the name part i of the object name is uploaded under
+// before they are composed.
+func partName(name string, i int) string {
+	return name + ".part-" + strconv.Itoa(i)
+}
+
+// sendComposite uploads the size bytes of f, the file at p, as up to
+// maxParts parts of at least u.partSize bytes, and composes them into obj.
+// Each part is sent with its CRC32C, so that GCS rejects a corrupted part,
+// and the compose with want, the whole file's, so that GCS rejects a wrong
+// assembly; the composed object's digest is then the file's, hashed as it
+// was sent. The parts are deleted afterwards, whether or not the upload
+// succeeded.
+func (u *Uploader) sendComposite(ctx context.Context, bucket *storage.BucketHandle, obj *storage.ObjectHandle, p string, f *localFile, size int64, want uint32, digest string, progress io.Writer) (File, error) {
+	partSize := u.partSize
+	if n := (size + maxParts - 1) / maxParts; n > partSize {
+		partSize = n
+	}
+	whole := sha256.New()
+	var (
+		parts   []Part
+		handles []*storage.ObjectHandle
+	)
+	defer func() {
+		for _, h := range handles {
+			h.Delete(context.Background())
+		}
+	}()
+	for off := int64(0); off < size; off += partSize {
+		n := partSize
+		if size-off < n {
+			n = size - off
+		}
+		// Checksum the part before sending it, so GCS can check it.
+		c := crc32.New(castagnoli)
+		h := sha256.New()
+		if _, err := io.Copy(io.MultiWriter(c, h), io.NewSectionReader(f, off, n)); err != nil {
+			return File{}, err
+		}
+		crc := c.Sum32()
+
+		if err := u.pace(ctx); err != nil {
+			return File{}, err
+		}
+		ph := bucket.Object(partName(obj.ObjectName(), len(parts)))
+		handles = append(handles, ph)
+		wctx, cancel := context.WithCancel(ctx)
+		w := ph.NewWriter(wctx)
+		w.ChunkSize = u.chunkSize
+		w.KMSKeyName = u.kmsKey
+		w.CRC32C = crc
+		w.SendCRC32C = true
+		sent := []io.Writer{progress}
+		if digest == "" {
+			sent = append(sent, whole)
+		}
+		body := io.TeeReader(u.throttle(ctx, io.NewSectionReader(f, off, n)), io.MultiWriter(sent...))
+		if _, err := io.Copy(w, body); err != nil {
+			cancel()
+			w.Close()
+			return File{}, err
+		}
+		err := w.Close()
+		cancel()
+		if err != nil {
+			return File{}, fmt.Errorf("finishing part %d: %v", len(parts), err)
+		}
+		if attrs := w.Attrs(); attrs.Size != n || attrs.CRC32C != crc {
+			return File{}, fmt.Errorf("GCS stored part %d as %d bytes with crc32c %08x, but %d bytes with crc32c %08x were uploaded", len(parts), attrs.Size, attrs.CRC32C, n, crc)
+		}
+		parts = append(parts, Part{Size: n, CRC32C: FormatCRC32C(crc), Digest: formatDigest(h)})
+	}
+
+	if err := u.pace(ctx); err != nil {
+		return File{}, err
+	}
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		return File{}, err
+	}
+	comp := obj.ComposerFrom(handles...)
+	comp.ContentType, comp.ContentLanguage = u.contentHeaders(p, detectContentType(obj.ObjectName(), bufio.NewReader(f)))
+	comp.CacheControl = u.cacheControl
+	comp.Metadata = u.metadata
+	comp.StorageClass = u.storageClass
+	comp.KMSKeyName = u.kmsKey
+	comp.CRC32C = want
+	comp.SendCRC32C = true
+	attrs, err := comp.Run(ctx)
+	if err != nil {
+		return File{}, fmt.Errorf("composing %d parts: %v", len(parts), err)
+	}
+	if attrs.Size != size || attrs.CRC32C != want {
+		return File{}, fmt.Errorf("GCS composed %d bytes with crc32c %08x, but %d bytes with crc32c %08x were uploaded", attrs.Size, attrs.CRC32C, size, want)
+	}
+
+	if digest == "" {
+		digest = formatDigest(whole)
+	}
+	return File{
+		Digest:      digest,
+		Size:        attrs.Size,
+		ContentType: attrs.ContentType,
+		CRC32C:      FormatCRC32C(attrs.CRC32C),
+		Generation:  attrs.Generation,
+		Encryption:  encryptionOf(attrs),
+		Parts:       parts,
+	}, nil
+}
+
+// checkParts compares parts, the first of which is part number first and
+// starts at byte off of its object, with the bytes read from r, naming
+// the first part that doesn't match.
+func checkParts(r io.Reader, parts []Part, first int, off int64) error {
+	for i, p := range parts {
+		got, err := Digest(io.LimitReader(r, p.Size))
+		if err != nil {
+			return err
+		}
+		if got != p.Digest {
+			return fmt.Errorf("part %d, bytes %d-%d: digest mismatch: manifest has %s, got %s", first+i, off, off+p.Size-1, p.Digest, got)
+		}
+		off += p.Size
+	}
+	return nil
+}
+
+// VerifyPart re-checks only part i of e, stored as obj, by reading that
+// range of the object, so that a large composite object can be verified a
+// part at a time.
+func (v *Verifier) VerifyPart(ctx context.Context, obj *storage.ObjectHandle, e Entry, i int) error {
+	if i < 0 || i >= len(e.Parts) {
+		return fmt.Errorf("%s has %d parts, not %d", e.Path, len(e.Parts), i+1)
+	}
+	var off int64
+	for _, p := range e.Parts[:i] {
+		off += p.Size
+	}
+	if err := v.pace(ctx); err != nil {
+		return err
+	}
+	r, err := v.encrypted(obj).NewRangeReader(ctx, off, e.Parts[i].Size)
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+	return checkParts(r, e.Parts[i:i+1], i, off)
+}
@@ -0,0 +1,80 @@
+package manifest
+
+import (
+	"compress/gzip"
+	"fmt"
+	"io"
+
+	"cloud.google.com/go/storage"
+)
+
+// checkCompression returns an error unless enc is an encoding
+// WithCompression supports. Only gzip is: it is an encoding GCS itself
+// understands, and objects stored with it are decompressed transparently
+// for any client that doesn't ask for them compressed, so downloads and
+// full-hash verification see the original bytes.
+func checkCompression(enc string) error {
+	switch enc {
+	case "", "gzip":
+		return nil
+	case "zstd":
+		// GCS won't decompress zstd on download, and neither the standard
+		// library nor anything vendored here can, so it isn't offered.
+		return fmt.Errorf("unsupported compression %q: GCS can't decompress it on download and no zstd implementation is vendored; use gzip", enc)
+	}
+	return fmt.Errorf("unsupported compression %q: only gzip is supported", enc)
+}
+
+// compress returns r compressed with the Uploader's encoding, setting w's
+// Content-Encoding to match, and a func that stops the compression early if
+// the upload fails. w's Content-Type should already be set from the
+// original bytes; the compressed ones would be sniffed as application/gzip.
+func (u *Uploader) compress(r io.Reader, w *storage.Writer) (io.Reader, func()) {
+	w.ContentEncoding = u.compression
+
+	pr, pw := io.Pipe()
+	go func() {
+		zw := gzip.NewWriter(pw)
+		_, err := io.Copy(zw, r)
+		if err == nil {
+			err = zw.Close()
+		}
+		pw.CloseWithError(err)
+	}()
+	return pr, func() { pr.Close() }
+}
+
+// decode returns what to restore e's file from, given r, its object's
+// bytes as stored, and the digest that must have. Compressed objects are
+// decompressed, and checked against the original file's digest, unless
+// WithKeepEncoding asked for them as stored, checked against the stored
+// digest. Either way the object is read as stored, since whether GCS
+// decompresses it on the way depends on what the client asks for.
+func (o *options) decode(e Entry, r io.Reader) (io.Reader, string, error) {
+	switch {
+	case e.ContentEncoding == "":
+		return r, e.Digest, nil
+	case o.keepEncoding:
+		if e.StoredDigest == "" {
+			return nil, "", fmt.Errorf("stored with content encoding %s, but the manifest doesn't record the stored digest", e.ContentEncoding)
+		}
+		return r, e.StoredDigest, nil
+	case e.ContentEncoding == "gzip":
+		zr, err := gzip.NewReader(r)
+		if err != nil {
+			return nil, "", fmt.Errorf("decompressing: %v", err)
+		}
+		return zr, e.Digest, nil
+	}
+	return nil, "", fmt.Errorf("unsupported content encoding %q", e.ContentEncoding)
+}
+
+// countingWriter counts the bytes written to it.
+type countingWriter struct {
+	n int64
+}
+
+func (c *countingWriter) Write(b []byte) (int, error) {
+	c.n += int64(len(b))
+	return len(b), nil
+}
@@ -0,0 +1,114 @@
+package manifest
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"strings"
+
+	"cloud.google.com/go/storage"
+)
+
+// ConflictPolicy is what Sync does with a file whose object was written by
+// someone else since the manifest was published, and after the file was
+// last modified, as can happen when several sources write to one prefix.
+type ConflictPolicy string
+
+const (
+	// LocalWins uploads the file over the object anyway. It is the default.
+	LocalWins ConflictPolicy = "local-wins"
+	// RemoteWins keeps the object, and records it in the manifest instead
+	// of the file.
+	RemoteWins ConflictPolicy = "remote-wins"
+	// FailOnConflict fails the sync, before anything is uploaded.
+	FailOnConflict ConflictPolicy = "fail"
+	// SkipConflicts leaves the object alone and the path out of the
+	// manifest, with a warning.
+	SkipConflicts ConflictPolicy = "skip"
+)
+
+// ParseConflictPolicy checks that p is a ConflictPolicy.
+func ParseConflictPolicy(p string) (ConflictPolicy, error) {
+	switch c := ConflictPolicy(p); c {
+	case LocalWins, RemoteWins, FailOnConflict, SkipConflicts:
+		return c, nil
+	}
+	return "", fmt.Errorf("unknown conflict policy %q, want one of %s, %s, %s or %s", p, LocalWins, RemoteWins, FailOnConflict, SkipConflicts)
+}
+
+// conflict returns the attributes of obj, where s would be uploaded, if it
+// was written after s was last modified and isn't what the manifest
+// recorded for s, if known; otherwise it returns nil. Only local files can
+// conflict: a gs:// source has no modification time of its own to compare.
+func (u *Uploader) conflict(ctx context.Context, obj *storage.ObjectHandle, s Source, want Entry, known bool) (*storage.ObjectAttrs, error) {
+	if isRemote(s.Path) || s.Link != "" {
+		return nil, nil
+	}
+	fi, err := os.Stat(s.Path)
+	if err != nil {
+		return nil, err
+	}
+	if err := u.pace(ctx); err != nil {
+		return nil, err
+	}
+	attrs, err := u.encrypted(obj).Attrs(ctx)
+	if err == storage.ErrObjectNotExist {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if known && FormatCRC32C(attrs.CRC32C) == want.CRC32C {
+		// Still what was published.
+		return nil, nil
+	}
+	if !attrs.Updated.After(fi.ModTime()) {
+		return nil, nil
+	}
+	return attrs, nil
+}
+
+// adopt returns the File recording the object obj, with attrs, for s's
+// path, as RemoteWins keeps it.
+func (u *Uploader) adopt(ctx context.Context, obj *storage.ObjectHandle, attrs *storage.ObjectAttrs, s Source) (File, error) {
+	if attrs.ContentEncoding != "" {
+		return File{}, fmt.Errorf("can't keep %s: it is stored with Content-Encoding %s", attrs.Name, attrs.ContentEncoding)
+	}
+	if err := u.pace(ctx); err != nil {
+		return File{}, err
+	}
+	r, err := u.encrypted(obj).Generation(attrs.Generation).NewReader(ctx)
+	if err != nil {
+		return File{}, err
+	}
+	defer r.Close()
+	d, err := Digest(r)
+	if err != nil {
+		return File{}, err
+	}
+	f := File{
+		Path:        s.RelPath,
+		Source:      "gs://" + attrs.Bucket + "/" + attrs.Name,
+		Digest:      d,
+		Size:        attrs.Size,
+		ContentType: attrs.ContentType,
+		CRC32C:      FormatCRC32C(attrs.CRC32C),
+		ModTime:     attrs.Updated.UTC(),
+		Generation:  attrs.Generation,
+		Encryption:  encryptionOf(attrs),
+	}
+	if name := u.objectFor(s.RelPath); name != s.RelPath {
+		f.Object = name
+	}
+	return f, nil
+}
+
+// ConflictError is returned by Sync under FailOnConflict, naming the paths
+// whose objects were written by someone else.
+type ConflictError struct {
+	Paths []string
+}
+
+func (e *ConflictError) Error() string {
+	return fmt.Sprintf("%d files were changed remotely since the manifest was published and after their local copies: %s", len(e.Paths), strings.Join(e.Paths, ", "))
+}
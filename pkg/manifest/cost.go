@@ -0,0 +1,146 @@
+package manifest
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+)
+
+// Prices are what GCS charges, in USD, for one storage class.
+type Prices struct {
+	// StorageGBMonth is the price of storing a GiB for a month.
+	StorageGBMonth float64 `json:"storageGBMonth"`
+	// ClassA and ClassB are the prices of 10,000 Class A operations, such
+	// as writes and composes, and Class B operations, such as reads of an
+	// object's metadata.
+	ClassA float64 `json:"classA"`
+	ClassB float64 `json:"classB"`
+	// RetrievalGB is the price of reading a GiB stored in the class, for
+	// those that charge for it.
+	RetrievalGB float64 `json:"retrievalGB,omitempty"`
+}
+
+// DefaultPrices are GCS's list prices for each storage class in a US
+// multi-region. They change now and then, and differ by location; see
+// LoadPrices for using others.
+var DefaultPrices = map[string]Prices{
+	"STANDARD": {StorageGBMonth: 0.026, ClassA: 0.05, ClassB: 0.004},
+	"NEARLINE": {StorageGBMonth: 0.010, ClassA: 0.10, ClassB: 0.01, RetrievalGB: 0.01},
+	"COLDLINE": {StorageGBMonth: 0.007, ClassA: 0.10, ClassB: 0.05, RetrievalGB: 0.02},
+	"ARCHIVE":  {StorageGBMonth: 0.004, ClassA: 0.50, ClassB: 0.50, RetrievalGB: 0.05},
+}
+
+// LoadPrices reads a JSON object mapping storage class names to Prices,
+// to be used instead of DefaultPrices.
+func LoadPrices(path string) (map[string]Prices, error) {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	prices := map[string]Prices{}
+	if err := json.Unmarshal(b, &prices); err != nil {
+		return nil, fmt.Errorf("parsing %s: %v", path, err)
+	}
+	return prices, nil
+}
+
+// Estimate is what an upload is expected to cost.
+type Estimate struct {
+	StorageClass string
+	// Files and Bytes are the local files that would be uploaded and
+	// their total size. gs:// sources are counted in Files, but their
+	// sizes aren't known without reading them, so they add no Bytes.
+	Files int
+	Bytes int64
+	// ClassA and ClassB are the operations the upload would make.
+	ClassA int64
+	ClassB int64
+	// OperationsCost is the cost of ClassA and ClassB, and StorageCost
+	// that of storing Bytes for a month.
+	OperationsCost float64
+	StorageCost    float64
+}
+
+// Cost is the estimate's total: its operations and a month's storage.
+func (e *Estimate) Cost() float64 {
+	return e.OperationsCost + e.StorageCost
+}
+
+// EstimateCost estimates what uploading sources with opts would cost at
+// prices, the objects being stored in storageClass, from the files' sizes
+// alone, without hashing them or contacting GCS. Resumable uploads cost an
+// operation for every chunk, and composite ones for every part and the
+// compose. Every file is counted as uploaded, including those Sync or the
+// content-addressed layout would find already stored, and at its size
+// before any compression, so the estimate is an upper bound; the checks
+// Sync and the content-addressed layout make for stored files are counted
+// too.
+func EstimateCost(sources []Source, storageClass string, prices map[string]Prices, sync bool, opts ...Option) (*Estimate, error) {
+	storageClass = strings.ToUpper(storageClass)
+	p, ok := prices[storageClass]
+	if !ok {
+		return nil, fmt.Errorf("no prices for storage class %q", storageClass)
+	}
+	o := newOptions(opts)
+	e := &Estimate{StorageClass: storageClass}
+	// writes is how many operations writing an object of size bytes takes.
+	writes := func(size int64) int64 {
+		if o.chunkSize <= 0 {
+			return 1
+		}
+		return 1 + (size+int64(o.chunkSize)-1)/int64(o.chunkSize)
+	}
+	sources, err := o.excludeManifest(sources)
+	if err != nil {
+		return nil, err
+	}
+	for _, s := range sources {
+		e.Files++
+		switch {
+		case s.Link != "":
+			continue
+		case isRemote(s.Path):
+			e.ClassA++
+			continue
+		}
+		fi, err := os.Stat(s.Path)
+		if err != nil {
+			return nil, err
+		}
+		size := fi.Size()
+		e.Bytes += size
+		if o.partSize > 0 && size > o.partSize {
+			partSize := o.partSize
+			if n := (size + maxParts - 1) / maxParts; n > partSize {
+				partSize = n
+			}
+			for off := int64(0); off < size; off += partSize {
+				n := partSize
+				if size-off < n {
+					n = size - off
+				}
+				e.ClassA += writes(n)
+			}
+			e.ClassA++
+		} else {
+			e.ClassA += writes(size)
+		}
+		if o.cas || sync {
+			e.ClassB++
+		}
+	}
+	// The manifest, which is small enough for one chunk, its signature and
+	// bundle, and under Sync reading the old one.
+	e.ClassA += 2
+	if o.signer != nil {
+		e.ClassA += 2
+	}
+	if sync {
+		e.ClassB++
+	}
+	e.OperationsCost = float64(e.ClassA)/10000*p.ClassA + float64(e.ClassB)/10000*p.ClassB
+	e.StorageCost = float64(e.Bytes) / (1 << 30) * p.StorageGBMonth
+	return e, nil
+}
@@ -0,0 +1,114 @@
+package manifest
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+)
+
+const (
+	// minFileBudget is the least time a file is given under WithDeadline,
+	// however small, while there's that much left of the run.
+	minFileBudget = time.Minute
+	// minProjection is how long a run under WithDeadline uploads before
+	// its throughput is trusted to tell whether it can finish in time.
+	minProjection = 10 * time.Second
+)
+
+// ErrDeadline is the error of the files an upload under WithDeadline didn't
+// finish because the run was stopped once it couldn't meet its deadline.
+var ErrDeadline = errors.New("not uploaded: the run can't finish before its deadline")
+
+// budget divides the time left before a WithDeadline deadline between the
+// files still to upload, and notices when the run as a whole can't make it.
+type budget struct {
+	deadline    time.Time
+	parallelism int
+	t           *tracker
+
+	mu  sync.Mutex
+	err error
+}
+
+// startBudget returns the budget for a run tracked by t, or nil if no
+// deadline was given. It stops the run, through stop, as soon as the
+// throughput so far says the bytes left won't be uploaded in time.
+func (u *Uploader) startBudget(ctx context.Context, t *tracker, stop func()) *budget {
+	if u.deadline.IsZero() {
+		return nil
+	}
+	b := &budget{deadline: u.deadline, parallelism: u.parallelism, t: t}
+	go func() {
+		tick := time.NewTicker(progressInterval)
+		defer tick.Stop()
+		for {
+			select {
+			case <-tick.C:
+				if err := b.project(); err != nil {
+					fmt.Fprintln(u.log, "Stopping:", err)
+					b.fail(err)
+					stop()
+					return
+				}
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+	return b
+}
+
+// project returns an error if, at the average rate so far, the run will
+// still be uploading at its deadline.
+func (b *budget) project() error {
+	p := b.t.snapshot()
+	if p.Elapsed < minProjection || p.Bytes == 0 {
+		return nil
+	}
+	if eta := p.ETA(); time.Now().Add(eta).After(b.deadline) {
+		return fmt.Errorf("can't meet the deadline: %d of %d bytes left at %.0f bytes/s needs %v, but only %v remain", p.TotalBytes-p.Bytes, p.TotalBytes, p.Rate(), eta.Round(time.Second), time.Until(b.deadline).Round(time.Second))
+	}
+	return nil
+}
+
+// file returns the time a file of size bytes may take: twice its share,
+// by size, of what's left of the run, as every worker uploads alongside
+// it, but at least minFileBudget and at most all that's left.
+func (b *budget) file(size int64) time.Duration {
+	left := time.Until(b.deadline)
+	p := b.t.snapshot()
+	share := left
+	if rest := p.TotalBytes - p.Bytes; rest > size && size > 0 {
+		share = time.Duration(2 * float64(left) * float64(b.parallelism) * float64(size) / float64(rest))
+	}
+	if share < minFileBudget {
+		share = minFileBudget
+	}
+	if share > left {
+		share = left
+	}
+	return share
+}
+
+// fail records why the run can't meet its deadline; the first reason
+// sticks.
+func (b *budget) fail(err error) {
+	b.mu.Lock()
+	if b.err == nil {
+		b.err = err
+	}
+	b.mu.Unlock()
+}
+
+// failed returns the reason the run was stopped for its deadline, or nil.
+// A nil budget never fails.
+func (b *budget) failed() error {
+	if b == nil {
+		return nil
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.err
+}
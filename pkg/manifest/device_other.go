@@ -0,0 +1,12 @@
+//go:build !darwin && !dragonfly && !freebsd && !linux && !netbsd && !openbsd
+// +build !darwin,!dragonfly,!freebsd,!linux,!netbsd,!openbsd
+
+package manifest
+
+import "os"
+
+// device is not implemented here, so the walk never sees a filesystem
+// boundary.
+func device(fi os.FileInfo) (uint64, bool) {
+	return 0, false
+}
@@ -0,0 +1,117 @@
+package manifest
+
+import (
+	"os"
+	"reflect"
+	"time"
+)
+
+// Modification is a path whose digest differs between two manifests.
+type Modification struct {
+	Path      string `json:"path"`
+	OldDigest string `json:"oldDigest"`
+	NewDigest string `json:"newDigest"`
+	OldSize   int64  `json:"oldSize"`
+	NewSize   int64  `json:"newSize"`
+}
+
+// Changes is what changed from one manifest to another, sorted by path.
+type Changes struct {
+	Added    []Entry        `json:"added"`
+	Removed  []Entry        `json:"removed"`
+	Modified []Modification `json:"modified"`
+	// Updated are the files, as recorded in the second manifest, whose
+	// contents are the same but whose entries otherwise differ; only
+	// Compare fills it in.
+	Updated []Entry `json:"updated,omitempty"`
+}
+
+// Empty reports whether the two manifests had the same files.
+func (c *Changes) Empty() bool {
+	return len(c.Added) == 0 && len(c.Removed) == 0 && len(c.Modified) == 0 && len(c.Updated) == 0
+}
+
+// Diff compares the digests of from and to.
+func Diff(from, to *Manifest) *Changes {
+	c := &Changes{Added: []Entry{}, Removed: []Entry{}, Modified: []Modification{}}
+	for _, p := range to.Paths() {
+		old, ok := from.Files[p]
+		e := to.Files[p]
+		switch {
+		case !ok:
+			c.Added = append(c.Added, e)
+		case old.Digest != e.Digest:
+			c.Modified = append(c.Modified, Modification{Path: p, OldDigest: old.Digest, NewDigest: e.Digest, OldSize: old.Size, NewSize: e.Size})
+		}
+	}
+	for _, p := range from.Paths() {
+		if _, ok := to.Files[p]; !ok {
+			c.Removed = append(c.Removed, from.Files[p])
+		}
+	}
+	return c
+}
+
+// Compare is Diff, but also reports as Updated the files whose contents are
+// the same in both manifests but whose entries otherwise differ, such as in
+// mode, link target, content type, or where and how the object is stored.
+// Modification times aren't compared, as every upload records new ones.
+// Like Diff, it looks at nothing but the manifests.
+func Compare(from, to *Manifest) Changes {
+	c := *Diff(from, to)
+	c.Updated = []Entry{}
+	for _, p := range to.Paths() {
+		old, ok := from.Files[p]
+		if e := to.Files[p]; ok && old.Digest == e.Digest && !sameEntry(old, e) {
+			c.Updated = append(c.Updated, e)
+		}
+	}
+	return c
+}
+
+// sameEntry reports whether a and b record the same file, but for their
+// modification times.
+func sameEntry(a, b Entry) bool {
+	if (a.Expires == nil) != (b.Expires == nil) || a.Expires != nil && !a.Expires.Equal(*b.Expires) {
+		return false
+	}
+	a.ModTime, b.ModTime = time.Time{}, time.Time{}
+	a.Expires, b.Expires = nil, nil
+	return reflect.DeepEqual(a, b)
+}
+
+// FromDir builds a manifest of the local directory dir by hashing every
+// file in it, as if it had just been uploaded. opts may limit the walk as
+// for Expand, and WithPreserveLinks and WithPreserveMode record links and
+// modes as an upload would.
+func FromDir(dir string, opts ...Option) (*Manifest, error) {
+	sources, err := Expand(dir, opts...)
+	if err != nil {
+		return nil, err
+	}
+	o := newOptions(opts)
+	m := New()
+	for _, s := range sources {
+		if isManifestFile(s.RelPath) {
+			continue
+		}
+		if s.Link != "" {
+			f, err := linkFile(s)
+			if err != nil {
+				return nil, err
+			}
+			m.Add(f.Entry())
+			continue
+		}
+		fi, err := os.Stat(s.Path)
+		if err != nil {
+			return nil, err
+		}
+		d, err := DigestFile(s.Path)
+		if err != nil {
+			return nil, err
+		}
+		m.Add(Entry{Path: s.RelPath, Digest: d, Size: fi.Size(), ModTime: fi.ModTime().UTC(), Mode: o.modeOf(fi)})
+	}
+	return m, nil
+}
@@ -0,0 +1,95 @@
+package manifest
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestCompare(t *testing.T) {
+	now := time.Date(2030, 1, 2, 3, 4, 5, 0, time.UTC)
+	later := now.Add(time.Hour)
+	a := Entry{Path: "a", Digest: "sha256:aa", Size: 1, ModTime: now}
+	b := Entry{Path: "b", Digest: "sha256:bb", Size: 2, ModTime: now}
+	parts := []Part{{Size: 1, CRC32C: "00000001", Digest: "sha256:01"}}
+	build := func(missing []string, entries ...Entry) *Manifest {
+		m := New()
+		for _, e := range entries {
+			m.Add(e)
+		}
+		m.Missing = missing
+		return m
+	}
+	with := func(e Entry, f func(*Entry)) Entry {
+		f(&e)
+		return e
+	}
+	for _, tc := range []struct {
+		name     string
+		from, to *Manifest
+		want     Changes
+	}{{
+		name: "same",
+		from: build(nil, a, b),
+		to:   build(nil, a, b),
+		want: Changes{},
+	}, {
+		name: "modification time only",
+		from: build(nil, a),
+		to:   build(nil, with(a, func(e *Entry) { e.ModTime = later })),
+		want: Changes{},
+	}, {
+		name: "added and removed",
+		from: build(nil, a),
+		to:   build(nil, b),
+		want: Changes{Added: []Entry{b}, Removed: []Entry{a}},
+	}, {
+		name: "modified",
+		from: build(nil, a),
+		to:   build(nil, with(a, func(e *Entry) { e.Digest, e.Size = "sha256:cc", 3 })),
+		want: Changes{Modified: []Modification{{Path: "a", OldDigest: "sha256:aa", NewDigest: "sha256:cc", OldSize: 1, NewSize: 3}}},
+	}, {
+		name: "mode",
+		from: build(nil, a),
+		to:   build(nil, with(a, func(e *Entry) { e.Mode = "0755" })),
+		want: Changes{Updated: []Entry{with(a, func(e *Entry) { e.Mode = "0755" })}},
+	}, {
+		name: "parts",
+		from: build(nil, a),
+		to:   build(nil, with(a, func(e *Entry) { e.Parts = parts })),
+		want: Changes{Updated: []Entry{with(a, func(e *Entry) { e.Parts = parts })}},
+	}, {
+		name: "expires added",
+		from: build(nil, a),
+		to:   build(nil, with(a, func(e *Entry) { e.Expires = &later })),
+		want: Changes{Updated: []Entry{with(a, func(e *Entry) { e.Expires = &later })}},
+	}, {
+		name: "expires equal",
+		from: build(nil, with(a, func(e *Entry) { e.Expires = &later })),
+		to:   build(nil, with(a, func(e *Entry) { x := later.In(time.FixedZone("X", 3600)); e.Expires = &x })),
+		want: Changes{},
+	}, {
+		name: "partial",
+		from: build([]string{"b"}, a),
+		to:   build(nil, a, b),
+		want: Changes{Added: []Entry{b}},
+	}} {
+		t.Run(tc.name, func(t *testing.T) {
+			got := Compare(tc.from, tc.to)
+			for _, l := range []*[]Entry{&tc.want.Added, &tc.want.Removed, &tc.want.Updated} {
+				if *l == nil {
+					*l = []Entry{}
+				}
+			}
+			if tc.want.Modified == nil {
+				tc.want.Modified = []Modification{}
+			}
+			if !reflect.DeepEqual(got, tc.want) {
+				t.Errorf("Compare() = %+v, want %+v", got, tc.want)
+			}
+			if got.Empty() != (len(tc.want.Added)+len(tc.want.Removed)+len(tc.want.Modified)+len(tc.want.Updated) == 0) {
+				t.Errorf("Empty() = %v for %+v", got.Empty(), got)
+			}
+		})
+	}
+}
@@ -0,0 +1,40 @@
+package manifest
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"hash"
+	"io"
+	"os"
+)
+
+// Digest returns the sha256 digest of everything read from r, in the form
+// recorded in manifests.
+func Digest(r io.Reader) (string, error) {
+	h := sha256.New()
+	if _, err := io.Copy(h, r); err != nil {
+		return "", err
+	}
+	return formatDigest(h), nil
+}
+
+// DigestFile returns the digest of a local file.
+func DigestFile(path string) (string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	return Digest(f)
+}
+
+func formatDigest(h hash.Hash) string {
+	return "sha256:" + hex.EncodeToString(h.Sum(nil))
+}
+
+// digestBytes is Digest for bytes already in memory.
+func digestBytes(b []byte) string {
+	h := sha256.New()
+	h.Write(b)
+	return formatDigest(h)
+}
@@ -0,0 +1,120 @@
+package manifest
+
+import (
+	"bufio"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"hash/fnv"
+	"io"
+	"math"
+	"os"
+	"path"
+	"strings"
+)
+
+// ReadDigests parses a digest file, as a build system that already hashes
+// its outputs can write it, for WithDigests. Each line is a sha256 in hex,
+// optionally prefixed with "sha256:", and a path relative to the source
+// being uploaded, separated by whitespace: the format sha256sum writes, its
+// "*" binary marker included. Blank lines and lines starting with "#" are
+// skipped. The result maps paths to digests in the form manifests record.
+func ReadDigests(r io.Reader) (map[string]string, error) {
+	digests := map[string]string{}
+	sc := bufio.NewScanner(r)
+	for n := 1; sc.Scan(); n++ {
+		line := strings.TrimSpace(sc.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		i := strings.IndexAny(line, " \t")
+		if i < 0 {
+			return nil, fmt.Errorf("line %d: want a digest and a path", n)
+		}
+		sum := strings.TrimPrefix(line[:i], "sha256:")
+		if b, err := hex.DecodeString(sum); err != nil || len(b) != 32 {
+			return nil, fmt.Errorf("line %d: %q isn't a sha256", n, line[:i])
+		}
+		p := strings.TrimPrefix(strings.TrimLeft(line[i:], " \t"), "*")
+		if p == "" {
+			return nil, fmt.Errorf("line %d: want a digest and a path", n)
+		}
+		p = path.Clean(p)
+		if path.IsAbs(p) || p == ".." || strings.HasPrefix(p, "../") {
+			return nil, fmt.Errorf("line %d: path %q isn't relative to the source", n, p)
+		}
+		d := "sha256:" + strings.ToLower(sum)
+		if prev, ok := digests[p]; ok && prev != d {
+			return nil, fmt.Errorf("line %d: %s is listed twice with different digests", n, p)
+		}
+		digests[p] = d
+	}
+	if err := sc.Err(); err != nil {
+		return nil, err
+	}
+	return digests, nil
+}
+
+// LoadDigests reads the digest file at p with ReadDigests.
+func LoadDigests(p string) (map[string]string, error) {
+	f, err := os.Open(p)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	d, err := ReadDigests(f)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", p, err)
+	}
+	return d, nil
+}
+
+// givenDigest returns the digest WithDigests gives for the local source s,
+// or "" if there is none, and whether it is trusted as it is. A digest that
+// isn't trusted belongs to a file picked for a spot check, which is hashed
+// anyway and compared with checkGiven. Each path is picked or not once per
+// run, so that retrying a file doesn't pick again.
+func (o *options) givenDigest(s Source) (string, bool) {
+	d, ok := o.digests[s.RelPath]
+	if !ok || isRemote(s.Path) || s.Link != "" {
+		return "", false
+	}
+	switch {
+	case o.spotCheck <= 0:
+		return d, true
+	case o.spotCheck >= 1:
+		return d, false
+	}
+	h := fnv.New64a()
+	binary.Write(h, binary.LittleEndian, o.spotSeed)
+	io.WriteString(h, s.RelPath)
+	return d, float64(h.Sum64()) >= o.spotCheck*math.MaxUint64
+}
+
+// checkGiven returns an error if got, the digest s was hashed to, isn't
+// the digest given for it.
+func checkGiven(s Source, given, got string) error {
+	if given == "" || given == got {
+		return nil
+	}
+	return fmt.Errorf("%s hashes to %s, but the digest file has %s", s.Path, got, given)
+}
+
+// digestFile returns the digest of the local source s: the one given for
+// it, or, if there is none or it is to be spot-checked, what it hashes to.
+func (o *options) digestFile(s Source) (string, error) {
+	given, trusted := o.givenDigest(s)
+	if trusted {
+		return given, nil
+	}
+	f, err := o.openLocal(s.Path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	d, err := Digest(f)
+	if err != nil {
+		return "", err
+	}
+	return d, checkGiven(s, given, d)
+}
@@ -0,0 +1,168 @@
+package manifest
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"cloud.google.com/go/storage"
+)
+
+// DownloadError is returned when some files could not be downloaded or
+// didn't match their digests, or when the manifest is partial, in which
+// case Missing lists the files it lacks and everything else is downloaded.
+type DownloadError struct {
+	Failed  []Failure
+	Total   int
+	Missing []string
+}
+
+func (e *DownloadError) Error() string {
+	if len(e.Failed) == 0 {
+		return fmt.Sprintf("the manifest is partial: %d files failed to upload and weren't downloaded", len(e.Missing))
+	}
+	msg := fmt.Sprintf("%d of %d files failed to download or verify", len(e.Failed), e.Total)
+	if len(e.Missing) > 0 {
+		msg += fmt.Sprintf(", and the manifest is partial: %d more failed to upload", len(e.Missing))
+	}
+	return msg
+}
+
+// Downloader restores files listed in a manifest, verifying each one.
+type Downloader struct {
+	*options
+}
+
+// NewDownloader returns a Downloader. Unless WithClient is given, a GCS
+// client is created with default credentials.
+func NewDownloader(ctx context.Context, opts ...Option) (*Downloader, error) {
+	o := newOptions(opts)
+	if o.client == nil {
+		c, err := storage.NewClient(ctx)
+		if err != nil {
+			return nil, fmt.Errorf("creating GCS client: %v", err)
+		}
+		o.client = c
+	}
+	return &Downloader{options: o}, nil
+}
+
+// Download fetches every file in m from under the gs:// path src into the
+// local directory dst. Files whose digest doesn't match are not kept; they
+// are reported in a *DownloadError once everything else has been fetched.
+// Objects encrypted with a customer-supplied key need WithEncryptionKey.
+// Compressed objects are restored decompressed unless WithKeepEncoding is
+// given. Objects that can't be opened are retried as WithRetries says, and
+// WithMaxRequestRate and WithMaxBandwidth pace the download.
+func (d *Downloader) Download(ctx context.Context, m *Manifest, src, dst string) error {
+	open, err := d.opener(src)
+	if err != nil {
+		return err
+	}
+	return d.download(ctx, m, dst, open)
+}
+
+// opener returns a func opening the object of an entry under the gs://
+// path src as it is stored, retried and paced as Download says.
+func (d *Downloader) opener(src string) (func(context.Context, Entry) (io.ReadCloser, error), error) {
+	bucketName, gcsPath, err := ParseURI(src)
+	if err != nil {
+		return nil, err
+	}
+	bucket := d.client.Bucket(bucketName)
+	return func(ctx context.Context, e Entry) (io.ReadCloser, error) {
+		if err := d.checkKey(e); err != nil {
+			return nil, err
+		}
+		name := path.Join(gcsPath, e.ObjectName())
+		obj := d.encrypted(bucket.Object(name))
+		var r *storage.Reader
+		err := d.retry(ctx, d.retries, name, func() error {
+			if err := d.pace(ctx); err != nil {
+				return err
+			}
+			var err error
+			r, err = obj.ReadCompressed(e.ContentEncoding != "").NewReader(ctx)
+			if err == storage.ErrObjectNotExist {
+				// A missing object won't turn up by retrying.
+				return nil
+			}
+			return err
+		})
+		if err == nil && r == nil {
+			err = storage.ErrObjectNotExist
+		}
+		if err != nil {
+			return nil, err
+		}
+		return throttledReadCloser{d.throttle(ctx, r), r, r.Attrs.Size}, nil
+	}, nil
+}
+
+// throttledReadCloser reads through a throttled reader and closes the
+// reader it wraps. size is the size of the object being read.
+type throttledReadCloser struct {
+	io.Reader
+	io.Closer
+	size int64
+}
+
+// DownloadObject streams obj to a temporary file beside dest, and only
+// renames it into place once its digest matches want.
+func DownloadObject(ctx context.Context, obj *storage.ObjectHandle, want, dest string) error {
+	r, err := obj.NewReader(ctx)
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+	return downloadTo(r, want, dest, defaultPerm)
+}
+
+func downloadTo(r io.Reader, want, dest string, perm os.FileMode) error {
+	if err := os.MkdirAll(filepath.Dir(dest), 0755); err != nil {
+		return err
+	}
+	tmp, err := ioutil.TempFile(filepath.Dir(dest), ".download-")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	got, err := Digest(io.TeeReader(r, tmp))
+	if err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Chmod(perm); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	if got != want {
+		return fmt.Errorf("digest mismatch: manifest has %s, got %s", want, got)
+	}
+	return os.Rename(tmp.Name(), dest)
+}
+
+// LocalPath maps a manifest path under dir, refusing paths that would
+// escape it.
+func LocalPath(dir, p string) (string, error) {
+	rel := filepath.Clean(filepath.FromSlash(p))
+	if filepath.IsAbs(rel) || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		return "", fmt.Errorf("manifest path %q escapes the destination directory", p)
+	}
+	return filepath.Join(dir, rel), nil
+}
+
+// ReadManifest reads a manifest from a gs:// URI or local path using the
+// Downloader's client, checking its signature if WithPublicKey was given.
+func (d *Downloader) ReadManifest(ctx context.Context, uri string) (*Manifest, error) {
+	return d.readVerified(ctx, uri)
+}
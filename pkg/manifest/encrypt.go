@@ -0,0 +1,67 @@
+package manifest
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"fmt"
+	"strings"
+
+	"cloud.google.com/go/storage"
+)
+
+// ParseEncryptionKey decodes a base64 AES-256 customer-supplied encryption
+// key, as gsutil's encryption_key setting takes it.
+func ParseEncryptionKey(s string) ([]byte, error) {
+	key, err := base64.StdEncoding.DecodeString(strings.TrimSpace(s))
+	if err != nil {
+		return nil, fmt.Errorf("encryption key isn't base64: %v", err)
+	}
+	if len(key) != 32 {
+		return nil, fmt.Errorf("encryption key is %d bytes, want 32 for AES-256", len(key))
+	}
+	return key, nil
+}
+
+// keySHA256 returns the base64 sha256 of a customer-supplied key, which is
+// how GCS, and so manifests, identify it.
+func keySHA256(key []byte) string {
+	sum := sha256.Sum256(key)
+	return base64.StdEncoding.EncodeToString(sum[:])
+}
+
+// encrypted returns obj set up to be written and read with the
+// customer-supplied key, if one was given.
+func (o *options) encrypted(obj *storage.ObjectHandle) *storage.ObjectHandle {
+	if o.encryptionKey == nil {
+		return obj
+	}
+	return obj.Key(o.encryptionKey)
+}
+
+// wantEncryption returns the encryption objects written with o get, or nil
+// if they are left to the bucket's default.
+func (o *options) wantEncryption() *Encryption {
+	switch {
+	case o.kmsKey != "":
+		return &Encryption{KMSKey: o.kmsKey}
+	case o.encryptionKey != nil:
+		return &Encryption{CustomerKeySHA256: keySHA256(o.encryptionKey)}
+	}
+	return nil
+}
+
+// checkKey returns an error if e's object is encrypted with a
+// customer-supplied key other than the one given, which GCS would refuse
+// to read it with.
+func (o *options) checkKey(e Entry) error {
+	if e.Encryption == nil || e.Encryption.CustomerKeySHA256 == "" {
+		return nil
+	}
+	if o.encryptionKey == nil {
+		return fmt.Errorf("encrypted with a customer-supplied key; none was given")
+	}
+	if got := keySHA256(o.encryptionKey); got != e.Encryption.CustomerKeySHA256 {
+		return fmt.Errorf("encrypted with a different customer-supplied key: manifest has %q, given %q", e.Encryption.CustomerKeySHA256, got)
+	}
+	return nil
+}
@@ -0,0 +1,195 @@
+package manifest
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand"
+	"net/http"
+	"os"
+	"os/user"
+	"path"
+	"strconv"
+	"time"
+
+	"cloud.google.com/go/storage"
+	"google.golang.org/api/googleapi"
+)
+
+// Event is one record in a publish event log.
+type Event struct {
+	Time   time.Time `json:"time"`
+	Action string    `json:"action"`
+	Actor  string    `json:"actor"`
+	RunID  string    `json:"runId,omitempty"`
+	Dst    string    `json:"dst"`
+	// ManifestDigest is the sha256 of the manifest as published.
+	ManifestDigest string `json:"manifestDigest,omitempty"`
+	Files          int    `json:"files"`
+	// Uploaded and Bytes are the files and bytes the run transferred, and
+	// Failed the files it couldn't; Seconds is how long it took. Together
+	// they summarize the run for comparing it with earlier ones.
+	Uploaded int     `json:"uploaded"`
+	Bytes    int64   `json:"bytes"`
+	Failed   int     `json:"failed,omitempty"`
+	Seconds  float64 `json:"seconds"`
+	// Outcome is "success", "failure", or "partial" when files failed but
+	// a partial manifest was published; Error says why for the last two.
+	Outcome string `json:"outcome"`
+	Error   string `json:"error,omitempty"`
+	// Warnings are what the run skipped or did differently, whatever the
+	// outcome.
+	Warnings []Warning `json:"warnings,omitempty"`
+}
+
+// DefaultActor names whoever is running this process, as user@host.
+func DefaultActor() string {
+	name := "unknown"
+	if u, err := user.Current(); err == nil {
+		name = u.Username
+	}
+	host, err := os.Hostname()
+	if err != nil {
+		return name
+	}
+	return name + "@" + host
+}
+
+// compactAt is how many components the event log may build up before the
+// next append rewrites it as a single object. GCS refuses to compose
+// objects with more than 1024 components, and each append adds one.
+const compactAt = 512
+
+// componentsKey is the metadata key counting the log's components; the GCS
+// client doesn't expose the count itself.
+const componentsKey = "gcs-manifest-components"
+
+// RecordEvent appends e as a line of the NDJSON log object at the gs:// URI
+// logURI. The record is written as its own temporary object and composed
+// onto the end of the log with a generation precondition, retrying if
+// another writer got there first, so many jobs can append concurrently
+// without losing records.
+func RecordEvent(ctx context.Context, client *storage.Client, logURI string, e Event) error {
+	bucketName, name, err := ParseURI(logURI)
+	if err != nil {
+		return err
+	}
+	if e.Time.IsZero() {
+		e.Time = time.Now()
+	}
+	e.Time = e.Time.UTC()
+	b, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+	b = append(b, '\n')
+
+	bucket := client.Bucket(bucketName)
+	rec := bucket.Object(path.Join(name+".d", fmt.Sprintf("%s-%s.json", e.Time.Format("20060102T150405.000000000Z"), e.RunID)))
+	w := rec.If(storage.Conditions{DoesNotExist: true}).NewWriter(ctx)
+	if _, err := w.Write(b); err != nil {
+		w.Close()
+		return err
+	}
+	if err := w.Close(); err != nil {
+		return err
+	}
+	defer rec.Delete(ctx)
+
+	log := bucket.Object(name)
+	backoff := 100 * time.Millisecond
+	for attempt := 0; ; attempt++ {
+		err := appendRecord(ctx, log, rec, b)
+		if !isPreconditionFailed(err) || attempt == 10 {
+			return err
+		}
+		// Someone else appended in the meantime; try again on top of theirs.
+		select {
+		case <-time.After(backoff + time.Duration(rand.Int63n(int64(backoff)))):
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+		backoff *= 2
+	}
+}
+
+// ReadEvents returns the records in the event log at the gs:// URI logURI,
+// oldest first.
+func ReadEvents(ctx context.Context, client *storage.Client, logURI string) ([]Event, error) {
+	bucketName, name, err := ParseURI(logURI)
+	if err != nil {
+		return nil, err
+	}
+	r, err := client.Bucket(bucketName).Object(name).NewReader(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+	var events []Event
+	dec := json.NewDecoder(r)
+	for {
+		var e Event
+		if err := dec.Decode(&e); err == io.EOF {
+			return events, nil
+		} else if err != nil {
+			return nil, fmt.Errorf("reading %s: %v", logURI, err)
+		}
+		events = append(events, e)
+	}
+}
+
+// appendRecord adds rec, whose contents are b, to the end of log, failing
+// with a precondition error if log changes meanwhile.
+func appendRecord(ctx context.Context, log, rec *storage.ObjectHandle, b []byte) error {
+	attrs, err := log.Attrs(ctx)
+	if err == storage.ErrObjectNotExist {
+		c := log.If(storage.Conditions{DoesNotExist: true}).ComposerFrom(rec)
+		c.ContentType = "application/x-ndjson"
+		c.Metadata = map[string]string{componentsKey: "1"}
+		_, err := c.Run(ctx)
+		return err
+	}
+	if err != nil {
+		return err
+	}
+	cond := log.If(storage.Conditions{GenerationMatch: attrs.Generation})
+
+	n, _ := strconv.Atoi(attrs.Metadata[componentsKey])
+	if n+1 < compactAt {
+		c := cond.ComposerFrom(log.Generation(attrs.Generation), rec)
+		c.ContentType = "application/x-ndjson"
+		c.Metadata = map[string]string{componentsKey: strconv.Itoa(n + 1)}
+		_, err := c.Run(ctx)
+		return err
+	}
+
+	// Compact: rewrite the whole log, plus the new record, as one object.
+	r, err := log.Generation(attrs.Generation).NewReader(ctx)
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+	// Cancelling, rather than closing, the writer on an error keeps a log
+	// that was only partly copied from replacing the whole one.
+	wctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	w := cond.NewWriter(wctx)
+	w.ContentType = "application/x-ndjson"
+	w.Metadata = map[string]string{componentsKey: "1"}
+	if _, err := io.Copy(w, r); err != nil {
+		cancel()
+		return err
+	}
+	if _, err := w.Write(b); err != nil {
+		cancel()
+		return err
+	}
+	return w.Close()
+}
+
+func isPreconditionFailed(err error) bool {
+	var gerr *googleapi.Error
+	return errors.As(err, &gerr) && gerr.Code == http.StatusPreconditionFailed
+}
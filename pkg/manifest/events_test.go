@@ -0,0 +1,75 @@
+package manifest
+
+import (
+	"bytes"
+	"context"
+	"strconv"
+	"testing"
+)
+
+func TestRecordEvent(t *testing.T) {
+	const old = `{"action":"publish"}` + "\n"
+	for _, tc := range []struct {
+		name string
+		// components is how many the log has; 0 means there's no log.
+		components int
+		truncate   bool
+		// wantComponents is the log's count afterwards; "" means the log
+		// must be left as it was.
+		wantComponents string
+		wantErr        bool
+	}{{
+		name:           "new log",
+		wantComponents: "1",
+	}, {
+		name:           "compose",
+		components:     3,
+		wantComponents: "4",
+	}, {
+		name:           "compact",
+		components:     compactAt - 1,
+		wantComponents: "1",
+	}, {
+		name:       "compact with the log cut short",
+		components: compactAt - 1,
+		truncate:   true,
+		wantErr:    true,
+	}} {
+		t.Run(tc.name, func(t *testing.T) {
+			fake, client := newFakeGCS(t)
+			if tc.components > 0 {
+				fake.put("b/events.ndjson", []byte(old), map[string]string{componentsKey: strconv.Itoa(tc.components)})
+			}
+			fake.truncate["b/events.ndjson"] = tc.truncate
+			before := fake.get("b/events.ndjson")
+
+			err := RecordEvent(context.Background(), client, "gs://b/events.ndjson", Event{Action: "publish", RunID: "r"})
+			if (err != nil) != tc.wantErr {
+				t.Fatalf("RecordEvent: %v, want error %v", err, tc.wantErr)
+			}
+			log := fake.get("b/events.ndjson")
+			if tc.wantComponents == "" {
+				if log != before {
+					t.Fatalf("log was replaced with %q", log.data)
+				}
+				return
+			}
+			if got := log.metadata[componentsKey]; got != tc.wantComponents {
+				t.Errorf("components = %s, want %s", got, tc.wantComponents)
+			}
+			want := 1
+			if before != nil {
+				want++
+			}
+			if got := bytes.Count(log.data, []byte("\n")); got != want {
+				t.Errorf("log has %d records, want %d:\n%s", got, want, log.data)
+			}
+			if tc.components > 0 && !bytes.HasPrefix(log.data, []byte(old)) {
+				t.Errorf("log lost its earlier records:\n%s", log.data)
+			}
+			if n := len(fake.objects); n != 1 {
+				t.Errorf("%d objects left, want just the log", n)
+			}
+		})
+	}
+}
@@ -0,0 +1,65 @@
+package manifest
+
+import (
+	"fmt"
+	"strings"
+	"time"
+)
+
+// ExpiryRule gives the files whose paths match Pattern, in the glob syntax
+// of WithInclude, a time to live of TTL from when they are uploaded.
+type ExpiryRule struct {
+	Pattern string
+	TTL     time.Duration
+}
+
+// ParseExpiryRule parses a rule written as pattern=ttl, such as
+// nightly/**=720h.
+func ParseExpiryRule(s string) (ExpiryRule, error) {
+	i := strings.LastIndex(s, "=")
+	if i <= 0 {
+		return ExpiryRule{}, fmt.Errorf("invalid expiry rule %q: want pattern=ttl", s)
+	}
+	ttl, err := time.ParseDuration(s[i+1:])
+	if err != nil || ttl <= 0 {
+		return ExpiryRule{}, fmt.Errorf("invalid expiry rule %q: want a positive ttl such as 720h", s)
+	}
+	return ExpiryRule{Pattern: s[:i], TTL: ttl}, nil
+}
+
+// expiryOf returns when a file at p uploaded now expires under the
+// WithExpiry rules, or nil if it doesn't.
+func (o *options) expiryOf(p string, now time.Time) *time.Time {
+	for _, r := range o.expiry {
+		if parseRules([]string{r.Pattern}).matchAny(p) {
+			t := now.Add(r.TTL).UTC().Truncate(time.Second)
+			return &t
+		}
+	}
+	return nil
+}
+
+// expire sets the expiry of each of files that doesn't have one yet.
+func (o *options) expire(files []File, now time.Time) {
+	for i, f := range files {
+		if f.Expires == nil {
+			files[i].Expires = o.expiryOf(f.Path, now)
+		}
+	}
+}
+
+// Expired splits m into the entries that had expired by now and the
+// manifest of the rest, which keeps m's missing paths.
+func (m *Manifest) Expired(now time.Time) ([]Entry, *Manifest) {
+	var expired []Entry
+	rest := New()
+	rest.Missing = m.Missing
+	for _, p := range m.Paths() {
+		if e := m.Files[p]; e.Expired(now) {
+			expired = append(expired, e)
+		} else {
+			rest.Add(e)
+		}
+	}
+	return expired, rest
+}
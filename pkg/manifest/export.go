@@ -0,0 +1,254 @@
+package manifest
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+
+	"cloud.google.com/go/storage"
+)
+
+// The layout of a bundle made by Export: the manifest and its signature
+// and signature bundle, as published, at the top, beside ExportSums and
+// ExportScript, and the files under ExportFiles.
+const (
+	ExportFiles  = "files"
+	ExportSums   = "SHA256SUMS"
+	ExportScript = "verify.sh"
+)
+
+// exportScript checks a bundle's files with nothing but sha256sum, or
+// shasum where that is missing, as on macOS.
+const exportScript = `#!/bin/sh
+# Checks every file of this bundle against the sha256 its manifest
+# records, offline. The manifest's signature, if it was signed, is in
+# manifest.json.sig; check it and the files together with
+#   verify --manifest manifest.json --verify-signature key.pem file://$PWD/files
+set -e
+cd "$(dirname "$0")"
+if command -v sha256sum >/dev/null 2>&1; then
+	exec sha256sum -c ` + ExportSums + `
+fi
+exec shasum -a 256 -c ` + ExportSums + `
+`
+
+// Export makes a portable bundle of the manifest at uri in the local
+// directory dir, for delivery where GCS can't be reached: every file, from
+// under the gs:// path src, downloaded and checked as Download does, the
+// manifest with its signature and signature bundle exactly as published,
+// checked first as ReadManifest does, and ExportSums and ExportScript to
+// check the files with standard tools. A partial manifest can't be
+// exported.
+func (d *Downloader) Export(ctx context.Context, uri, src, dir string) (*Manifest, error) {
+	b, err := ReadBytes(ctx, d.client, uri)
+	if err != nil {
+		return nil, err
+	}
+	m, err := d.verified(ctx, uri, b)
+	if err != nil {
+		return nil, err
+	}
+	if len(m.Missing) > 0 {
+		return nil, fmt.Errorf("%s is partial: %d files failed to upload", uri, len(m.Missing))
+	}
+	if err := d.Download(ctx, m, src, filepath.Join(dir, ExportFiles)); err != nil {
+		return nil, err
+	}
+
+	if err := writeFileAtomic(filepath.Join(dir, Name), b); err != nil {
+		return nil, err
+	}
+	for _, suffix := range []string{SignatureSuffix, BundleSuffix} {
+		sb, err := ReadBytes(ctx, d.client, uri+suffix)
+		if err != nil {
+			// An unsigned manifest has neither.
+			continue
+		}
+		if err := writeFileAtomic(filepath.Join(dir, Name+suffix), sb); err != nil {
+			return nil, err
+		}
+	}
+	var sums bytes.Buffer
+	for _, p := range m.Paths() {
+		if e := m.Files[p]; e.Link == "" {
+			fmt.Fprintf(&sums, "%s  %s\n", strings.TrimPrefix(e.Digest, "sha256:"), path.Join(ExportFiles, p))
+		}
+	}
+	if err := writeFileAtomic(filepath.Join(dir, ExportSums), sums.Bytes()); err != nil {
+		return nil, err
+	}
+	if err := writeFileAtomic(filepath.Join(dir, ExportScript), []byte(exportScript)); err != nil {
+		return nil, err
+	}
+	return m, os.Chmod(filepath.Join(dir, ExportScript), 0755)
+}
+
+// Import uploads a bundle made by Export, in the local directory dir, to
+// the gs:// path dst. Each file is stored in the object its manifest
+// entry names, with the Content-Type and CRC32C the entry records, so
+// that GCS rejects one that has changed, and is only kept if its sha256
+// matches too. The manifest, its signature and signature bundle are then
+// published unchanged, so the signature still verifies. Files that were
+// stored compressed can't be stored again byte for byte, so a manifest
+// with any is refused.
+func (u *Uploader) Import(ctx context.Context, dir, dst string) (*Manifest, error) {
+	b, err := ioutil.ReadFile(filepath.Join(dir, Name))
+	if err != nil {
+		return nil, err
+	}
+	m, err := Parse(b)
+	if err != nil {
+		return nil, fmt.Errorf("parsing %s: %v", filepath.Join(dir, Name), err)
+	}
+	if len(m.Missing) > 0 {
+		return nil, fmt.Errorf("the bundle's manifest is partial")
+	}
+	for _, p := range m.Paths() {
+		if e := m.Files[p]; e.ContentEncoding != "" {
+			return nil, fmt.Errorf("%s is stored with Content-Encoding %s, which can't be imported; upload the bundle's files instead", p, e.ContentEncoding)
+		}
+		if err := u.checkKey(m.Files[p]); err != nil {
+			return nil, fmt.Errorf("%s: %v", p, err)
+		}
+	}
+	bucketName, gcsPath, err := ParseURI(dst)
+	if err != nil {
+		return nil, err
+	}
+	bucket := u.client.Bucket(bucketName)
+
+	// Several files may share an object under the content-addressed
+	// layout; it is uploaded once.
+	seen := map[string]bool{}
+	var paths []string
+	for _, p := range m.Paths() {
+		if e := m.Files[p]; e.Link == "" && !seen[e.ObjectName()] {
+			seen[e.ObjectName()] = true
+			paths = append(paths, p)
+		}
+	}
+	var (
+		mu       sync.Mutex
+		firstErr error
+		wg       sync.WaitGroup
+	)
+	jobs := make(chan string)
+	for i := 0; i < u.parallelism; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for p := range jobs {
+				e := m.Files[p]
+				err := u.retry(ctx, u.retries, p, func() error {
+					return u.importFile(ctx, bucket.Object(path.Join(gcsPath, e.ObjectName())), filepath.Join(dir, ExportFiles, filepath.FromSlash(p)), e)
+				})
+				if err != nil {
+					mu.Lock()
+					if firstErr == nil {
+						firstErr = fmt.Errorf("%s: %v", p, err)
+					}
+					mu.Unlock()
+				}
+			}
+		}()
+	}
+	for _, p := range paths {
+		mu.Lock()
+		failed := firstErr != nil
+		mu.Unlock()
+		if failed || ctx.Err() != nil {
+			break
+		}
+		jobs <- p
+	}
+	close(jobs)
+	wg.Wait()
+	if firstErr != nil {
+		return nil, firstErr
+	}
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	// The manifest is published as it was signed, not signed again.
+	plain := *u.options
+	plain.signer = nil
+	object := path.Join(gcsPath, Name)
+	if err := (&Uploader{options: &plain}).putManifest(ctx, bucket, object, b, false); err != nil {
+		return nil, err
+	}
+	for _, suffix := range []string{SignatureSuffix, BundleSuffix} {
+		sb, err := ioutil.ReadFile(filepath.Join(dir, Name+suffix))
+		if os.IsNotExist(err) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		err = u.retry(ctx, u.manifestRetries, Name+suffix+" upload", func() error {
+			w := bucket.Object(object + suffix).NewWriter(ctx)
+			w.KMSKeyName = u.kmsKey
+			if _, err := w.Write(sb); err != nil {
+				w.Close()
+				return err
+			}
+			return w.Close()
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+	return m, nil
+}
+
+// importFile uploads the local file p to obj as e records it.
+func (u *Uploader) importFile(ctx context.Context, obj *storage.ObjectHandle, p string, e Entry) error {
+	f, err := u.openLocal(p)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	if err := u.pace(ctx); err != nil {
+		return err
+	}
+	fmt.Fprintln(u.log, "Importing:", e.Path)
+	// Cancelling the writer's context abandons the upload, so that an
+	// object whose digest turns out wrong is never finalized.
+	wctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	w := u.encrypted(obj).NewWriter(wctx)
+	w.ChunkSize = u.chunkSize
+	w.ContentType = e.ContentType
+	if e.Encryption != nil && e.Encryption.KMSKey != "" {
+		w.KMSKeyName = e.Encryption.KMSKey
+	}
+	if e.CRC32C != "" {
+		crc, err := strconv.ParseUint(e.CRC32C, 16, 32)
+		if err != nil {
+			return fmt.Errorf("bad crc32c %q in manifest", e.CRC32C)
+		}
+		w.CRC32C = uint32(crc)
+		w.SendCRC32C = true
+	}
+	h := sha256.New()
+	if _, err := io.Copy(w, io.TeeReader(u.throttle(ctx, f), h)); err != nil {
+		cancel()
+		w.Close()
+		return err
+	}
+	if got := formatDigest(h); got != e.Digest {
+		cancel()
+		w.Close()
+		return fmt.Errorf("digest mismatch: manifest has %s, got %s", e.Digest, got)
+	}
+	return w.Close()
+}
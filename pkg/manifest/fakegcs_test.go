@@ -0,0 +1,296 @@
+package manifest
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"io/ioutil"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+
+	"cloud.google.com/go/storage"
+	"google.golang.org/api/option"
+)
+
+// fakeObject is an object stored in a fakeGCS.
+type fakeObject struct {
+	data            []byte
+	generation      int64
+	contentType     string
+	contentEncoding string
+	metadata        map[string]string
+}
+
+// fakeGCS is an in-memory GCS serving just the JSON API calls and reads
+// the storage client makes for the code under test: object attrs, media
+// uploads, compose, rewrite, delete and reads. Objects are keyed by
+// bucket/name.
+type fakeGCS struct {
+	mu      sync.Mutex
+	objects map[string]*fakeObject
+	gen     int64
+	// truncate names objects whose reads are cut off halfway, and broken
+	// the prefixes of keys every request for which fails with a 403.
+	truncate map[string]bool
+	broken   []string
+}
+
+// newFakeGCS starts a fakeGCS for the length of t and returns it with a
+// client that talks to it.
+func newFakeGCS(t *testing.T) (*fakeGCS, *storage.Client) {
+	f := &fakeGCS{objects: map[string]*fakeObject{}, truncate: map[string]bool{}}
+	srv := httptest.NewTLSServer(f)
+	t.Cleanup(srv.Close)
+	client, err := storage.NewClient(context.Background(), option.WithEndpoint(srv.URL+"/storage/v1/"), option.WithHTTPClient(srv.Client()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return f, client
+}
+
+// put stores data at bucket/name with metadata md, as a new generation.
+func (f *fakeGCS) put(key string, data []byte, md map[string]string) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.store(key, &fakeObject{data: data, metadata: md})
+}
+
+// get returns the object at key, or nil.
+func (f *fakeGCS) get(key string) *fakeObject {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.objects[key]
+}
+
+func (f *fakeGCS) store(key string, o *fakeObject) {
+	f.gen++
+	o.generation = f.gen
+	f.objects[key] = o
+}
+
+func (f *fakeGCS) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	var parts []string
+	for _, p := range strings.Split(strings.Trim(r.URL.EscapedPath(), "/"), "/") {
+		p, _ = url.PathUnescape(p)
+		parts = append(parts, p)
+	}
+	q := r.URL.Query()
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	switch {
+	case f.isBroken(parts, q):
+		fakeError(w, http.StatusForbidden)
+	case len(parts) == 6 && parts[0] == "upload" && r.Method == "POST":
+		f.insert(w, r, parts[4], q)
+	case len(parts) >= 6 && parts[0] == "storage":
+		f.object(w, r, parts[3], parts[5], parts[6:], q)
+	default:
+		f.read(w, r, strings.Join(parts, "/"), q)
+	}
+}
+
+// isBroken reports whether the request for the path parts, with query q,
+// touches a broken key: the object it reads, writes or copies to.
+func (f *fakeGCS) isBroken(parts []string, q url.Values) bool {
+	var key string
+	switch {
+	case len(parts) == 6 && parts[0] == "upload":
+		key = parts[4] + "/" + q.Get("name")
+	case len(parts) == 11 && parts[0] == "storage" && parts[6] == "rewriteTo":
+		key = parts[8] + "/" + parts[10]
+	case len(parts) >= 6 && parts[0] == "storage":
+		key = parts[3] + "/" + parts[5]
+	default:
+		key = strings.Join(parts, "/")
+	}
+	for _, b := range f.broken {
+		if strings.HasPrefix(key, b) {
+			return true
+		}
+	}
+	return false
+}
+
+func (f *fakeGCS) object(w http.ResponseWriter, r *http.Request, bucket, name string, rest []string, q url.Values) {
+	key := bucket + "/" + name
+	o := f.objects[key]
+	switch {
+	case len(rest) == 0 && r.Method == "GET":
+		if o == nil {
+			fakeError(w, http.StatusNotFound)
+			return
+		}
+		f.reply(w, bucket, name, o)
+	case len(rest) == 0 && r.Method == "DELETE":
+		if o == nil {
+			fakeError(w, http.StatusNotFound)
+			return
+		}
+		delete(f.objects, key)
+		w.WriteHeader(http.StatusNoContent)
+	case len(rest) == 1 && rest[0] == "compose":
+		if !f.matches(w, o, q) {
+			return
+		}
+		var req struct {
+			Destination struct {
+				ContentType string            `json:"contentType"`
+				Metadata    map[string]string `json:"metadata"`
+			} `json:"destination"`
+			SourceObjects []struct {
+				Name       string `json:"name"`
+				Generation int64  `json:"generation,string"`
+			} `json:"sourceObjects"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			fakeError(w, http.StatusBadRequest)
+			return
+		}
+		composed := &fakeObject{contentType: req.Destination.ContentType, metadata: req.Destination.Metadata}
+		for _, s := range req.SourceObjects {
+			so := f.objects[bucket+"/"+s.Name]
+			if so == nil || (s.Generation != 0 && so.generation != s.Generation) {
+				fakeError(w, http.StatusNotFound)
+				return
+			}
+			composed.data = append(composed.data, so.data...)
+		}
+		f.store(key, composed)
+		f.reply(w, bucket, name, composed)
+	case len(rest) == 5 && rest[0] == "rewriteTo":
+		if o == nil {
+			fakeError(w, http.StatusNotFound)
+			return
+		}
+		if g := q.Get("sourceGeneration"); g != "" && g != strconv.FormatInt(o.generation, 10) {
+			fakeError(w, http.StatusNotFound)
+			return
+		}
+		dst := rest[2] + "/" + rest[4]
+		if !f.matches(w, f.objects[dst], q) {
+			return
+		}
+		c := *o
+		f.store(dst, &c)
+		json.NewEncoder(w).Encode(map[string]interface{}{"done": true, "resource": fakeAttrs(rest[2], rest[4], &c)})
+	default:
+		fakeError(w, http.StatusNotImplemented)
+	}
+}
+
+// insert serves a multipart media upload to bucket.
+func (f *fakeGCS) insert(w http.ResponseWriter, r *http.Request, bucket string, q url.Values) {
+	name := q.Get("name")
+	if !f.matches(w, f.objects[bucket+"/"+name], q) {
+		return
+	}
+	_, params, err := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	if err != nil || q.Get("uploadType") != "multipart" {
+		fakeError(w, http.StatusBadRequest)
+		return
+	}
+	mr := multipart.NewReader(r.Body, params["boundary"])
+	var meta struct {
+		ContentType     string            `json:"contentType"`
+		ContentEncoding string            `json:"contentEncoding"`
+		Metadata        map[string]string `json:"metadata"`
+	}
+	p, err := mr.NextPart()
+	if err == nil {
+		err = json.NewDecoder(p).Decode(&meta)
+	}
+	var data []byte
+	if err == nil {
+		p, err = mr.NextPart()
+	}
+	if err == nil {
+		data, err = ioutil.ReadAll(p)
+	}
+	if err == nil {
+		if _, err = mr.NextPart(); err == io.EOF {
+			err = nil
+		}
+	}
+	if err != nil {
+		// A cancelled or broken upload stores nothing.
+		fakeError(w, http.StatusBadRequest)
+		return
+	}
+	o := &fakeObject{data: data, contentType: meta.ContentType, contentEncoding: meta.ContentEncoding, metadata: meta.Metadata}
+	f.store(bucket+"/"+name, o)
+	f.reply(w, bucket, name, o)
+}
+
+// read serves an object's contents, as the client's readers fetch them.
+func (f *fakeGCS) read(w http.ResponseWriter, r *http.Request, key string, q url.Values) {
+	o := f.objects[key]
+	if o == nil || (q.Get("generation") != "" && q.Get("generation") != strconv.FormatInt(o.generation, 10)) {
+		http.NotFound(w, r)
+		return
+	}
+	w.Header().Set("Content-Length", strconv.Itoa(len(o.data)))
+	w.Header().Set("X-Goog-Generation", strconv.FormatInt(o.generation, 10))
+	if !f.truncate[key] {
+		w.Write(o.data)
+		return
+	}
+	w.Write(o.data[:len(o.data)/2])
+	w.(http.Flusher).Flush()
+	panic(http.ErrAbortHandler)
+}
+
+// matches reports whether o, the object a request would replace, meets
+// the request's generation precondition, replying 412 if not.
+func (f *fakeGCS) matches(w http.ResponseWriter, o *fakeObject, q url.Values) bool {
+	g := q.Get("ifGenerationMatch")
+	if g == "" {
+		return true
+	}
+	var have int64
+	if o != nil {
+		have = o.generation
+	}
+	if g != strconv.FormatInt(have, 10) {
+		fakeError(w, http.StatusPreconditionFailed)
+		return false
+	}
+	return true
+}
+
+func (f *fakeGCS) reply(w http.ResponseWriter, bucket, name string, o *fakeObject) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(fakeAttrs(bucket, name, o))
+}
+
+func fakeAttrs(bucket, name string, o *fakeObject) map[string]interface{} {
+	crc := make([]byte, 4)
+	binary.BigEndian.PutUint32(crc, crc32.Checksum(o.data, castagnoli))
+	return map[string]interface{}{
+		"bucket":          bucket,
+		"name":            name,
+		"generation":      strconv.FormatInt(o.generation, 10),
+		"size":            strconv.Itoa(len(o.data)),
+		"crc32c":          base64.StdEncoding.EncodeToString(crc),
+		"contentType":     o.contentType,
+		"contentEncoding": o.contentEncoding,
+		"metadata":        o.metadata,
+	}
+}
+
+func fakeError(w http.ResponseWriter, code int) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	fmt.Fprintf(w, `{"error":{"code":%d,"message":%q}}`, code, http.StatusText(code))
+}
@@ -0,0 +1,188 @@
+package manifest
+
+import (
+	"bufio"
+	"crypto/md5"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+	"path"
+	"strings"
+
+	"cloud.google.com/go/storage"
+)
+
+// GsutilHash is a file's checksums as printed by gsutil hash. Either may
+// be empty if gsutil was asked for only the other.
+type GsutilHash struct {
+	Name string
+	// CRC32C is 8 hex digits, as manifests record it; MD5 is hex.
+	CRC32C string
+	MD5    string
+}
+
+// HashFileGsutil computes the checksums gsutil hash would print for the
+// local file p.
+func HashFileGsutil(p string) (GsutilHash, error) {
+	f, err := os.Open(p)
+	if err != nil {
+		return GsutilHash{}, err
+	}
+	defer f.Close()
+	c := crc32.New(castagnoli)
+	m := md5.New()
+	if _, err := io.Copy(io.MultiWriter(c, m), f); err != nil {
+		return GsutilHash{}, err
+	}
+	return GsutilHash{Name: p, CRC32C: FormatCRC32C(c.Sum32()), MD5: hex.EncodeToString(m.Sum(nil))}, nil
+}
+
+// WriteGsutilHashes prints hashes in the format of gsutil hash, with the
+// checksums in base64 or, with hexFormat, as gsutil hash -h does.
+func WriteGsutilHashes(w io.Writer, hashes []GsutilHash, hexFormat bool) error {
+	format := "base64"
+	if hexFormat {
+		format = "hex"
+	}
+	for _, h := range hashes {
+		if _, err := fmt.Fprintf(w, "Hashes [%s] for %s:\n", format, h.Name); err != nil {
+			return err
+		}
+		for _, sum := range []struct{ name, hex string }{{"crc32c", h.CRC32C}, {"md5", h.MD5}} {
+			if sum.hex == "" {
+				continue
+			}
+			v := sum.hex
+			if !hexFormat {
+				b, err := hex.DecodeString(sum.hex)
+				if err != nil {
+					return fmt.Errorf("%s of %s: %v", sum.name, h.Name, err)
+				}
+				v = base64.StdEncoding.EncodeToString(b)
+			}
+			if _, err := fmt.Fprintf(w, "\tHash (%s):\t\t%s\n", sum.name, v); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// ParseGsutilHashes reads the output of gsutil hash, in either its base64
+// or hex form.
+func ParseGsutilHashes(r io.Reader) ([]GsutilHash, error) {
+	var (
+		hashes []GsutilHash
+		b64    bool
+	)
+	sc := bufio.NewScanner(r)
+	for n := 1; sc.Scan(); n++ {
+		line := strings.TrimRight(sc.Text(), "\r")
+		switch {
+		case strings.TrimSpace(line) == "":
+		case strings.HasPrefix(line, "Hashes [") && strings.HasSuffix(line, ":"):
+			format, name := splitHashesLine(line)
+			if format != "base64" && format != "hex" {
+				return nil, fmt.Errorf("line %d: unknown hash format %q", n, format)
+			}
+			b64 = format == "base64"
+			hashes = append(hashes, GsutilHash{Name: name})
+		case strings.HasPrefix(strings.TrimSpace(line), "Hash ("):
+			if len(hashes) == 0 {
+				return nil, fmt.Errorf("line %d: hash before any file name", n)
+			}
+			fields := strings.Fields(line)
+			if len(fields) != 3 {
+				return nil, fmt.Errorf("line %d: malformed hash line", n)
+			}
+			v, err := decodeGsutilHash(fields[2], b64)
+			if err != nil {
+				return nil, fmt.Errorf("line %d: %v", n, err)
+			}
+			h := &hashes[len(hashes)-1]
+			switch fields[1] {
+			case "(crc32c):":
+				if len(v) != 4 {
+					return nil, fmt.Errorf("line %d: crc32c is %d bytes, want 4", n, len(v))
+				}
+				h.CRC32C = FormatCRC32C(binary.BigEndian.Uint32(v))
+			case "(md5):":
+				h.MD5 = hex.EncodeToString(v)
+			default:
+				return nil, fmt.Errorf("line %d: unknown hash %s", n, strings.Trim(fields[1], "():"))
+			}
+		default:
+			return nil, fmt.Errorf("line %d: not gsutil hash output: %q", n, line)
+		}
+	}
+	return hashes, sc.Err()
+}
+
+// splitHashesLine splits "Hashes [<format>] for <name>:" into its format
+// and name. The name may contain anything, brackets and colons included.
+func splitHashesLine(line string) (format, name string) {
+	line = strings.TrimSuffix(strings.TrimPrefix(line, "Hashes ["), ":")
+	i := strings.Index(line, "] for ")
+	if i < 0 {
+		return "", ""
+	}
+	return line[:i], line[i+len("] for "):]
+}
+
+func decodeGsutilHash(s string, b64 bool) ([]byte, error) {
+	if b64 {
+		return base64.StdEncoding.DecodeString(s)
+	}
+	return hex.DecodeString(s)
+}
+
+// matchGsutilHashes pairs each of hashes with the manifest path it is for,
+// returning them keyed by path along with the names that match no path.
+// gsutil names files as they were given on its command line, so a name
+// matches the path it ends with, the longest one if several do.
+func matchGsutilHashes(m *Manifest, hashes []GsutilHash) (map[string]GsutilHash, []string) {
+	matched := map[string]GsutilHash{}
+	var unmatched []string
+	for _, h := range hashes {
+		name := path.Clean(strings.ReplaceAll(h.Name, `\`, "/"))
+		for {
+			if _, ok := m.Files[name]; ok {
+				matched[name] = h
+				break
+			}
+			i := strings.Index(name, "/")
+			if i < 0 {
+				unmatched = append(unmatched, h.Name)
+				break
+			}
+			name = name[i+1:]
+		}
+	}
+	return matched, unmatched
+}
+
+// checkGsutil compares the checksums gsutil computed for e's file with
+// those GCS reports for its object. A compressed object's checksums are of
+// the compressed bytes, not the file gsutil hashed, and those of one
+// encrypted with a customer-supplied key aren't listed, so neither can be
+// compared.
+func checkGsutil(h GsutilHash, e Entry, attrs *storage.ObjectAttrs) error {
+	if e.ContentEncoding != "" || attrs.CustomerKeySHA256 != "" {
+		return nil
+	}
+	if h.CRC32C != "" {
+		if got := FormatCRC32C(attrs.CRC32C); got != h.CRC32C {
+			return fmt.Errorf("crc32c mismatch: gsutil has %s, got %s", h.CRC32C, got)
+		}
+	}
+	if h.MD5 != "" && len(attrs.MD5) > 0 {
+		if got := hex.EncodeToString(attrs.MD5); got != h.MD5 {
+			return fmt.Errorf("md5 mismatch: gsutil has %s, got %s", h.MD5, got)
+		}
+	}
+	return nil
+}
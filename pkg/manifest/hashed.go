@@ -0,0 +1,82 @@
+package manifest
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"path"
+	"regexp"
+	"strings"
+
+	"cloud.google.com/go/storage"
+)
+
+// HashedDir is the directory, under a destination, that manifests
+// published by their digest are kept in.
+const HashedDir = "manifests"
+
+var hashedName = regexp.MustCompile(`^sha256-[0-9a-f]{64}\.json$`)
+
+// HashedName returns the name, relative to the destination, that the
+// manifest b is published under by WriteHashedManifest:
+// manifests/sha256-<hex digest>.json.
+func HashedName(b []byte) string {
+	return HashedDir + "/" + strings.Replace(digestBytes(b), ":", "-", 1) + ".json"
+}
+
+// isHashedManifest reports whether name, relative to a destination or a
+// full URI, is a manifest published by its digest, or its signature or
+// bundle.
+func isHashedManifest(name string) bool {
+	name = strings.TrimSuffix(strings.TrimSuffix(name, SignatureSuffix), BundleSuffix)
+	return hashedName.MatchString(path.Base(name)) && path.Base(path.Dir(name)) == HashedDir
+}
+
+// ManifestRoot returns the gs:// destination the files of the manifest at
+// the gs:// URI uri are stored under: the directory it is in, or for a
+// manifest published by its digest, the one above that.
+func ManifestRoot(uri string) string {
+	dir := path.Dir(strings.TrimPrefix(uri, "gs://"))
+	if isHashedManifest(uri) {
+		dir = path.Dir(dir)
+	}
+	return "gs://" + dir
+}
+
+// WriteHashedManifest publishes m under dst by its own digest, as
+// HashedName, and returns its gs:// URI. The object is only ever created,
+// never overwritten, so a manifest published this way is immutable and can
+// be shared by its digest alone; a channel can point to it to give it a
+// mutable name. Publishing the same manifest again is a no-op.
+func (u *Uploader) WriteHashedManifest(ctx context.Context, dst string, m *Manifest) (string, error) {
+	bucketName, gcsPath, err := ParseURI(dst)
+	if err != nil {
+		return "", err
+	}
+	b, err := m.MarshalJSON()
+	if err != nil {
+		return "", err
+	}
+	object := path.Join(gcsPath, HashedName(b))
+	if err := u.putManifest(ctx, u.client.Bucket(bucketName), object, b, true); err != nil {
+		return "", err
+	}
+	return "gs://" + bucketName + "/" + object, nil
+}
+
+// sameManifest checks that the manifest already at obj is b.
+func sameManifest(ctx context.Context, obj *storage.ObjectHandle, b []byte) error {
+	r, err := obj.NewReader(ctx)
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+	existing, err := ioutil.ReadAll(r)
+	if err != nil {
+		return err
+	}
+	if digestBytes(existing) != digestBytes(b) {
+		return fmt.Errorf("gs://%s/%s already exists with different contents", obj.BucketName(), obj.ObjectName())
+	}
+	return nil
+}
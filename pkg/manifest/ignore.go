@@ -0,0 +1,146 @@
+package manifest
+
+import (
+	"bufio"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+// IgnoreFile is read from the root of a source directory when
+// WithIgnoreFile is given. It uses .gitignore syntax, but only the one at
+// the root is read.
+const IgnoreFile = ".gcsignore"
+
+// ignoreRule is one .gitignore-style pattern.
+type ignoreRule struct {
+	pattern string
+	// negate re-includes paths an earlier rule excluded.
+	negate bool
+	// dirOnly rules, written with a trailing slash, only match
+	// directories.
+	dirOnly bool
+	// anchored rules contain a slash and are matched against the whole
+	// path from the root; others match a file or directory name at any
+	// depth.
+	anchored bool
+}
+
+type ignoreRules []ignoreRule
+
+func parseRule(line string) (ignoreRule, bool) {
+	line = strings.TrimRight(line, " \t\r")
+	if line == "" || strings.HasPrefix(line, "#") {
+		return ignoreRule{}, false
+	}
+	var r ignoreRule
+	if strings.HasPrefix(line, "!") {
+		r.negate = true
+		line = line[1:]
+	} else if strings.HasPrefix(line, `\`) {
+		line = line[1:]
+	}
+	if strings.HasSuffix(line, "/") {
+		r.dirOnly = true
+		line = strings.TrimRight(line, "/")
+	}
+	if strings.Contains(line, "/") {
+		r.anchored = true
+		line = strings.TrimPrefix(line, "/")
+	}
+	r.pattern = line
+	return r, line != ""
+}
+
+func parseRules(patterns []string) ignoreRules {
+	var rules ignoreRules
+	for _, p := range patterns {
+		if r, ok := parseRule(p); ok {
+			rules = append(rules, r)
+		}
+	}
+	return rules
+}
+
+// readIgnoreFile returns the rules in root's IgnoreFile, or none if root
+// isn't a directory or has no such file.
+func readIgnoreFile(root string) (ignoreRules, error) {
+	if fi, err := os.Stat(root); err != nil || !fi.IsDir() {
+		return nil, nil
+	}
+	f, err := os.Open(filepath.Join(root, IgnoreFile))
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var lines []string
+	s := bufio.NewScanner(f)
+	for s.Scan() {
+		lines = append(lines, s.Text())
+	}
+	return parseRules(lines), s.Err()
+}
+
+// ignored reports whether the slash-separated path rel is excluded. As in
+// Git, the last matching rule decides.
+func (rs ignoreRules) ignored(rel string, isDir bool) bool {
+	ignored := false
+	for _, r := range rs {
+		if r.dirOnly && !isDir {
+			continue
+		}
+		if r.matches(rel) {
+			ignored = !r.negate
+		}
+	}
+	return ignored
+}
+
+func (r ignoreRule) matches(rel string) bool {
+	if r.anchored {
+		return matchGlob(r.pattern, rel)
+	}
+	return matchGlob(r.pattern, path.Base(rel))
+}
+
+// matchAny reports whether rel matches any of rules, ignoring negation.
+func (rs ignoreRules) matchAny(rel string) bool {
+	for _, r := range rs {
+		if r.matches(rel) {
+			return true
+		}
+	}
+	return false
+}
+
+// matchGlob is path.Match with "**" matching any number of whole path
+// segments.
+func matchGlob(pattern, name string) bool {
+	return matchSegments(strings.Split(pattern, "/"), strings.Split(name, "/"))
+}
+
+func matchSegments(pattern, name []string) bool {
+	for len(pattern) > 0 {
+		if pattern[0] == "**" {
+			for i := 0; i <= len(name); i++ {
+				if matchSegments(pattern[1:], name[i:]) {
+					return true
+				}
+			}
+			return false
+		}
+		if len(name) == 0 {
+			return false
+		}
+		if ok, err := path.Match(pattern[0], name[0]); err != nil || !ok {
+			return false
+		}
+		pattern, name = pattern[1:], name[1:]
+	}
+	return len(name) == 0
+}
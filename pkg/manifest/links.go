@@ -0,0 +1,124 @@
+package manifest
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// defaultPerm is the mode files are restored with when their entry doesn't
+// record one.
+const defaultPerm = 0644
+
+// formatMode renders the permission bits of m the way manifests record
+// them.
+func formatMode(m os.FileMode) string {
+	return fmt.Sprintf("%04o", m.Perm())
+}
+
+// perm returns the permission bits to restore e's file with.
+func (e Entry) perm() (os.FileMode, error) {
+	if e.Mode == "" {
+		return defaultPerm, nil
+	}
+	n, err := strconv.ParseUint(e.Mode, 8, 32)
+	if err != nil || n > 0777 {
+		return 0, fmt.Errorf("bad mode %q", e.Mode)
+	}
+	return os.FileMode(n), nil
+}
+
+// modeOf returns the mode to record for a file with info fi: its
+// permission bits if WithPreserveMode was given, otherwise none.
+func (o *options) modeOf(fi os.FileInfo) string {
+	if !o.preserveMode {
+		return ""
+	}
+	return formatMode(fi.Mode())
+}
+
+// linkInTree reports whether target, the target of a symlink at the
+// manifest path p, resolves to somewhere within the tree p is in. Only
+// such links are recorded and restored, since a download writing through
+// any other could end up outside its destination.
+func linkInTree(p, target string) bool {
+	if target == "" || path.IsAbs(target) || filepath.IsAbs(target) {
+		return false
+	}
+	t := path.Join(path.Dir(p), filepath.ToSlash(target))
+	return t != ".." && !strings.HasPrefix(t, "../")
+}
+
+// cleanLink returns target cleaned, in the form manifests record. Once
+// clean, a target only climbs out of its directory before descending, and
+// so can be checked without knowing which of the paths it names through
+// are themselves links.
+func cleanLink(target string) string {
+	return path.Clean(filepath.ToSlash(target))
+}
+
+// checkLinks returns an error if any entry of m has a symlink as one of
+// its parent directories, which a download would otherwise have to write
+// through.
+func checkLinks(m *Manifest) error {
+	for p := range m.Files {
+		for d := path.Dir(p); d != "." && d != "/"; d = path.Dir(d) {
+			if m.Files[d].Link != "" {
+				return fmt.Errorf("manifest entry %s is under the symlink %s", p, d)
+			}
+		}
+	}
+	return nil
+}
+
+// linkDigest returns the digest recorded for a symlink to target.
+func linkDigest(target string) string {
+	h := sha256.New()
+	h.Write([]byte(target))
+	return formatDigest(h)
+}
+
+// linkFile returns the File recorded for the symlink source s. Nothing is
+// uploaded for it.
+func linkFile(s Source) (File, error) {
+	fi, err := os.Lstat(s.Path)
+	if err != nil {
+		return File{}, err
+	}
+	return File{
+		Path:    s.RelPath,
+		Source:  s.Path,
+		Digest:  linkDigest(s.Link),
+		Size:    int64(len(s.Link)),
+		ModTime: fi.ModTime().UTC(),
+		Link:    s.Link,
+	}, nil
+}
+
+// restoreLink creates a symlink to target at dest, replacing whatever file
+// or link is there, after checking that target stays within the tree of
+// the manifest path p.
+func restoreLink(p, target, dest string) error {
+	if !linkInTree(p, target) {
+		return fmt.Errorf("symlink target %q is outside the destination", target)
+	}
+	if err := os.MkdirAll(filepath.Dir(dest), 0755); err != nil {
+		return err
+	}
+	// Create the link beside dest and rename it into place, as files are.
+	tmp, err := ioutil.TempDir(filepath.Dir(dest), ".download-")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(tmp)
+	link := filepath.Join(tmp, "link")
+	if err := os.Symlink(filepath.FromSlash(cleanLink(target)), link); err != nil {
+		return err
+	}
+	return os.Rename(link, dest)
+}
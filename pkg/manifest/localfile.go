@@ -0,0 +1,78 @@
+package manifest
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"time"
+)
+
+const (
+	// localRetries is how many times a local read that fails with a
+	// transient error is retried, and localBackoff how long to wait before
+	// the first retry, doubling each time.
+	localRetries = 5
+	localBackoff = 100 * time.Millisecond
+)
+
+// localFile is a local source opened for reading, whose reads are retried
+// when they fail with a transient error. The file isn't embedded, so that
+// io.Copy can't go around Read through the file's own WriteTo.
+type localFile struct {
+	f   *os.File
+	log io.Writer
+}
+
+// openLocal opens the local file p, retrying transient errors.
+func (o *options) openLocal(p string) (*localFile, error) {
+	f := &localFile{log: o.log}
+	err := f.retry(p, func() error {
+		var err error
+		f.f, err = os.Open(p)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+func (f *localFile) Name() string                              { return f.f.Name() }
+func (f *localFile) Stat() (os.FileInfo, error)                { return f.f.Stat() }
+func (f *localFile) Seek(off int64, whence int) (int64, error) { return f.f.Seek(off, whence) }
+func (f *localFile) Close() error                              { return f.f.Close() }
+
+func (f *localFile) Read(p []byte) (int, error) {
+	var n int
+	// A read(2) that fails reads nothing, so it can just be repeated.
+	err := f.retry(f.Name(), func() error {
+		var err error
+		n, err = f.f.Read(p)
+		return err
+	})
+	return n, err
+}
+
+func (f *localFile) ReadAt(p []byte, off int64) (int, error) {
+	var n int
+	err := f.retry(f.Name(), func() error {
+		m, err := f.f.ReadAt(p[n:], off+int64(n))
+		n += m
+		return err
+	})
+	return n, err
+}
+
+// retry calls read until it succeeds or fails with anything but a
+// transient error, up to localRetries more times.
+func (f *localFile) retry(p string, read func() error) error {
+	backoff := localBackoff
+	err := read()
+	for attempt := 1; err != nil && attempt <= localRetries && IsTransientFSError(err); attempt++ {
+		fmt.Fprintf(f.log, "Retrying reading %s in %v: %v\n", p, backoff, err)
+		time.Sleep(backoff)
+		backoff *= 2
+		err = read()
+	}
+	return err
+}
@@ -0,0 +1,23 @@
+//go:build !darwin && !dragonfly && !freebsd && !linux && !netbsd && !openbsd
+// +build !darwin,!dragonfly,!freebsd,!linux,!netbsd,!openbsd
+
+package manifest
+
+import (
+	"errors"
+	"os"
+)
+
+// IsTransientFSError reports whether err is a local filesystem error that
+// may well go away if the operation is tried again. Errnos aren't told
+// apart here, so no error is taken for transient.
+func IsTransientFSError(err error) bool {
+	return false
+}
+
+// IsPermanentFSError reports whether err is a local filesystem error that
+// retrying won't fix, here only a file that doesn't exist or can't be
+// read.
+func IsPermanentFSError(err error) bool {
+	return errors.Is(err, os.ErrNotExist) || errors.Is(err, os.ErrPermission)
+}
@@ -0,0 +1,39 @@
+//go:build darwin || dragonfly || freebsd || linux || netbsd || openbsd
+// +build darwin dragonfly freebsd linux netbsd openbsd
+
+package manifest
+
+import (
+	"errors"
+	"syscall"
+)
+
+// IsTransientFSError reports whether err is a local filesystem error that
+// may well go away if the operation is tried again, as NFS and FUSE
+// mounts return when a server is slow or briefly unreachable. Reads of
+// local sources are retried on such errors before a file is failed.
+func IsTransientFSError(err error) bool {
+	var errno syscall.Errno
+	if !errors.As(err, &errno) {
+		return false
+	}
+	switch errno {
+	case syscall.EINTR, syscall.EAGAIN, syscall.EIO, syscall.ETIMEDOUT, syscall.ENOTCONN, syscall.ESTALE:
+		return true
+	}
+	return false
+}
+
+// IsPermanentFSError reports whether err is a local filesystem error that
+// retrying won't fix, such as a file that doesn't exist or can't be read.
+func IsPermanentFSError(err error) bool {
+	var errno syscall.Errno
+	if !errors.As(err, &errno) {
+		return false
+	}
+	switch errno {
+	case syscall.ENOENT, syscall.EACCES, syscall.EPERM, syscall.EISDIR, syscall.ENOTDIR, syscall.ELOOP, syscall.ENAMETOOLONG:
+		return true
+	}
+	return false
+}
@@ -0,0 +1,157 @@
+package manifest
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+// LockEntry pins a manifest path to one generation of one object.
+type LockEntry struct {
+	Path       string
+	Digest     string
+	Bucket     string
+	Object     string
+	Generation int64
+}
+
+// LockEntries returns the lockfile entries for files uploaded under the
+// gs:// path dst, sorted by path.
+func LockEntries(dst string, files []File) ([]LockEntry, error) {
+	bucketName, gcsPath, err := ParseURI(dst)
+	if err != nil {
+		return nil, err
+	}
+	entries := make([]LockEntry, 0, len(files))
+	for _, f := range files {
+		// A symlink has no object to pin.
+		if f.Link != "" {
+			continue
+		}
+		entries = append(entries, LockEntry{
+			Path:       f.Path,
+			Digest:     f.Digest,
+			Bucket:     bucketName,
+			Object:     path.Join(gcsPath, f.Entry().ObjectName()),
+			Generation: f.Generation,
+		})
+	}
+	sort.Slice(entries, func(i, j int) bool { return entries[i].Path < entries[j].Path })
+	return entries, nil
+}
+
+// FormatLockfile renders one line per entry in the form
+// "<path> <digest> gs://<bucket>/<object>#<generation>", like go.sum for
+// GCS-hosted artifacts. A path or URI with spaces, quotes or unprintable
+// characters in it is written as a Go-quoted string.
+func FormatLockfile(entries []LockEntry) []byte {
+	var b strings.Builder
+	for _, e := range entries {
+		uri := fmt.Sprintf("gs://%s/%s#%d", e.Bucket, e.Object, e.Generation)
+		fmt.Fprintf(&b, "%s %s %s\n", lockField(e.Path), e.Digest, lockField(uri))
+	}
+	return []byte(b.String())
+}
+
+// lockField returns s as a lockfile field, quoted if it wouldn't otherwise
+// read back as a single one.
+func lockField(s string) string {
+	for _, r := range s {
+		if r == '"' || r == '\\' || unicode.IsSpace(r) || !unicode.IsPrint(r) {
+			return strconv.Quote(s)
+		}
+	}
+	if s == "" {
+		return `""`
+	}
+	return s
+}
+
+// ParseLockfile reads a lockfile written by FormatLockfile.
+func ParseLockfile(r io.Reader) ([]LockEntry, error) {
+	var entries []LockEntry
+	s := bufio.NewScanner(r)
+	for line := 1; s.Scan(); line++ {
+		if strings.TrimSpace(s.Text()) == "" {
+			continue
+		}
+		e, err := parseLockLine(s.Text())
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %v", line, err)
+		}
+		entries = append(entries, e)
+	}
+	return entries, s.Err()
+}
+
+func parseLockLine(line string) (LockEntry, error) {
+	fields, err := lockFields(line)
+	if err != nil {
+		return LockEntry{}, err
+	}
+	if len(fields) != 3 {
+		return LockEntry{}, fmt.Errorf("expected 3 fields, got %d", len(fields))
+	}
+	uri := strings.TrimPrefix(fields[2], "gs://")
+	hash := strings.LastIndex(uri, "#")
+	if hash < 0 {
+		return LockEntry{}, fmt.Errorf("missing generation: %s", fields[2])
+	}
+	gen, err := strconv.ParseInt(uri[hash+1:], 10, 64)
+	if err != nil {
+		return LockEntry{}, fmt.Errorf("invalid generation: %s", fields[2])
+	}
+	bucketName, object, err := ParseURI(uri[:hash])
+	if err != nil {
+		return LockEntry{}, err
+	}
+	return LockEntry{
+		Path:       fields[0],
+		Digest:     fields[1],
+		Bucket:     bucketName,
+		Object:     object,
+		Generation: gen,
+	}, nil
+}
+
+// lockFields splits a lockfile line into its space-separated fields,
+// unquoting those FormatLockfile quoted.
+func lockFields(line string) ([]string, error) {
+	var fields []string
+	for {
+		line = strings.TrimLeftFunc(line, unicode.IsSpace)
+		if line == "" {
+			return fields, nil
+		}
+		if line[0] != '"' {
+			end := strings.IndexFunc(line, unicode.IsSpace)
+			if end < 0 {
+				end = len(line)
+			}
+			fields = append(fields, line[:end])
+			line = line[end:]
+			continue
+		}
+		end := 1
+		for end < len(line) && line[end] != '"' {
+			if line[end] == '\\' {
+				end++
+			}
+			end++
+		}
+		if end >= len(line) {
+			return nil, fmt.Errorf("unterminated quoted field: %s", line)
+		}
+		field, err := strconv.Unquote(line[:end+1])
+		if err != nil {
+			return nil, fmt.Errorf("invalid quoted field %s: %v", line[:end+1], err)
+		}
+		fields = append(fields, field)
+		line = line[end+1:]
+	}
+}
@@ -0,0 +1,47 @@
+package manifest
+
+import (
+	"bytes"
+	"reflect"
+	"testing"
+)
+
+func TestLockfileRoundTrip(t *testing.T) {
+	for _, tc := range []struct {
+		name  string
+		entry LockEntry
+	}{{
+		name:  "plain",
+		entry: LockEntry{Path: "bin/tool", Digest: "sha256:aa", Bucket: "b", Object: "release/bin/tool", Generation: 1},
+	}, {
+		name:  "spaces",
+		entry: LockEntry{Path: "docs/read me.txt", Digest: "sha256:bb", Bucket: "b", Object: "release/docs/read me.txt", Generation: 2},
+	}, {
+		name:  "quotes and tabs",
+		entry: LockEntry{Path: "a \"b\"\tc\\d", Digest: "sha256:cc", Bucket: "b", Object: "x/a \"b\"\tc\\d", Generation: 3},
+	}} {
+		t.Run(tc.name, func(t *testing.T) {
+			entries, err := ParseLockfile(bytes.NewReader(FormatLockfile([]LockEntry{tc.entry})))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if want := []LockEntry{tc.entry}; !reflect.DeepEqual(entries, want) {
+				t.Errorf("got %+v, want %+v", entries, want)
+			}
+		})
+	}
+}
+
+func TestParseLockfileUnquoted(t *testing.T) {
+	entries, err := ParseLockfile(bytes.NewBufferString("bin/tool sha256:aa gs://b/release/bin/tool#7\n\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []LockEntry{{Path: "bin/tool", Digest: "sha256:aa", Bucket: "b", Object: "release/bin/tool", Generation: 7}}
+	if !reflect.DeepEqual(entries, want) {
+		t.Errorf("got %+v, want %+v", entries, want)
+	}
+	if _, err := ParseLockfile(bytes.NewBufferString("\"bin/tool sha256:aa gs://b/o#7\n")); err == nil {
+		t.Error("expected an error for an unterminated quote")
+	}
+}
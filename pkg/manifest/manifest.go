@@ -0,0 +1,412 @@
+// Package manifest uploads files to Google Cloud Storage together with a
+// manifest recording each file's sha256 digest, and restores and checks
+// them against it.
+//
+// The simplest use mirrors the upload command:
+//
+//	m, err := manifest.Upload(ctx, "./dist", "gs://bucket/releases/v1")
+package manifest
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"cloud.google.com/go/storage"
+)
+
+// Name is the object name a manifest is published under, relative to the
+// destination path.
+const Name = "manifest.json"
+
+// isManifestFile reports whether name, relative to a destination, is where
+// the manifest, its signature or its signature bundle is published, by
+// Name or by its digest.
+func isManifestFile(name string) bool {
+	return name == Name || name == Name+SignatureSuffix || name == Name+BundleSuffix || path.Dir(name) == HashedDir && isHashedManifest(name)
+}
+
+// SchemaVersion is the latest version of the manifest format this package
+// writes. Version 1 was a flat JSON object mapping each path to its digest;
+// it is still accepted by Parse. Version 3 added Entry.Object, version 4
+// Entry.Link, version 5 Manifest.Missing, version 6 Entry.Parts and
+// version 7 Entry.Expires;
+// manifests are written with the oldest version that can hold them, so
+// that older readers can read them, and a partial manifest isn't mistaken
+// by one for a complete set.
+const SchemaVersion = 7
+
+// Entry describes one file in a manifest.
+type Entry struct {
+	Path        string `json:"path"`
+	Digest      string `json:"digest"`
+	Size        int64  `json:"size,omitempty"`
+	ContentType string `json:"contentType,omitempty"`
+	// CRC32C is the checksum GCS reported for the stored object, as 8 hex
+	// digits, so the object can be checked without reading it back.
+	CRC32C  string    `json:"crc32c,omitempty"`
+	ModTime time.Time `json:"modTime"`
+	// Encryption is how GCS reported the stored object to be encrypted,
+	// when it wasn't just Google-managed encryption.
+	Encryption *Encryption `json:"encryption,omitempty"`
+	// ContentEncoding is set when the object is stored compressed. Digest
+	// and Size are still the original file's; StoredSize and StoredDigest
+	// are the stored object's.
+	ContentEncoding string `json:"contentEncoding,omitempty"`
+	StoredSize      int64  `json:"storedSize,omitempty"`
+	StoredDigest    string `json:"storedDigest,omitempty"`
+	// Object is the name the file is stored under, relative to the
+	// destination, when that isn't Path: under the content-addressed
+	// layout, blobs/sha256/<hex digest>, or the file's path under the
+	// prefix a route sent it to.
+	Object string `json:"object,omitempty"`
+	// Mode is the file's permission bits in octal, such as "0755", when
+	// they were preserved; files are otherwise restored as 0644.
+	Mode string `json:"mode,omitempty"`
+	// Link is set when the file is a symlink, to its cleaned, relative
+	// target. Nothing is stored for it; Digest and Size are those of the
+	// target string.
+	Link string `json:"link,omitempty"`
+	// Parts are set when the file was uploaded as a composite object, one
+	// for each of the parts it was composed from.
+	Parts []Part `json:"parts,omitempty"`
+	// Expires is set when the file was uploaded under an expiry rule, to
+	// when it may be pruned; see WithExpiry.
+	Expires *time.Time `json:"expires,omitempty"`
+}
+
+// Expired reports whether e had expired by now.
+func (e Entry) Expired(now time.Time) bool {
+	return e.Expires != nil && !now.Before(*e.Expires)
+}
+
+// ObjectName returns the name e's file is stored under, relative to the
+// destination.
+func (e Entry) ObjectName() string {
+	if e.Object != "" {
+		return e.Object
+	}
+	return e.Path
+}
+
+// Encryption records the key a stored object is encrypted with.
+type Encryption struct {
+	// KMSKey is the Cloud KMS key (CMEK), without the key version, so
+	// that rotating the key doesn't invalidate the manifest.
+	KMSKey string `json:"kmsKey,omitempty"`
+	// CustomerKeySHA256 is the base64 sha256 of the customer-supplied key
+	// (CSEK).
+	CustomerKeySHA256 string `json:"customerKeySha256,omitempty"`
+}
+
+// encryptionOf returns the Encryption recorded for an object with attrs,
+// or nil if it uses Google-managed encryption.
+func encryptionOf(attrs *storage.ObjectAttrs) *Encryption {
+	if attrs.KMSKeyName == "" && attrs.CustomerKeySHA256 == "" {
+		return nil
+	}
+	key := attrs.KMSKeyName
+	if i := strings.Index(key, "/cryptoKeyVersions/"); i >= 0 {
+		key = key[:i]
+	}
+	return &Encryption{KMSKey: key, CustomerKeySHA256: attrs.CustomerKeySHA256}
+}
+
+// checkEncryption returns an error unless attrs show the object is
+// encrypted as want says. A nil want only requires that the object isn't
+// encrypted with a key of its own either.
+func checkEncryption(want *Encryption, attrs *storage.ObjectAttrs) error {
+	got := encryptionOf(attrs)
+	if want == nil {
+		want = &Encryption{}
+	}
+	if got == nil {
+		got = &Encryption{}
+	}
+	if got.KMSKey != want.KMSKey {
+		return fmt.Errorf("kms key mismatch: manifest has %q, got %q", want.KMSKey, got.KMSKey)
+	}
+	if got.CustomerKeySHA256 != want.CustomerKeySHA256 {
+		return fmt.Errorf("customer-supplied key mismatch: manifest has %q, got %q", want.CustomerKeySHA256, got.CustomerKeySHA256)
+	}
+	return nil
+}
+
+// Manifest records every file of an upload, keyed by its path relative to
+// the upload root. Digests are in the form "sha256:<hex>". Manifests read
+// from version 1 documents only have paths and digests.
+type Manifest struct {
+	Files map[string]Entry
+	// Missing are the paths that an upload with WithContinueOnError
+	// failed to upload, making the manifest partial; Files holds the rest.
+	Missing []string
+}
+
+// Partial reports whether m is missing files that failed to upload.
+func (m *Manifest) Partial() bool {
+	return len(m.Missing) > 0
+}
+
+// New returns an empty manifest.
+func New() *Manifest {
+	return &Manifest{Files: map[string]Entry{}}
+}
+
+// Add records e, replacing any entry with the same path.
+func (m *Manifest) Add(e Entry) {
+	m.Files[e.Path] = e
+}
+
+// Parse decodes a manifest from its JSON form, in either schema version.
+func Parse(b []byte) (*Manifest, error) {
+	m := New()
+	if err := json.Unmarshal(b, m); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+// Read loads a manifest from a gs:// URI or a local path. client may be nil
+// when reading a local file.
+func Read(ctx context.Context, client *storage.Client, uri string) (*Manifest, error) {
+	b, err := ReadBytes(ctx, client, uri)
+	if err != nil {
+		return nil, err
+	}
+	m, err := Parse(b)
+	if err != nil {
+		return nil, fmt.Errorf("parsing %s: %v", uri, err)
+	}
+	return m, nil
+}
+
+// ReadBytes returns the contents of a gs://, s3:// or file:// URI or a
+// local path, such as a manifest's exact bytes for checking its signature.
+// client may be nil unless uri is gs://.
+func ReadBytes(ctx context.Context, client *storage.Client, uri string) ([]byte, error) {
+	if IsStorageURI(uri) {
+		st, name, err := openParent(ctx, uri, client)
+		if err != nil {
+			return nil, err
+		}
+		r, err := st.Get(ctx, name)
+		if err != nil {
+			return nil, err
+		}
+		defer r.Close()
+		return ioutil.ReadAll(r)
+	}
+	if !strings.HasPrefix(uri, "gs://") {
+		return ioutil.ReadFile(uri)
+	}
+	if client == nil {
+		return nil, fmt.Errorf("reading %s: no GCS client", uri)
+	}
+	bucketName, name, err := ParseURI(uri)
+	if err != nil {
+		return nil, err
+	}
+	r, err := client.Bucket(bucketName).Object(name).NewReader(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+	return ioutil.ReadAll(r)
+}
+
+type document struct {
+	SchemaVersion int      `json:"schemaVersion"`
+	Files         []Entry  `json:"files"`
+	Missing       []string `json:"missing,omitempty"`
+}
+
+// MarshalJSON encodes the manifest in the current schema, with files sorted
+// by path.
+func (m *Manifest) MarshalJSON() ([]byte, error) {
+	return json.Marshal(m.document())
+}
+
+// Digest returns the sha256 of m as MarshalJSON encodes it, in the form
+// "sha256:<hex>". That is the digest of m as WriteManifest publishes it, and
+// so the one a Channel pointing to it records and the one HashedName names
+// it by, and two manifests have the same digest only if they record the
+// same files in the same way. It is computed from m alone.
+func (m *Manifest) Digest() (string, error) {
+	b, err := m.MarshalJSON()
+	if err != nil {
+		return "", err
+	}
+	return digestBytes(b), nil
+}
+
+// document returns m in the form it is encoded in, with the oldest schema
+// version that can hold it.
+func (m *Manifest) document() document {
+	doc := document{SchemaVersion: 2, Files: []Entry{}}
+	for _, p := range m.Paths() {
+		e := m.Files[p]
+		switch {
+		case e.Expires != nil:
+			doc.SchemaVersion = 7
+		case len(e.Parts) > 0 && doc.SchemaVersion < 6:
+			doc.SchemaVersion = 6
+		case e.Link != "" && doc.SchemaVersion < 4:
+			doc.SchemaVersion = 4
+		case e.Object != "" && doc.SchemaVersion < 3:
+			doc.SchemaVersion = 3
+		}
+		doc.Files = append(doc.Files, e)
+	}
+	if len(m.Missing) > 0 {
+		if doc.SchemaVersion < 5 {
+			doc.SchemaVersion = 5
+		}
+		doc.Missing = append([]string(nil), m.Missing...)
+		sort.Strings(doc.Missing)
+	}
+	return doc
+}
+
+// UnmarshalJSON decodes either the current schema or a version 1 flat path
+// to digest object.
+func (m *Manifest) UnmarshalJSON(b []byte) error {
+	raw := map[string]json.RawMessage{}
+	if err := json.Unmarshal(b, &raw); err != nil {
+		return err
+	}
+	// A version 1 manifest may well have a file called schemaVersion, but
+	// its value is a digest string rather than a number.
+	if v, ok := raw["schemaVersion"]; !ok || strings.HasPrefix(string(v), `"`) {
+		files := map[string]string{}
+		if err := json.Unmarshal(b, &files); err != nil {
+			return err
+		}
+		m.Files = map[string]Entry{}
+		for p, d := range files {
+			m.Files[p] = Entry{Path: p, Digest: d}
+		}
+		return nil
+	}
+
+	var doc document
+	if err := json.Unmarshal(b, &doc); err != nil {
+		return err
+	}
+	return m.setDocument(doc)
+}
+
+// setDocument sets m from doc, after checking that it is a manifest this
+// package can use.
+func (m *Manifest) setDocument(doc document) error {
+	if doc.SchemaVersion > SchemaVersion {
+		return fmt.Errorf("unsupported manifest schema version %d", doc.SchemaVersion)
+	}
+	m.Files = map[string]Entry{}
+	for _, e := range doc.Files {
+		if _, ok := m.Files[e.Path]; ok {
+			return fmt.Errorf("duplicate manifest entry for %s", e.Path)
+		}
+		// Nothing stops a manifest naming any object at all, but it has
+		// to be one under its own destination.
+		if o := e.Object; o != "" && (path.IsAbs(o) || path.Clean(o) != o || o == ".." || strings.HasPrefix(o, "../")) {
+			return fmt.Errorf("manifest entry for %s has bad object name %q", e.Path, o)
+		}
+		if e.Link != "" && e.Object != "" {
+			return fmt.Errorf("manifest entry for %s is a symlink but names an object", e.Path)
+		}
+		if len(e.Parts) > 0 {
+			var size int64
+			for _, p := range e.Parts {
+				size += p.Size
+			}
+			if size != e.Size || e.Link != "" || e.ContentEncoding != "" {
+				return fmt.Errorf("manifest entry for %s has parts that don't make up its object", e.Path)
+			}
+		}
+		if _, err := e.perm(); err != nil {
+			return fmt.Errorf("manifest entry for %s: %v", e.Path, err)
+		}
+		m.Files[e.Path] = e
+	}
+	for _, p := range doc.Missing {
+		if _, ok := m.Files[p]; ok {
+			return fmt.Errorf("manifest lists %s as both present and missing", p)
+		}
+	}
+	m.Missing = doc.Missing
+	return checkLinks(m)
+}
+
+// objects returns the names, relative to the destination, of the objects
+// m's files are stored in. Under the content-addressed layout several
+// files may share one; symlinks have none.
+func (m *Manifest) objects() map[string]bool {
+	objects := map[string]bool{}
+	for _, e := range m.Files {
+		if e.Link == "" {
+			objects[e.ObjectName()] = true
+		}
+	}
+	return objects
+}
+
+// ObjectNames returns the names, relative to the destination, of the
+// objects m's files are stored in, sorted and without duplicates.
+func (m *Manifest) ObjectNames() []string {
+	var names []string
+	for name := range m.objects() {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Paths returns the manifest's paths in sorted order.
+func (m *Manifest) Paths() []string {
+	paths := make([]string, 0, len(m.Files))
+	for p := range m.Files {
+		paths = append(paths, p)
+	}
+	sort.Strings(paths)
+	return paths
+}
+
+// Filter returns a manifest holding only the entries, and missing paths,
+// whose paths match one of the include globs, or every one if include is
+// empty.
+func (m *Manifest) Filter(include []string) (*Manifest, error) {
+	keep := func(p string) (bool, error) {
+		for _, pattern := range include {
+			if ok, err := filepath.Match(pattern, p); err != nil || ok {
+				return ok, err
+			}
+		}
+		return len(include) == 0, nil
+	}
+	out := New()
+	for p, e := range m.Files {
+		ok, err := keep(p)
+		if err != nil {
+			return nil, err
+		}
+		if ok {
+			out.Files[p] = e
+		}
+	}
+	for _, p := range m.Missing {
+		ok, err := keep(p)
+		if err != nil {
+			return nil, err
+		}
+		if ok {
+			out.Missing = append(out.Missing, p)
+		}
+	}
+	return out, nil
+}
@@ -0,0 +1,119 @@
+package manifest
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestMissingRoundTrip(t *testing.T) {
+	expires := time.Date(2030, 1, 2, 3, 4, 5, 0, time.UTC)
+	for _, tc := range []struct {
+		name    string
+		entry   Entry
+		version int
+	}{{
+		name:    "plain",
+		entry:   Entry{Path: "a", Digest: "sha256:aa", Size: 3},
+		version: 5,
+	}, {
+		name:    "parts",
+		entry:   Entry{Path: "a", Digest: "sha256:aa", Size: 3, Parts: []Part{{Size: 1, CRC32C: "00000001", Digest: "sha256:01"}, {Size: 2, CRC32C: "00000002", Digest: "sha256:02"}}},
+		version: 6,
+	}, {
+		name:    "expires",
+		entry:   Entry{Path: "a", Digest: "sha256:aa", Size: 3, Expires: &expires},
+		version: 7,
+	}} {
+		t.Run(tc.name, func(t *testing.T) {
+			m := New()
+			m.Add(tc.entry)
+			m.Missing = []string{"c", "b"}
+			b, err := m.MarshalJSON()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if v := m.document().SchemaVersion; v != tc.version {
+				t.Errorf("schema version = %d, want %d", v, tc.version)
+			}
+			got, err := Parse(b)
+			if err != nil {
+				t.Fatalf("Parse(%s): %v", b, err)
+			}
+			if !got.Partial() {
+				t.Fatalf("Parse(%s) isn't partial", b)
+			}
+			if want := []string{"b", "c"}; !reflect.DeepEqual(got.Missing, want) {
+				t.Errorf("Missing = %v, want %v", got.Missing, want)
+			}
+			if len(got.Files) != 1 {
+				t.Errorf("Files = %v, want just a", got.Files)
+			}
+		})
+	}
+}
+
+func TestDigest(t *testing.T) {
+	now := time.Date(2030, 1, 2, 3, 4, 5, 0, time.UTC)
+	later := now.Add(time.Hour)
+	a := Entry{Path: "a", Digest: "sha256:aa", Size: 1, ModTime: now}
+	b := Entry{Path: "b", Digest: "sha256:bb", Size: 2, ModTime: now}
+	build := func(missing []string, entries ...Entry) *Manifest {
+		m := New()
+		for _, e := range entries {
+			m.Add(e)
+		}
+		m.Missing = missing
+		return m
+	}
+	withParts, withExpires := a, a
+	withParts.Parts = []Part{{Size: 1, CRC32C: "00000001", Digest: "sha256:01"}}
+	withExpires.Expires = &later
+	laterA := a
+	laterA.ModTime = later
+
+	base := build(nil, a, b)
+	for _, tc := range []struct {
+		name string
+		m    *Manifest
+		same bool
+	}{
+		{name: "same files added in another order", m: build(nil, b, a), same: true},
+		{name: "another modification time", m: build(nil, laterA, b)},
+		{name: "a file fewer", m: build(nil, a)},
+		{name: "partial", m: build([]string{"c"}, a, b)},
+		{name: "parts", m: build(nil, withParts, b)},
+		{name: "expires", m: build(nil, withExpires, b)},
+		{name: "partial with parts", m: build([]string{"c"}, withParts, b)},
+		{name: "partial with expires", m: build([]string{"c"}, withExpires, b)},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			want, err := base.Digest()
+			if err != nil {
+				t.Fatal(err)
+			}
+			got, err := tc.m.Digest()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if (got == want) != tc.same {
+				t.Errorf("Digest() = %s, base has %s; want same = %v", got, want, tc.same)
+			}
+			// Parsing what was marshalled must give back the same digest.
+			j, err := tc.m.MarshalJSON()
+			if err != nil {
+				t.Fatal(err)
+			}
+			parsed, err := Parse(j)
+			if err != nil {
+				t.Fatalf("Parse(%s): %v", j, err)
+			}
+			if again, err := parsed.Digest(); err != nil || again != got {
+				t.Errorf("Digest() after a round trip = %s, %v; want %s", again, err, got)
+			}
+			if digestBytes(j) != got {
+				t.Errorf("Digest() = %s, but the encoded manifest hashes to %s", got, digestBytes(j))
+			}
+		})
+	}
+}
@@ -0,0 +1,6 @@
+// Package manifestpb holds the Go types generated from manifest.proto, the
+// protobuf form of a manifest. The manifest package converts to and from
+// them; see Manifest.Proto and FromProto.
+package manifestpb
+
+//go:generate protoc --go_out=. --go_opt=paths=source_relative manifest.proto
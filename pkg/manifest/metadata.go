@@ -0,0 +1,87 @@
+package manifest
+
+import (
+	"bufio"
+	"mime"
+	"net/http"
+	"os"
+	"path"
+
+	"cloud.google.com/go/storage"
+)
+
+// detectContentType picks the Content-Type to store name with: the one
+// registered for its extension, or else the one sniffed from the first
+// bytes of br, which are left unread.
+func detectContentType(name string, br *bufio.Reader) string {
+	if t := mime.TypeByExtension(path.Ext(name)); t != "" {
+		return t
+	}
+	head, _ := br.Peek(512)
+	return http.DetectContentType(head)
+}
+
+// detectFileContentType is detectContentType for a local file.
+func detectFileContentType(p string) (string, error) {
+	f, err := os.Open(p)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	return detectContentType(p, bufio.NewReader(f)), nil
+}
+
+// MetadataRule sets the Content-Language, or the charset parameter of the
+// Content-Type, of the files whose paths match Pattern, in the glob syntax
+// of WithInclude, such as the pages of a localized site that browsers
+// should read in the right language and encoding straight from GCS. Empty
+// fields are left as they would be.
+type MetadataRule struct {
+	Pattern  string
+	Language string
+	Charset  string
+}
+
+// contentHeaders returns the Content-Type and Content-Language to store
+// the file at p with, given the Content-Type detected for it. For each,
+// the first MetadataRule matching p that sets it applies.
+func (o *options) contentHeaders(p, contentType string) (string, string) {
+	var language, charset string
+	for _, r := range o.metadataRules {
+		if (language != "" || r.Language == "") && (charset != "" || r.Charset == "") {
+			continue
+		}
+		if !parseRules([]string{r.Pattern}).matchAny(p) {
+			continue
+		}
+		if language == "" {
+			language = r.Language
+		}
+		if charset == "" {
+			charset = r.Charset
+		}
+	}
+	if charset != "" {
+		if t, params, err := mime.ParseMediaType(contentType); err == nil {
+			params["charset"] = charset
+			contentType = mime.FormatMediaType(t, params)
+		}
+	}
+	return contentType, language
+}
+
+// setMetadata applies the metadata options to an object being written for
+// the file at p.
+func (o *options) setMetadata(w *storage.Writer, p string) {
+	w.ContentType, w.ContentLanguage = o.contentHeaders(p, w.ContentType)
+	if o.cacheControl != "" {
+		w.CacheControl = o.cacheControl
+	}
+	w.StorageClass = o.storageClass
+	if len(o.metadata) > 0 {
+		w.Metadata = map[string]string{}
+		for k, v := range o.metadata {
+			w.Metadata[k] = v
+		}
+	}
+}
@@ -0,0 +1,208 @@
+package manifest
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"sync"
+	"time"
+
+	"google.golang.org/api/option"
+	htransport "google.golang.org/api/transport/http"
+)
+
+// Notifier is told when an upload run by UploadSources or Sync starts and
+// how it ends, with the Event summarizing it: at the start, only who is
+// uploading what, and at the end everything else. A Notifier that fails is
+// logged, but doesn't fail the run.
+type Notifier interface {
+	RunStarted(ctx context.Context, e Event) error
+	RunCompleted(ctx context.Context, e Event) error
+	RunFailed(ctx context.Context, e Event) error
+}
+
+// Notification is what the built-in Notifiers send: the Event, and whether
+// the run started, completed or failed.
+type Notification struct {
+	Type  string `json:"type"`
+	Event Event  `json:"event"`
+}
+
+// The Types of Notification.
+const (
+	StartedNotification   = "run.started"
+	CompletedNotification = "run.completed"
+	FailedNotification    = "run.failed"
+)
+
+// notifyTimeout bounds each notification, which may be sent after the
+// run's context is done.
+const notifyTimeout = 30 * time.Second
+
+// notified runs upload to dst, telling every WithNotifier Notifier when it
+// starts and how it ends. The Uploader upload is passed is u, but
+// collecting the run's warnings for the Event.
+func (u *Uploader) notified(dst string, upload func(*Uploader) (*Result, error)) (*Result, error) {
+	if len(u.notifiers) == 0 {
+		return upload(u)
+	}
+	var (
+		mu       sync.Mutex
+		warnings []Warning
+	)
+	o := *u.options
+	o.onWarning = func(w Warning) {
+		mu.Lock()
+		warnings = append(warnings, w)
+		mu.Unlock()
+		if u.onWarning != nil {
+			u.onWarning(w)
+		}
+	}
+	started := time.Now()
+	e := Event{Time: started.UTC(), Action: "upload", Actor: DefaultActor(), RunID: u.runID, Dst: dst}
+	u.notify(StartedNotification, e)
+
+	res, err := upload(&Uploader{options: &o})
+
+	e.Time = time.Now().UTC()
+	e.Seconds = time.Since(started).Seconds()
+	mu.Lock()
+	e.Warnings = warnings
+	mu.Unlock()
+	var uerr *UploadError
+	switch {
+	case err == nil:
+		e.Outcome = "success"
+		e.Files, e.Uploaded, e.Bytes = len(res.Files), res.Uploaded, res.Bytes
+		e.ManifestDigest, _ = res.Manifest.Digest()
+		u.notify(CompletedNotification, e)
+		return res, nil
+	case errors.As(err, &uerr):
+		e.Outcome = "failure"
+		if uerr.Manifest != nil {
+			e.Outcome = "partial"
+		}
+		e.Files, e.Uploaded, e.Failed = len(uerr.Uploaded)+len(uerr.Failed), len(uerr.Uploaded), len(uerr.Failed)
+	default:
+		e.Outcome = "failure"
+	}
+	e.Error = err.Error()
+	u.notify(FailedNotification, e)
+	return nil, err
+}
+
+// notify sends e as a Notification of type typ to every Notifier, logging
+// those that fail.
+func (u *Uploader) notify(typ string, e Event) {
+	for _, n := range u.notifiers {
+		ctx, cancel := context.WithTimeout(context.Background(), notifyTimeout)
+		var err error
+		switch typ {
+		case StartedNotification:
+			err = n.RunStarted(ctx, e)
+		case CompletedNotification:
+			err = n.RunCompleted(ctx, e)
+		case FailedNotification:
+			err = n.RunFailed(ctx, e)
+		}
+		cancel()
+		if err != nil {
+			fmt.Fprintf(u.log, "Failed to send %s notification: %v\n", typ, err)
+		}
+	}
+}
+
+// sender adapts a function sending a Notification to a Notifier.
+type sender func(context.Context, Notification) error
+
+func (s sender) RunStarted(ctx context.Context, e Event) error {
+	return s(ctx, Notification{Type: StartedNotification, Event: e})
+}
+
+func (s sender) RunCompleted(ctx context.Context, e Event) error {
+	return s(ctx, Notification{Type: CompletedNotification, Event: e})
+}
+
+func (s sender) RunFailed(ctx context.Context, e Event) error {
+	return s(ctx, Notification{Type: FailedNotification, Event: e})
+}
+
+// NewLogNotifier returns a Notifier writing each Notification to w as a
+// line of JSON.
+func NewLogNotifier(w io.Writer) Notifier {
+	var mu sync.Mutex
+	return sender(func(_ context.Context, n Notification) error {
+		b, err := json.Marshal(n)
+		if err != nil {
+			return err
+		}
+		mu.Lock()
+		defer mu.Unlock()
+		_, err = w.Write(append(b, '\n'))
+		return err
+	})
+}
+
+// NewWebhookNotifier returns a Notifier POSTing each Notification as JSON
+// to url, and failing unless it gets a 2xx response.
+func NewWebhookNotifier(url string) Notifier {
+	return sender(func(ctx context.Context, n Notification) error {
+		b, err := json.Marshal(n)
+		if err != nil {
+			return err
+		}
+		return post(ctx, http.DefaultClient, url, b)
+	})
+}
+
+// NewPubSubNotifier returns a Notifier publishing each Notification as
+// JSON to the Pub/Sub topic projects/<project>/topics/<topic>, with its
+// type in the "type" attribute, authenticated with default credentials.
+func NewPubSubNotifier(ctx context.Context, topic string) (Notifier, error) {
+	hc, _, err := htransport.NewClient(ctx, option.WithScopes("https://www.googleapis.com/auth/pubsub"))
+	if err != nil {
+		return nil, err
+	}
+	url := "https://pubsub.googleapis.com/v1/" + topic + ":publish"
+	return sender(func(ctx context.Context, n Notification) error {
+		data, err := json.Marshal(n)
+		if err != nil {
+			return err
+		}
+		b, err := json.Marshal(map[string]interface{}{
+			"messages": []map[string]interface{}{{
+				"data":       data,
+				"attributes": map[string]string{"type": n.Type},
+			}},
+		})
+		if err != nil {
+			return err
+		}
+		return post(ctx, hc, url, b)
+	}), nil
+}
+
+// post POSTs body as JSON to url, failing unless the response is a 2xx.
+func post(ctx context.Context, client *http.Client, url string, body []byte) error {
+	req, err := http.NewRequest(http.MethodPost, url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := client.Do(req.WithContext(ctx))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		b, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 1<<10))
+		return fmt.Errorf("posting to %s: %s: %s", url, resp.Status, bytes.TrimSpace(b))
+	}
+	return nil
+}
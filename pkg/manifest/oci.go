@@ -0,0 +1,390 @@
+package manifest
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"golang.org/x/oauth2/google"
+)
+
+// Media types of the OCI artifact PushOCI pushes. The artifact is an image
+// manifest whose only layer is the manifest's JSON, with an empty config,
+// as the OCI guidance for artifacts has it.
+const (
+	OCIArtifactType  = "application/vnd.gcs-manifest.manifest.v1+json"
+	ociManifestType  = "application/vnd.oci.image.manifest.v1+json"
+	ociEmptyType     = "application/vnd.oci.empty.v1+json"
+	ociFileKeyPrefix = "dev.gcs-manifest.file."
+)
+
+// ociDescriptor is an OCI content descriptor.
+type ociDescriptor struct {
+	MediaType   string            `json:"mediaType"`
+	Digest      string            `json:"digest"`
+	Size        int64             `json:"size"`
+	Annotations map[string]string `json:"annotations,omitempty"`
+}
+
+type ociManifest struct {
+	SchemaVersion int               `json:"schemaVersion"`
+	MediaType     string            `json:"mediaType"`
+	ArtifactType  string            `json:"artifactType"`
+	Config        ociDescriptor     `json:"config"`
+	Layers        []ociDescriptor   `json:"layers"`
+	Annotations   map[string]string `json:"annotations,omitempty"`
+}
+
+// PushOCI pushes m, published at the gs:// path dst, to the registry
+// reference ref, such as ghcr.io/org/artifacts:v1.2.3, as an OCI artifact,
+// and returns the digest of the artifact's manifest. The manifest's JSON
+// is its one layer; dst and every file's digest, under
+// dev.gcs-manifest.file.<path>, are annotations, so that registry tooling
+// can find and check the upload without fetching the layer.
+//
+// Credentials come from the docker config file's auths, or, for gcr.io and
+// pkg.dev registries, from Google default credentials. Credential helpers
+// aren't supported.
+func PushOCI(ctx context.Context, ref string, m *Manifest, dst string) (string, error) {
+	r, err := parseOCIRef(ref)
+	if err != nil {
+		return "", err
+	}
+	layer, err := m.MarshalJSON()
+	if err != nil {
+		return "", err
+	}
+	config := []byte("{}")
+
+	annotations := map[string]string{
+		"org.opencontainers.image.created": time.Now().UTC().Format(time.RFC3339),
+		"dev.gcs-manifest.dst":             dst,
+	}
+	for p, e := range m.Files {
+		annotations[ociFileKeyPrefix+p] = e.Digest
+	}
+	om := ociManifest{
+		SchemaVersion: 2,
+		MediaType:     ociManifestType,
+		ArtifactType:  OCIArtifactType,
+		Config:        ociDescriptor{MediaType: ociEmptyType, Digest: ociDigest(config), Size: int64(len(config))},
+		Layers: []ociDescriptor{{
+			MediaType:   OCIArtifactType,
+			Digest:      ociDigest(layer),
+			Size:        int64(len(layer)),
+			Annotations: map[string]string{"org.opencontainers.image.title": Name},
+		}},
+		Annotations: annotations,
+	}
+	body, err := json.Marshal(om)
+	if err != nil {
+		return "", err
+	}
+
+	for _, blob := range [][]byte{config, layer} {
+		if err := r.pushBlob(ctx, blob); err != nil {
+			return "", err
+		}
+	}
+	resp, err := r.do(ctx, http.MethodPut, r.url("manifests/"+r.tag), ociManifestType, body)
+	if err != nil {
+		return "", err
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusCreated && resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("pushing %s: %s", ref, resp.Status)
+	}
+	return ociDigest(body), nil
+}
+
+func ociDigest(b []byte) string {
+	sum := sha256.Sum256(b)
+	return "sha256:" + hex.EncodeToString(sum[:])
+}
+
+// ociRegistry is a repository in a registry, and the credentials and token
+// to push to it with.
+type ociRegistry struct {
+	host  string
+	repo  string
+	tag   string
+	user  string
+	pass  string
+	token string
+}
+
+// parseOCIRef splits ref, registry/repository:tag, the same way docker
+// does: a first component without a dot or colon, other than localhost,
+// is part of a Docker Hub repository.
+func parseOCIRef(ref string) (*ociRegistry, error) {
+	r := &ociRegistry{tag: "latest"}
+	name := ref
+	if i := strings.LastIndex(name, ":"); i > strings.LastIndex(name, "/") {
+		name, r.tag = name[:i], name[i+1:]
+	}
+	if strings.Contains(name, "@") || r.tag == "" || name == "" {
+		return nil, fmt.Errorf("invalid OCI reference %q: want registry/repository:tag", ref)
+	}
+	r.host, r.repo = "registry-1.docker.io", name
+	if i := strings.Index(name, "/"); i >= 0 && (strings.ContainsAny(name[:i], ".:") || name[:i] == "localhost") {
+		r.host, r.repo = name[:i], name[i+1:]
+	} else if !strings.Contains(name, "/") {
+		r.repo = "library/" + name
+	}
+	return r, nil
+}
+
+func (r *ociRegistry) url(p string) string {
+	scheme := "https"
+	if strings.HasPrefix(r.host, "localhost") || strings.HasPrefix(r.host, "127.0.0.1") {
+		scheme = "http"
+	}
+	return scheme + "://" + r.host + "/v2/" + r.repo + "/" + p
+}
+
+// pushBlob uploads b, in one request, unless the registry already has it.
+func (r *ociRegistry) pushBlob(ctx context.Context, b []byte) error {
+	digest := ociDigest(b)
+	resp, err := r.do(ctx, http.MethodHead, r.url("blobs/"+digest), "", nil)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode == http.StatusOK {
+		return nil
+	}
+
+	resp, err = r.do(ctx, http.MethodPost, r.url("blobs/uploads/"), "", nil)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusAccepted {
+		return fmt.Errorf("starting upload of %s: %s", digest, resp.Status)
+	}
+	loc, err := resp.Request.URL.Parse(resp.Header.Get("Location"))
+	if err != nil {
+		return fmt.Errorf("starting upload of %s: %v", digest, err)
+	}
+	q := loc.Query()
+	q.Set("digest", digest)
+	loc.RawQuery = q.Encode()
+	resp, err = r.do(ctx, http.MethodPut, loc.String(), "application/octet-stream", b)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusCreated {
+		return fmt.Errorf("uploading %s: %s", digest, resp.Status)
+	}
+	return nil
+}
+
+// do sends a request, authenticating and sending it again if the registry
+// asks for credentials.
+func (r *ociRegistry) do(ctx context.Context, method, u, contentType string, body []byte) (*http.Response, error) {
+	send := func() (*http.Response, error) {
+		req, err := http.NewRequest(method, u, bytes.NewReader(body))
+		if err != nil {
+			return nil, err
+		}
+		if contentType != "" {
+			req.Header.Set("Content-Type", contentType)
+		}
+		switch {
+		case r.token != "":
+			req.Header.Set("Authorization", "Bearer "+r.token)
+		case r.user != "":
+			req.SetBasicAuth(r.user, r.pass)
+		}
+		return http.DefaultClient.Do(req.WithContext(ctx))
+	}
+	resp, err := send()
+	if err != nil || resp.StatusCode != http.StatusUnauthorized || r.token != "" {
+		return resp, err
+	}
+	resp.Body.Close()
+	if err := r.login(ctx, resp.Header.Get("WWW-Authenticate")); err != nil {
+		return nil, err
+	}
+	return send()
+}
+
+// login answers the registry's challenge: for Basic, by sending the
+// credentials with every request; for Bearer, by exchanging them for a
+// push token.
+func (r *ociRegistry) login(ctx context.Context, challenge string) error {
+	if err := r.credentials(ctx); err != nil {
+		return err
+	}
+	scheme, params := parseChallenge(challenge)
+	switch scheme {
+	case "basic":
+		if r.user == "" {
+			return fmt.Errorf("%s needs credentials, and none were found", r.host)
+		}
+		return nil
+	case "bearer":
+	default:
+		return fmt.Errorf("%s: unsupported authentication challenge %q", r.host, challenge)
+	}
+
+	realm, err := url.Parse(params["realm"])
+	if err != nil || params["realm"] == "" {
+		return fmt.Errorf("%s: bad token realm %q", r.host, params["realm"])
+	}
+	q := realm.Query()
+	if s := params["service"]; s != "" {
+		q.Set("service", s)
+	}
+	q.Set("scope", "repository:"+r.repo+":pull,push")
+	realm.RawQuery = q.Encode()
+	req, err := http.NewRequest(http.MethodGet, realm.String(), nil)
+	if err != nil {
+		return err
+	}
+	if r.user != "" {
+		req.SetBasicAuth(r.user, r.pass)
+	}
+	resp, err := http.DefaultClient.Do(req.WithContext(ctx))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	b, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("getting a token for %s: %s: %s", r.host, resp.Status, bytes.TrimSpace(b))
+	}
+	var tok struct {
+		Token       string `json:"token"`
+		AccessToken string `json:"access_token"`
+	}
+	if err := json.Unmarshal(b, &tok); err != nil {
+		return err
+	}
+	if r.token = tok.Token; r.token == "" {
+		r.token = tok.AccessToken
+	}
+	if r.token == "" {
+		return fmt.Errorf("getting a token for %s: none returned", r.host)
+	}
+	return nil
+}
+
+// parseChallenge splits a WWW-Authenticate header into its lowercased
+// scheme and parameters.
+func parseChallenge(h string) (string, map[string]string) {
+	params := map[string]string{}
+	parts := strings.SplitN(strings.TrimSpace(h), " ", 2)
+	scheme := strings.ToLower(parts[0])
+	if len(parts) == 1 {
+		return scheme, params
+	}
+	rest := parts[1]
+	for rest != "" {
+		eq := strings.Index(rest, "=")
+		if eq < 0 {
+			break
+		}
+		key := strings.ToLower(strings.TrimSpace(rest[:eq]))
+		rest = rest[eq+1:]
+		var val string
+		if strings.HasPrefix(rest, `"`) {
+			end := strings.Index(rest[1:], `"`)
+			if end < 0 {
+				end = len(rest) - 1
+			}
+			val, rest = rest[1:end+1], rest[end+1:]
+			if len(rest) > 0 {
+				rest = rest[1:]
+			}
+		} else {
+			end := strings.Index(rest, ",")
+			if end < 0 {
+				end = len(rest)
+			}
+			val, rest = rest[:end], rest[end:]
+		}
+		params[key] = val
+		rest = strings.TrimLeft(rest, ", ")
+	}
+	return scheme, params
+}
+
+// credentials finds credentials for r's host, if it hasn't already.
+func (r *ociRegistry) credentials(ctx context.Context) error {
+	if r.user != "" {
+		return nil
+	}
+	if strings.HasSuffix(r.host, "gcr.io") || strings.HasSuffix(r.host, "-docker.pkg.dev") {
+		ts, err := google.DefaultTokenSource(ctx, "https://www.googleapis.com/auth/cloud-platform")
+		if err != nil {
+			return err
+		}
+		tok, err := ts.Token()
+		if err != nil {
+			return err
+		}
+		r.user, r.pass = "oauth2accesstoken", tok.AccessToken
+		return nil
+	}
+
+	dir := os.Getenv("DOCKER_CONFIG")
+	if dir == "" {
+		home, err := os.UserHomeDir()
+		if err != nil {
+			return nil
+		}
+		dir = filepath.Join(home, ".docker")
+	}
+	b, err := ioutil.ReadFile(filepath.Join(dir, "config.json"))
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	var cfg struct {
+		Auths map[string]struct {
+			Auth string `json:"auth"`
+		} `json:"auths"`
+	}
+	if err := json.Unmarshal(b, &cfg); err != nil {
+		return fmt.Errorf("parsing docker config: %v", err)
+	}
+	keys := []string{r.host, "https://" + r.host}
+	if r.host == "registry-1.docker.io" {
+		keys = append(keys, "https://index.docker.io/v1/", "docker.io")
+	}
+	for _, k := range keys {
+		a, ok := cfg.Auths[k]
+		if !ok || a.Auth == "" {
+			continue
+		}
+		dec, err := base64.StdEncoding.DecodeString(a.Auth)
+		if err != nil {
+			return fmt.Errorf("docker config auth for %s: %v", k, err)
+		}
+		i := strings.Index(string(dec), ":")
+		if i < 0 {
+			return fmt.Errorf("docker config auth for %s: want user:password", k)
+		}
+		r.user, r.pass = string(dec[:i]), string(dec[i+1:])
+		return nil
+	}
+	return nil
+}
@@ -0,0 +1,552 @@
+package manifest
+
+import (
+	"crypto"
+	"crypto/x509"
+	"io"
+	"io/ioutil"
+	"runtime"
+	"strings"
+	"time"
+
+	"cloud.google.com/go/storage"
+	"google.golang.org/api/googleapi"
+)
+
+// DefaultParallelism is the number of files uploaded at once unless
+// WithParallelism says otherwise: twice the number of CPUs, since uploads
+// spend most of their time waiting on the network.
+func DefaultParallelism() int {
+	return 2 * runtime.NumCPU()
+}
+
+type options struct {
+	client            *storage.Client
+	log               io.Writer
+	stableWait        time.Duration
+	safetyWindow      time.Duration
+	retryUnstable     bool
+	replicas          *replicaSet
+	manifestRetries   int
+	manifestChunkSize int
+	maxDepth          int
+	maxFiles          int
+	oneFileSystem     bool
+	preserveLinks     bool
+	preserveMode      bool
+	parallelism       int
+	strict            bool
+	retries           int
+	continueOnError   bool
+	checkpoint        string
+	spoolDir          string
+	spoolMax          int64
+	snapshotSrc       string
+	routes            []Route
+	chunkSize         int
+	partSize          int64
+	fullHash          bool
+	strictPrefix      bool
+	readAhead         int64
+	keepEncoding      bool
+	resume            bool
+	gsutilHashes      []GsutilHash
+	include           []string
+	exclude           []string
+	ignoreFile        bool
+	signer            Signer
+	certChain         []*x509.Certificate
+	publicKeys        []crypto.PublicKey
+	maxAge            time.Duration
+	progress          func(Progress)
+	compression       string
+	kmsKey            string
+	encryptionKey     []byte
+	digests           map[string]string
+	bandwidth         *limiter
+	requests          *limiter
+	spotCheck         float64
+	spotSeed          uint64
+	cas               bool
+	onConflict        ConflictPolicy
+	expiry            []ExpiryRule
+	cacheControl      string
+	storageClass      string
+	metadataRules     []MetadataRule
+	metadata          map[string]string
+	onWarning         func(Warning)
+	notifiers         []Notifier
+	runID             string
+	deadline          time.Time
+}
+
+// Option configures an Uploader, Downloader or Verifier.
+type Option func(*options)
+
+func newOptions(opts []Option) *options {
+	o := &options{
+		log:               ioutil.Discard,
+		manifestRetries:   5,
+		manifestChunkSize: 16 << 20,
+		parallelism:       DefaultParallelism(),
+		retries:           3,
+		chunkSize:         googleapi.DefaultUploadChunkSize,
+		readAhead:         DefaultReadAhead,
+	}
+	for _, opt := range opts {
+		opt(o)
+	}
+	return o
+}
+
+// WithClient sets the GCS client to use instead of creating one with
+// default credentials.
+func WithClient(c *storage.Client) Option {
+	return func(o *options) { o.client = c }
+}
+
+// WithLog sets where progress messages are written; they are discarded by
+// default.
+func WithLog(w io.Writer) Option {
+	return func(o *options) { o.log = w }
+}
+
+// WithStableOnly skips files whose size or modification time changes
+// across two stats wait apart, i.e. files that are still being written.
+func WithStableOnly(wait time.Duration) Option {
+	return func(o *options) { o.stableWait = wait }
+}
+
+// WithRetryUnstable treats files modified while they were being uploaded as
+// failed so they are retried, instead of just reporting them.
+func WithRetryUnstable() Option {
+	return func(o *options) { o.retryUnstable = true }
+}
+
+// WithReplicas makes an Uploader copy every object it stores under its
+// gs:// destination to the same place under each of the gs:// paths
+// replicas, such as buckets in other regions, server-side and checked by
+// size and CRC32C, and only record a file in the manifest once at least
+// quorum of the destinations, the original one included, have it; one
+// that doesn't reach that many fails like any other. A quorum of 0 means
+// all of them. The manifest is then published to every replica too, as a
+// partial one to a replica missing any of its files, and the run fails
+// unless at least quorum destinations have a complete one; the partial
+// manifest of a failed run under WithContinueOnError is only published to
+// the original destination. Copies are encrypted as WithKMSKey or
+// WithEncryptionKey ask, and otherwise keep the original's storage class
+// and metadata. Only UploadSources, and Upload, Sync and Watch, which are
+// built on it, support replicas, and only to a gs:// destination.
+func WithReplicas(quorum int, replicas ...string) Option {
+	return func(o *options) {
+		if quorum == 0 {
+			quorum = len(replicas) + 1
+		}
+		o.replicas = &replicaSet{paths: replicas, quorum: quorum}
+	}
+}
+
+// WithManifestRetries sets how many times uploading the manifest itself is
+// retried.
+func WithManifestRetries(n int) Option {
+	return func(o *options) { o.manifestRetries = n }
+}
+
+// WithManifestChunkSize sets the chunk size of the resumable manifest
+// upload.
+func WithManifestChunkSize(n int) Option {
+	return func(o *options) { o.manifestChunkSize = n }
+}
+
+// WithMaxDepth makes walking a source directory fail if it contains
+// directories nested more than n levels deep. Zero means no limit.
+func WithMaxDepth(n int) Option {
+	return func(o *options) { o.maxDepth = n }
+}
+
+// WithMaxFiles makes walking the sources fail once more than n files have
+// been found. Zero means no limit.
+func WithMaxFiles(n int) Option {
+	return func(o *options) { o.maxFiles = n }
+}
+
+// WithOneFileSystem keeps the walk from descending into directories on a
+// different filesystem than the source, like rsync -x or tar
+// --one-file-system.
+func WithOneFileSystem() Option {
+	return func(o *options) { o.oneFileSystem = true }
+}
+
+// WithPreserveLinks makes the walk record symlinks, with their targets,
+// instead of skipping them. Only links to somewhere within the tree being
+// walked are recorded; others are still skipped with a warning. Downloads
+// restore recorded links whether or not this is given.
+func WithPreserveLinks() Option {
+	return func(o *options) { o.preserveLinks = true }
+}
+
+// WithPreserveMode makes an Uploader record each file's permission bits,
+// so that a download restores executables as executable. Without it files
+// are restored as 0644.
+func WithPreserveMode() Option {
+	return func(o *options) { o.preserveMode = true }
+}
+
+// WithParallelism sets how many files are uploaded, or downloaded, at
+// once. Values below one are treated as one.
+func WithParallelism(n int) Option {
+	return func(o *options) {
+		if n < 1 {
+			n = 1
+		}
+		o.parallelism = n
+	}
+}
+
+// WithContinueOnError makes an Uploader keep uploading the other files when
+// one fails even after its retries, and then retry each failure once more,
+// rather than stopping at the first. If any still fail, a partial manifest
+// is published, listing them in Missing, so that consumers can tell the set
+// is incomplete; without this option no manifest is written at all.
+func WithContinueOnError() Option {
+	return func(o *options) { o.continueOnError = true }
+}
+
+// WithDeadline makes an Uploader finish uploading to a gs:// destination
+// by t, or stop as soon as it's clear it can't. Each file gets twice its
+// share, by size, of the time left when it starts, and at least a minute,
+// and one that takes longer fails with ErrDeadline; so does the run, once
+// it has been going long enough for its average rate to say the bytes left
+// won't make it. Either stops the whole run, even under
+// WithContinueOnError, failing the files not yet finished with
+// ErrDeadline, so that what did finish can be reported while there's still
+// time to.
+func WithDeadline(t time.Time) Option {
+	return func(o *options) { o.deadline = t }
+}
+
+// WithCheckpoint makes an Uploader save the files it has finished to the
+// local file path every few seconds while it uploads, so that a run that
+// is killed can be finished with Resume instead of starting over. The
+// file is removed once the manifest is published.
+func WithCheckpoint(path string) Option {
+	return func(o *options) { o.checkpoint = path }
+}
+
+// WithSpool makes an Uploader copy each local file of at most maxSize
+// bytes to a temporary file in dir, or the default temporary directory if
+// dir is empty, before hashing and uploading it from the copy, so that a
+// slow or flaky source filesystem can't stall or break a GCS upload in
+// progress. Reading the source is retried, like uploading, if it fails.
+// Up to WithParallelism files are spooled at once, so dir needs room for
+// that many of them.
+func WithSpool(dir string, maxSize int64) Option {
+	return func(o *options) {
+		o.spoolDir = dir
+		o.spoolMax = maxSize
+	}
+}
+
+// WithConsistentSnapshot makes UploadSources fingerprint the local source
+// tree src, the one its sources were expanded from, by the path, size and
+// modification time of every file before uploading anything, and fail with
+// a SnapshotError instead of publishing a manifest if the tree is any
+// different once the files are uploaded, so that a manifest that is
+// published describes the tree at a single point in time.
+func WithConsistentSnapshot(src string) Option {
+	return func(o *options) { o.snapshotSrc = src }
+}
+
+// WithRoutes makes an Uploader store the files under each route's From
+// directory under its To prefix of the destination instead, recording the
+// object each is stored in in its manifest entry. The first route a file
+// is under applies; files under none are stored at their paths as usual.
+func WithRoutes(routes ...Route) Option {
+	return func(o *options) { o.routes = append(o.routes, routes...) }
+}
+
+// WithStrict makes an upload fail rather than leave out any file under its
+// source, so that its manifest describes the whole tree: a named pipe,
+// socket or device, a symlink that isn't preserved, a file the include,
+// exclude or ignore rules filter out, one at the manifest's path, one
+// that is unstable or changes while it is uploaded, or one a sync skips
+// as a conflict. It can't be combined with WithContinueOnError, whose
+// manifests may be partial.
+func WithStrict() Option {
+	return func(o *options) { o.strict = true }
+}
+
+// WithRetries sets how many times a failed file upload is retried, with
+// exponential backoff, before it counts as failed.
+func WithRetries(n int) Option {
+	return func(o *options) { o.retries = n }
+}
+
+// WithChunkSize sets the chunk size of resumable file uploads. Zero uploads
+// each file in a single request, which can't be resumed.
+func WithChunkSize(n int) Option {
+	return func(o *options) { o.chunkSize = n }
+}
+
+// WithCompositeUpload makes an Uploader upload files larger than partSize
+// bytes as parts of at least that size, up to 32 of them, which GCS then
+// composes into the file's object. GCS checks each part's CRC32C as it is
+// uploaded, and the composed object's as it is composed, and the manifest
+// records every part's size, CRC32C and digest, so that a range of the
+// object can be checked later without reading all of it; see
+// Verifier.VerifyPart. It can't be combined with WithCompression or
+// WithEncryptionKey.
+func WithCompositeUpload(partSize int64) Option {
+	return func(o *options) { o.partSize = partSize }
+}
+
+// WithMaxBandwidth caps the bytes a second an Uploader sends, or a
+// Downloader receives, across all the files it transfers at once. Zero
+// means no limit.
+func WithMaxBandwidth(bytesPerSecond int64) Option {
+	return func(o *options) {
+		o.bandwidth = nil
+		if bytesPerSecond > 0 {
+			o.bandwidth = newLimiter(float64(bytesPerSecond))
+		}
+	}
+}
+
+// WithMaxRequestRate caps how many object operations a second an Uploader
+// or Downloader starts, across all files, such as writing, copying or checking an
+// object, so as to stay under GCS's rate limits. Zero means no limit.
+func WithMaxRequestRate(perSecond float64) Option {
+	return func(o *options) {
+		o.requests = nil
+		if perSecond > 0 {
+			o.requests = newLimiter(perSecond)
+		}
+	}
+}
+
+// WithGsutilHashes makes a Verifier also compare each object with the
+// checksums gsutil hash computed for its file, as read by
+// ParseGsutilHashes.
+func WithGsutilHashes(hashes []GsutilHash) Option {
+	return func(o *options) { o.gsutilHashes = hashes }
+}
+
+// WithReadAhead sets how many bytes of small objects a download may hold in
+// memory, split between its workers, so as to fetch them in batches rather
+// than one at a time. Zero fetches every object on its own.
+func WithReadAhead(n int64) Option {
+	return func(o *options) { o.readAhead = n }
+}
+
+// WithKeepEncoding makes a Downloader restore objects uploaded with
+// WithCompression as they are stored, still compressed, and check them
+// against the manifest's StoredDigest, rather than decompressing them and
+// checking the original file's digest.
+func WithKeepEncoding() Option {
+	return func(o *options) { o.keepEncoding = true }
+}
+
+// WithResume makes a Downloader keep the files already in the destination
+// that match their digests, from a download that was interrupted, rather
+// than fetching them again.
+func WithResume() Option {
+	return func(o *options) { o.resume = true }
+}
+
+// WithStrictPrefix makes Verify hold a prefix to exactly what its manifest
+// describes: any object under it besides the manifest's files and the
+// manifest itself is reported as extra, including the directory
+// placeholders that are otherwise ignored.
+func WithStrictPrefix() Option {
+	return func(o *options) { o.strictPrefix = true }
+}
+
+// WithSafetyWindow makes Prune keep stale objects written less than d
+// ago, which may be the files of a publish still in progress rather than
+// garbage.
+func WithSafetyWindow(d time.Duration) Option {
+	return func(o *options) { o.safetyWindow = d }
+}
+
+// WithFullHash makes a Verifier stream every object and compare its sha256,
+// even when the manifest records a CRC32C that could be checked instead.
+func WithFullHash() Option {
+	return func(o *options) { o.fullHash = true }
+}
+
+// WithInclude limits the walk to files matching at least one of patterns.
+// Patterns use the same syntax as WithExclude, without negation.
+func WithInclude(patterns ...string) Option {
+	return func(o *options) { o.include = append(o.include, patterns...) }
+}
+
+// WithExclude skips files and directories matching any of patterns, in
+// .gitignore syntax: a pattern without a slash matches a name at any depth,
+// one with a slash matches the path from the source root, "**" matches any
+// number of directories, and a trailing slash matches only directories.
+func WithExclude(patterns ...string) Option {
+	return func(o *options) { o.exclude = append(o.exclude, patterns...) }
+}
+
+// WithIgnoreFile reads exclude patterns from IgnoreFile at the root of the
+// source, if there is one. Patterns given with WithExclude are applied
+// after it.
+func WithIgnoreFile() Option {
+	return func(o *options) { o.ignoreFile = true }
+}
+
+// WithSigner makes an Uploader write a detached signature next to every
+// manifest it uploads.
+func WithSigner(s Signer) Option {
+	return func(o *options) { o.signer = s }
+}
+
+// WithCertChain records certs, the signing key's certificate and the chain
+// up from it, as ParseCertChain returns them, in the signature bundle of
+// every manifest an Uploader signs.
+func WithCertChain(certs []*x509.Certificate) Option {
+	return func(o *options) { o.certChain = certs }
+}
+
+// WithPublicKey makes a Downloader or Verifier refuse any manifest whose
+// detached signature doesn't verify with pub. Given more than once, a
+// signature from any of the keys is accepted.
+func WithPublicKey(pub crypto.PublicKey) Option {
+	return func(o *options) { o.publicKeys = append(o.publicKeys, pub) }
+}
+
+// WithProgress makes an Uploader call f about once a second while it
+// uploads files, and once more when they have all finished. f is called
+// from its own goroutine. The per-file "Uploading:" lines are no longer
+// logged, since f replaces them.
+func WithProgress(f func(Progress)) Option {
+	return func(o *options) { o.progress = f }
+}
+
+// WithKMSKey makes an Uploader encrypt every object it writes, the
+// manifest included, with the Cloud KMS key (CMEK) name, given without a
+// key version, rather than the bucket's default. A Verifier given it
+// reports every object not encrypted with that key as corrupted.
+func WithKMSKey(name string) Option {
+	return func(o *options) { o.kmsKey = name }
+}
+
+// WithEncryptionKey sets the AES-256 customer-supplied encryption key
+// (CSEK) that an Uploader encrypts files with, and that a Downloader or
+// Verifier reads them back with. The manifest and its signature are left
+// unencrypted, so that they can be read without the key. See
+// ParseEncryptionKey.
+func WithEncryptionKey(key []byte) Option {
+	return func(o *options) { o.encryptionKey = key }
+}
+
+// WithDigests gives an Uploader the digests of its local sources, keyed by
+// path relative to the source as ReadDigests returns them, so that it
+// records them instead of hashing the files itself. Sync and Plan use them
+// too. Files missing from digests are hashed as usual. The digests are
+// trusted: a wrong one ends up in the manifest, and fails verification
+// later, unless WithSpotCheck catches it.
+func WithDigests(digests map[string]string) Option {
+	return func(o *options) { o.digests = digests }
+}
+
+// WithSpotCheck makes an Uploader hash a random fraction, between 0 and 1,
+// of the files WithDigests gives digests for anyway, and fail each whose
+// digest is wrong.
+func WithSpotCheck(fraction float64) Option {
+	return func(o *options) {
+		o.spotCheck = fraction
+		o.spotSeed = uint64(time.Now().UnixNano())
+	}
+}
+
+// WithCompression makes an Uploader compress every file it uploads with
+// enc, which must be "gzip", and store it with that Content-Encoding. The
+// manifest records the original file's digest and size, which is what a
+// download gets back, and the stored object's as well.
+func WithCompression(enc string) Option {
+	return func(o *options) { o.compression = enc }
+}
+
+// WithContentAddressed makes an Uploader store each file under
+// blobs/sha256/<hex digest> below the destination instead of under its
+// path, which the manifest maps to it. Identical files are stored once,
+// and a file whose contents are already stored isn't uploaded again. It
+// can't be combined with WithCompression or used for gs:// sources.
+func WithContentAddressed() Option {
+	return func(o *options) { o.cas = true }
+}
+
+// WithExpiry records in the manifest when each file matching one of rules
+// expires, for pruning it once it has; the first rule a path matches
+// decides. Files carried over from an earlier run keep the expiry they
+// were uploaded with.
+func WithExpiry(rules ...ExpiryRule) Option {
+	return func(o *options) { o.expiry = append(o.expiry, rules...) }
+}
+
+// WithConflictPolicy sets what Uploader.Sync does with files whose objects
+// were written by someone else since the manifest was published and after
+// the files were last modified. Checking for them takes a request for each
+// new or changed file, unless p is LocalWins. It can't be combined with
+// WithContentAddressed, under which objects are never overwritten anyway.
+func WithConflictPolicy(p ConflictPolicy) Option {
+	return func(o *options) { o.onConflict = p }
+}
+
+// WithCacheControl sets the Cache-Control of every file an Uploader
+// uploads. Files copied from gs:// sources keep their own.
+func WithCacheControl(cc string) Option {
+	return func(o *options) { o.cacheControl = cc }
+}
+
+// WithMetadata adds custom metadata to every file an Uploader uploads.
+// Given more than once, the maps are merged. Files copied from gs://
+// sources keep their own.
+func WithMetadata(md map[string]string) Option {
+	return func(o *options) {
+		if o.metadata == nil {
+			o.metadata = map[string]string{}
+		}
+		for k, v := range md {
+			o.metadata[k] = v
+		}
+	}
+}
+
+// WithStorageClass sets the storage class, such as NEARLINE or ARCHIVE, of
+// every file an Uploader uploads, instead of the bucket's default. Files
+// copied from gs:// sources keep their own.
+func WithStorageClass(class string) Option {
+	return func(o *options) { o.storageClass = strings.ToUpper(class) }
+}
+
+// WithMetadataRules sets the Content-Language and charset of the files an
+// Uploader uploads that the rules match; see MetadataRule. Files copied
+// from gs:// sources keep their own.
+func WithMetadataRules(rules ...MetadataRule) Option {
+	return func(o *options) { o.metadataRules = append(o.metadataRules, rules...) }
+}
+
+// WithWarnings calls f with every Warning, as well as logging it. f may be
+// called from several goroutines at once.
+func WithWarnings(f func(Warning)) Option {
+	return func(o *options) { o.onWarning = f }
+}
+
+// WithNotifier adds a Notifier for an Uploader to tell when each run of
+// UploadSources or Sync starts and ends.
+func WithNotifier(n Notifier) Option {
+	return func(o *options) { o.notifiers = append(o.notifiers, n) }
+}
+
+// WithRunID sets the run ID recorded in the Events sent to Notifiers.
+func WithRunID(id string) Option {
+	return func(o *options) { o.runID = id }
+}
+
+// WithMaxAge makes a Downloader or Verifier refuse any manifest published
+// longer than d ago.
+func WithMaxAge(d time.Duration) Option {
+	return func(o *options) { o.maxAge = d }
+}
@@ -0,0 +1,76 @@
+package manifest
+
+import (
+	"fmt"
+	"os"
+	"path"
+	"strings"
+)
+
+// PlannedFile is one upload a run would make.
+type PlannedFile struct {
+	Source string
+	Object string
+	Size   int64
+}
+
+// Plan hashes sources locally, other than those WithDigests gives digests
+// for, and returns what uploading them to dst, a
+// gs:// path or a Storage URI, would do, and the manifest it would write,
+// without contacting anything. Only local sources can be planned.
+func Plan(sources []Source, dst string, opts ...Option) ([]PlannedFile, *Manifest, error) {
+	object := func(rel string) string { return strings.TrimSuffix(dst, "/") + "/" + rel }
+	if !IsStorageURI(dst) {
+		bucketName, gcsPath, err := ParseURI(dst)
+		if err != nil {
+			return nil, nil, err
+		}
+		object = func(rel string) string { return "gs://" + path.Join(bucketName, gcsPath, rel) }
+	}
+	o := newOptions(opts)
+	var planned []PlannedFile
+	m := New()
+	sources, err := o.excludeManifest(sources)
+	if err != nil {
+		return nil, nil, err
+	}
+	for _, s := range sources {
+		if isRemote(s.Path) {
+			return nil, nil, fmt.Errorf("can't plan copying %s without contacting GCS", s.Path)
+		}
+		if s.Link != "" {
+			f, err := linkFile(s)
+			if err != nil {
+				return nil, nil, err
+			}
+			m.Add(f.Entry())
+			continue
+		}
+		fi, err := os.Stat(s.Path)
+		if err != nil {
+			return nil, nil, err
+		}
+		d, err := o.digestFile(s)
+		if err != nil {
+			return nil, nil, err
+		}
+		ct, err := detectFileContentType(s.Path)
+		if err != nil {
+			return nil, nil, err
+		}
+		e := Entry{Path: s.RelPath, Digest: d, Size: fi.Size(), ContentType: ct, ModTime: fi.ModTime().UTC(), Mode: o.modeOf(fi)}
+		if name := o.objectFor(s.RelPath); name != s.RelPath {
+			e.Object = name
+		}
+		if o.cas {
+			e.Object = casObject(d)
+		}
+		planned = append(planned, PlannedFile{
+			Source: s.Path,
+			Object: object(e.ObjectName()),
+			Size:   fi.Size(),
+		})
+		m.Add(e)
+	}
+	return planned, m, nil
+}
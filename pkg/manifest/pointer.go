@@ -0,0 +1,95 @@
+package manifest
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io/ioutil"
+	"math/rand"
+	"time"
+
+	"cloud.google.com/go/storage"
+)
+
+// pointerRetries is how many times UpdatePointer tries again after losing
+// a race with another writer.
+const pointerRetries = 8
+
+// UpdatePointer replaces the small mutable object at the gs:// URI uri,
+// such as a channel, with what update returns given its current contents,
+// or nil if it doesn't exist yet. The write is conditional on the object
+// still having the generation and metageneration that were read, or on it
+// still not existing, so that of two concurrent updates only one succeeds
+// at first. The other reads the object again and calls update again, after
+// a randomized backoff, up to pointerRetries times; concurrent controllers
+// so each apply their change on top of the other's, instead of the last
+// to write silently undoing the rest. update may fail to refuse a change
+// it can't make to what it finds. If it returns the current contents, the
+// object isn't written at all. UpdatePointer returns the generation of the
+// object as left. Only the log option applies.
+func UpdatePointer(ctx context.Context, client *storage.Client, uri, contentType string, update func(current []byte) ([]byte, error), opts ...Option) (int64, error) {
+	o := newOptions(opts)
+	bucketName, name, err := ParseURI(uri)
+	if err != nil {
+		return 0, err
+	}
+	obj := client.Bucket(bucketName).Object(name)
+	backoff := 100 * time.Millisecond
+	for attempt := 0; ; attempt++ {
+		current, cond, err := readPointer(ctx, obj)
+		if err != nil {
+			return 0, err
+		}
+		b, err := update(current)
+		if err != nil {
+			return 0, err
+		}
+		if current != nil && bytes.Equal(b, current) {
+			return cond.GenerationMatch, nil
+		}
+		w := obj.If(cond).NewWriter(ctx)
+		w.ContentType = contentType
+		// Pointers are polled, so they mustn't be served stale.
+		w.CacheControl = "no-cache"
+		if _, err := w.Write(b); err != nil {
+			w.Close()
+			return 0, err
+		}
+		err = w.Close()
+		if err == nil {
+			return w.Attrs().Generation, nil
+		}
+		if !isPreconditionFailed(err) {
+			return 0, err
+		}
+		if attempt == pointerRetries {
+			return 0, fmt.Errorf("%s kept changing while being updated; gave up after %d attempts", uri, attempt+1)
+		}
+		wait := backoff/2 + time.Duration(rand.Int63n(int64(backoff)))
+		fmt.Fprintf(o.log, "%s changed while being updated; retrying in %v\n", uri, wait.Round(time.Millisecond))
+		select {
+		case <-time.After(wait):
+		case <-ctx.Done():
+			return 0, ctx.Err()
+		}
+		backoff *= 2
+	}
+}
+
+// readPointer returns the contents of obj, or nil if it doesn't exist, and
+// the conditions under which it is still as read.
+func readPointer(ctx context.Context, obj *storage.ObjectHandle) ([]byte, storage.Conditions, error) {
+	r, err := obj.NewReader(ctx)
+	if err == storage.ErrObjectNotExist {
+		return nil, storage.Conditions{DoesNotExist: true}, nil
+	}
+	if err != nil {
+		return nil, storage.Conditions{}, err
+	}
+	defer r.Close()
+	b, err := ioutil.ReadAll(r)
+	if err != nil {
+		return nil, storage.Conditions{}, err
+	}
+	return b, storage.Conditions{GenerationMatch: r.Attrs.Generation, MetagenerationMatch: r.Attrs.Metageneration}, nil
+}
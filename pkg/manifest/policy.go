@@ -0,0 +1,108 @@
+package manifest
+
+import (
+	"crypto"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"time"
+)
+
+// Policy is a verification policy file, telling download and verify which
+// manifests to accept:
+//
+//	{
+//	  "keys": ["keys/release.pem"],
+//	  "fingerprints": ["sha256:9f86d0..."],
+//	  "maxAge": "24h"
+//	}
+type Policy struct {
+	// Keys are PEM public key files, relative to the policy file, any of
+	// which may have signed the manifest.
+	Keys []string `json:"keys"`
+	// Fingerprints, if set, pin Keys: every key must have one of these
+	// KeyFingerprints, so a swapped key file is caught.
+	Fingerprints []string `json:"fingerprints,omitempty"`
+	// MaxAge is the oldest a manifest may be, as a Go duration.
+	MaxAge string `json:"maxAge,omitempty"`
+
+	// Identities and Attestations are recognised only to reject them:
+	// keyless identities and attestations aren't supported, and a policy
+	// asking for them must not pass silently.
+	Identities   []json.RawMessage `json:"identities,omitempty"`
+	Attestations []string          `json:"attestations,omitempty"`
+
+	dir string
+}
+
+// LoadPolicy reads a policy file.
+func LoadPolicy(path string) (*Policy, error) {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	p := &Policy{dir: filepath.Dir(path)}
+	if err := json.Unmarshal(b, p); err != nil {
+		return nil, fmt.Errorf("parsing %s: %v", path, err)
+	}
+	return p, nil
+}
+
+// Options returns the Downloader or Verifier options enforcing p.
+func (p *Policy) Options() ([]Option, error) {
+	if len(p.Identities) > 0 {
+		return nil, fmt.Errorf("policy requires signer identities, but keyless signatures aren't supported")
+	}
+	if len(p.Attestations) > 0 {
+		return nil, fmt.Errorf("policy requires attestations, but they aren't supported")
+	}
+	pinned := map[string]bool{}
+	for _, f := range p.Fingerprints {
+		pinned[f] = true
+	}
+
+	var opts []Option
+	for _, k := range p.Keys {
+		if !filepath.IsAbs(k) {
+			k = filepath.Join(p.dir, k)
+		}
+		pub, err := LoadPublicKey(k)
+		if err != nil {
+			return nil, err
+		}
+		fp, err := KeyFingerprint(pub)
+		if err != nil {
+			return nil, err
+		}
+		if len(pinned) > 0 && !pinned[fp] {
+			return nil, fmt.Errorf("key %s has fingerprint %s, which the policy doesn't list", k, fp)
+		}
+		opts = append(opts, WithPublicKey(pub))
+	}
+	if len(p.Fingerprints) > 0 && len(p.Keys) == 0 {
+		return nil, fmt.Errorf("policy lists fingerprints but no keys to check signatures with")
+	}
+	if p.MaxAge != "" {
+		d, err := time.ParseDuration(p.MaxAge)
+		if err != nil {
+			return nil, fmt.Errorf("policy maxAge: %v", err)
+		}
+		opts = append(opts, WithMaxAge(d))
+	}
+	return opts, nil
+}
+
+// KeyFingerprint returns "sha256:" and the hex sha256 of pub's DER PKIX
+// encoding.
+func KeyFingerprint(pub crypto.PublicKey) (string, error) {
+	der, err := x509.MarshalPKIXPublicKey(pub)
+	if err != nil {
+		return "", err
+	}
+	sum := sha256.Sum256(der)
+	return "sha256:" + hex.EncodeToString(sum[:]), nil
+}
@@ -0,0 +1,224 @@
+package manifest
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"sort"
+	"sync"
+)
+
+// DefaultReadAhead is how many bytes of small objects a download buffers in
+// memory unless WithReadAhead says otherwise.
+const DefaultReadAhead = 32 << 20
+
+const (
+	// tinyObject is the largest object a download fetches in a batch
+	// rather than on its own.
+	tinyObject = 256 << 10
+	// maxBatch caps the objects in a batch, and so the requests a batch
+	// has in flight at once.
+	maxBatch = 32
+)
+
+// schedule splits the paths of m's files, other than symlinks, into the
+// jobs a download hands to its workers, in the order they should start.
+// Objects other than tiny ones come first, largest first, so that the
+// slowest transfers start early rather than last. Tiny objects follow in
+// batches of up to batchBytes, in path order, and fill the workers left
+// over as the large ones finish.
+func schedule(m *Manifest, batchBytes int64) [][]string {
+	var (
+		large, tiny []string
+		jobs        [][]string
+	)
+	for _, p := range m.Paths() {
+		if m.Files[p].Link != "" {
+			continue
+		}
+		if size := m.Files[p].Size; size <= tinyObject && size <= batchBytes {
+			tiny = append(tiny, p)
+		} else {
+			large = append(large, p)
+		}
+	}
+	sort.SliceStable(large, func(i, j int) bool { return m.Files[large[i]].Size > m.Files[large[j]].Size })
+	for _, p := range large {
+		jobs = append(jobs, []string{p})
+	}
+	var (
+		batch []string
+		size  int64
+	)
+	for _, p := range tiny {
+		if len(batch) > 0 && (len(batch) == maxBatch || size+m.Files[p].Size > batchBytes) {
+			jobs = append(jobs, batch)
+			batch, size = nil, 0
+		}
+		batch = append(batch, p)
+		size += m.Files[p].Size
+	}
+	if len(batch) > 0 {
+		jobs = append(jobs, batch)
+	}
+	return jobs
+}
+
+// download fetches every file in m into the local directory dst, opening
+// each object with open. Up to the parallelism option's worth of jobs, as
+// laid out by schedule, run at once. A job of one object streams it to
+// disk; a batch of tiny objects reads them all into memory at once, so the
+// time to their first bytes overlaps, and then writes them out. Each
+// worker's batches are capped at its share of the read-ahead budget.
+// Symlinks are created once every file is in place, and files get the
+// mode their entry records. A partial manifest's files are downloaded, but
+// the result is still a *DownloadError. open must return objects as
+// stored, without decompressing them.
+func (o *options) download(ctx context.Context, m *Manifest, dst string, open func(context.Context, Entry) (io.ReadCloser, error)) error {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	// Check every path first so nothing is fetched for a manifest that
+	// would write outside dst.
+	dests := map[string]string{}
+	for _, p := range m.Paths() {
+		var err error
+		if dests[p], err = LocalPath(dst, p); err != nil {
+			return err
+		}
+	}
+
+	todo := m
+	if o.resume {
+		todo = o.remaining(m, dests)
+		fmt.Fprintf(o.log, "%d files already downloaded, %d to go\n", len(m.Files)-len(todo.Files), len(todo.Files))
+	}
+
+	var (
+		mu     sync.Mutex
+		wg     sync.WaitGroup
+		failed []Failure
+	)
+	fail := func(p string, err error) {
+		fmt.Fprintf(o.log, "FAILED: %s: %v\n", p, err)
+		mu.Lock()
+		failed = append(failed, Failure{Path: p, Err: err})
+		mu.Unlock()
+	}
+	// write saves the file at p from r, its object as stored, with the
+	// mode its entry records.
+	write := func(p string, r io.Reader) error {
+		perm, err := m.Files[p].perm()
+		if err != nil {
+			return err
+		}
+		r, want, err := o.decode(m.Files[p], r)
+		if err != nil {
+			return err
+		}
+		return downloadTo(r, want, dests[p], perm)
+	}
+	jobs := make(chan []string)
+	for i := 0; i < o.parallelism; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for job := range jobs {
+				if len(job) == 1 {
+					p := job[0]
+					fmt.Fprintln(o.log, "Downloading:", p)
+					r, err := open(ctx, m.Files[p])
+					if err == nil {
+						err = write(p, r)
+						r.Close()
+					}
+					if err != nil {
+						fail(p, err)
+					}
+					continue
+				}
+				bufs := make([][]byte, len(job))
+				errs := make([]error, len(job))
+				var batch sync.WaitGroup
+				for i, p := range job {
+					batch.Add(1)
+					go func(i int, e Entry) {
+						defer batch.Done()
+						r, err := open(ctx, e)
+						if err != nil {
+							errs[i] = err
+							return
+						}
+						defer r.Close()
+						bufs[i], errs[i] = ioutil.ReadAll(r)
+					}(i, m.Files[p])
+				}
+				batch.Wait()
+				for i, p := range job {
+					fmt.Fprintln(o.log, "Downloading:", p)
+					err := errs[i]
+					if err == nil {
+						err = write(p, bytes.NewReader(bufs[i]))
+					}
+					if err != nil {
+						fail(p, err)
+					}
+				}
+			}
+		}()
+	}
+	for _, job := range schedule(todo, o.readAhead/int64(o.parallelism)) {
+		select {
+		case jobs <- job:
+		case <-ctx.Done():
+		}
+	}
+	close(jobs)
+	wg.Wait()
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	for _, p := range m.Paths() {
+		if e := m.Files[p]; e.Link != "" {
+			fmt.Fprintln(o.log, "Linking:", p)
+			if err := restoreLink(p, e.Link, dests[p]); err != nil {
+				fail(p, err)
+			}
+		}
+	}
+	if len(failed) > 0 || m.Partial() {
+		sort.Slice(failed, func(i, j int) bool { return failed[i].Path < failed[j].Path })
+		return &DownloadError{Failed: failed, Total: len(m.Files), Missing: m.Missing}
+	}
+	return nil
+}
+
+// remaining returns m without the files already at their destinations in
+// dests, as a download that was interrupted left them.
+func (o *options) remaining(m *Manifest, dests map[string]string) *Manifest {
+	todo := &Manifest{Files: map[string]Entry{}, Missing: m.Missing}
+	for p, e := range m.Files {
+		if e.Link != "" || !o.downloaded(e, dests[p]) {
+			todo.Files[p] = e
+		}
+	}
+	return todo
+}
+
+// downloaded reports whether dest already holds the file e describes.
+func (o *options) downloaded(e Entry, dest string) bool {
+	want := e.Digest
+	if e.ContentEncoding != "" && o.keepEncoding {
+		want = e.StoredDigest
+	}
+	f, err := os.Open(dest)
+	if err != nil {
+		return false
+	}
+	defer f.Close()
+	got, err := Digest(f)
+	return err == nil && got == want
+}
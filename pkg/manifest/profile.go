@@ -0,0 +1,106 @@
+package manifest
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// BucketEnv names the environment variable holding the bucket that gs://
+// URIs written without one, such as gs:///releases/v1, refer to.
+const BucketEnv = "GCS_MANIFEST_BUCKET"
+
+// Profile is a named set of credentials, project and default bucket to
+// work with, like a gcloud configuration, so that switching between
+// environments is a matter of naming one. Each is stored as JSON in
+// ProfileDir, as <name>.json.
+type Profile struct {
+	// Credentials is the service account key file to authenticate with.
+	// A relative path is relative to ProfileDir.
+	Credentials string `json:"credentials,omitempty"`
+	Project     string `json:"project,omitempty"`
+	// Bucket is what gs:// URIs without a bucket refer to.
+	Bucket string `json:"bucket,omitempty"`
+}
+
+// ProfileDir returns the directory profiles are stored in, under the
+// user's config directory.
+func ProfileDir() (string, error) {
+	dir, err := os.UserConfigDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(dir, "gcs-manifest", "profiles"), nil
+}
+
+// LoadProfile reads the profile called name from ProfileDir.
+func LoadProfile(name string) (*Profile, error) {
+	if name == "" || strings.ContainsAny(name, `/\`) || strings.HasPrefix(name, ".") {
+		return nil, fmt.Errorf("invalid profile name %q", name)
+	}
+	dir, err := ProfileDir()
+	if err != nil {
+		return nil, err
+	}
+	b, err := ioutil.ReadFile(filepath.Join(dir, name+".json"))
+	if os.IsNotExist(err) {
+		return nil, fmt.Errorf("no profile %q in %s", name, dir)
+	}
+	if err != nil {
+		return nil, err
+	}
+	var p Profile
+	if err := json.Unmarshal(b, &p); err != nil {
+		return nil, fmt.Errorf("profile %q: %v", name, err)
+	}
+	if p.Credentials != "" && !filepath.IsAbs(p.Credentials) {
+		p.Credentials = filepath.Join(dir, p.Credentials)
+	}
+	return &p, nil
+}
+
+// Apply makes p the environment everything after it in this process works
+// in, through the variables default credentials, project lookups and
+// ParseURI read: GOOGLE_APPLICATION_CREDENTIALS, GOOGLE_CLOUD_PROJECT and
+// BucketEnv. Settings p leaves empty keep their current value.
+func (p *Profile) Apply() error {
+	for k, v := range map[string]string{
+		"GOOGLE_APPLICATION_CREDENTIALS": p.Credentials,
+		"GOOGLE_CLOUD_PROJECT":           p.Project,
+		BucketEnv:                        p.Bucket,
+	} {
+		if v == "" {
+			continue
+		}
+		if err := os.Setenv(k, v); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// UseProfile loads the profile called name and applies it.
+func UseProfile(name string) error {
+	p, err := LoadProfile(name)
+	if err != nil {
+		return err
+	}
+	return p.Apply()
+}
+
+// ProfileFlag defines a --profile flag on fs and returns a func that, once
+// fs has been parsed, applies the profile it names, if any, so that every
+// command takes one the same way.
+func ProfileFlag(fs *flag.FlagSet) func() error {
+	name := fs.String("profile", "", "profile whose credentials, project and default bucket to use, from gcs-manifest/profiles/<name>.json in the user config dir")
+	return func() error {
+		if *name == "" {
+			return nil
+		}
+		return UseProfile(*name)
+	}
+}
@@ -0,0 +1,189 @@
+package manifest
+
+import (
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// progressInterval is how often a progress func is called during an
+// upload.
+const progressInterval = time.Second
+
+// Progress is a snapshot of an upload, as passed to a WithProgress func.
+type Progress struct {
+	// TotalFiles and TotalBytes are what the run set out to upload. Bytes
+	// of gs:// sources aren't known up front and aren't counted.
+	TotalFiles int
+	TotalBytes int64
+	// Files and Bytes are what has been uploaded so far, including the
+	// bytes of files still in flight.
+	Files  int
+	Bytes  int64
+	Failed int
+	// Elapsed is the time since the upload started.
+	Elapsed time.Duration
+	// Done is set on the last call, once every file has finished.
+	Done bool
+}
+
+// Rate returns the average upload rate so far in bytes per second.
+func (p Progress) Rate() float64 {
+	if p.Elapsed <= 0 {
+		return 0
+	}
+	return float64(p.Bytes) / p.Elapsed.Seconds()
+}
+
+// ETA estimates the time left from the average rate so far, or returns 0
+// if nothing has been uploaded yet.
+func (p Progress) ETA() time.Duration {
+	rate := p.Rate()
+	if rate == 0 || p.Bytes >= p.TotalBytes {
+		return 0
+	}
+	return time.Duration(float64(p.TotalBytes-p.Bytes) / rate * float64(time.Second))
+}
+
+// tracker accumulates progress for a run. A nil tracker does nothing, so
+// callers needn't check whether progress was asked for.
+type tracker struct {
+	report func(Progress)
+	start  time.Time
+	// bytes is updated by writers on every chunk, so it is atomic; the
+	// rest is guarded by mu.
+	bytes int64
+	mu    sync.Mutex
+	p     Progress
+	stop  chan struct{}
+	wg    sync.WaitGroup
+}
+
+// startTracker begins reporting progress for sources, if a progress func
+// was given. Under WithDeadline sources are tracked without one too, to
+// budget the run by.
+func (o *options) startTracker(sources []Source) *tracker {
+	if o.progress == nil && o.deadline.IsZero() {
+		return nil
+	}
+	t := &tracker{report: o.progress, start: time.Now(), stop: make(chan struct{})}
+	t.p.TotalFiles = len(sources)
+	for _, s := range sources {
+		if isRemote(s.Path) || s.Link != "" {
+			continue
+		}
+		if fi, err := os.Stat(s.Path); err == nil {
+			t.p.TotalBytes += fi.Size()
+		}
+	}
+	if t.report == nil {
+		return t
+	}
+	t.wg.Add(1)
+	go func() {
+		defer t.wg.Done()
+		tick := time.NewTicker(progressInterval)
+		defer tick.Stop()
+		for {
+			select {
+			case <-tick.C:
+				t.report(t.snapshot())
+			case <-t.stop:
+				return
+			}
+		}
+	}()
+	return t
+}
+
+func (t *tracker) snapshot() Progress {
+	t.mu.Lock()
+	p := t.p
+	t.mu.Unlock()
+	p.Bytes = atomic.LoadInt64(&t.bytes)
+	p.Elapsed = time.Since(t.start)
+	return p
+}
+
+// Write counts bytes as they are uploaded; it never fails.
+func (t *tracker) Write(b []byte) (int, error) {
+	if t != nil {
+		atomic.AddInt64(&t.bytes, int64(len(b)))
+	}
+	return len(b), nil
+}
+
+// attempt returns a writer that counts one upload attempt's bytes, so
+// that they can be taken back if it fails.
+func (t *tracker) attempt() *attempt {
+	return &attempt{t: t}
+}
+
+type attempt struct {
+	t *tracker
+	n int64
+}
+
+func (a *attempt) Write(b []byte) (int, error) {
+	a.n += int64(len(b))
+	return a.t.Write(b)
+}
+
+func (a *attempt) undo() {
+	if a.t != nil {
+		atomic.AddInt64(&a.t.bytes, -a.n)
+	}
+}
+
+// uploaded counts f as done. Copies of gs:// sources happen server-side,
+// so their bytes are only counted, in both totals, once they finish.
+func (t *tracker) uploaded(f File) {
+	if t == nil {
+		return
+	}
+	t.mu.Lock()
+	t.p.Files++
+	if isRemote(f.Source) {
+		t.p.TotalBytes += f.Size
+		atomic.AddInt64(&t.bytes, f.Size)
+	}
+	t.mu.Unlock()
+}
+
+func (t *tracker) failed() {
+	if t == nil {
+		return
+	}
+	t.mu.Lock()
+	t.p.Failed++
+	t.mu.Unlock()
+}
+
+// retried moves a file counted as failed back, before it is tried again.
+func (t *tracker) retried() {
+	if t == nil {
+		return
+	}
+	t.mu.Lock()
+	t.p.Failed--
+	t.mu.Unlock()
+}
+
+// reporting reports whether progress is being reported, in place of
+// logging each file.
+func (t *tracker) reporting() bool {
+	return t != nil && t.report != nil
+}
+
+// close stops the periodic reports and makes the final one.
+func (t *tracker) close() {
+	if !t.reporting() {
+		return
+	}
+	close(t.stop)
+	t.wg.Wait()
+	p := t.snapshot()
+	p.Done = true
+	t.report(p)
+}
@@ -0,0 +1,125 @@
+package manifest
+
+import (
+	"fmt"
+
+	"github.com/dlorenc/gcs-manifest/pkg/manifest/manifestpb"
+	"github.com/golang/protobuf/ptypes"
+	"google.golang.org/protobuf/proto"
+)
+
+// Proto returns m in its protobuf form, which holds exactly what its JSON
+// form does, in the same order.
+func (m *Manifest) Proto() (*manifestpb.Manifest, error) {
+	doc := m.document()
+	pb := &manifestpb.Manifest{SchemaVersion: uint32(doc.SchemaVersion), Missing: doc.Missing}
+	for _, e := range doc.Files {
+		pe := &manifestpb.Entry{
+			Path:            e.Path,
+			Digest:          e.Digest,
+			Size:            e.Size,
+			ContentType:     e.ContentType,
+			Crc32C:          e.CRC32C,
+			ContentEncoding: e.ContentEncoding,
+			StoredSize:      e.StoredSize,
+			StoredDigest:    e.StoredDigest,
+			Object:          e.Object,
+			Mode:            e.Mode,
+			Link:            e.Link,
+		}
+		if !e.ModTime.IsZero() {
+			ts, err := ptypes.TimestampProto(e.ModTime)
+			if err != nil {
+				return nil, fmt.Errorf("manifest entry for %s: %v", e.Path, err)
+			}
+			pe.ModTime = ts
+		}
+		if e.Expires != nil {
+			ts, err := ptypes.TimestampProto(*e.Expires)
+			if err != nil {
+				return nil, fmt.Errorf("manifest entry for %s: %v", e.Path, err)
+			}
+			pe.Expires = ts
+		}
+		if e.Encryption != nil {
+			pe.Encryption = &manifestpb.Encryption{KmsKey: e.Encryption.KMSKey, CustomerKeySha256: e.Encryption.CustomerKeySHA256}
+		}
+		for _, p := range e.Parts {
+			pe.Parts = append(pe.Parts, &manifestpb.Part{Size: p.Size, Crc32C: p.CRC32C, Digest: p.Digest})
+		}
+		pb.Files = append(pb.Files, pe)
+	}
+	return pb, nil
+}
+
+// FromProto returns the manifest pb holds, checked as Parse checks a JSON
+// one.
+func FromProto(pb *manifestpb.Manifest) (*Manifest, error) {
+	doc := document{SchemaVersion: int(pb.GetSchemaVersion()), Missing: pb.GetMissing()}
+	for _, pe := range pb.GetFiles() {
+		e := Entry{
+			Path:            pe.GetPath(),
+			Digest:          pe.GetDigest(),
+			Size:            pe.GetSize(),
+			ContentType:     pe.GetContentType(),
+			CRC32C:          pe.GetCrc32C(),
+			ContentEncoding: pe.GetContentEncoding(),
+			StoredSize:      pe.GetStoredSize(),
+			StoredDigest:    pe.GetStoredDigest(),
+			Object:          pe.GetObject(),
+			Mode:            pe.GetMode(),
+			Link:            pe.GetLink(),
+		}
+		if pe.ModTime != nil {
+			t, err := ptypes.Timestamp(pe.ModTime)
+			if err != nil {
+				return nil, fmt.Errorf("manifest entry for %s: %v", e.Path, err)
+			}
+			e.ModTime = t
+		}
+		if pe.Expires != nil {
+			t, err := ptypes.Timestamp(pe.Expires)
+			if err != nil {
+				return nil, fmt.Errorf("manifest entry for %s: %v", e.Path, err)
+			}
+			e.Expires = &t
+		}
+		if enc := pe.GetEncryption(); enc != nil {
+			e.Encryption = &Encryption{KMSKey: enc.GetKmsKey(), CustomerKeySHA256: enc.GetCustomerKeySha256()}
+		}
+		for _, p := range pe.GetParts() {
+			e.Parts = append(e.Parts, Part{Size: p.GetSize(), CRC32C: p.GetCrc32C(), Digest: p.GetDigest()})
+		}
+		doc.Files = append(doc.Files, e)
+	}
+	m := New()
+	if err := m.setDocument(doc); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+// MarshalBinary encodes m in its protobuf form. It also makes encoding/gob
+// use that form for manifests.
+func (m *Manifest) MarshalBinary() ([]byte, error) {
+	pb, err := m.Proto()
+	if err != nil {
+		return nil, err
+	}
+	return proto.Marshal(pb)
+}
+
+// UnmarshalBinary decodes a manifest in its protobuf form, as MarshalBinary
+// encodes it.
+func (m *Manifest) UnmarshalBinary(b []byte) error {
+	var pb manifestpb.Manifest
+	if err := proto.Unmarshal(b, &pb); err != nil {
+		return err
+	}
+	got, err := FromProto(&pb)
+	if err != nil {
+		return err
+	}
+	*m = *got
+	return nil
+}
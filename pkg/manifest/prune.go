@@ -0,0 +1,127 @@
+package manifest
+
+import (
+	"context"
+	"fmt"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"cloud.google.com/go/storage"
+	"google.golang.org/api/iterator"
+)
+
+// StaleObject is an object under a destination that its manifest doesn't
+// reference.
+type StaleObject struct {
+	Path string
+	Size int64
+	// Generation is the generation listed, so that Prune leaves the object
+	// alone if it has been overwritten since.
+	Generation int64
+	// Created is when that generation was written.
+	Created time.Time
+}
+
+// Recent reports whether s was written less than window before now, so
+// recently that it may belong to a publish whose manifest isn't visible
+// yet.
+func (s StaleObject) Recent(window time.Duration, now time.Time) bool {
+	return now.Sub(s.Created) < window
+}
+
+// Stale lists the objects under the gs:// prefix dst that m doesn't
+// reference, sorted by path. The manifest and its signature, and directory
+// placeholders, are never stale.
+func Stale(ctx context.Context, client *storage.Client, dst string, m *Manifest) ([]StaleObject, error) {
+	bucketName, prefix := ParsePrefix(dst)
+	if prefix != "" && !strings.HasSuffix(prefix, "/") {
+		prefix += "/"
+	}
+	objects := m.objects()
+	var stale []StaleObject
+	it := client.Bucket(bucketName).Objects(ctx, &storage.Query{Prefix: prefix})
+	for {
+		attrs, err := it.Next()
+		if err == iterator.Done {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("listing %s: %v", dst, err)
+		}
+		name := strings.TrimPrefix(attrs.Name, prefix)
+		if objects[name] || !isData(name) {
+			continue
+		}
+		stale = append(stale, StaleObject{Path: name, Size: attrs.Size, Generation: attrs.Generation, Created: attrs.Created})
+	}
+	sort.Slice(stale, func(i, j int) bool { return stale[i].Path < stale[j].Path })
+	return stale, nil
+}
+
+// isData reports whether the object name under a destination could be a
+// data file, as opposed to the manifest, its signature or bundle, or a
+// directory placeholder.
+func isData(name string) bool {
+	return !isManifestFile(name) && name != "" && !strings.HasSuffix(name, "/")
+}
+
+// Prune deletes the stale objects from under the gs:// prefix dst, as
+// listed by Stale, and returns those it couldn't delete. An object that has
+// been overwritten since it was listed is kept and reported as a failure:
+// it may belong to a run whose manifest isn't published yet. For the same
+// reason, objects written within the WithSafetyWindow window are skipped.
+// Deletions are paced by WithMaxRequestRate. Only those and the log and
+// parallelism options apply.
+func Prune(ctx context.Context, client *storage.Client, dst string, stale []StaleObject, opts ...Option) []Failure {
+	o := newOptions(opts)
+	now := time.Now()
+	bucketName, prefix := ParsePrefix(dst)
+	bucket := client.Bucket(bucketName)
+
+	jobs := make(chan StaleObject)
+	var (
+		mu     sync.Mutex
+		wg     sync.WaitGroup
+		failed []Failure
+	)
+	for i := 0; i < o.parallelism; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for s := range jobs {
+				if s.Recent(o.safetyWindow, now) {
+					fmt.Fprintln(o.log, "Keeping recent:", s.Path)
+					continue
+				}
+				obj := bucket.Object(path.Join(prefix, s.Path)).If(storage.Conditions{GenerationMatch: s.Generation})
+				err := o.pace(ctx)
+				if err == nil {
+					err = obj.Delete(ctx)
+				}
+				switch {
+				case err == nil:
+					fmt.Fprintln(o.log, "Deleted:", s.Path)
+					continue
+				case err == storage.ErrObjectNotExist:
+					// Deleted by someone else already.
+					continue
+				case isPreconditionFailed(err):
+					err = fmt.Errorf("overwritten since it was listed; not deleted")
+				}
+				mu.Lock()
+				failed = append(failed, Failure{Path: s.Path, Err: err})
+				mu.Unlock()
+			}
+		}()
+	}
+	for _, s := range stale {
+		jobs <- s
+	}
+	close(jobs)
+	wg.Wait()
+	sort.Slice(failed, func(i, j int) bool { return failed[i].Path < failed[j].Path })
+	return failed
+}
@@ -0,0 +1,128 @@
+package manifest
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"strings"
+
+	"cloud.google.com/go/storage"
+	"google.golang.org/api/iterator"
+)
+
+func isRemote(p string) bool {
+	return strings.HasPrefix(p, "gs://")
+}
+
+// Expand is like the package-level Expand, but src may also be a gs://
+// prefix, in which case every object under it becomes a source recorded
+// relative to the prefix.
+func (u *Uploader) Expand(ctx context.Context, src string) ([]Source, error) {
+	if !isRemote(src) {
+		return u.expand(src)
+	}
+	bucketName, prefix := ParsePrefix(src)
+	if prefix != "" && !strings.HasSuffix(prefix, "/") {
+		prefix += "/"
+	}
+	var sources []Source
+	it := u.client.Bucket(bucketName).Objects(ctx, &storage.Query{Prefix: prefix})
+	for {
+		attrs, err := it.Next()
+		if err == iterator.Done {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("listing %s: %v", src, err)
+		}
+		rel := strings.TrimPrefix(attrs.Name, prefix)
+		if rel == "" || strings.HasSuffix(rel, "/") {
+			// Zero-byte placeholders the console creates for "folders".
+			continue
+		}
+		if u.maxFiles > 0 && len(sources) == u.maxFiles {
+			return nil, fmt.Errorf("more than %d objects found under %s; raise the max file count if this is intended", u.maxFiles, src)
+		}
+		sources = append(sources, Source{Path: "gs://" + bucketName + "/" + attrs.Name, RelPath: rel})
+	}
+	if len(sources) == 0 {
+		return nil, fmt.Errorf("no objects under %s", src)
+	}
+	return sources, nil
+}
+
+// copyObject records the gs:// object s in the manifest as dstObj. Its
+// sha256 is computed by streaming it, and it is then copied server-side,
+// pinned to the generation that was hashed, so the data never goes through
+// this machine twice. If dstObj is the source object itself, it is only
+// hashed.
+func (u *Uploader) copyObject(ctx context.Context, s Source, dstObj *storage.ObjectHandle) (File, error) {
+	bucketName, name, err := ParseURI(s.Path)
+	if err != nil {
+		return File{}, err
+	}
+	srcObj := u.client.Bucket(bucketName).Object(name)
+	if err := u.pace(ctx); err != nil {
+		return File{}, err
+	}
+	attrs, err := srcObj.Attrs(ctx)
+	if err != nil {
+		return File{}, err
+	}
+	srcObj = srcObj.Generation(attrs.Generation)
+
+	if err := u.pace(ctx); err != nil {
+		return File{}, err
+	}
+	r, err := srcObj.NewReader(ctx)
+	if err != nil {
+		return File{}, err
+	}
+	// An object stored compressed is read decompressed, so count what is
+	// read to get the original size.
+	read := &countingWriter{}
+	digest, err := Digest(io.TeeReader(r, read))
+	r.Close()
+	if err != nil {
+		return File{}, err
+	}
+
+	// The copy is encrypted as asked, or else takes the destination
+	// bucket's default encryption, so its attributes are the ones to
+	// record.
+	stored := attrs
+	if dstObj.BucketName() != bucketName || dstObj.ObjectName() != name {
+		if u.cacheControl != "" || len(u.metadata) > 0 || u.storageClass != "" {
+			u.warn(WarnMetadata, s.Path, "copied object keeps its own Cache-Control, metadata and storage class")
+		}
+		c := u.encrypted(dstObj).CopierFrom(srcObj)
+		c.DestinationKMSKeyName = u.kmsKey
+		if err := u.pace(ctx); err != nil {
+			return File{}, err
+		}
+		copied, err := c.Run(ctx)
+		if err != nil {
+			return File{}, err
+		}
+		stored = copied
+	} else if want := u.wantEncryption(); want != nil && checkEncryption(want, attrs) != nil {
+		u.warn(WarnMetadata, s.Path, "object recorded in place keeps its own encryption")
+	}
+	f := File{
+		Path:        s.RelPath,
+		Source:      s.Path,
+		Digest:      digest,
+		Size:        attrs.Size,
+		ContentType: attrs.ContentType,
+		CRC32C:      FormatCRC32C(attrs.CRC32C),
+		ModTime:     attrs.Updated.UTC(),
+		Generation:  stored.Generation,
+		Encryption:  encryptionOf(stored),
+	}
+	if attrs.ContentEncoding != "" {
+		f.Size = read.n
+		f.ContentEncoding = attrs.ContentEncoding
+		f.StoredSize = attrs.Size
+	}
+	return f, nil
+}
@@ -0,0 +1,180 @@
+package manifest
+
+import (
+	"context"
+	"fmt"
+	"path"
+	"sync"
+
+	"cloud.google.com/go/storage"
+)
+
+// replicaSet is where a run under WithReplicas copies each object it
+// stores under its destination, and how many of those places, the
+// destination included, must have a file before it is recorded.
+type replicaSet struct {
+	paths  []string
+	quorum int
+}
+
+// check returns an error if r, with the other options in o, can't be
+// written to. A nil replicaSet is fine.
+func (r *replicaSet) check(o *options) error {
+	if r == nil {
+		return nil
+	}
+	if len(r.paths) == 0 || r.quorum < 1 || r.quorum > len(r.paths)+1 {
+		return fmt.Errorf("a quorum of %d can't be met with %d replicas", r.quorum, len(r.paths))
+	}
+	if o.cas || len(o.routes) > 0 {
+		return fmt.Errorf("replicas aren't supported with the content-addressed layout or routes")
+	}
+	for _, p := range r.paths {
+		if IsStorageURI(p) {
+			return fmt.Errorf("replica %s: replicas must be gs:// paths", p)
+		}
+		if _, _, err := ParseURI(p); err != nil {
+			return fmt.Errorf("replica %s: %v", p, err)
+		}
+	}
+	return nil
+}
+
+// replicate copies the object of every file in files, as stored under the
+// gs:// path gcsPath of bucket, to each WithReplicas replica, at most
+// u.parallelism at a time. It returns the files that didn't reach the
+// quorum of destinations, the original one counting as one, as failures,
+// and, for each replica, the paths it now has. A replica that already has
+// an object with the same size and CRC32C isn't copied to again, so
+// repeating a run costs no more copies than resuming it. Symlinks have no
+// object and count as stored everywhere.
+func (u *Uploader) replicate(ctx context.Context, files []File, gcsPath string, bucket *storage.BucketHandle) ([]Failure, []map[string]bool) {
+	has := make([]map[string]bool, len(u.replicas.paths))
+	for i := range has {
+		has[i] = map[string]bool{}
+	}
+	var (
+		mu     sync.Mutex
+		failed []Failure
+	)
+	jobs := make(chan File)
+	var wg sync.WaitGroup
+	for i := 0; i < u.parallelism; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for f := range jobs {
+				stored := make([]bool, len(u.replicas.paths))
+				n := 1
+				var errs []error
+				for i, dst := range u.replicas.paths {
+					if f.Link == "" {
+						if err := u.copyToReplica(ctx, f, bucket.Object(path.Join(gcsPath, f.Entry().ObjectName())), dst); err != nil {
+							errs = append(errs, fmt.Errorf("%s: %v", dst, err))
+							continue
+						}
+					}
+					stored[i] = true
+					n++
+				}
+				mu.Lock()
+				for i, ok := range stored {
+					if ok {
+						has[i][f.Path] = true
+					}
+				}
+				if n >= u.replicas.quorum {
+					for _, err := range errs {
+						u.warn(WarnReplica, f.Path, fmt.Sprintf("not replicated to %v", err))
+					}
+				} else {
+					err := fmt.Errorf("stored in %d of %d destinations, %d needed: %v", n, len(u.replicas.paths)+1, u.replicas.quorum, errs)
+					failed = append(failed, Failure{Path: f.Path, Source: f.Source, Link: f.Link, Err: err})
+				}
+				mu.Unlock()
+			}
+		}()
+	}
+	for _, f := range files {
+		if ctx.Err() != nil {
+			mu.Lock()
+			failed = append(failed, Failure{Path: f.Path, Source: f.Source, Link: f.Link, Err: ctx.Err()})
+			mu.Unlock()
+			continue
+		}
+		jobs <- f
+	}
+	close(jobs)
+	wg.Wait()
+	return failed, has
+}
+
+// copyToReplica copies src, the object of f, to the same place under the
+// gs:// path dst, unless a copy is already there, and checks the copy's
+// size and CRC32C against f's.
+func (u *Uploader) copyToReplica(ctx context.Context, f File, src *storage.ObjectHandle, dst string) error {
+	bucketName, gcsPath, err := ParseURI(dst)
+	if err != nil {
+		return err
+	}
+	obj := u.encrypted(u.client.Bucket(bucketName).Object(path.Join(gcsPath, f.Entry().ObjectName())))
+	size := f.Size
+	if f.ContentEncoding != "" {
+		size = f.StoredSize
+	}
+	if err := u.pace(ctx); err != nil {
+		return err
+	}
+	if attrs, err := obj.Attrs(ctx); err == nil && attrs.Size == size && FormatCRC32C(attrs.CRC32C) == f.CRC32C {
+		return nil
+	}
+
+	return u.retry(ctx, u.retries, "replicating "+f.Path+" to "+dst, func() error {
+		if err := u.pace(ctx); err != nil {
+			return err
+		}
+		c := obj.CopierFrom(u.encrypted(src.Generation(f.Generation)))
+		c.DestinationKMSKeyName = u.kmsKey
+		attrs, err := c.Run(ctx)
+		if err != nil {
+			return err
+		}
+		if attrs.Size != size || FormatCRC32C(attrs.CRC32C) != f.CRC32C {
+			return fmt.Errorf("copy has size %d and crc32c %s, want %d and %s", attrs.Size, FormatCRC32C(attrs.CRC32C), size, f.CRC32C)
+		}
+		return nil
+	})
+}
+
+// writeReplicaManifests publishes m to each replica, once it has been
+// published to the destination; has is what replicate says each replica
+// has. A replica that is missing any of m's files gets a partial manifest
+// listing them instead. It fails unless complete manifests reached the
+// quorum of destinations.
+func (u *Uploader) writeReplicaManifests(ctx context.Context, m *Manifest, has []map[string]bool) error {
+	published := 1
+	for i, dst := range u.replicas.paths {
+		rm := New()
+		rm.Missing = append([]string(nil), m.Missing...)
+		for _, p := range m.Paths() {
+			if !has[i][p] {
+				rm.Missing = append(rm.Missing, p)
+				continue
+			}
+			rm.Add(m.Files[p])
+		}
+		if err := u.WriteManifest(ctx, dst, Name, rm); err != nil {
+			u.warn(WarnReplica, dst, fmt.Sprintf("manifest not written: %v", err))
+			continue
+		}
+		if len(rm.Missing) > len(m.Missing) {
+			u.warn(WarnReplica, dst, fmt.Sprintf("wrote a partial manifest, missing %d files", len(rm.Missing)-len(m.Missing)))
+			continue
+		}
+		published++
+	}
+	if published < u.replicas.quorum {
+		return fmt.Errorf("the manifest is complete in %d of %d destinations, %d needed", published, len(u.replicas.paths)+1, u.replicas.quorum)
+	}
+	return nil
+}
@@ -0,0 +1,187 @@
+package manifest
+
+import (
+	"context"
+	"hash/crc32"
+	"reflect"
+	"sort"
+	"testing"
+)
+
+func TestReplicaSetCheck(t *testing.T) {
+	for _, tc := range []struct {
+		name    string
+		opts    []Option
+		wantErr bool
+	}{{
+		name: "no replicas",
+	}, {
+		name: "quorum of all",
+		opts: []Option{WithReplicas(0, "gs://r1/rel", "gs://r2/rel")},
+	}, {
+		name: "quorum of one",
+		opts: []Option{WithReplicas(1, "gs://r1/rel")},
+	}, {
+		name:    "quorum too large",
+		opts:    []Option{WithReplicas(3, "gs://r1/rel")},
+		wantErr: true,
+	}, {
+		name:    "no paths",
+		opts:    []Option{WithReplicas(1)},
+		wantErr: true,
+	}, {
+		name:    "s3 replica",
+		opts:    []Option{WithReplicas(0, "s3://r1/rel")},
+		wantErr: true,
+	}, {
+		name:    "bucket without a path",
+		opts:    []Option{WithReplicas(0, "gs://r1")},
+		wantErr: true,
+	}, {
+		name:    "content-addressed",
+		opts:    []Option{WithReplicas(0, "gs://r1/rel"), WithContentAddressed()},
+		wantErr: true,
+	}} {
+		t.Run(tc.name, func(t *testing.T) {
+			o := newOptions(tc.opts)
+			if err := o.replicas.check(o); (err != nil) != tc.wantErr {
+				t.Errorf("check() = %v, want error %v", err, tc.wantErr)
+			}
+		})
+	}
+}
+
+func TestReplicate(t *testing.T) {
+	for _, tc := range []struct {
+		name     string
+		replicas []string
+		quorum   int
+		broken   []string
+		// copied are objects the replicas already have, which mustn't be
+		// copied again.
+		copied []string
+		// wantFailed are the files that missed the quorum, and wantMissing
+		// what each replica's manifest lacks; a replica missing from it
+		// gets no manifest.
+		wantFailed  []string
+		wantMissing map[string][]string
+		wantErr     bool
+	}{{
+		name:        "every replica",
+		replicas:    []string{"gs://r1/rel", "gs://r2/rel"},
+		wantMissing: map[string][]string{"r1": nil, "r2": nil},
+	}, {
+		name:        "already replicated",
+		replicas:    []string{"gs://r1/rel"},
+		copied:      []string{"r1/rel/a"},
+		wantMissing: map[string][]string{"r1": nil},
+	}, {
+		name:        "quorum met despite a broken replica",
+		replicas:    []string{"gs://r1/rel", "gs://r2/rel"},
+		quorum:      2,
+		broken:      []string{"r2/"},
+		wantMissing: map[string][]string{"r1": nil},
+	}, {
+		name:        "partial replica",
+		replicas:    []string{"gs://r1/rel"},
+		quorum:      1,
+		broken:      []string{"r1/rel/dir/b"},
+		wantMissing: map[string][]string{"r1": {"dir/b"}},
+	}, {
+		name:        "partial replica short of the quorum",
+		replicas:    []string{"gs://r1/rel", "gs://r2/rel"},
+		quorum:      2,
+		broken:      []string{"r1/rel/dir/b", "r2/"},
+		wantFailed:  []string{"dir/b"},
+		wantMissing: map[string][]string{"r1": nil},
+	}, {
+		name:       "quorum missed",
+		replicas:   []string{"gs://r1/rel", "gs://r2/rel"},
+		quorum:     2,
+		broken:     []string{"r1/", "r2/"},
+		wantFailed: []string{"a", "dir/b"},
+		wantErr:    true,
+	}} {
+		t.Run(tc.name, func(t *testing.T) {
+			ctx := context.Background()
+			fake, client := newFakeGCS(t)
+			var files []File
+			for _, p := range []string{"a", "dir/b"} {
+				data := []byte("contents of " + p)
+				fake.put("b/rel/"+p, data, nil)
+				files = append(files, File{Path: p, Source: "/src/" + p, Digest: digestOf(t, string(data)), Size: int64(len(data)), CRC32C: FormatCRC32C(crc32.Checksum(data, castagnoli)), Generation: fake.get("b/rel/" + p).generation})
+			}
+			// Symlinks have no object, so count as replicated everywhere.
+			files = append(files, File{Path: "l", Source: "/src/l", Digest: linkDigest("a"), Size: 1, Link: "a"})
+			copied := map[string]int64{}
+			for _, k := range tc.copied {
+				fake.put(k, fake.get("b/"+k[len("r1/"):]).data, nil)
+				copied[k] = fake.get(k).generation
+			}
+			fake.broken = tc.broken
+
+			u, err := NewUploader(ctx, WithClient(client), WithReplicas(tc.quorum, tc.replicas...), WithRetries(0), WithManifestRetries(0))
+			if err != nil {
+				t.Fatal(err)
+			}
+			failed, has := u.replicate(ctx, files, "rel", client.Bucket("b"))
+			var gotFailed []string
+			for _, f := range failed {
+				gotFailed = append(gotFailed, f.Path)
+			}
+			sort.Strings(gotFailed)
+			if !reflect.DeepEqual(gotFailed, tc.wantFailed) {
+				t.Errorf("failed = %v, want %v", failed, tc.wantFailed)
+			}
+			for k, gen := range copied {
+				if got := fake.get(k).generation; got != gen {
+					t.Errorf("%s was copied again", k)
+				}
+			}
+
+			m := New()
+			for _, f := range files {
+				if !contains(tc.wantFailed, f.Path) {
+					m.Add(f.Entry())
+				}
+			}
+			err = u.writeReplicaManifests(ctx, m, has)
+			if (err != nil) != tc.wantErr {
+				t.Errorf("writeReplicaManifests() = %v, want error %v", err, tc.wantErr)
+			}
+			for _, r := range []string{"r1", "r2"} {
+				want, ok := tc.wantMissing[r]
+				o := fake.get(r + "/rel/" + Name)
+				if !ok {
+					if o != nil {
+						t.Errorf("%s has a manifest", r)
+					}
+					continue
+				}
+				if o == nil {
+					t.Errorf("%s has no manifest", r)
+					continue
+				}
+				rm, err := Parse(o.data)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if !reflect.DeepEqual(rm.Missing, want) {
+					t.Errorf("%s's manifest is missing %v, want %v", r, rm.Missing, want)
+				}
+				if len(rm.Files)+len(rm.Missing) != len(m.Files) {
+					t.Errorf("%s's manifest has %d files and %d missing, want %d in all", r, len(rm.Files), len(rm.Missing), len(m.Files))
+				}
+			}
+		})
+	}
+}
+
+func contains(list []string, s string) bool {
+	for _, x := range list {
+		if x == s {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,126 @@
+package manifest
+
+import (
+	"context"
+	"fmt"
+	"path"
+	"sort"
+	"sync"
+	"time"
+
+	"cloud.google.com/go/storage"
+)
+
+// Retrieval is what a download would read, by the storage class of the
+// objects, and what reading it would cost. Unlike archive tiers elsewhere,
+// GCS has nothing to restore: objects in COLDLINE and ARCHIVE are served at
+// once, like STANDARD ones, but each GiB read from them is charged for.
+type Retrieval struct {
+	// Files and Bytes are the objects to read and their stored sizes, by
+	// storage class.
+	Files map[string]int
+	Bytes map[string]int64
+	// Cost is what reading them costs, in USD: a Class B operation each,
+	// and a retrieval fee for each GiB in a class that charges one.
+	Cost float64
+	// Time is how long reading Bytes takes at WithMaxBandwidth, and so
+	// when the last file will be available; 0 without a limit.
+	Time time.Duration
+}
+
+// Classes returns the storage classes of r, sorted.
+func (r *Retrieval) Classes() []string {
+	var classes []string
+	for c := range r.Files {
+		classes = append(classes, c)
+	}
+	sort.Strings(classes)
+	return classes
+}
+
+// PlanRetrieval looks up the storage class of every object Download would
+// read to restore m from under the gs:// path src into dst, skipping the
+// files WithResume would keep, and prices reading them at prices. Lookups
+// are paced and retried as downloads are.
+func (d *Downloader) PlanRetrieval(ctx context.Context, m *Manifest, src, dst string, prices map[string]Prices) (*Retrieval, error) {
+	bucketName, gcsPath, err := ParseURI(src)
+	if err != nil {
+		return nil, err
+	}
+	bucket := d.client.Bucket(bucketName)
+	todo := m
+	if d.resume {
+		dests := map[string]string{}
+		for _, p := range m.Paths() {
+			if dests[p], err = LocalPath(dst, p); err != nil {
+				return nil, err
+			}
+		}
+		todo = d.remaining(m, dests)
+	}
+
+	r := &Retrieval{Files: map[string]int{}, Bytes: map[string]int64{}}
+	var (
+		mu    sync.Mutex
+		wg    sync.WaitGroup
+		first error
+	)
+	jobs := make(chan Entry)
+	for i := 0; i < d.parallelism; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for e := range jobs {
+				name := path.Join(gcsPath, e.ObjectName())
+				var attrs *storage.ObjectAttrs
+				err := d.retry(ctx, d.retries, name, func() error {
+					if err := d.pace(ctx); err != nil {
+						return err
+					}
+					var err error
+					attrs, err = d.encrypted(bucket.Object(name)).Attrs(ctx)
+					return err
+				})
+				mu.Lock()
+				if err != nil && first == nil {
+					first = fmt.Errorf("%s: %v", e.Path, err)
+				}
+				if err == nil {
+					r.Files[attrs.StorageClass]++
+					r.Bytes[attrs.StorageClass] += attrs.Size
+				}
+				mu.Unlock()
+			}
+		}()
+	}
+	for _, p := range todo.Paths() {
+		if e := todo.Files[p]; e.Link == "" {
+			select {
+			case jobs <- e:
+			case <-ctx.Done():
+			}
+		}
+	}
+	close(jobs)
+	wg.Wait()
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	if first != nil {
+		return nil, first
+	}
+
+	var total int64
+	for class, n := range r.Files {
+		p, ok := prices[class]
+		if !ok {
+			return nil, fmt.Errorf("no prices for storage class %q", class)
+		}
+		r.Cost += float64(n)/10000*p.ClassB + float64(r.Bytes[class])/(1<<30)*p.RetrievalGB
+		total += r.Bytes[class]
+	}
+	if d.bandwidth != nil {
+		r.Time = time.Duration(float64(total) / d.bandwidth.rate * float64(time.Second))
+	}
+	return r, nil
+}
@@ -0,0 +1,75 @@
+package manifest
+
+import (
+	"fmt"
+	"path"
+	"strings"
+)
+
+// Route sends the files under the directory From of a source to the
+// prefix To of the destination instead, so that one upload can lay out
+// several subtrees, such as bin/ under releases/ and symbols/ under debug/,
+// and still describe them all in one manifest. Both are relative: From to
+// the source and To to the destination.
+type Route struct {
+	From string
+	To   string
+}
+
+// ParseRoute parses a route written as from=to, such as bin=releases.
+func ParseRoute(s string) (Route, error) {
+	i := strings.Index(s, "=")
+	if i < 0 {
+		return Route{}, fmt.Errorf("invalid route %q: want from=to", s)
+	}
+	r := Route{From: strings.Trim(s[:i], "/"), To: strings.Trim(s[i+1:], "/")}
+	for _, p := range []string{r.From, r.To} {
+		if p == "" || path.Clean(p) != p || p == ".." || strings.HasPrefix(p, "../") {
+			return Route{}, fmt.Errorf("invalid route %q: want two relative directories", s)
+		}
+	}
+	return r, nil
+}
+
+// objectFor returns the name, relative to the destination, of the object
+// the file at p is uploaded to: p itself unless the first WithRoutes route
+// whose directory it is under sends it elsewhere.
+func (o *options) objectFor(p string) string {
+	for _, r := range o.routes {
+		if strings.HasPrefix(p, r.From+"/") {
+			return r.To + strings.TrimPrefix(p, r.From)
+		}
+	}
+	return p
+}
+
+// checkRoutes fails if two of the files being uploaded, sources or prior,
+// would be stored in the same object.
+func (o *options) checkRoutes(sources []Source, prior []File) error {
+	if len(o.routes) == 0 {
+		return nil
+	}
+	taken := map[string]string{}
+	claim := func(p, object string) error {
+		if other, ok := taken[object]; ok && other != p {
+			return fmt.Errorf("%s and %s would both be uploaded to %s", other, p, object)
+		}
+		taken[object] = p
+		return nil
+	}
+	for _, f := range prior {
+		if f.Link == "" {
+			if err := claim(f.Path, f.Entry().ObjectName()); err != nil {
+				return err
+			}
+		}
+	}
+	for _, s := range sources {
+		if s.Link == "" {
+			if err := claim(s.RelPath, o.objectFor(s.RelPath)); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,355 @@
+package manifest
+
+import (
+	"bytes"
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"time"
+
+	"google.golang.org/api/option"
+	htransport "google.golang.org/api/transport/http"
+)
+
+// SignatureSuffix is appended to a manifest's name to get the name of its
+// detached signature. The signature object holds the base64 signature of
+// the manifest's sha256, as cosign does.
+const SignatureSuffix = ".sig"
+
+// BundleSuffix is appended to a manifest's name to get the name of its
+// signature bundle, written alongside the signature. It says which key the
+// manifest was signed with, so that while a signing key is being rotated,
+// verifiers trusting both the old and the new key know which one to check
+// it with.
+const BundleSuffix = ".bundle"
+
+// Bundle is the contents of a signature bundle.
+type Bundle struct {
+	// KeyID is the KeyFingerprint of the signing key, if the Signer is a
+	// KeyIdentifier.
+	KeyID string `json:"keyId,omitempty"`
+	// KeyRef names the key where it is kept, such as a KMS key version.
+	KeyRef string `json:"keyRef,omitempty"`
+	// Signature is the signature object's contents.
+	Signature string `json:"signature"`
+	// CertChain is the PEM certificates given with WithCertChain, leaf
+	// first.
+	CertChain []string `json:"certChain,omitempty"`
+}
+
+// Signer signs the sha256 digest of a manifest.
+type Signer interface {
+	Sign(ctx context.Context, digest []byte) ([]byte, error)
+}
+
+// KeyIdentifier is implemented by Signers that can say which key they sign
+// with: its KeyFingerprint, and a reference to where it is kept.
+type KeyIdentifier interface {
+	KeyID(ctx context.Context) (id, ref string, err error)
+}
+
+// KMSSigner signs with an asymmetric Cloud KMS key version, so the private
+// key never leaves KMS.
+type KMSSigner struct {
+	// KeyVersion is the key version's resource name,
+	// projects/*/locations/*/keyRings/*/cryptoKeys/*/cryptoKeyVersions/*.
+	KeyVersion string
+	client     *http.Client
+}
+
+// NewKMSSigner returns a KMSSigner authenticated with default credentials.
+func NewKMSSigner(ctx context.Context, keyVersion string) (*KMSSigner, error) {
+	hc, _, err := htransport.NewClient(ctx, option.WithScopes("https://www.googleapis.com/auth/cloudkms"))
+	if err != nil {
+		return nil, err
+	}
+	return &KMSSigner{KeyVersion: keyVersion, client: hc}, nil
+}
+
+// Sign calls the KMS asymmetricSign method.
+func (s *KMSSigner) Sign(ctx context.Context, digest []byte) ([]byte, error) {
+	body, err := json.Marshal(map[string]interface{}{
+		"digest": map[string][]byte{"sha256": digest},
+	})
+	if err != nil {
+		return nil, err
+	}
+	url := "https://cloudkms.googleapis.com/v1/" + s.KeyVersion + ":asymmetricSign"
+	req, err := http.NewRequest(http.MethodPost, url, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := s.client.Do(req.WithContext(ctx))
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	b, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("signing with %s: %s: %s", s.KeyVersion, resp.Status, bytes.TrimSpace(b))
+	}
+	var signed struct {
+		Signature []byte `json:"signature"`
+	}
+	if err := json.Unmarshal(b, &signed); err != nil {
+		return nil, err
+	}
+	return signed.Signature, nil
+}
+
+// KeyID fetches the key version's public key from KMS and returns its
+// fingerprint, with the key version as the reference.
+func (s *KMSSigner) KeyID(ctx context.Context) (string, string, error) {
+	url := "https://cloudkms.googleapis.com/v1/" + s.KeyVersion + "/publicKey"
+	req, err := http.NewRequest(http.MethodGet, url, nil)
+	if err != nil {
+		return "", "", err
+	}
+	resp, err := s.client.Do(req.WithContext(ctx))
+	if err != nil {
+		return "", "", err
+	}
+	defer resp.Body.Close()
+	b, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return "", "", err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return "", "", fmt.Errorf("getting public key of %s: %s: %s", s.KeyVersion, resp.Status, bytes.TrimSpace(b))
+	}
+	var key struct {
+		PEM string `json:"pem"`
+	}
+	if err := json.Unmarshal(b, &key); err != nil {
+		return "", "", err
+	}
+	block, _ := pem.Decode([]byte(key.PEM))
+	if block == nil {
+		return "", "", fmt.Errorf("public key of %s: no PEM data", s.KeyVersion)
+	}
+	pub, err := x509.ParsePKIXPublicKey(block.Bytes)
+	if err != nil {
+		return "", "", err
+	}
+	id, err := KeyFingerprint(pub)
+	return id, s.KeyVersion, err
+}
+
+// sign returns the contents of the signature object and the signature
+// bundle for data.
+func (o *options) sign(ctx context.Context, data []byte) ([]byte, []byte, error) {
+	digest := sha256.Sum256(data)
+	sig, err := o.signer.Sign(ctx, digest[:])
+	if err != nil {
+		return nil, nil, err
+	}
+	sigObj := []byte(base64.StdEncoding.EncodeToString(sig))
+
+	bundle := Bundle{Signature: string(sigObj)}
+	if ki, ok := o.signer.(KeyIdentifier); ok {
+		if bundle.KeyID, bundle.KeyRef, err = ki.KeyID(ctx); err != nil {
+			return nil, nil, fmt.Errorf("identifying signing key: %v", err)
+		}
+	}
+	if len(o.certChain) > 0 {
+		leaf, err := KeyFingerprint(o.certChain[0].PublicKey)
+		if err != nil {
+			return nil, nil, err
+		}
+		if bundle.KeyID != "" && leaf != bundle.KeyID {
+			return nil, nil, fmt.Errorf("certificate chain is for key %s, but the manifest is signed with %s", leaf, bundle.KeyID)
+		}
+		bundle.KeyID = leaf
+		for _, c := range o.certChain {
+			bundle.CertChain = append(bundle.CertChain, string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: c.Raw})))
+		}
+	}
+	b, err := json.Marshal(bundle)
+	if err != nil {
+		return nil, nil, err
+	}
+	return sigObj, b, nil
+}
+
+// ParseCertChain decodes the PEM certificates in b, leaf first, for
+// WithCertChain.
+func ParseCertChain(b []byte) ([]*x509.Certificate, error) {
+	var certs []*x509.Certificate
+	for {
+		var block *pem.Block
+		block, b = pem.Decode(b)
+		if block == nil {
+			break
+		}
+		if block.Type != "CERTIFICATE" {
+			continue
+		}
+		c, err := x509.ParseCertificate(block.Bytes)
+		if err != nil {
+			return nil, err
+		}
+		certs = append(certs, c)
+	}
+	if len(certs) == 0 {
+		return nil, errors.New("no PEM certificates")
+	}
+	return certs, nil
+}
+
+// checkCertChain checks that chain is for the key pub, and that each
+// certificate in it is signed by the next. It doesn't establish that
+// anyone trusts the chain: pub is trusted already.
+func checkCertChain(pub crypto.PublicKey, chain []string) error {
+	var certs []*x509.Certificate
+	for _, c := range chain {
+		cs, err := ParseCertChain([]byte(c))
+		if err != nil {
+			return err
+		}
+		certs = append(certs, cs...)
+	}
+	want, err := KeyFingerprint(pub)
+	if err != nil {
+		return err
+	}
+	if got, err := KeyFingerprint(certs[0].PublicKey); err != nil || got != want {
+		return fmt.Errorf("certificate chain is for key %s, not the signing key %s", got, want)
+	}
+	for i := 0; i+1 < len(certs); i++ {
+		if err := certs[i].CheckSignatureFrom(certs[i+1]); err != nil {
+			return fmt.Errorf("certificate chain: %s: %v", certs[i].Subject, err)
+		}
+	}
+	return nil
+}
+
+// LoadPublicKey reads a PEM-encoded PKIX public key, such as the one
+// Cloud KMS exports for a key version.
+func LoadPublicKey(path string) (crypto.PublicKey, error) {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	block, _ := pem.Decode(b)
+	if block == nil {
+		return nil, fmt.Errorf("%s: no PEM data", path)
+	}
+	return x509.ParsePKIXPublicKey(block.Bytes)
+}
+
+// ErrBadSignature is returned when a manifest's signature doesn't verify.
+var ErrBadSignature = errors.New("manifest signature does not verify")
+
+// VerifySignature checks sigObj, the contents of a signature object,
+// against data with pub. ECDSA keys and RSA keys, with PKCS #1 v1.5 or PSS
+// padding, are supported.
+func VerifySignature(pub crypto.PublicKey, data, sigObj []byte) error {
+	sig, err := base64.StdEncoding.DecodeString(string(bytes.TrimSpace(sigObj)))
+	if err != nil {
+		return fmt.Errorf("decoding signature: %v", err)
+	}
+	digest := sha256.Sum256(data)
+	switch k := pub.(type) {
+	case *ecdsa.PublicKey:
+		if ecdsa.VerifyASN1(k, digest[:], sig) {
+			return nil
+		}
+	case *rsa.PublicKey:
+		if rsa.VerifyPKCS1v15(k, crypto.SHA256, digest[:], sig) == nil {
+			return nil
+		}
+		if rsa.VerifyPSS(k, crypto.SHA256, digest[:], sig, nil) == nil {
+			return nil
+		}
+	default:
+		return fmt.Errorf("unsupported public key type %T", pub)
+	}
+	return ErrBadSignature
+}
+
+// readVerified reads the manifest at uri and, if public keys or a maximum
+// age were given, refuses it unless its detached signature verifies with
+// one of the keys and it is recent enough. The key the signature bundle
+// names, if there is a bundle, is tried first.
+func (o *options) readVerified(ctx context.Context, uri string) (*Manifest, error) {
+	b, err := ReadBytes(ctx, o.client, uri)
+	if err != nil {
+		return nil, err
+	}
+	return o.verified(ctx, uri, b)
+}
+
+// verified is readVerified for the manifest at uri already read as b.
+func (o *options) verified(ctx context.Context, uri string, b []byte) (*Manifest, error) {
+	if len(o.publicKeys) > 0 {
+		sig, err := ReadBytes(ctx, o.client, uri+SignatureSuffix)
+		if err != nil {
+			return nil, fmt.Errorf("reading signature: %v", err)
+		}
+		// The bundle only says which key to try first; a manifest signed
+		// before there were bundles has none.
+		var bundle Bundle
+		if bb, err := ReadBytes(ctx, o.client, uri+BundleSuffix); err == nil {
+			if err := json.Unmarshal(bb, &bundle); err != nil {
+				return nil, fmt.Errorf("parsing signature bundle: %v", err)
+			}
+		}
+		keys := o.publicKeys
+		if bundle.KeyID != "" {
+			keys = nil
+			for _, pub := range o.publicKeys {
+				if id, _ := KeyFingerprint(pub); id == bundle.KeyID {
+					keys = append([]crypto.PublicKey{pub}, keys...)
+				} else {
+					keys = append(keys, pub)
+				}
+			}
+		}
+		var signer crypto.PublicKey
+		err = ErrBadSignature
+		for _, pub := range keys {
+			if err = VerifySignature(pub, b, sig); err == nil {
+				signer = pub
+				break
+			}
+		}
+		if err != nil {
+			return nil, fmt.Errorf("%s: %v", uri, err)
+		}
+		if len(bundle.CertChain) > 0 {
+			if err := checkCertChain(signer, bundle.CertChain); err != nil {
+				return nil, fmt.Errorf("%s: %v", uri, err)
+			}
+		}
+		id, _ := KeyFingerprint(signer)
+		fmt.Fprintf(o.log, "Verified signature of %s with key %s\n", uri, id)
+	}
+	if o.maxAge > 0 {
+		published, err := o.published(ctx, uri)
+		if err != nil {
+			return nil, err
+		}
+		if age := time.Since(published); age > o.maxAge {
+			return nil, fmt.Errorf("%s was published %v ago, longer than the allowed %v", uri, age.Round(time.Second), o.maxAge)
+		}
+	}
+	m, err := Parse(b)
+	if err != nil {
+		return nil, fmt.Errorf("parsing %s: %v", uri, err)
+	}
+	return m, nil
+}
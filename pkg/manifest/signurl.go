@@ -0,0 +1,146 @@
+package manifest
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"path"
+	"time"
+
+	"cloud.google.com/go/compute/metadata"
+	"cloud.google.com/go/storage"
+	"golang.org/x/oauth2/google"
+	"google.golang.org/api/option"
+	htransport "google.golang.org/api/transport/http"
+)
+
+// URLSigner is the service account SignedURLs signs as: with its private
+// key, or with SignBytes when the key isn't at hand.
+type URLSigner struct {
+	GoogleAccessID string
+	PrivateKey     []byte
+	SignBytes      func([]byte) ([]byte, error)
+}
+
+// LoadURLSigner returns a URLSigner for the service account JSON key file
+// at p.
+func LoadURLSigner(p string) (*URLSigner, error) {
+	b, err := ioutil.ReadFile(p)
+	if err != nil {
+		return nil, err
+	}
+	return urlSignerFromJSON(b)
+}
+
+func urlSignerFromJSON(b []byte) (*URLSigner, error) {
+	cfg, err := google.JWTConfigFromJSON(b)
+	if err != nil {
+		return nil, err
+	}
+	return &URLSigner{GoogleAccessID: cfg.Email, PrivateKey: cfg.PrivateKey}, nil
+}
+
+// NewIAMURLSigner returns a URLSigner that signs as the service account
+// email through the IAM Credentials signBlob method, authenticated with
+// default credentials, so that no private key is needed. Those credentials
+// need the Service Account Token Creator role on the account. An empty
+// email means the account of the default credentials themselves: a key
+// file's account is signed for locally, and on GCE the instance's account
+// is.
+func NewIAMURLSigner(ctx context.Context, email string) (*URLSigner, error) {
+	if email == "" {
+		creds, err := google.FindDefaultCredentials(ctx)
+		if err != nil {
+			return nil, err
+		}
+		var key struct {
+			Type string `json:"type"`
+		}
+		if json.Unmarshal(creds.JSON, &key) == nil && key.Type == "service_account" {
+			return urlSignerFromJSON(creds.JSON)
+		}
+		if !metadata.OnGCE() {
+			return nil, fmt.Errorf("the default credentials aren't a service account; name one to sign as")
+		}
+		if email, err = metadata.Email("default"); err != nil {
+			return nil, fmt.Errorf("finding the instance's service account: %v", err)
+		}
+	}
+	hc, _, err := htransport.NewClient(ctx, option.WithScopes("https://www.googleapis.com/auth/cloud-platform"))
+	if err != nil {
+		return nil, err
+	}
+	return &URLSigner{
+		GoogleAccessID: email,
+		SignBytes: func(b []byte) ([]byte, error) {
+			return signBlob(ctx, hc, email, b)
+		},
+	}, nil
+}
+
+// signBlob calls the IAM Credentials signBlob method.
+func signBlob(ctx context.Context, hc *http.Client, email string, payload []byte) ([]byte, error) {
+	body, err := json.Marshal(map[string][]byte{"payload": payload})
+	if err != nil {
+		return nil, err
+	}
+	url := "https://iamcredentials.googleapis.com/v1/projects/-/serviceAccounts/" + email + ":signBlob"
+	req, err := http.NewRequest(http.MethodPost, url, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := hc.Do(req.WithContext(ctx))
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	b, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("signing as %s: %s: %s", email, resp.Status, bytes.TrimSpace(b))
+	}
+	var signed struct {
+		SignedBlob []byte `json:"signedBlob"`
+	}
+	if err := json.Unmarshal(b, &signed); err != nil {
+		return nil, err
+	}
+	return signed.SignedBlob, nil
+}
+
+// SignedURLs returns a V4 signed GET URL for the object of every file in
+// m under the gs:// path dst, keyed by path, each valid for ttl, which GCS
+// caps at seven days. Symlinks, which have no object, are left out.
+func SignedURLs(m *Manifest, dst string, ttl time.Duration, s *URLSigner) (map[string]string, error) {
+	bucketName, gcsPath, err := ParseURI(dst)
+	if err != nil {
+		return nil, err
+	}
+	expires := time.Now().Add(ttl)
+	urls := map[string]string{}
+	for _, p := range m.Paths() {
+		e := m.Files[p]
+		if e.Link != "" {
+			continue
+		}
+		u, err := storage.SignedURL(bucketName, path.Join(gcsPath, e.ObjectName()), &storage.SignedURLOptions{
+			GoogleAccessID: s.GoogleAccessID,
+			PrivateKey:     s.PrivateKey,
+			SignBytes:      s.SignBytes,
+			Method:         http.MethodGet,
+			Expires:        expires,
+			Scheme:         storage.SigningSchemeV4,
+		})
+		if err != nil {
+			return nil, fmt.Errorf("signing a URL for %s: %v", p, err)
+		}
+		urls[p] = u
+	}
+	return urls, nil
+}
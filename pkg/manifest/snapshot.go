@@ -0,0 +1,110 @@
+package manifest
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sort"
+	"strings"
+	"time"
+)
+
+// stamp is what a fingerprint records of one file.
+type stamp struct {
+	size    int64
+	modTime time.Time
+	link    string
+}
+
+// fingerprint maps the manifest path of every file of a source tree to its
+// stamp.
+type fingerprint map[string]stamp
+
+// fingerprint walks src as Expand does, without repeating its warnings,
+// and stats every file found.
+func (u *Uploader) fingerprint(src string) (fingerprint, error) {
+	if isRemote(src) {
+		return nil, fmt.Errorf("a consistent snapshot needs a local source, not %s", src)
+	}
+	quiet := *u.options
+	quiet.log, quiet.onWarning = ioutil.Discard, nil
+	sources, err := quiet.expand(src)
+	if err != nil {
+		return nil, err
+	}
+	fp := fingerprint{}
+	if sources, err = u.excludeManifest(sources); err != nil {
+		return nil, err
+	}
+	for _, s := range sources {
+		fi, err := os.Lstat(s.Path)
+		if err != nil {
+			return nil, err
+		}
+		fp[s.RelPath] = stamp{size: fi.Size(), modTime: fi.ModTime(), link: s.Link}
+	}
+	return fp, nil
+}
+
+// changed returns the paths, sorted, that were added, removed or modified
+// between fp and later.
+func (fp fingerprint) changed(later fingerprint) []string {
+	var paths []string
+	for p, s := range fp {
+		l, ok := later[p]
+		if !ok || l.size != s.size || !l.modTime.Equal(s.modTime) || l.link != s.link {
+			paths = append(paths, p)
+		}
+	}
+	for p := range later {
+		if _, ok := fp[p]; !ok {
+			paths = append(paths, p)
+		}
+	}
+	sort.Strings(paths)
+	return paths
+}
+
+// SnapshotError is returned by an upload under WithConsistentSnapshot when
+// the source tree changed while it ran, naming the paths that changed. No
+// manifest is published.
+type SnapshotError struct {
+	Paths []string
+}
+
+func (e *SnapshotError) Error() string {
+	return fmt.Sprintf("%d files changed during the upload, so it isn't a consistent snapshot: %s", len(e.Paths), strings.Join(e.Paths, ", "))
+}
+
+// checkSnapshot compares the source tree now with before, the fingerprint
+// taken at the start of the run, and with the files being uploaded,
+// sources and prior. A file in before but not among those was added after the
+// walk the caller made to find them, so is reported as changed too.
+func (u *Uploader) checkSnapshot(before fingerprint, sources []Source, prior []File) error {
+	after, err := u.fingerprint(u.snapshotSrc)
+	if err != nil {
+		return fmt.Errorf("checking the source is unchanged: %v", err)
+	}
+	paths := before.changed(after)
+	seen := map[string]bool{}
+	for _, p := range paths {
+		seen[p] = true
+	}
+	uploaded := map[string]bool{}
+	for _, s := range sources {
+		uploaded[s.RelPath] = true
+	}
+	for _, f := range prior {
+		uploaded[f.Path] = true
+	}
+	for p := range before {
+		if !uploaded[p] && !seen[p] {
+			paths = append(paths, p)
+		}
+	}
+	if len(paths) == 0 {
+		return nil
+	}
+	sort.Strings(paths)
+	return &SnapshotError{Paths: paths}
+}
@@ -0,0 +1,55 @@
+package manifest
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+)
+
+// spool copies the local file s, of size bytes, to a temporary file in the
+// WithSpool directory and returns the copy, at its start, to upload from,
+// and a func that closes and removes it. A read that fails starts the copy
+// over from a fresh open of s, with backoff, up to the retry limit, so that
+// a hiccup of the source's filesystem costs a re-read of the file rather
+// than a GCS upload session.
+func (u *Uploader) spool(ctx context.Context, s Source, size int64) (*os.File, func(), error) {
+	tmp, err := ioutil.TempFile(u.spoolDir, "gcs-manifest-spool-")
+	if err != nil {
+		return nil, nil, err
+	}
+	cleanup := func() {
+		tmp.Close()
+		os.Remove(tmp.Name())
+	}
+	err = u.retry(ctx, u.retries, "spooling "+s.Path, func() error {
+		if _, err := tmp.Seek(0, io.SeekStart); err != nil {
+			return err
+		}
+		if err := tmp.Truncate(0); err != nil {
+			return err
+		}
+		src, err := u.openLocal(s.Path)
+		if err != nil {
+			return err
+		}
+		defer src.Close()
+		n, err := io.Copy(tmp, src)
+		if err != nil {
+			return err
+		}
+		if n != size {
+			return fmt.Errorf("read %d bytes of %s, expected %d", n, s.Path, size)
+		}
+		return nil
+	})
+	if err == nil {
+		_, err = tmp.Seek(0, io.SeekStart)
+	}
+	if err != nil {
+		cleanup()
+		return nil, nil, err
+	}
+	return tmp, cleanup, nil
+}
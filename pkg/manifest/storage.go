@@ -0,0 +1,449 @@
+package manifest
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"io"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"cloud.google.com/go/storage"
+	"google.golang.org/api/iterator"
+)
+
+// Storage is somewhere files and their manifest can be published other
+// than through the GCS-specific Uploader, such as an S3 mirror. Names are
+// slash-separated and relative to the storage's root. Manifests don't
+// depend on where they are stored, so one published to any Storage is
+// checked the same way.
+type Storage interface {
+	// Put stores size bytes from r as name, replacing any existing object.
+	Put(ctx context.Context, name string, r io.Reader, size int64) error
+	// Get opens name for reading. It returns ErrNotExist if there is no
+	// such object.
+	Get(ctx context.Context, name string) (io.ReadCloser, error)
+	// Stat describes name. It returns ErrNotExist if there is no such
+	// object.
+	Stat(ctx context.Context, name string) (ObjectInfo, error)
+	// List describes every object whose name starts with prefix.
+	List(ctx context.Context, prefix string) ([]ObjectInfo, error)
+}
+
+// ObjectInfo describes an object in a Storage.
+type ObjectInfo struct {
+	Name    string
+	Size    int64
+	ModTime time.Time
+}
+
+// ErrNotExist is returned by a Storage for an object that doesn't exist.
+var ErrNotExist = errors.New("object does not exist")
+
+// IsStorageURI reports whether uri names one of the backends only
+// reachable through a Storage: s3://bucket/prefix or file://dir.
+func IsStorageURI(uri string) bool {
+	return strings.HasPrefix(uri, "s3://") || strings.HasPrefix(uri, "file://")
+}
+
+// OpenStorage returns the Storage rooted at uri, which is gs://bucket/prefix,
+// s3://bucket/prefix or file://dir. client is only needed for gs:// URIs. S3
+// credentials and region are taken from the standard AWS_* environment
+// variables.
+func OpenStorage(ctx context.Context, uri string, client *storage.Client) (Storage, error) {
+	switch {
+	case strings.HasPrefix(uri, "s3://"):
+		bucket, prefix := splitBucket(strings.TrimPrefix(uri, "s3://"))
+		return newS3Storage(bucket, prefix)
+	case strings.HasPrefix(uri, "file://"):
+		return &fileStorage{dir: strings.TrimPrefix(uri, "file://")}, nil
+	case isRemote(uri):
+		if client == nil {
+			return nil, fmt.Errorf("opening %s: no GCS client", uri)
+		}
+		bucket, prefix := ParsePrefix(uri)
+		return &gcsStorage{bucket: client.Bucket(bucket), prefix: prefix}, nil
+	}
+	return nil, fmt.Errorf("unsupported storage URI %q", uri)
+}
+
+func splitBucket(s string) (string, string) {
+	split := strings.SplitN(s, "/", 2)
+	if len(split) != 2 {
+		return split[0], ""
+	}
+	return split[0], split[1]
+}
+
+// openParent opens the Storage holding uri and returns it together with
+// uri's name within it.
+func openParent(ctx context.Context, uri string, client *storage.Client) (Storage, string, error) {
+	i := strings.LastIndex(uri, "/")
+	if i < 0 {
+		return nil, "", fmt.Errorf("invalid uri: %s", uri)
+	}
+	s, err := OpenStorage(ctx, uri[:i], client)
+	if err != nil {
+		return nil, "", err
+	}
+	return s, uri[i+1:], nil
+}
+
+// UploadTo uploads sources and their manifest to s. It is the backend-
+// agnostic counterpart of Uploader.UploadSources, with the same worker pool
+// and retries: each file is hashed as it is sent and its stored size
+// checked, but there are no CRC32Cs or generations to record. gs:// sources
+// can't be copied this way. WithSigner signs the manifest as usual.
+func UploadTo(ctx context.Context, s Storage, sources []Source, opts ...Option) (*Result, error) {
+	o := newOptions(opts)
+	if o.compression != "" {
+		return nil, fmt.Errorf("compression is only supported when uploading to gs://")
+	}
+	if o.cas {
+		return nil, fmt.Errorf("the content-addressed layout is only supported when uploading to gs://")
+	}
+	if o.kmsKey != "" || o.encryptionKey != nil {
+		return nil, fmt.Errorf("encryption keys are only supported when uploading to gs://")
+	}
+	if o.storageClass != "" {
+		return nil, fmt.Errorf("storage classes are only supported when uploading to gs://")
+	}
+	if o.replicas != nil {
+		return nil, fmt.Errorf("replicas are only supported when uploading to gs://")
+	}
+	sources, err := o.excludeManifest(sources)
+	if err != nil {
+		return nil, err
+	}
+	for _, src := range sources {
+		if isRemote(src.Path) {
+			return nil, fmt.Errorf("%s: gs:// sources can only be copied to gs://", src.Path)
+		}
+	}
+
+	// As with UploadSources, the first failure stops the rest unless
+	// WithContinueOnError was given.
+	parent := ctx
+	ctx, stop := context.WithCancel(ctx)
+	defer stop()
+	files := make([]File, len(sources))
+	errs := make([]error, len(sources))
+	jobs := make(chan int)
+	var wg sync.WaitGroup
+	for i := 0; i < o.parallelism; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range jobs {
+				started := ctx.Err() == nil
+				if started {
+					fmt.Fprintln(o.log, "Uploading:", sources[i].Path)
+					errs[i] = o.retry(ctx, o.retries, sources[i].Path, func() error {
+						var err error
+						files[i], err = putFile(ctx, o, s, sources[i])
+						return err
+					})
+				}
+				switch {
+				case !started || errs[i] != nil && ctx.Err() != nil:
+					errs[i] = ErrStopped
+					if parent.Err() != nil {
+						errs[i] = parent.Err()
+					}
+				case errs[i] != nil && !o.continueOnError:
+					stop()
+				}
+			}
+		}()
+	}
+	for i := range sources {
+		jobs <- i
+	}
+	close(jobs)
+	wg.Wait()
+
+	var (
+		uploaded []File
+		failed   []Failure
+	)
+	for i, src := range sources {
+		if errs[i] != nil {
+			failed = append(failed, Failure{Path: src.RelPath, Source: src.Path, Link: src.Link, Err: errs[i]})
+			continue
+		}
+		uploaded = append(uploaded, files[i])
+	}
+	o.expire(uploaded, time.Now())
+	m := New()
+	for _, f := range uploaded {
+		m.Add(f.Entry())
+	}
+	if len(failed) > 0 {
+		uerr := &UploadError{Uploaded: uploaded, Failed: failed}
+		if o.continueOnError {
+			uerr.Manifest = o.writePartial(ctx, m, failed, func(m *Manifest) error {
+				return putManifest(ctx, o, s, m)
+			})
+		}
+		return nil, uerr
+	}
+	if err := putManifest(ctx, o, s, m); err != nil {
+		return nil, err
+	}
+	res := &Result{Manifest: m, Files: uploaded}
+	for _, f := range uploaded {
+		res.add(f)
+	}
+	return res, nil
+}
+
+func putFile(ctx context.Context, o *options, s Storage, src Source) (File, error) {
+	if src.Link != "" {
+		return linkFile(src)
+	}
+	f, err := o.openLocal(src.Path)
+	if err != nil {
+		return File{}, err
+	}
+	defer f.Close()
+	fi, err := f.Stat()
+	if err != nil {
+		return File{}, err
+	}
+	given, trusted := o.givenDigest(src)
+	h := sha256.New()
+	if err := o.pace(ctx); err != nil {
+		return File{}, err
+	}
+	r := o.throttle(ctx, f)
+	if !trusted {
+		r = io.TeeReader(r, h)
+	}
+	if err := s.Put(ctx, src.RelPath, r, fi.Size()); err != nil {
+		return File{}, err
+	}
+	digest := given
+	if !trusted {
+		digest = formatDigest(h)
+		if err := checkGiven(src, given, digest); err != nil {
+			return File{}, err
+		}
+	}
+	info, err := s.Stat(ctx, src.RelPath)
+	if err != nil {
+		return File{}, err
+	}
+	if info.Size != fi.Size() {
+		return File{}, fmt.Errorf("stored %d bytes, want %d", info.Size, fi.Size())
+	}
+	return File{
+		Path:    src.RelPath,
+		Source:  src.Path,
+		Digest:  digest,
+		Size:    fi.Size(),
+		ModTime: fi.ModTime().UTC(),
+		Mode:    o.modeOf(fi),
+	}, nil
+}
+
+// putManifest writes m, and its signature and bundle if there is a signer,
+// to s.
+func putManifest(ctx context.Context, o *options, s Storage, m *Manifest) error {
+	b, err := m.MarshalJSON()
+	if err != nil {
+		return err
+	}
+	if err := putBytes(ctx, o, s, Name, b); err != nil {
+		return fmt.Errorf("uploading manifest: %v", err)
+	}
+	if o.signer == nil {
+		return nil
+	}
+	sig, bundle, err := o.sign(ctx, b)
+	if err != nil {
+		return fmt.Errorf("signing manifest: %v", err)
+	}
+	if err := putBytes(ctx, o, s, Name+SignatureSuffix, sig); err != nil {
+		return fmt.Errorf("uploading signature: %v", err)
+	}
+	if err := putBytes(ctx, o, s, Name+BundleSuffix, bundle); err != nil {
+		return fmt.Errorf("uploading signature bundle: %v", err)
+	}
+	return nil
+}
+
+func putBytes(ctx context.Context, o *options, s Storage, name string, b []byte) error {
+	return o.retry(ctx, o.manifestRetries, name+" upload", func() error {
+		return s.Put(ctx, name, bytes.NewReader(b), int64(len(b)))
+	})
+}
+
+// DownloadFrom is the backend-agnostic counterpart of Downloader.Download:
+// it fetches every file in m from s into the local directory dst, keeping
+// only those whose digest matches.
+func DownloadFrom(ctx context.Context, s Storage, m *Manifest, dst string, opts ...Option) error {
+	return newOptions(opts).download(ctx, m, dst, func(ctx context.Context, e Entry) (io.ReadCloser, error) {
+		return s.Get(ctx, e.ObjectName())
+	})
+}
+
+// VerifyStorage is the backend-agnostic counterpart of Verifier.Verify.
+// Every object is read back and its sha256 compared, since only GCS
+// reports a checksum that could be checked instead.
+func VerifyStorage(ctx context.Context, s Storage, m *Manifest, opts ...Option) (*Report, error) {
+	o := newOptions(opts)
+	objs, err := s.List(ctx, "")
+	if err != nil {
+		return nil, fmt.Errorf("listing: %v", err)
+	}
+	stored := map[string]ObjectInfo{}
+	for _, obj := range objs {
+		stored[obj.Name] = obj
+	}
+
+	objects := m.objects()
+	r := &Report{Checked: len(m.Files), Partial: m.Missing, Expected: len(objects)}
+	var toCheck []string
+	for _, p := range m.Paths() {
+		if m.Files[p].Link != "" {
+			continue
+		}
+		if _, ok := stored[m.Files[p].ObjectName()]; !ok {
+			r.Missing = append(r.Missing, p)
+			continue
+		}
+		toCheck = append(toCheck, p)
+	}
+	for name := range stored {
+		if !isManifestFile(name) {
+			r.Objects++
+		}
+		if !objects[name] && !isManifestFile(name) {
+			r.Extra = append(r.Extra, name)
+		}
+	}
+	sort.Strings(r.Extra)
+
+	jobs := make(chan string)
+	var (
+		mu sync.Mutex
+		wg sync.WaitGroup
+	)
+	for i := 0; i < o.parallelism; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for p := range jobs {
+				if err := checkStored(ctx, o, s, m.Files[p], stored[m.Files[p].ObjectName()]); err != nil {
+					mu.Lock()
+					r.Corrupted = append(r.Corrupted, Failure{Path: p, Err: err})
+					mu.Unlock()
+				}
+			}
+		}()
+	}
+	for _, p := range toCheck {
+		jobs <- p
+	}
+	close(jobs)
+	wg.Wait()
+	sort.Slice(r.Corrupted, func(i, j int) bool { return r.Corrupted[i].Path < r.Corrupted[j].Path })
+	return r, nil
+}
+
+func checkStored(ctx context.Context, o *options, s Storage, e Entry, info ObjectInfo) error {
+	if e.Size != 0 && info.Size != e.Size {
+		return fmt.Errorf("size mismatch: manifest has %d, got %d", e.Size, info.Size)
+	}
+	fmt.Fprintln(o.log, "Hashing:", info.Name)
+	rd, err := s.Get(ctx, info.Name)
+	if err != nil {
+		return err
+	}
+	defer rd.Close()
+	got, err := Digest(rd)
+	if err != nil {
+		return err
+	}
+	if got != e.Digest {
+		return fmt.Errorf("digest mismatch: manifest has %s, got %s", e.Digest, got)
+	}
+	return nil
+}
+
+// ReadManifest reads a manifest from a gs://, s3:// or file:// URI or a
+// local path, checking it as Downloader.ReadManifest does. No GCS client
+// is needed unless uri is gs:// or WithClient is given anyway.
+func ReadManifest(ctx context.Context, uri string, opts ...Option) (*Manifest, error) {
+	return newOptions(opts).readVerified(ctx, uri)
+}
+
+// Published is like Verifier.Published, for manifests read with
+// ReadManifest.
+func Published(ctx context.Context, uri string, opts ...Option) (time.Time, error) {
+	return newOptions(opts).published(ctx, uri)
+}
+
+// gcsStorage is a Storage over a GCS prefix, for tools that don't need
+// anything GCS-specific.
+type gcsStorage struct {
+	bucket *storage.BucketHandle
+	prefix string
+}
+
+func (s *gcsStorage) Put(ctx context.Context, name string, r io.Reader, size int64) error {
+	w := s.bucket.Object(path.Join(s.prefix, name)).NewWriter(ctx)
+	if _, err := io.Copy(w, r); err != nil {
+		w.Close()
+		return err
+	}
+	return w.Close()
+}
+
+func (s *gcsStorage) Get(ctx context.Context, name string) (io.ReadCloser, error) {
+	// Objects are read as stored, like those of the other backends, rather
+	// than decompressed.
+	r, err := s.bucket.Object(path.Join(s.prefix, name)).ReadCompressed(true).NewReader(ctx)
+	if err == storage.ErrObjectNotExist {
+		return nil, ErrNotExist
+	}
+	return r, err
+}
+
+func (s *gcsStorage) Stat(ctx context.Context, name string) (ObjectInfo, error) {
+	attrs, err := s.bucket.Object(path.Join(s.prefix, name)).Attrs(ctx)
+	if err == storage.ErrObjectNotExist {
+		return ObjectInfo{}, ErrNotExist
+	}
+	if err != nil {
+		return ObjectInfo{}, err
+	}
+	return ObjectInfo{Name: name, Size: attrs.Size, ModTime: attrs.Updated}, nil
+}
+
+func (s *gcsStorage) List(ctx context.Context, prefix string) ([]ObjectInfo, error) {
+	root := s.prefix
+	if root != "" && !strings.HasSuffix(root, "/") {
+		root += "/"
+	}
+	var objs []ObjectInfo
+	it := s.bucket.Objects(ctx, &storage.Query{Prefix: root + prefix})
+	for {
+		attrs, err := it.Next()
+		if err == iterator.Done {
+			return objs, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		if strings.HasSuffix(attrs.Name, "/") {
+			continue
+		}
+		objs = append(objs, ObjectInfo{Name: strings.TrimPrefix(attrs.Name, root), Size: attrs.Size, ModTime: attrs.Updated})
+	}
+}
@@ -0,0 +1,176 @@
+package manifest
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path"
+	"time"
+
+	"cloud.google.com/go/storage"
+)
+
+// Sync uploads only the sources that are new or changed since the manifest
+// already published at dst. A source is skipped if its sha256 matches that
+// manifest and its object still exists; the rest are uploaded with
+// UploadSources, and the manifest written covers both. Paths in the old
+// manifest that are no longer among sources are dropped from it, but their
+// objects are left in place. A new or changed source whose object was
+// written since by someone else is handled as WithConflictPolicy says.
+func (u *Uploader) Sync(ctx context.Context, sources []Source, dst string) (*Result, error) {
+	return u.notified(dst, func(u *Uploader) (*Result, error) {
+		return u.sync(ctx, sources, dst)
+	})
+}
+
+func (u *Uploader) sync(ctx context.Context, sources []Source, dst string) (*Result, error) {
+	bucketName, gcsPath, err := ParseURI(dst)
+	if err != nil {
+		return nil, err
+	}
+	bucket := u.client.Bucket(bucketName)
+
+	remote, err := Read(ctx, u.client, "gs://"+path.Join(bucketName, gcsPath, Name))
+	switch {
+	case err == storage.ErrObjectNotExist:
+		fmt.Fprintln(u.log, "No manifest at", dst+"; uploading everything")
+		remote = New()
+	case err != nil:
+		return nil, fmt.Errorf("reading existing manifest: %v", err)
+	}
+
+	var (
+		changed   []Source
+		unchanged []File
+		conflicts []string
+	)
+	// upload queues s, unless its object conflicts with it.
+	upload := func(s Source, want Entry, known bool) error {
+		if u.onConflict == "" || u.onConflict == LocalWins {
+			changed = append(changed, s)
+			return nil
+		}
+		obj := bucket.Object(path.Join(gcsPath, u.objectFor(s.RelPath)))
+		attrs, err := u.conflict(ctx, obj, s, want, known)
+		if err != nil || attrs == nil {
+			changed = append(changed, s)
+			return err
+		}
+		switch u.onConflict {
+		case RemoteWins:
+			fmt.Fprintln(u.log, "Changed remotely, keeping the remote copy:", s.Path)
+			f, err := u.adopt(ctx, obj, attrs, s)
+			if err != nil {
+				return err
+			}
+			unchanged = append(unchanged, f)
+		case SkipConflicts:
+			if u.strict {
+				return fmt.Errorf("%s conflicts with gs://%s/%s, changed remotely at %s, which strict mode won't skip", s.Path, attrs.Bucket, attrs.Name, attrs.Updated.UTC().Format(time.RFC3339))
+			}
+			u.warn(WarnConflict, s.Path, fmt.Sprintf("skipped: gs://%s/%s was changed remotely at %s", attrs.Bucket, attrs.Name, attrs.Updated.UTC().Format(time.RFC3339)))
+		default:
+			conflicts = append(conflicts, s.RelPath)
+		}
+		return nil
+	}
+	for _, s := range sources {
+		// Symlinks cost nothing to record again.
+		want, ok := remote.Files[s.RelPath]
+		if !ok || s.Link != "" || want.Link != "" {
+			if err := upload(s, want, ok); err != nil {
+				return nil, err
+			}
+			continue
+		}
+		got, modTime, mode, err := u.sourceDigest(ctx, s)
+		if err != nil {
+			return nil, err
+		}
+		// A file stored somewhere other than where it would be uploaded to
+		// now, under a different layout or route, is uploaded again.
+		placed := want.ObjectName() == u.objectFor(s.RelPath)
+		if u.cas {
+			placed = want.Object != ""
+		}
+		if got != want.Digest || want.ContentEncoding != u.compression || !placed || mode != want.Mode {
+			if err := upload(s, want, ok); err != nil {
+				return nil, err
+			}
+			continue
+		}
+		if err := u.pace(ctx); err != nil {
+			return nil, err
+		}
+		attrs, err := u.encrypted(bucket.Object(path.Join(gcsPath, want.ObjectName()))).Attrs(ctx)
+		if err == storage.ErrObjectNotExist {
+			fmt.Fprintln(u.log, "Missing from GCS, re-uploading:", s.Path)
+			changed = append(changed, s)
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		if enc := u.wantEncryption(); enc != nil && checkEncryption(enc, attrs) != nil {
+			fmt.Fprintln(u.log, "Not encrypted as asked, re-uploading:", s.Path)
+			changed = append(changed, s)
+			continue
+		}
+		fmt.Fprintln(u.log, "Unchanged:", s.Path)
+		size := attrs.Size
+		if want.ContentEncoding != "" {
+			size = want.Size
+		}
+		unchanged = append(unchanged, File{
+			Path:            s.RelPath,
+			Source:          s.Path,
+			Digest:          got,
+			Size:            size,
+			ContentType:     attrs.ContentType,
+			CRC32C:          FormatCRC32C(attrs.CRC32C),
+			ModTime:         modTime,
+			Generation:      attrs.Generation,
+			Encryption:      encryptionOf(attrs),
+			ContentEncoding: want.ContentEncoding,
+			StoredSize:      want.StoredSize,
+			StoredDigest:    want.StoredDigest,
+			Object:          want.Object,
+			Mode:            mode,
+			Parts:           want.Parts,
+			Expires:         want.Expires,
+		})
+	}
+	if len(conflicts) > 0 {
+		return nil, &ConflictError{Paths: conflicts}
+	}
+	fmt.Fprintf(u.log, "%d files unchanged, %d to upload\n", len(unchanged), len(changed))
+	return u.uploadSources(ctx, changed, dst, unchanged)
+}
+
+// sourceDigest returns the digest and modification time of a local file or
+// gs:// object, and the mode to record for it. A local file's digest comes
+// from WithDigests if it was given there.
+func (u *Uploader) sourceDigest(ctx context.Context, s Source) (string, time.Time, string, error) {
+	if isRemote(s.Path) {
+		bucketName, name, err := ParseURI(s.Path)
+		if err != nil {
+			return "", time.Time{}, "", err
+		}
+		if err := u.pace(ctx); err != nil {
+			return "", time.Time{}, "", err
+		}
+		r, err := u.client.Bucket(bucketName).Object(name).NewReader(ctx)
+		if err != nil {
+			return "", time.Time{}, "", err
+		}
+		defer r.Close()
+		d, err := Digest(r)
+		return d, r.Attrs.LastModified.UTC(), "", err
+	}
+	fi, err := os.Stat(s.Path)
+	if err != nil {
+		return "", time.Time{}, "", err
+	}
+	d, err := u.digestFile(s)
+	return d, fi.ModTime().UTC(), u.modeOf(fi), err
+}
@@ -0,0 +1,304 @@
+package manifest
+
+import (
+	"archive/tar"
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/sha256"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"time"
+)
+
+// UploadTar uploads every regular file in the tar stream r to the gs://
+// path dst and writes the manifest, without staging anything on local
+// disk. Entries are recorded under their cleaned tar names, and symlinks
+// and modes too under WithPreserveLinks and WithPreserveMode. A stream can't
+// be rewound, so unlike UploadSources a failed file fails the whole upload.
+func (u *Uploader) UploadTar(ctx context.Context, r io.Reader, dst string) (*Result, error) {
+	if u.cas {
+		// Each object's name would depend on a digest only known once
+		// it has been streamed.
+		return nil, fmt.Errorf("the content-addressed layout isn't supported for tar streams")
+	}
+	if u.replicas != nil {
+		return nil, fmt.Errorf("replicas aren't supported for tar streams")
+	}
+	bucketName, gcsPath, err := ParseURI(dst)
+	if err != nil {
+		return nil, err
+	}
+	bucket := u.client.Bucket(bucketName)
+
+	m := New()
+	var files []File
+	tr := tar.NewReader(r)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("reading tar stream: %v", err)
+		}
+		link := hdr.Typeflag == tar.TypeSymlink && u.preserveLinks
+		if hdr.Typeflag != tar.TypeReg && hdr.Typeflag != tar.TypeRegA && !link {
+			if u.strict && hdr.Typeflag != tar.TypeDir {
+				return nil, fmt.Errorf("tar entry %s isn't a regular file, which strict mode won't leave out", hdr.Name)
+			}
+			continue
+		}
+		rel := path.Clean(strings.TrimPrefix(hdr.Name, "./"))
+		if path.IsAbs(rel) || rel == ".." || strings.HasPrefix(rel, "../") {
+			return nil, fmt.Errorf("tar entry %q escapes the destination", hdr.Name)
+		}
+		if isManifestFile(rel) {
+			if err := u.skip(WarnManifest, hdr.Name, "file at the manifest's path"); err != nil {
+				return nil, err
+			}
+			continue
+		}
+		if _, ok := m.Files[rel]; ok {
+			return nil, fmt.Errorf("tar stream has %s more than once", rel)
+		}
+
+		if link {
+			target := cleanLink(hdr.Linkname)
+			if !linkInTree(rel, target) {
+				if err := u.skip(WarnSymlink, hdr.Name, "symlink to outside the tree"); err != nil {
+					return nil, err
+				}
+				continue
+			}
+			fmt.Fprintln(u.log, "Linked:", rel)
+			f := File{Path: rel, Digest: linkDigest(target), Size: int64(len(target)), ModTime: hdr.ModTime.UTC(), Link: target, Expires: u.expiryOf(rel, time.Now())}
+			files = append(files, f)
+			m.Add(f.Entry())
+			continue
+		}
+
+		fmt.Fprintln(u.log, "Uploading:", rel)
+		// A stream can't be checksummed up front, so what GCS stored is
+		// only checked afterwards.
+		f, err := u.send(ctx, bucket.Object(path.Join(gcsPath, rel)), rel, tr, nil, "", ioutil.Discard)
+		if err != nil {
+			return nil, fmt.Errorf("uploading %s: %v", rel, err)
+		}
+		f.Path = rel
+		f.ModTime = hdr.ModTime.UTC()
+		if u.preserveMode {
+			f.Mode = formatMode(os.FileMode(hdr.Mode))
+		}
+		f.Expires = u.expiryOf(rel, time.Now())
+		files = append(files, f)
+		m.Add(f.Entry())
+	}
+
+	if err := u.WriteManifest(ctx, dst, Name, m); err != nil {
+		return nil, fmt.Errorf("uploading manifest: %v", err)
+	}
+	res := &Result{Manifest: m, Files: files}
+	for _, f := range files {
+		res.add(f)
+	}
+	return res, nil
+}
+
+// VerifyTar checks the files in the tar stream r, which may be gzipped,
+// against m without extracting them, as an archive UploadTar was given
+// would be checked before accepting it. Every regular file must be in m
+// with the same digest, and size if m records one, and every symlink m
+// records must be in the stream with the same target; other symlinks,
+// which UploadTar skips unless preserving links, and anything at the
+// manifest's path are ignored. Files m lists that the stream lacks are reported Missing, and
+// those it has that m doesn't list Extra.
+func VerifyTar(r io.Reader, m *Manifest) (*Report, error) {
+	br := bufio.NewReader(r)
+	if magic, _ := br.Peek(2); len(magic) == 2 && magic[0] == 0x1f && magic[1] == 0x8b {
+		gz, err := gzip.NewReader(br)
+		if err != nil {
+			return nil, err
+		}
+		defer gz.Close()
+		r = gz
+	} else {
+		r = br
+	}
+
+	rep := &Report{Checked: len(m.Files), Partial: m.Missing}
+	seen := map[string]bool{}
+	tr := tar.NewReader(r)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("reading tar stream: %v", err)
+		}
+		if hdr.Typeflag != tar.TypeReg && hdr.Typeflag != tar.TypeRegA && hdr.Typeflag != tar.TypeSymlink {
+			continue
+		}
+		rel := path.Clean(strings.TrimPrefix(hdr.Name, "./"))
+		if isManifestFile(rel) {
+			continue
+		}
+		e, ok := m.Files[rel]
+		if hdr.Typeflag == tar.TypeSymlink {
+			if !ok || e.Link == "" {
+				continue
+			}
+			seen[rel] = true
+			if target := cleanLink(hdr.Linkname); target != e.Link {
+				rep.Corrupted = append(rep.Corrupted, Failure{Path: rel, Err: fmt.Errorf("link target mismatch: manifest has %s, got %s", e.Link, target)})
+			}
+			continue
+		}
+		if !ok {
+			rep.Extra = append(rep.Extra, rel)
+			continue
+		}
+		seen[rel] = true
+		got, err := Digest(tr)
+		if err != nil {
+			return nil, fmt.Errorf("reading %s from tar stream: %v", rel, err)
+		}
+		switch {
+		case e.Link != "":
+			rep.Corrupted = append(rep.Corrupted, Failure{Path: rel, Err: fmt.Errorf("manifest has a symlink to %s, got a regular file", e.Link)})
+		case e.Size != 0 && hdr.Size != e.Size:
+			// Version 1 manifests don't record sizes, so theirs are 0 and
+			// only the digest can be checked.
+			rep.Corrupted = append(rep.Corrupted, Failure{Path: rel, Err: fmt.Errorf("size mismatch: manifest has %d, got %d", e.Size, hdr.Size)})
+		case got != e.Digest:
+			rep.Corrupted = append(rep.Corrupted, Failure{Path: rel, Err: fmt.Errorf("digest mismatch: manifest has %s, got %s", e.Digest, got)})
+		}
+	}
+	for _, p := range m.Paths() {
+		if !seen[p] {
+			rep.Missing = append(rep.Missing, p)
+		}
+	}
+	sort.Strings(rep.Extra)
+	return rep, nil
+}
+
+// DownloadTar writes every file in m from under the gs:// path src to w as
+// a tar archive, in path order, without extracting anything to local
+// disk. Files are archived with the modes their entries record, and
+// symlinks as symlinks. Each file is verified against its size, or its
+// object's for version 1 manifests, which have none, and its digest before
+// any of it is written, so files larger than 256KiB are staged, one at a
+// time, in a temporary file in the WithSpool directory, or the default
+// temporary directory if it's unset. One that doesn't match stops
+// the archive before it, unfinished, and DownloadTar returns the error.
+// Paths that would escape the archive's root, and partial manifests, are
+// refused before anything is written.
+func (d *Downloader) DownloadTar(ctx context.Context, m *Manifest, src string, w io.Writer) error {
+	if m.Partial() {
+		return fmt.Errorf("the manifest is partial: %d files failed to upload", len(m.Missing))
+	}
+	for _, p := range m.Paths() {
+		if _, err := LocalPath(".", p); err != nil {
+			return err
+		}
+		if e := m.Files[p]; e.Link != "" && !linkInTree(p, e.Link) {
+			return fmt.Errorf("%s: symlink target %q is outside the archive", p, e.Link)
+		}
+	}
+	open, err := d.opener(src)
+	if err != nil {
+		return err
+	}
+
+	tw := tar.NewWriter(w)
+	for _, p := range m.Paths() {
+		e := m.Files[p]
+		perm, err := e.perm()
+		if err != nil {
+			return fmt.Errorf("%s: %v", p, err)
+		}
+		hdr := &tar.Header{Name: p, Mode: int64(perm), ModTime: e.ModTime}
+		if e.Link != "" {
+			hdr.Typeflag, hdr.Linkname, hdr.Mode = tar.TypeSymlink, e.Link, 0777
+			if err := tw.WriteHeader(hdr); err != nil {
+				return err
+			}
+			continue
+		}
+		fmt.Fprintln(d.log, "Streaming:", p)
+		if err := d.tarFile(ctx, tw, hdr, e, open); err != nil {
+			return fmt.Errorf("%s: %v", p, err)
+		}
+	}
+	return tw.Close()
+}
+
+// tarFile writes the file e describes, opened with open, to tw under hdr.
+// The file is read in full and its size and digest checked before its
+// header is written, in memory if it's small and otherwise through a
+// temporary file in the WithSpool directory, so that nothing unverified
+// ever reaches the archive.
+func (d *Downloader) tarFile(ctx context.Context, tw *tar.Writer, hdr *tar.Header, e Entry, open func(context.Context, Entry) (io.ReadCloser, error)) error {
+	r, err := open(ctx, e)
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+	body, want, err := d.decode(e, r)
+	if err != nil {
+		return err
+	}
+	hdr.Size = e.Size
+	if e.ContentEncoding != "" && d.keepEncoding {
+		hdr.Size = e.StoredSize
+	}
+	if t, ok := r.(throttledReadCloser); ok && hdr.Size == 0 && e.ContentEncoding == "" {
+		// Version 1 manifests don't record sizes, so the header takes the
+		// object's own, and only the digest is checked against m.
+		hdr.Size = t.size
+	}
+
+	var verified io.Reader
+	h := sha256.New()
+	var n int64
+	if hdr.Size <= tinyObject {
+		var buf bytes.Buffer
+		n, err = io.Copy(io.MultiWriter(&buf, h), body)
+		verified = &buf
+	} else {
+		tmp, terr := ioutil.TempFile(d.spoolDir, "gcs-manifest-tar-")
+		if terr != nil {
+			return terr
+		}
+		defer os.Remove(tmp.Name())
+		defer tmp.Close()
+		n, err = io.Copy(io.MultiWriter(tmp, h), body)
+		if err == nil {
+			_, err = tmp.Seek(0, io.SeekStart)
+		}
+		verified = tmp
+	}
+	if err != nil {
+		return err
+	}
+	if n != hdr.Size {
+		return fmt.Errorf("size mismatch: manifest has %d, got %d", hdr.Size, n)
+	}
+	if got := formatDigest(h); got != want {
+		return fmt.Errorf("digest mismatch: manifest has %s, got %s", want, got)
+	}
+
+	if err := tw.WriteHeader(hdr); err != nil {
+		return err
+	}
+	_, err = io.Copy(tw, verified)
+	return err
+}
@@ -0,0 +1,243 @@
+package manifest
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"io/ioutil"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// tarFixture is a file or, with link set, a symlink in a test archive.
+type tarFixture struct {
+	name, body, link string
+}
+
+func makeTar(t *testing.T, files ...tarFixture) []byte {
+	var buf bytes.Buffer
+	tw := tar.NewWriter(&buf)
+	for _, f := range files {
+		hdr := &tar.Header{Name: f.name, Mode: 0644, Size: int64(len(f.body)), Typeflag: tar.TypeReg}
+		if f.link != "" {
+			hdr = &tar.Header{Name: f.name, Mode: 0777, Linkname: f.link, Typeflag: tar.TypeSymlink}
+		}
+		if err := tw.WriteHeader(hdr); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := tw.Write([]byte(f.body)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func gzipped(t *testing.T, b []byte) []byte {
+	var buf bytes.Buffer
+	gz := gzip.NewWriter(&buf)
+	if _, err := gz.Write(b); err != nil {
+		t.Fatal(err)
+	}
+	if err := gz.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func manifestOf(entries ...Entry) *Manifest {
+	m := New()
+	for _, e := range entries {
+		m.Add(e)
+	}
+	return m
+}
+
+func digestOf(t *testing.T, s string) string {
+	d, err := Digest(strings.NewReader(s))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return d
+}
+
+func TestVerifyTar(t *testing.T) {
+	a := Entry{Path: "a", Digest: digestOf(t, "alpha"), Size: 5}
+	b := Entry{Path: "dir/b", Digest: digestOf(t, "beta"), Size: 4}
+	link := Entry{Path: "l", Digest: linkDigest("a"), Size: 1, Link: "a"}
+	v1, err := Parse([]byte(`{"a": "` + a.Digest + `", "dir/b": "` + b.Digest + `"}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	wrongSize := b
+	wrongSize.Size = 3
+	archive := makeTar(t, tarFixture{name: "a", body: "alpha"}, tarFixture{name: "./dir/b", body: "beta"}, tarFixture{name: Name, body: "{}"})
+
+	for _, tc := range []struct {
+		name          string
+		archive       []byte
+		m             *Manifest
+		wantMissing   []string
+		wantExtra     []string
+		wantCorrupted []string
+	}{{
+		name:    "match",
+		archive: archive,
+		m:       manifestOf(a, b),
+	}, {
+		name:    "gzipped",
+		archive: gzipped(t, archive),
+		m:       manifestOf(a, b),
+	}, {
+		name:    "version 1 manifest",
+		archive: archive,
+		m:       v1,
+	}, {
+		name:          "version 1 manifest with changed contents",
+		archive:       makeTar(t, tarFixture{name: "a", body: "alpha"}, tarFixture{name: "dir/b", body: "bet"}),
+		m:             v1,
+		wantCorrupted: []string{"dir/b"},
+	}, {
+		name:          "size mismatch",
+		archive:       archive,
+		m:             manifestOf(a, wrongSize),
+		wantCorrupted: []string{"dir/b"},
+	}, {
+		name:          "digest mismatch",
+		archive:       makeTar(t, tarFixture{name: "a", body: "alpha"}, tarFixture{name: "dir/b", body: "BETA"}),
+		m:             manifestOf(a, b),
+		wantCorrupted: []string{"dir/b"},
+	}, {
+		name:        "missing and extra",
+		archive:     makeTar(t, tarFixture{name: "a", body: "alpha"}, tarFixture{name: "c", body: "gamma"}),
+		m:           manifestOf(a, b),
+		wantMissing: []string{"dir/b"},
+		wantExtra:   []string{"c"},
+	}, {
+		name:    "symlink",
+		archive: makeTar(t, tarFixture{name: "a", body: "alpha"}, tarFixture{name: "l", link: "a"}),
+		m:       manifestOf(a, link),
+	}, {
+		name:          "symlink to elsewhere",
+		archive:       makeTar(t, tarFixture{name: "a", body: "alpha"}, tarFixture{name: "l", link: "dir/b"}),
+		m:             manifestOf(a, link),
+		wantCorrupted: []string{"l"},
+	}, {
+		name:          "file where a symlink was",
+		archive:       makeTar(t, tarFixture{name: "a", body: "alpha"}, tarFixture{name: "l", body: "a"}),
+		m:             manifestOf(a, link),
+		wantCorrupted: []string{"l"},
+	}} {
+		t.Run(tc.name, func(t *testing.T) {
+			rep, err := VerifyTar(bytes.NewReader(tc.archive), tc.m)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var corrupted []string
+			for _, f := range rep.Corrupted {
+				corrupted = append(corrupted, f.Path)
+			}
+			if !reflect.DeepEqual(rep.Missing, tc.wantMissing) {
+				t.Errorf("Missing = %v, want %v", rep.Missing, tc.wantMissing)
+			}
+			if !reflect.DeepEqual(rep.Extra, tc.wantExtra) {
+				t.Errorf("Extra = %v, want %v", rep.Extra, tc.wantExtra)
+			}
+			if !reflect.DeepEqual(corrupted, tc.wantCorrupted) {
+				t.Errorf("Corrupted = %v, want %v", rep.Corrupted, tc.wantCorrupted)
+			}
+		})
+	}
+}
+
+func TestDownloadTar(t *testing.T) {
+	small, large := "alpha", strings.Repeat("beta", tinyObject/4+1)
+	a := Entry{Path: "a", Digest: digestOf(t, small), Size: int64(len(small))}
+	b := Entry{Path: "dir/b", Digest: digestOf(t, large), Size: int64(len(large))}
+	v1, err := Parse([]byte(`{"a": "` + a.Digest + `", "dir/b": "` + b.Digest + `"}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	wrongSize, wrongDigest := a, a
+	wrongSize.Size = 4
+	wrongDigest.Digest = digestOf(t, "alphA")
+
+	for _, tc := range []struct {
+		name     string
+		m        *Manifest
+		truncate string
+		// want are the files the archive has, in order; wantErr says
+		// whether it was cut short.
+		want    []string
+		wantErr bool
+	}{{
+		name: "sizes recorded",
+		m:    manifestOf(a, b),
+		want: []string{"a", "dir/b"},
+	}, {
+		name: "version 1 manifest",
+		m:    v1,
+		want: []string{"a", "dir/b"},
+	}, {
+		name:     "version 1 manifest with a truncated object",
+		m:        v1,
+		truncate: "dir/b",
+		want:     []string{"a"},
+		wantErr:  true,
+	}, {
+		name:     "truncated object",
+		m:        manifestOf(a, b),
+		truncate: "a",
+		wantErr:  true,
+	}, {
+		name:    "size mismatch",
+		m:       manifestOf(wrongSize, b),
+		wantErr: true,
+	}, {
+		name:    "digest mismatch",
+		m:       manifestOf(wrongDigest, b),
+		wantErr: true,
+	}} {
+		t.Run(tc.name, func(t *testing.T) {
+			fake, client := newFakeGCS(t)
+			fake.put("b/release/a", []byte(small), nil)
+			fake.put("b/release/dir/b", []byte(large), nil)
+			if tc.truncate != "" {
+				fake.truncate["b/release/"+tc.truncate] = true
+			}
+			d, err := NewDownloader(context.Background(), WithClient(client), WithLog(ioutil.Discard))
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			var buf bytes.Buffer
+			err = d.DownloadTar(context.Background(), tc.m, "gs://b/release", &buf)
+			if (err != nil) != tc.wantErr {
+				t.Fatalf("DownloadTar: %v, want error %v", err, tc.wantErr)
+			}
+			var got []string
+			tr := tar.NewReader(&buf)
+			for {
+				hdr, err := tr.Next()
+				if err != nil {
+					break
+				}
+				body, err := ioutil.ReadAll(tr)
+				if err != nil {
+					t.Fatalf("reading %s: %v", hdr.Name, err)
+				}
+				if want := map[string]string{"a": small, "dir/b": large}[hdr.Name]; string(body) != want {
+					t.Errorf("%s has %d bytes, want %d", hdr.Name, len(body), len(want))
+				}
+				got = append(got, hdr.Name)
+			}
+			if !reflect.DeepEqual(got, tc.want) {
+				t.Errorf("archive has %v, want %v", got, tc.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,91 @@
+package manifest
+
+import (
+	"context"
+	"io"
+	"math"
+	"sync"
+	"time"
+)
+
+// limiter is a token bucket that paces whatever shares it to rate tokens
+// a second, allowing bursts of up to a second's worth.
+type limiter struct {
+	mu     sync.Mutex
+	rate   float64
+	burst  float64
+	tokens float64
+	last   time.Time
+}
+
+func newLimiter(rate float64) *limiter {
+	burst := math.Max(rate, 1)
+	return &limiter{rate: rate, burst: burst, tokens: burst, last: time.Now()}
+}
+
+// wait takes n tokens, blocking until the bucket has refilled enough to
+// cover them or ctx is done. Tokens are taken at once, going into debt if
+// need be, so that callers are served in the order they arrive.
+func (l *limiter) wait(ctx context.Context, n float64) error {
+	if l == nil {
+		return nil
+	}
+	l.mu.Lock()
+	now := time.Now()
+	l.tokens = math.Min(l.burst, l.tokens+now.Sub(l.last).Seconds()*l.rate)
+	l.last = now
+	l.tokens -= n
+	var d time.Duration
+	if l.tokens < 0 {
+		d = time.Duration(-l.tokens / l.rate * float64(time.Second))
+	}
+	l.mu.Unlock()
+	if d == 0 {
+		return nil
+	}
+	t := time.NewTimer(d)
+	defer t.Stop()
+	select {
+	case <-t.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// throttleChunk is the most a throttledReader reads at once.
+const throttleChunk = 32 << 10
+
+// throttledReader paces reads from r to its limiter's rate in bytes.
+type throttledReader struct {
+	ctx context.Context
+	r   io.Reader
+	l   *limiter
+}
+
+func (t *throttledReader) Read(p []byte) (int, error) {
+	// Small reads keep the pace even rather than bursty.
+	if max := int(math.Min(t.l.burst, throttleChunk)); len(p) > max {
+		p = p[:max]
+	}
+	n, err := t.r.Read(p)
+	if n > 0 {
+		if werr := t.l.wait(t.ctx, float64(n)); werr != nil {
+			return n, werr
+		}
+	}
+	return n, err
+}
+
+// throttle returns r paced to WithMaxBandwidth, if it was given.
+func (o *options) throttle(ctx context.Context, r io.Reader) io.Reader {
+	if o.bandwidth == nil {
+		return r
+	}
+	return &throttledReader{ctx: ctx, r: r, l: o.bandwidth}
+}
+
+// pace waits for WithMaxRequestRate to allow another object operation.
+func (o *options) pace(ctx context.Context) error {
+	return o.requests.wait(ctx, 1)
+}
@@ -0,0 +1,1069 @@
+package manifest
+
+import (
+	"bufio"
+	"context"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"hash"
+	"hash/crc32"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"cloud.google.com/go/storage"
+)
+
+var castagnoli = crc32.MakeTable(crc32.Castagnoli)
+
+// Source is a local file and the manifest path it is recorded under.
+type Source struct {
+	Path    string
+	RelPath string
+	// Link is the target of a symlink source, recorded rather than
+	// followed under WithPreserveLinks.
+	Link string
+}
+
+// File is a successfully uploaded file.
+type File struct {
+	// Path is the file's manifest path.
+	Path string
+	// Source is the local file it was read from.
+	Source      string
+	Digest      string
+	Size        int64
+	ContentType string
+	CRC32C      string
+	ModTime     time.Time
+	Generation  int64
+	Encryption  *Encryption
+	// ContentEncoding, StoredSize and StoredDigest describe the stored
+	// object when it was compressed; Size and Digest are always those of
+	// the original file.
+	ContentEncoding string
+	StoredSize      int64
+	StoredDigest    string
+	// Object is the name the file is stored under when it isn't Path, and
+	// Existing is set when that object was already stored and nothing was
+	// uploaded, as happens under the content-addressed layout.
+	Object   string
+	Existing bool
+	// Mode, Link, Parts and Expires are as in Entry.
+	Mode    string
+	Link    string
+	Parts   []Part
+	Expires *time.Time
+}
+
+// FormatCRC32C renders a CRC32C the way manifests record it.
+func FormatCRC32C(c uint32) string {
+	return fmt.Sprintf("%08x", c)
+}
+
+// Entry returns f's manifest entry.
+func (f File) Entry() Entry {
+	return Entry{
+		Path:            f.Path,
+		Digest:          f.Digest,
+		Size:            f.Size,
+		ContentType:     f.ContentType,
+		CRC32C:          f.CRC32C,
+		ModTime:         f.ModTime,
+		Encryption:      f.Encryption,
+		ContentEncoding: f.ContentEncoding,
+		StoredSize:      f.StoredSize,
+		StoredDigest:    f.StoredDigest,
+		Object:          f.Object,
+		Mode:            f.Mode,
+		Link:            f.Link,
+		Parts:           f.Parts,
+		Expires:         f.Expires,
+	}
+}
+
+// Failure is a file that could not be uploaded or downloaded.
+type Failure struct {
+	Path   string
+	Source string
+	// Link is the source's symlink target, when it is a symlink being
+	// preserved, so that retrying it records the link again.
+	Link string
+	Err  error
+}
+
+// ErrStopped is the error of the files an upload didn't finish because
+// another file failed first; see WithContinueOnError.
+var ErrStopped = errors.New("not uploaded: stopped after another file failed")
+
+// UploadError is returned when some files could not be uploaded. Only a
+// partial manifest, if any, is written in that case; Uploaded and Failed
+// together describe the whole run so it can be finished later with
+// UploadSources.
+type UploadError struct {
+	Uploaded []File
+	Failed   []Failure
+	// Prior is how many of Uploaded, at the start, were passed in as prior
+	// rather than uploaded by this run.
+	Prior int
+	// Manifest is the partial manifest published under
+	// WithContinueOnError, listing the failed paths as missing, or nil if
+	// none was.
+	Manifest *Manifest
+}
+
+func (e *UploadError) Error() string {
+	return fmt.Sprintf("%d of %d files failed to upload", len(e.Failed), len(e.Uploaded)+len(e.Failed))
+}
+
+// Result describes a completed upload.
+type Result struct {
+	Manifest *Manifest
+	Files    []File
+	// Uploaded is how many of Files this run uploaded, rather than carried
+	// over from prior or found unchanged by Sync, and Bytes how many bytes
+	// it sent for them.
+	Uploaded int
+	Bytes    int64
+	// Prior is how many of Files, at the start, were carried over from
+	// prior or found unchanged by Sync.
+	Prior int
+}
+
+// add counts f as uploaded by this run.
+func (r *Result) add(f File) {
+	if f.Existing || f.Link != "" {
+		return
+	}
+	r.Uploaded++
+	if f.ContentEncoding != "" {
+		r.Bytes += f.StoredSize
+	} else {
+		r.Bytes += f.Size
+	}
+}
+
+// Uploader uploads local files to GCS and publishes their manifest.
+type Uploader struct {
+	*options
+}
+
+// NewUploader returns an Uploader. Unless WithClient is given, a GCS client
+// is created with default credentials.
+func NewUploader(ctx context.Context, opts ...Option) (*Uploader, error) {
+	o := newOptions(opts)
+	if err := checkCompression(o.compression); err != nil {
+		return nil, err
+	}
+	if o.cas && o.compression != "" {
+		return nil, fmt.Errorf("the content-addressed layout doesn't support compression")
+	}
+	if o.cas && len(o.routes) > 0 {
+		return nil, fmt.Errorf("the content-addressed layout doesn't support routes")
+	}
+	if o.cas && o.onConflict != "" && o.onConflict != LocalWins {
+		return nil, fmt.Errorf("the content-addressed layout doesn't support conflict policies")
+	}
+	if o.kmsKey != "" && o.encryptionKey != nil {
+		return nil, fmt.Errorf("a KMS key and a customer-supplied encryption key can't both be used")
+	}
+	if o.partSize > 0 && (o.compression != "" || o.encryptionKey != nil) {
+		return nil, fmt.Errorf("composite uploads don't support compression or customer-supplied encryption keys")
+	}
+	if o.strict && o.continueOnError {
+		return nil, fmt.Errorf("strict mode can't continue on errors, which publishes partial manifests")
+	}
+	if o.encryptionKey != nil && len(o.encryptionKey) != 32 {
+		return nil, fmt.Errorf("encryption key is %d bytes, want 32 for AES-256", len(o.encryptionKey))
+	}
+	if o.client == nil {
+		c, err := storage.NewClient(ctx)
+		if err != nil {
+			return nil, fmt.Errorf("creating GCS client: %v", err)
+		}
+		o.client = c
+	}
+	if err := o.replicas.check(o); err != nil {
+		return nil, err
+	}
+	return &Uploader{options: o}, nil
+}
+
+// Upload uploads src, a file, directory or glob, to the gs:// path dst and
+// writes the manifest next to the files.
+func Upload(ctx context.Context, src, dst string, opts ...Option) (*Manifest, error) {
+	u, err := NewUploader(ctx, opts...)
+	if err != nil {
+		return nil, err
+	}
+	res, err := u.Upload(ctx, src, dst)
+	if err != nil {
+		return nil, err
+	}
+	return res.Manifest, nil
+}
+
+// Upload uploads src, a file, directory, glob or gs:// prefix, to the gs://
+// path dst and writes the manifest next to the files.
+func (u *Uploader) Upload(ctx context.Context, src, dst string) (*Result, error) {
+	sources, err := u.Expand(ctx, src)
+	if err != nil {
+		return nil, err
+	}
+	return u.UploadSources(ctx, sources, dst, nil)
+}
+
+// UploadSources uploads the given files to dst. Files already uploaded by
+// an earlier, partially failed run can be passed as prior; they are included
+// in the manifest without being uploaded again.
+func (u *Uploader) UploadSources(ctx context.Context, sources []Source, dst string, prior []File) (*Result, error) {
+	return u.notified(dst, func(u *Uploader) (*Result, error) {
+		return u.uploadSources(ctx, sources, dst, prior)
+	})
+}
+
+func (u *Uploader) uploadSources(ctx context.Context, sources []Source, dst string, prior []File) (*Result, error) {
+	bucketName, gcsPath, err := ParseURI(dst)
+	if err != nil {
+		return nil, err
+	}
+	bucket := u.client.Bucket(bucketName)
+
+	// The manifest is written to dst after the data, so a data file at the
+	// same path would be recorded and then overwritten.
+	if sources, err = u.excludeManifest(sources); err != nil {
+		return nil, err
+	}
+	if err := u.checkRoutes(sources, prior); err != nil {
+		return nil, err
+	}
+
+	if u.stableWait > 0 {
+		if sources, err = u.filterStable(sources); err != nil {
+			return nil, err
+		}
+	}
+
+	var before fingerprint
+	if u.snapshotSrc != "" {
+		if before, err = u.fingerprint(u.snapshotSrc); err != nil {
+			return nil, err
+		}
+	}
+
+	files := append([]File(nil), prior...)
+	var failed []Failure
+	t := u.startTracker(sources)
+	cp := u.startCheckpoint(dst, prior)
+	for _, r := range u.uploadAll(ctx, sources, gcsPath, bucket, t, cp) {
+		if r.err == nil {
+			files = append(files, r.file)
+			continue
+		}
+		// Give failures a second chance one at a time, after the main pass,
+		// so they aren't competing with everything else for bandwidth. A
+		// run that stopped at the first failure doesn't carry on here.
+		if u.continueOnError && ctx.Err() == nil && !errors.Is(r.err, ErrDeadline) {
+			fmt.Fprintf(u.log, "Retrying: %s: %v\n", r.file.Path, r.err)
+			t.retried()
+			file, err := u.uploadFile(ctx, Source{Path: r.file.Source, RelPath: r.file.Path, Link: r.file.Link}, gcsPath, bucket, t)
+			if err == nil {
+				t.uploaded(file)
+				cp.add(file)
+				files = append(files, file)
+				continue
+			}
+			t.failed()
+			r.err = err
+		}
+		failed = append(failed, Failure{Path: r.file.Path, Source: r.file.Source, Link: r.file.Link, Err: r.err})
+	}
+	t.close()
+	// Under WithReplicas, a file stored in too few places fails, even one
+	// carried over from prior.
+	carried := len(prior)
+	var replicated []map[string]bool
+	if u.replicas != nil {
+		var unreplicated []Failure
+		unreplicated, replicated = u.replicate(ctx, files, gcsPath, bucket)
+		if len(unreplicated) > 0 {
+			drop := map[string]bool{}
+			for _, f := range unreplicated {
+				drop[f.Path] = true
+			}
+			kept := files[:0:0]
+			for i, f := range files {
+				if drop[f.Path] {
+					if i < len(prior) {
+						carried--
+					}
+					continue
+				}
+				kept = append(kept, f)
+			}
+			files = kept
+			failed = append(failed, unreplicated...)
+		}
+	}
+
+	if before != nil && ctx.Err() == nil {
+		if err := u.checkSnapshot(before, sources, prior); err != nil {
+			cp.close(false)
+			return nil, err
+		}
+	}
+
+	u.expire(files, time.Now())
+	m := New()
+	for _, f := range files {
+		m.Add(f.Entry())
+	}
+	if len(failed) > 0 {
+		cp.close(false)
+		uerr := &UploadError{Uploaded: files, Failed: failed, Prior: carried}
+		if u.continueOnError {
+			uerr.Manifest = u.writePartial(ctx, m, failed, func(m *Manifest) error {
+				return u.WriteManifest(ctx, dst, Name, m)
+			})
+		}
+		return nil, uerr
+	}
+	if err := u.WriteManifest(ctx, dst, Name, m); err != nil {
+		cp.close(false)
+		return nil, fmt.Errorf("uploading manifest: %v", err)
+	}
+	if u.replicas != nil {
+		if err := u.writeReplicaManifests(ctx, m, replicated); err != nil {
+			cp.close(false)
+			return nil, err
+		}
+	}
+	cp.close(true)
+	res := &Result{Manifest: m, Files: files, Prior: carried}
+	for _, f := range files[carried:] {
+		res.add(f)
+	}
+	return res, nil
+}
+
+// writePartial marks m as missing the failed paths and publishes it with
+// write, returning it, or nil if it couldn't be written. The run has failed
+// either way, so a failure to write is only logged.
+func (o *options) writePartial(ctx context.Context, m *Manifest, failed []Failure, write func(*Manifest) error) *Manifest {
+	if ctx.Err() != nil {
+		return nil
+	}
+	for _, f := range failed {
+		m.Missing = append(m.Missing, f.Path)
+	}
+	if err := write(m); err != nil {
+		fmt.Fprintf(o.log, "FAILED: writing the partial manifest: %v\n", err)
+		return nil
+	}
+	fmt.Fprintf(o.log, "Wrote a partial manifest, missing %d files\n", len(m.Missing))
+	return m
+}
+
+// WriteManifest uploads m as name under dst. It is a resumable, chunked
+// write with its own retries, and the stored object's size and CRC32C are
+// checked afterwards: the manifest is written last, so losing it to a blip
+// wastes the whole run.
+func (u *Uploader) WriteManifest(ctx context.Context, dst, name string, m *Manifest) error {
+	bucketName, gcsPath, err := ParseURI(dst)
+	if err != nil {
+		return err
+	}
+	b, err := m.MarshalJSON()
+	if err != nil {
+		return err
+	}
+	return u.putManifest(ctx, u.client.Bucket(bucketName), path.Join(gcsPath, name), b, false)
+}
+
+// putManifest writes the manifest b to object, and its signature and
+// bundle next to it if there is a Signer. If immutable, nothing is
+// overwritten: each object is only created, and one that already exists
+// is kept, as long as the manifest already there is b.
+func (u *Uploader) putManifest(ctx context.Context, bucket *storage.BucketHandle, object string, b []byte, immutable bool) error {
+	obj := bucket.Object(object)
+	if immutable {
+		obj = obj.If(storage.Conditions{DoesNotExist: true})
+	}
+	name := path.Base(object)
+
+	crc := crc32.Checksum(b, castagnoli)
+	err := u.retry(ctx, u.manifestRetries, "manifest upload", func() error {
+		w := obj.NewWriter(ctx)
+		w.ChunkSize = u.manifestChunkSize
+		w.KMSKeyName = u.kmsKey
+		w.CRC32C = crc
+		w.SendCRC32C = true
+		if _, err := w.Write(b); err != nil {
+			w.Close()
+			return err
+		}
+		if err := w.Close(); err != nil {
+			if immutable && isPreconditionFailed(err) {
+				return sameManifest(ctx, bucket.Object(object), b)
+			}
+			return err
+		}
+		attrs := w.Attrs()
+		if attrs.Size != int64(len(b)) || attrs.CRC32C != crc {
+			return fmt.Errorf("stored manifest has size %d and crc32c %08x, want %d and %08x", attrs.Size, attrs.CRC32C, len(b), crc)
+		}
+		return nil
+	})
+	if err != nil || u.signer == nil {
+		return err
+	}
+
+	sig, bundle, err := u.sign(ctx, b)
+	if err != nil {
+		return fmt.Errorf("signing manifest: %v", err)
+	}
+	for _, o := range []struct {
+		suffix string
+		b      []byte
+	}{{SignatureSuffix, sig}, {BundleSuffix, bundle}} {
+		obj := bucket.Object(object + o.suffix)
+		if immutable {
+			obj = obj.If(storage.Conditions{DoesNotExist: true})
+		}
+		err := u.retry(ctx, u.manifestRetries, name+o.suffix+" upload", func() error {
+			w := obj.NewWriter(ctx)
+			w.KMSKeyName = u.kmsKey
+			if _, err := w.Write(o.b); err != nil {
+				w.Close()
+				return err
+			}
+			err := w.Close()
+			// A signature of the same manifest from an earlier publish is
+			// as good as this one.
+			if immutable && isPreconditionFailed(err) {
+				return nil
+			}
+			return err
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// retry calls f until it succeeds, up to retries more times, sleeping with
+// exponential backoff in between.
+func (o *options) retry(ctx context.Context, retries int, what string, f func() error) error {
+	backoff := time.Second
+	err := f()
+	for attempt := 1; err != nil && attempt <= retries; attempt++ {
+		fmt.Fprintf(o.log, "Retrying %s in %v: %v\n", what, backoff, err)
+		select {
+		case <-time.After(backoff):
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+		backoff *= 2
+		err = f()
+	}
+	return err
+}
+
+// Expand resolves src into the files to upload. src may be a file, a
+// directory, or a shell-style glob; globs are expanded here rather than
+// relying on a shell, with matches recorded relative to the directory the
+// pattern starts in. WithMaxDepth and WithMaxFiles bound the walk.
+func Expand(src string, opts ...Option) ([]Source, error) {
+	return newOptions(opts).expand(src)
+}
+
+// walkState is shared by the walks of every match of a glob.
+type walkState struct {
+	n       int
+	exclude ignoreRules
+	include ignoreRules
+}
+
+func (o *options) expand(src string) ([]Source, error) {
+	root := src
+	if hasMeta(src) {
+		root = globRoot(src)
+	}
+	st := &walkState{include: parseRules(o.include)}
+	if o.ignoreFile {
+		rules, err := readIgnoreFile(root)
+		if err != nil {
+			return nil, err
+		}
+		st.exclude = rules
+	}
+	// Flags come after the file so they can override it.
+	st.exclude = append(st.exclude, parseRules(o.exclude)...)
+
+	if !hasMeta(src) {
+		return o.walk(src, "", st)
+	}
+	matches, err := filepath.Glob(src)
+	if err != nil {
+		return nil, err
+	}
+	if len(matches) == 0 {
+		return nil, fmt.Errorf("no files match %s", src)
+	}
+	absRoot, err := filepath.Abs(root)
+	if err != nil {
+		return nil, err
+	}
+	var sources []Source
+	for _, m := range matches {
+		s, err := o.walk(m, absRoot, st)
+		if err != nil {
+			return nil, err
+		}
+		sources = append(sources, s...)
+	}
+	return sources, nil
+}
+
+func hasMeta(path string) bool {
+	return strings.ContainsAny(path, `*?[`)
+}
+
+// globRoot returns the longest leading directory of pattern that contains
+// no glob metacharacters.
+func globRoot(pattern string) string {
+	dir := filepath.Dir(pattern)
+	for hasMeta(dir) {
+		dir = filepath.Dir(dir)
+	}
+	return dir
+}
+
+// walk returns the regular files under root. Paths are recorded relative
+// to relTo, or to root itself if relTo is empty.
+func (o *options) walk(root, relTo string, st *walkState) ([]Source, error) {
+	absRoot, err := filepath.Abs(root)
+	if err != nil {
+		return nil, err
+	}
+	var (
+		sources []Source
+		rootDev uint64
+		haveDev bool
+	)
+	err = filepath.Walk(absRoot, func(path string, fi os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if o.oneFileSystem {
+			dev, ok := device(fi)
+			switch {
+			case path == absRoot:
+				rootDev, haveDev = dev, ok
+			case haveDev && ok && dev != rootDev:
+				fmt.Fprintln(o.log, "Skipping other filesystem:", path)
+				if fi.IsDir() {
+					return filepath.SkipDir
+				}
+				return nil
+			}
+		}
+
+		// We might start with a file, not a directory, in which case it's
+		// recorded under its own name.
+		var relPath string
+		switch {
+		case relTo != "":
+			relPath, err = filepath.Rel(relTo, path)
+		case absRoot == path:
+			relPath = filepath.Base(path)
+		default:
+			relPath, err = filepath.Rel(absRoot, path)
+		}
+		if err != nil {
+			return err
+		}
+		relPath = filepath.ToSlash(relPath)
+		if path != absRoot || !fi.IsDir() {
+			if st.exclude.ignored(relPath, fi.IsDir()) {
+				if o.strict {
+					return fmt.Errorf("%s is excluded, which strict mode won't allow", path)
+				}
+				if fi.IsDir() {
+					return filepath.SkipDir
+				}
+				return nil
+			}
+			if !fi.IsDir() && len(st.include) > 0 && !st.include.matchAny(relPath) {
+				if o.strict {
+					return fmt.Errorf("%s isn't included, which strict mode won't allow", path)
+				}
+				return nil
+			}
+		}
+
+		if fi.IsDir() && path != absRoot && o.maxDepth > 0 {
+			rel, err := filepath.Rel(absRoot, path)
+			if err != nil {
+				return err
+			}
+			if depth := strings.Count(rel, string(filepath.Separator)) + 1; depth > o.maxDepth {
+				return fmt.Errorf("%s is nested more than %d directories below %s; raise the max depth if this is intended", path, o.maxDepth, absRoot)
+			}
+		}
+		if !fi.Mode().IsRegular() {
+			if fi.IsDir() {
+				return nil
+			}
+			if fi.Mode()&os.ModeSymlink != 0 {
+				if !o.preserveLinks {
+					return o.skip(WarnSymlink, path, "symlink")
+				}
+				target, err := os.Readlink(path)
+				if err != nil {
+					return err
+				}
+				target = cleanLink(target)
+				if !linkInTree(relPath, target) {
+					return o.skip(WarnSymlink, path, "symlink to outside the tree")
+				}
+				if st.n++; o.maxFiles > 0 && st.n > o.maxFiles {
+					return fmt.Errorf("more than %d files found under %s; raise the max file count if this is intended", o.maxFiles, root)
+				}
+				sources = append(sources, Source{Path: path, RelPath: relPath, Link: target})
+				return nil
+			}
+			return o.skip(WarnSpecialFile, path, fileType(fi.Mode()))
+		}
+		if st.n++; o.maxFiles > 0 && st.n > o.maxFiles {
+			return fmt.Errorf("more than %d files found under %s; raise the max file count if this is intended", o.maxFiles, root)
+		}
+		sources = append(sources, Source{Path: path, RelPath: relPath})
+		return nil
+	})
+	return sources, err
+}
+
+// excludeManifest drops any source that would be uploaded where the
+// manifest or its signature or bundle goes, such as the manifest.json of an earlier run
+// sitting in the source directory.
+func (o *options) excludeManifest(sources []Source) ([]Source, error) {
+	var kept []Source
+	for _, s := range sources {
+		if isManifestFile(s.RelPath) {
+			if err := o.skip(WarnManifest, s.Path, "file at the manifest's path"); err != nil {
+				return nil, err
+			}
+			continue
+		}
+		kept = append(kept, s)
+	}
+	return kept, nil
+}
+
+// fileType names the kind of non-regular, non-symlink file m describes.
+func fileType(m os.FileMode) string {
+	switch {
+	case m&os.ModeNamedPipe != 0:
+		return "named pipe"
+	case m&os.ModeSocket != 0:
+		return "socket"
+	case m&os.ModeCharDevice != 0:
+		return "character device"
+	case m&os.ModeDevice != 0:
+		return "device"
+	default:
+		return "special file"
+	}
+}
+
+// filterStable drops files that are still being written: anything whose
+// size or modification time differs between two stats stableWait apart.
+func (u *Uploader) filterStable(sources []Source) ([]Source, error) {
+	before := make([]os.FileInfo, len(sources))
+	for i, s := range sources {
+		if isRemote(s.Path) || s.Link != "" {
+			continue
+		}
+		fi, err := os.Stat(s.Path)
+		if err != nil {
+			return nil, err
+		}
+		before[i] = fi
+	}
+	time.Sleep(u.stableWait)
+
+	var stable []Source
+	for i, s := range sources {
+		// Objects are immutable once written, so only local files can be
+		// unstable; a symlink's target is read just once.
+		if isRemote(s.Path) || s.Link != "" {
+			stable = append(stable, s)
+			continue
+		}
+		fi, err := os.Stat(s.Path)
+		if err != nil {
+			return nil, err
+		}
+		if fi.Size() != before[i].Size() || !fi.ModTime().Equal(before[i].ModTime()) {
+			if err := u.skip(WarnUnstable, s.Path, "unstable file"); err != nil {
+				return nil, err
+			}
+			continue
+		}
+		stable = append(stable, s)
+	}
+	return stable, nil
+}
+
+// result is the outcome of uploading one file. On failure err is set and
+// only file's Path, Source and Link are filled in.
+type result struct {
+	file File
+	err  error
+}
+
+// uploadAll uploads every file using a pool of u.parallelism workers.
+// Failures are returned rather than aborting the run. Unless
+// WithContinueOnError was given, the first file to fail stops the rest:
+// uploads in flight are abandoned and no more are started, and they all
+// fail with ErrStopped.
+func (u *Uploader) uploadAll(ctx context.Context, sources []Source, gcsPath string, bucket *storage.BucketHandle, t *tracker, cp *checkpointer) []result {
+	parent := ctx
+	ctx, stop := context.WithCancel(ctx)
+	defer stop()
+	b := u.startBudget(ctx, t, stop)
+	// stopped returns the error for a file that failed or never started
+	// because ctx is done.
+	stopped := func() error {
+		if parent.Err() != nil {
+			return parent.Err()
+		}
+		if b.failed() != nil {
+			return ErrDeadline
+		}
+		return ErrStopped
+	}
+
+	jobs := make(chan Source)
+	resCh := make(chan result)
+
+	wg := sync.WaitGroup{}
+	for i := 0; i < u.parallelism; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for s := range jobs {
+				if !t.reporting() {
+					fmt.Fprintln(u.log, "Uploading:", s.Path)
+				}
+				f, err := u.uploadBudgeted(ctx, s, gcsPath, bucket, t, b)
+				if err != nil {
+					if errors.Is(err, ErrDeadline) {
+						b.fail(err)
+						stop()
+					} else if ctx.Err() != nil {
+						err = stopped()
+					} else if !u.continueOnError {
+						stop()
+					}
+					t.failed()
+					resCh <- result{file: File{Path: s.RelPath, Source: s.Path, Link: s.Link}, err: err}
+					continue
+				}
+				t.uploaded(f)
+				cp.add(f)
+				resCh <- result{file: f}
+				switch {
+				case t.reporting():
+				case f.Link != "":
+					fmt.Fprintln(u.log, "Linked:", s.Path)
+				case f.Existing:
+					fmt.Fprintln(u.log, "Already stored:", s.Path)
+				default:
+					fmt.Fprintln(u.log, "Uploaded:", s.Path)
+				}
+			}
+		}()
+	}
+
+	go func() {
+		defer close(jobs)
+		for _, s := range sources {
+			// Every file shares what's left of ctx's deadline; once it has
+			// passed there's no point starting more.
+			select {
+			case jobs <- s:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+
+	// Close the channel when every worker is done.
+	go func() {
+		wg.Wait()
+		close(resCh)
+	}()
+	var results []result
+	done := map[string]bool{}
+	for r := range resCh {
+		results = append(results, r)
+		done[r.file.Path] = true
+	}
+	// Files never started because the deadline passed, or the run was
+	// stopped, count as failed too.
+	for _, s := range sources {
+		if !done[s.RelPath] {
+			results = append(results, result{file: File{Path: s.RelPath, Source: s.Path, Link: s.Link}, err: stopped()})
+		}
+	}
+	return results
+}
+
+// uploadBudgeted uploads s with uploadWithRetries, within its share of
+// the time left under WithDeadline, if b isn't nil. A file that runs out
+// of its share fails with ErrDeadline.
+func (u *Uploader) uploadBudgeted(ctx context.Context, s Source, gcsPath string, bucket *storage.BucketHandle, t *tracker, b *budget) (File, error) {
+	if b == nil {
+		return u.uploadWithRetries(ctx, s, gcsPath, bucket, t)
+	}
+	var size int64
+	if !isRemote(s.Path) && s.Link == "" {
+		if fi, err := os.Stat(s.Path); err == nil {
+			size = fi.Size()
+		}
+	}
+	limit := b.file(size)
+	fctx, cancel := context.WithTimeout(ctx, limit)
+	defer cancel()
+	f, err := u.uploadWithRetries(fctx, s, gcsPath, bucket, t)
+	if err != nil && ctx.Err() == nil && fctx.Err() == context.DeadlineExceeded {
+		return File{}, fmt.Errorf("%w: took longer than its %v share of the time left", ErrDeadline, limit.Round(time.Second))
+	}
+	return f, err
+}
+
+// uploadWithRetries retries uploadFile with backoff. Each attempt starts
+// the object over, but within an attempt the chunked upload already resumes
+// from the last chunk GCS acknowledged.
+func (u *Uploader) uploadWithRetries(ctx context.Context, s Source, gcsPath string, bucket *storage.BucketHandle, t *tracker) (File, error) {
+	var f File
+	err := u.retry(ctx, u.retries, s.Path, func() error {
+		var err error
+		f, err = u.uploadFile(ctx, s, gcsPath, bucket, t)
+		return err
+	})
+	return f, err
+}
+
+func (u *Uploader) uploadFile(ctx context.Context, s Source, gcsPath string, bucket *storage.BucketHandle, t *tracker) (File, error) {
+	if isRemote(s.Path) {
+		if u.cas {
+			return File{}, fmt.Errorf("%s: the content-addressed layout doesn't support gs:// sources", s.Path)
+		}
+		file, err := u.copyObject(ctx, s, bucket.Object(path.Join(gcsPath, u.objectFor(s.RelPath))))
+		if name := u.objectFor(s.RelPath); err == nil && name != s.RelPath {
+			file.Object = name
+		}
+		return file, err
+	}
+	if s.Link != "" {
+		return linkFile(s)
+	}
+	f, err := u.openLocal(s.Path)
+	if err != nil {
+		return File{}, err
+	}
+	defer f.Close()
+	start, err := f.Stat()
+	if err != nil {
+		return File{}, err
+	}
+	if u.spoolMax > 0 && start.Size() <= u.spoolMax {
+		spooled, cleanup, err := u.spool(ctx, s, start.Size())
+		if err != nil {
+			return File{}, err
+		}
+		defer cleanup()
+		f = &localFile{f: spooled, log: u.log}
+	}
+
+	// Checksum the file before uploading it, so GCS can reject the write
+	// if the bytes it receives are different. Compressed bytes can only be
+	// checked once they are stored. The content-addressed layout needs the
+	// digest up front too, for the object name, unless it was given.
+	given, trusted := u.givenDigest(s)
+	digest := ""
+	if trusted {
+		digest = given
+	}
+	name := u.objectFor(s.RelPath)
+	var want *uint32
+	if u.compression == "" {
+		c := crc32.New(castagnoli)
+		h := sha256.New()
+		sums := io.Writer(c)
+		if u.cas && !trusted {
+			sums = io.MultiWriter(c, h)
+		}
+		if _, err := io.Copy(sums, f); err != nil {
+			return File{}, err
+		}
+		sum := c.Sum32()
+		want = &sum
+		if u.cas {
+			if !trusted {
+				digest = formatDigest(h)
+				if err := checkGiven(s, given, digest); err != nil {
+					return File{}, err
+				}
+			}
+			name = casObject(digest)
+			if err := u.pace(ctx); err != nil {
+				return File{}, err
+			}
+			file, err := existingBlob(ctx, u.encrypted(bucket.Object(path.Join(gcsPath, name))), start.Size(), sum, u.wantEncryption())
+			if err != nil {
+				return File{}, err
+			}
+			if file != nil {
+				file.Path = s.RelPath
+				file.Source = s.Path
+				file.Digest = digest
+				file.ModTime = start.ModTime().UTC()
+				file.Object = name
+				file.Mode = u.modeOf(start)
+				return *file, nil
+			}
+		}
+		if _, err := f.Seek(0, io.SeekStart); err != nil {
+			return File{}, err
+		}
+	}
+
+	// Bytes counted for an attempt that fails are taken back, so the file
+	// isn't counted twice when it is retried.
+	a := t.attempt()
+	var file File
+	if want != nil && u.partSize > 0 && start.Size() > u.partSize {
+		file, err = u.sendComposite(ctx, bucket, bucket.Object(path.Join(gcsPath, name)), s.RelPath, f, start.Size(), *want, digest, a)
+	} else {
+		file, err = u.send(ctx, bucket.Object(path.Join(gcsPath, name)), s.RelPath, f, want, digest, a)
+	}
+	if err == nil {
+		err = checkGiven(s, given, file.Digest)
+	}
+	if err != nil {
+		a.undo()
+		return File{}, err
+	}
+
+	// The tee hashed exactly what was uploaded, but the file may have been
+	// rewritten underneath us and no longer match either.
+	end, err := os.Stat(s.Path)
+	if err != nil {
+		a.undo()
+		return File{}, err
+	}
+	if end.Size() != start.Size() || !end.ModTime().Equal(start.ModTime()) {
+		if u.retryUnstable || u.strict {
+			a.undo()
+			return File{}, fmt.Errorf("%s changed during upload", s.Path)
+		}
+		u.warn(WarnUnstable, s.Path, "changed during upload")
+	}
+
+	file.Path = s.RelPath
+	file.Source = s.Path
+	file.ModTime = start.ModTime().UTC()
+	file.Mode = u.modeOf(start)
+	if name != s.RelPath {
+		file.Object = name
+	}
+	return file, nil
+}
+
+// send uploads r, the file at p, to obj, compressing it if WithCompression
+// was given, and checks that GCS stored exactly what was sent. want, if not
+// nil, is r's CRC32C, which is sent so that GCS rejects a corrupted write
+// outright. digest, if not empty, is recorded as r's digest rather than
+// hashing r again. Everything read from r is also written to progress. The
+// returned File's Path, Source and ModTime are left to the caller.
+func (u *Uploader) send(ctx context.Context, obj *storage.ObjectHandle, p string, r io.Reader, want *uint32, digest string, progress io.Writer) (File, error) {
+	if err := u.pace(ctx); err != nil {
+		return File{}, err
+	}
+	r = u.throttle(ctx, r)
+	// Cancelling the writer's context abandons the upload; closing it
+	// after a failed copy would instead finalize a truncated object.
+	wctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	w := u.encrypted(obj).NewWriter(wctx)
+	w.ChunkSize = u.chunkSize
+	w.KMSKeyName = u.kmsKey
+	if want != nil {
+		w.CRC32C = *want
+		w.SendCRC32C = true
+	}
+
+	// Hash what is read as it goes, and what is stored if that differs.
+	h := sha256.New()
+	read := &countingWriter{}
+	readSide := []io.Writer{read, progress}
+	if digest == "" {
+		readSide = append(readSide, h)
+	}
+	br := bufio.NewReader(io.TeeReader(r, io.MultiWriter(readSide...)))
+	w.ContentType = detectContentType(obj.ObjectName(), br)
+	u.setMetadata(w, p)
+	var body io.Reader = br
+	c := crc32.New(castagnoli)
+	storedSide := []io.Writer{c}
+	var stored hash.Hash
+	if u.compression != "" {
+		var stop func()
+		body, stop = u.compress(body, w)
+		defer stop()
+		stored = sha256.New()
+		storedSide = append(storedSide, stored)
+	}
+	n, err := io.Copy(w, io.TeeReader(body, io.MultiWriter(storedSide...)))
+	if err != nil {
+		cancel()
+		w.Close()
+		return File{}, err
+	}
+	if err := w.Close(); err != nil {
+		return File{}, fmt.Errorf("finishing upload: %v", err)
+	}
+	attrs := w.Attrs()
+	if attrs.Size != n || attrs.CRC32C != c.Sum32() {
+		return File{}, fmt.Errorf("GCS stored %d bytes with crc32c %08x, but %d bytes with crc32c %08x were uploaded", attrs.Size, attrs.CRC32C, n, c.Sum32())
+	}
+
+	if digest == "" {
+		digest = formatDigest(h)
+	}
+	f := File{
+		Digest:      digest,
+		Size:        attrs.Size,
+		ContentType: attrs.ContentType,
+		CRC32C:      FormatCRC32C(attrs.CRC32C),
+		Generation:  attrs.Generation,
+		Encryption:  encryptionOf(attrs),
+	}
+	if stored != nil {
+		f.Size = read.n
+		f.ContentEncoding = attrs.ContentEncoding
+		f.StoredSize = attrs.Size
+		f.StoredDigest = formatDigest(stored)
+	}
+	return f, nil
+}
@@ -0,0 +1,48 @@
+package manifest
+
+import (
+	"fmt"
+	"os"
+	"strings"
+)
+
+// ParseURI splits a gs://bucket/path URI, with or without the scheme, into
+// its bucket and path. The path must not be empty. A URI without a bucket,
+// gs:///path, is in the bucket named by BucketEnv.
+func ParseURI(uri string) (string, string, error) {
+	if strings.HasPrefix(uri, "gs://") {
+		uri = strings.TrimPrefix(uri, "gs://")
+	}
+	split := strings.SplitN(uri, "/", 2)
+	if len(split) != 2 {
+		return "", "", fmt.Errorf("invalid uri: %s", uri)
+	}
+	bucket, err := defaultBucket(split[0])
+	if err != nil {
+		return "", "", err
+	}
+	return bucket, split[1], nil
+}
+
+// ParsePrefix is like ParseURI but allows an empty prefix, meaning the
+// whole bucket. Without a bucket or BucketEnv, the bucket is empty.
+func ParsePrefix(uri string) (string, string) {
+	uri = strings.TrimPrefix(uri, "gs://")
+	split := strings.SplitN(uri, "/", 2)
+	bucket, _ := defaultBucket(split[0])
+	if len(split) != 2 {
+		return bucket, ""
+	}
+	return bucket, split[1]
+}
+
+// defaultBucket returns bucket, or BucketEnv's bucket if it is empty.
+func defaultBucket(bucket string) (string, error) {
+	if bucket != "" {
+		return bucket, nil
+	}
+	if bucket = os.Getenv(BucketEnv); bucket == "" {
+		return "", fmt.Errorf("no bucket given, and $%s isn't set", BucketEnv)
+	}
+	return bucket, nil
+}
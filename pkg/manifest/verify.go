@@ -0,0 +1,255 @@
+package manifest
+
+import (
+	"context"
+	"crypto/sha256"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"cloud.google.com/go/storage"
+	"google.golang.org/api/iterator"
+)
+
+// Report is the result of checking a GCS prefix against its manifest.
+type Report struct {
+	// Checked is the number of manifest entries looked at.
+	Checked int
+	// Objects is the number of objects found under the prefix, besides
+	// the manifest and its signatures, and Expected the number the
+	// manifest stores its files in.
+	Objects  int
+	Expected int
+	// Missing are manifest paths with no object.
+	Missing []string
+	// Extra are objects under the prefix that the manifest doesn't list.
+	Extra []string
+	// Corrupted are objects whose contents don't match the manifest.
+	Corrupted []Failure
+	// Unmatched are the names given WithGsutilHashes that aren't files in
+	// the manifest.
+	Unmatched []string
+	// Partial are the paths a partial manifest lists as having failed to
+	// upload. Such a prefix never counts as OK, however well the files it
+	// does have check out.
+	Partial []string
+}
+
+// OK reports whether the prefix matched the manifest exactly.
+func (r *Report) OK() bool {
+	return len(r.Missing) == 0 && len(r.Extra) == 0 && len(r.Corrupted) == 0 && len(r.Unmatched) == 0 && len(r.Partial) == 0
+}
+
+// Verifier checks published files against their manifest.
+type Verifier struct {
+	*options
+}
+
+// NewVerifier returns a Verifier. Unless WithClient is given, a GCS client
+// is created with default credentials.
+func NewVerifier(ctx context.Context, opts ...Option) (*Verifier, error) {
+	o := newOptions(opts)
+	if o.client == nil {
+		c, err := storage.NewClient(ctx)
+		if err != nil {
+			return nil, fmt.Errorf("creating GCS client: %v", err)
+		}
+		o.client = c
+	}
+	return &Verifier{options: o}, nil
+}
+
+// unexpected reports whether the object name, under a destination whose
+// manifest stores its files in objects, shouldn't be there.
+func (o *options) unexpected(name string, objects map[string]bool) bool {
+	if objects[name] || isManifestFile(name) || name == "" {
+		return false
+	}
+	return o.strictPrefix || isData(name)
+}
+
+// Verify checks every file in m against the objects under the gs:// path
+// dst, and reports objects there that m doesn't reference, other than the
+// manifest itself and, unless WithStrictPrefix, directory placeholders. Objects
+// whose entry records a CRC32C are checked against the CRC32C GCS
+// reports, without being read; the rest, and all of them with
+// WithFullHash, are streamed and their sha256 compared. Only errors that
+// stop the check from running are returned; problems with individual
+// objects are in the Report.
+func (v *Verifier) Verify(ctx context.Context, m *Manifest, dst string) (*Report, error) {
+	bucketName, prefix := ParsePrefix(dst)
+	if prefix != "" && !strings.HasSuffix(prefix, "/") {
+		prefix += "/"
+	}
+	bucket := v.client.Bucket(bucketName)
+
+	remote := map[string]*storage.ObjectAttrs{}
+	it := bucket.Objects(ctx, &storage.Query{Prefix: prefix})
+	for {
+		attrs, err := it.Next()
+		if err == iterator.Done {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("listing %s: %v", dst, err)
+		}
+		remote[strings.TrimPrefix(attrs.Name, prefix)] = attrs
+	}
+
+	objects := m.objects()
+	r := &Report{Checked: len(m.Files), Partial: m.Missing, Expected: len(objects)}
+	gsutil, unmatched := matchGsutilHashes(m, v.gsutilHashes)
+	r.Unmatched = unmatched
+	var toCheck []string
+	for _, p := range m.Paths() {
+		// A symlink has nothing stored to check.
+		if m.Files[p].Link != "" {
+			continue
+		}
+		if _, ok := remote[m.Files[p].ObjectName()]; !ok {
+			r.Missing = append(r.Missing, p)
+			continue
+		}
+		toCheck = append(toCheck, p)
+	}
+	for name := range remote {
+		if !isManifestFile(name) {
+			r.Objects++
+		}
+		if v.unexpected(name, objects) {
+			r.Extra = append(r.Extra, name)
+		}
+	}
+	sort.Strings(r.Extra)
+
+	jobs := make(chan string)
+	var (
+		mu sync.Mutex
+		wg sync.WaitGroup
+	)
+	for i := 0; i < v.parallelism; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for p := range jobs {
+				e := m.Files[p]
+				err := v.check(ctx, bucket.Object(path.Join(prefix, e.ObjectName())), e, remote[e.ObjectName()])
+				if h, ok := gsutil[p]; ok && err == nil {
+					err = checkGsutil(h, e, remote[e.ObjectName()])
+				}
+				if err != nil {
+					mu.Lock()
+					r.Corrupted = append(r.Corrupted, Failure{Path: p, Err: err})
+					mu.Unlock()
+				}
+			}
+		}()
+	}
+	for _, p := range toCheck {
+		jobs <- p
+	}
+	close(jobs)
+	wg.Wait()
+	sort.Slice(r.Corrupted, func(i, j int) bool { return r.Corrupted[i].Path < r.Corrupted[j].Path })
+	return r, nil
+}
+
+func (v *Verifier) check(ctx context.Context, obj *storage.ObjectHandle, e Entry, attrs *storage.ObjectAttrs) error {
+	size := e.Size
+	if e.ContentEncoding != "" {
+		if attrs.ContentEncoding != e.ContentEncoding {
+			return fmt.Errorf("content encoding mismatch: manifest has %q, got %q", e.ContentEncoding, attrs.ContentEncoding)
+		}
+		size = e.StoredSize
+	}
+	if size != 0 && attrs.Size != size {
+		return fmt.Errorf("size mismatch: manifest has %d, got %d", size, attrs.Size)
+	}
+	if err := checkEncryption(e.Encryption, attrs); err != nil {
+		return err
+	}
+	if v.kmsKey != "" && (e.Encryption == nil || e.Encryption.KMSKey != v.kmsKey) {
+		return fmt.Errorf("not encrypted with %s", v.kmsKey)
+	}
+	// GCS only reports the checksums of an object encrypted with a
+	// customer-supplied key to those who have the key, so it is hashed.
+	csek := e.Encryption != nil && e.Encryption.CustomerKeySHA256 != ""
+	if csek {
+		if err := v.checkKey(e); err != nil {
+			return err
+		}
+	}
+	if e.CRC32C != "" && !v.fullHash && !csek {
+		if got := FormatCRC32C(attrs.CRC32C); got != e.CRC32C {
+			return fmt.Errorf("crc32c mismatch: manifest has %s, got %s", e.CRC32C, got)
+		}
+		return nil
+	}
+	fmt.Fprintln(v.log, "Hashing:", attrs.Name)
+	rd, err := v.encrypted(obj.Generation(attrs.Generation)).NewReader(ctx)
+	if err != nil {
+		return err
+	}
+	defer rd.Close()
+	// A composite object's parts are checked on the way, so that a
+	// mismatch says which part of it is wrong.
+	h := sha256.New()
+	if err := checkParts(io.TeeReader(rd, h), e.Parts, 0, 0); err != nil {
+		return err
+	}
+	if _, err := io.Copy(h, rd); err != nil {
+		return err
+	}
+	got := formatDigest(h)
+	if got != e.Digest {
+		return fmt.Errorf("digest mismatch: manifest has %s, got %s", e.Digest, got)
+	}
+	return nil
+}
+
+// ReadManifest reads a manifest from a gs:// URI or local path using the
+// Verifier's client, checking its signature if WithPublicKey was given.
+func (v *Verifier) ReadManifest(ctx context.Context, uri string) (*Manifest, error) {
+	return v.readVerified(ctx, uri)
+}
+
+// Published returns when the manifest at uri was written: the object's
+// update time for a gs:// URI, or the file's modification time.
+func (v *Verifier) Published(ctx context.Context, uri string) (time.Time, error) {
+	return v.published(ctx, uri)
+}
+
+func (o *options) published(ctx context.Context, uri string) (time.Time, error) {
+	if IsStorageURI(uri) {
+		st, name, err := openParent(ctx, uri, o.client)
+		if err != nil {
+			return time.Time{}, err
+		}
+		info, err := st.Stat(ctx, name)
+		if err != nil {
+			return time.Time{}, err
+		}
+		return info.ModTime, nil
+	}
+	if !isRemote(uri) {
+		fi, err := os.Stat(uri)
+		if err != nil {
+			return time.Time{}, err
+		}
+		return fi.ModTime(), nil
+	}
+	bucketName, name, err := ParseURI(uri)
+	if err != nil {
+		return time.Time{}, err
+	}
+	attrs, err := o.client.Bucket(bucketName).Object(name).Attrs(ctx)
+	if err != nil {
+		return time.Time{}, err
+	}
+	return attrs.Updated, nil
+}
@@ -0,0 +1,58 @@
+package manifest
+
+import "fmt"
+
+// WarningKind classifies a Warning.
+type WarningKind string
+
+const (
+	// WarnSymlink is a symlink that was skipped rather than followed.
+	WarnSymlink WarningKind = "symlink"
+	// WarnSpecialFile is a named pipe, socket or device that was skipped.
+	WarnSpecialFile WarningKind = "special-file"
+	// WarnManifest is a source at the manifest's own path, which was
+	// dropped so it wouldn't be overwritten.
+	WarnManifest WarningKind = "manifest"
+	// WarnUnstable is a file that was skipped, or uploaded anyway, because
+	// it was changing.
+	WarnUnstable WarningKind = "unstable"
+	// WarnMetadata is metadata that was asked for but couldn't be applied.
+	WarnMetadata WarningKind = "metadata"
+	// WarnConflict is a file left out of a sync because its object was
+	// written by someone else.
+	WarnConflict WarningKind = "conflict"
+	// WarnReplica is a file, or a manifest, that didn't reach one of the
+	// WithReplicas replicas, though enough others did.
+	WarnReplica WarningKind = "replica"
+)
+
+// Warning is something a run did differently from what was asked without
+// failing, such as skipping a file.
+type Warning struct {
+	Kind    WarningKind `json:"kind"`
+	Path    string      `json:"path"`
+	Message string      `json:"message"`
+}
+
+func (w Warning) String() string {
+	return fmt.Sprintf("%s: %s", w.Message, w.Path)
+}
+
+// skip warns that the file at path, a what, was left out, unless
+// WithStrict was given, in which case leaving it out is an error instead.
+func (o *options) skip(kind WarningKind, path, what string) error {
+	if o.strict {
+		return fmt.Errorf("%s is a %s, which strict mode won't leave out", path, what)
+	}
+	o.warn(kind, path, "skipped "+what)
+	return nil
+}
+
+// warn logs a warning and passes it to the WithWarnings func, if any.
+func (o *options) warn(kind WarningKind, path, msg string) {
+	w := Warning{Kind: kind, Path: path, Message: msg}
+	fmt.Fprintln(o.log, "WARNING:", w)
+	if o.onWarning != nil {
+		o.onWarning(w)
+	}
+}
@@ -0,0 +1,111 @@
+package manifest
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"time"
+)
+
+// Watch keeps the manifest at dst in step with local files after files
+// have been published there. Every interval it lists the sources again
+// with expand and, if any were added or removed, or changed size,
+// modification time, mode or link target, uploads the added and changed
+// ones with UploadSources, the rest carried over, so that the new manifest
+// replaces the old in a single write. Changes are found by polling rather
+// than by filesystem notifications, which aren't portable. published is
+// called after each such run with its result or error; a run that fails is
+// tried again at the next interval, since its files still differ from what
+// was published. Watch returns when ctx is done, or at once if a source is
+// a gs:// object, which can't be watched.
+func (u *Uploader) Watch(ctx context.Context, expand func(context.Context) ([]Source, error), dst string, files []File, interval time.Duration, published func(*Result, error)) error {
+	// Changed files are checked for stability here, so that one still being
+	// written keeps its old entry instead of dropping out of the manifest.
+	o := *u.options
+	o.stableWait = 0
+	up := &Uploader{options: &o}
+
+	current := map[string]File{}
+	for _, f := range files {
+		current[f.Path] = f
+	}
+	for {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(interval):
+		}
+		sources, err := expand(ctx)
+		if err != nil {
+			published(nil, err)
+			continue
+		}
+		var (
+			changed []Source
+			prior   []File
+			removed int
+		)
+		seen := map[string]bool{}
+		if sources, err = u.excludeManifest(sources); err != nil {
+			return err
+		}
+		for _, s := range sources {
+			if isRemote(s.Path) {
+				return fmt.Errorf("can't watch %s; only local files can be watched", s.Path)
+			}
+			seen[s.RelPath] = true
+			if f, ok := current[s.RelPath]; ok && u.unchanged(s, f) {
+				prior = append(prior, f)
+			} else {
+				changed = append(changed, s)
+			}
+		}
+		for p := range current {
+			if !seen[p] {
+				removed++
+			}
+		}
+		if u.stableWait > 0 && len(changed) > 0 {
+			stable, err := u.filterStable(changed)
+			if err != nil {
+				published(nil, err)
+				continue
+			}
+			settled := map[string]bool{}
+			for _, s := range stable {
+				settled[s.RelPath] = true
+			}
+			for _, s := range changed {
+				if f, ok := current[s.RelPath]; ok && !settled[s.RelPath] {
+					prior = append(prior, f)
+				}
+			}
+			changed = stable
+		}
+		if len(changed) == 0 && removed == 0 {
+			continue
+		}
+		fmt.Fprintf(u.log, "%d files added or changed, %d removed; publishing\n", len(changed), removed)
+		res, err := up.UploadSources(ctx, changed, dst, prior)
+		if err == nil {
+			current = map[string]File{}
+			for _, f := range res.Files {
+				current[f.Path] = f
+			}
+		}
+		published(res, err)
+	}
+}
+
+// unchanged reports whether the local source s still looks like the file
+// f it was published as.
+func (u *Uploader) unchanged(s Source, f File) bool {
+	if s.Link != "" || f.Link != "" {
+		return s.Link == f.Link
+	}
+	fi, err := os.Stat(s.Path)
+	if err != nil {
+		return false
+	}
+	return fi.Size() == f.Size && fi.ModTime().UTC().Equal(f.ModTime) && u.modeOf(fi) == f.Mode
+}
@@ -0,0 +1,138 @@
+// Package server publishes uploads over HTTP: each request carries a tar
+// stream that is uploaded to GCS with its manifest, without touching local
+// disk, so it can run somewhere like Cloud Run.
+//
+// Requests are POSTs with the destination in the dst query parameter:
+//
+//	tar -c dist | curl --data-binary @- \
+//	    -H "X-Storage-Authorization: Bearer $(gcloud auth print-access-token)" \
+//	    "$URL/?dst=gs://bucket/releases/v1"
+package server
+
+import (
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"sync"
+
+	"cloud.google.com/go/storage"
+	"github.com/dlorenc/gcs-manifest/pkg/manifest"
+	"google.golang.org/api/option"
+)
+
+// AuthHeader carries the OAuth2 access token uploads are made with. It is
+// separate from Authorization, which Cloud Run uses to authenticate the
+// caller to the service itself.
+const AuthHeader = "X-Storage-Authorization"
+
+// Response is the JSON body of every reply.
+type Response struct {
+	Dst      string             `json:"dst"`
+	Manifest *manifest.Manifest `json:"manifest,omitempty"`
+	Error    string             `json:"error,omitempty"`
+	// Warnings are what the upload skipped, such as a file at the
+	// manifest's path.
+	Warnings []manifest.Warning `json:"warnings,omitempty"`
+}
+
+// Handler serves publish requests.
+type Handler struct {
+	// AllowDefaultCredentials lets requests without an AuthHeader upload
+	// with the server's own credentials. Otherwise they are rejected.
+	AllowDefaultCredentials bool
+	// Options are passed to the Uploader of every request.
+	Options []manifest.Option
+}
+
+func (h *Handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	dst := r.URL.Query().Get("dst")
+	if r.Method != http.MethodPost {
+		reply(w, http.StatusMethodNotAllowed, Response{Dst: dst, Error: "only POST is supported"})
+		return
+	}
+	if _, _, err := manifest.ParseURI(dst); err != nil || !strings.HasPrefix(dst, "gs://") {
+		reply(w, http.StatusBadRequest, Response{Dst: dst, Error: "dst must be a gs://bucket/path URI"})
+		return
+	}
+
+	ctx := r.Context()
+	client, err := h.client(ctx, r.Header.Get(AuthHeader))
+	if err == errNoCredentials {
+		reply(w, http.StatusUnauthorized, Response{Dst: dst, Error: err.Error()})
+		return
+	}
+	if err != nil {
+		reply(w, http.StatusInternalServerError, Response{Dst: dst, Error: err.Error()})
+		return
+	}
+	defer client.Close()
+
+	body := io.Reader(r.Body)
+	if r.Header.Get("Content-Encoding") == "gzip" {
+		gz, err := gzip.NewReader(r.Body)
+		if err != nil {
+			reply(w, http.StatusBadRequest, Response{Dst: dst, Error: err.Error()})
+			return
+		}
+		defer gz.Close()
+		body = gz
+	}
+
+	var (
+		mu       sync.Mutex
+		warnings []manifest.Warning
+	)
+	warn := manifest.WithWarnings(func(w manifest.Warning) {
+		mu.Lock()
+		defer mu.Unlock()
+		warnings = append(warnings, w)
+	})
+	opts := append(append([]manifest.Option(nil), h.Options...), manifest.WithClient(client), warn)
+	u, err := manifest.NewUploader(ctx, opts...)
+	if err != nil {
+		reply(w, http.StatusInternalServerError, Response{Dst: dst, Error: err.Error()})
+		return
+	}
+	res, err := u.UploadTar(ctx, body, dst)
+	if err != nil {
+		reply(w, http.StatusBadGateway, Response{Dst: dst, Error: err.Error(), Warnings: warnings})
+		return
+	}
+	reply(w, http.StatusOK, Response{Dst: dst, Manifest: res.Manifest, Warnings: warnings})
+}
+
+var errNoCredentials = fmt.Errorf("missing %s header", AuthHeader)
+
+// client returns a GCS client acting with the request's own token, so what
+// a caller can publish is bounded by its own permissions.
+func (h *Handler) client(ctx context.Context, auth string) (*storage.Client, error) {
+	if auth == "" {
+		if !h.AllowDefaultCredentials {
+			return nil, errNoCredentials
+		}
+		return storage.NewClient(ctx)
+	}
+	hc := &http.Client{Transport: &bearerTransport{auth: auth, base: http.DefaultTransport}}
+	return storage.NewClient(ctx, option.WithHTTPClient(hc))
+}
+
+type bearerTransport struct {
+	auth string
+	base http.RoundTripper
+}
+
+func (t *bearerTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	req = req.Clone(req.Context())
+	req.Header.Set("Authorization", t.auth)
+	return t.base.RoundTrip(req)
+}
+
+func reply(w http.ResponseWriter, status int, resp Response) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(resp)
+}
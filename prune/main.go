@@ -0,0 +1,217 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"path"
+	"strings"
+	"time"
+
+	"cloud.google.com/go/storage"
+	"github.com/dlorenc/gcs-manifest/pkg/manifest"
+)
+
+var (
+	dryRun      = flag.Bool("dry-run", true, "list the objects that would be deleted without deleting them; pass --dry-run=false to delete them")
+	force       = flag.Bool("force", false, "delete without asking for confirmation")
+	parallelism = flag.Int("parallelism", manifest.DefaultParallelism(), "how many objects to delete at once")
+	rate        = flag.Float64("max-requests-per-second", 0, "cap on deletions started a second; 0 means no limit")
+	window      = flag.Duration("safety-window", time.Hour, "keep stale objects written less than this long ago, which may belong to a publish whose manifest isn't visible yet")
+	expired     = flag.Bool("expired", false, "instead, drop the manifest's expired entries, rewrite it without them, and delete their objects")
+	kmsKey      = flag.String("kms-key", "", "with --expired, Cloud KMS key version to sign the rewritten manifest with; needed if the manifest is signed")
+	keep        stringsFlag
+
+	useProfile = manifest.ProfileFlag(flag.CommandLine)
+)
+
+// stringsFlag collects a repeatable string flag.
+type stringsFlag []string
+
+func (s *stringsFlag) String() string { return strings.Join(*s, ",") }
+
+func (s *stringsFlag) Set(v string) error {
+	if _, err := path.Match(v, ""); err != nil {
+		return fmt.Errorf("bad pattern %q: %v", v, err)
+	}
+	*s = append(*s, v)
+	return nil
+}
+
+func main() {
+	flag.Var(&keep, "keep", "glob, relative to the prefix, of objects to keep though the manifest doesn't list them, such as a --public-manifest (repeatable)")
+	flag.Usage = func() {
+		fmt.Fprintf(os.Stderr, "usage: %s [flags] gs://bucket/prefix\n", os.Args[0])
+		fmt.Fprintf(os.Stderr, "\nLists, and with --dry-run=false deletes, the objects under the prefix that its manifest.json doesn't list or, with --expired, the files it lists that have expired.\n\n")
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+	if err := useProfile(); err != nil {
+		log.Fatal(err)
+	}
+	if flag.NArg() != 1 {
+		flag.Usage()
+		os.Exit(2)
+	}
+	dst := strings.TrimSuffix(flag.Arg(0), "/")
+
+	ctx := context.Background()
+	client, err := storage.NewClient(ctx)
+	if err != nil {
+		log.Fatalf("Failed to create new GCS client: %v", err)
+	}
+	// Without a manifest there is no telling what is stale, so a missing
+	// one is an error rather than a manifest listing nothing.
+	m, err := manifest.Read(ctx, client, dst+"/"+manifest.Name)
+	if err != nil {
+		log.Fatalf("Failed to read the manifest: %v", err)
+	}
+	if *expired {
+		pruneExpired(ctx, client, dst, m)
+		return
+	}
+	all, err := manifest.Stale(ctx, client, dst, m)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	var (
+		stale  []manifest.StaleObject
+		total  int64
+		recent int
+	)
+	now := time.Now()
+	for _, s := range all {
+		if kept(s.Path) {
+			continue
+		}
+		if s.Recent(*window, now) {
+			recent++
+			continue
+		}
+		fmt.Printf("%s\t%d\n", s.Path, s.Size)
+		stale = append(stale, s)
+		total += s.Size
+	}
+	fmt.Fprintf(os.Stderr, "%d objects under %s are not in the manifest (%d bytes).\n", len(stale), dst, total)
+	if recent > 0 {
+		fmt.Fprintf(os.Stderr, "%d more were written within the last %v and are kept; see --safety-window.\n", recent, *window)
+	}
+	if len(stale) == 0 || *dryRun {
+		return
+	}
+	if !*force && !confirm(fmt.Sprintf("Delete %d objects from %s?", len(stale), dst)) {
+		fmt.Fprintln(os.Stderr, "Nothing deleted.")
+		os.Exit(1)
+	}
+
+	failed := manifest.Prune(ctx, client, dst, stale, pruneOptions()...)
+	for _, f := range failed {
+		fmt.Fprintf(os.Stderr, "Failed to delete %s: %v\n", f.Path, f.Err)
+	}
+	fmt.Fprintf(os.Stderr, "Deleted %d objects.\n", len(stale)-len(failed))
+	if len(failed) > 0 {
+		os.Exit(1)
+	}
+}
+
+// pruneOptions are the options to delete objects with.
+func pruneOptions() []manifest.Option {
+	return []manifest.Option{
+		manifest.WithLog(os.Stderr),
+		manifest.WithParallelism(*parallelism),
+		manifest.WithMaxRequestRate(*rate),
+		manifest.WithSafetyWindow(*window),
+	}
+}
+
+// pruneExpired drops m's expired entries, publishes the manifest of the
+// rest, and only then deletes the objects that no remaining entry uses, so
+// that the published manifest never lists a deleted object.
+func pruneExpired(ctx context.Context, client *storage.Client, dst string, m *manifest.Manifest) {
+	gone, rest := m.Expired(time.Now())
+	objects := map[string]bool{}
+	for _, e := range gone {
+		fmt.Printf("%s\texpired %s\n", e.Path, e.Expires.Format(time.RFC3339))
+		if e.Link == "" {
+			objects[e.ObjectName()] = true
+		}
+	}
+	fmt.Fprintf(os.Stderr, "%d files in the manifest of %s have expired.\n", len(gone), dst)
+	if len(gone) == 0 || *dryRun {
+		return
+	}
+	if !*force && !confirm(fmt.Sprintf("Remove %d files from the manifest of %s and delete them?", len(gone), dst)) {
+		fmt.Fprintln(os.Stderr, "Nothing deleted.")
+		os.Exit(1)
+	}
+
+	opts := []manifest.Option{manifest.WithClient(client), manifest.WithLog(os.Stderr)}
+	if *kmsKey != "" {
+		signer, err := manifest.NewKMSSigner(ctx, *kmsKey)
+		if err != nil {
+			log.Fatal(err)
+		}
+		opts = append(opts, manifest.WithSigner(signer))
+	} else if _, err := manifest.ReadBytes(ctx, client, dst+"/"+manifest.Name+manifest.SignatureSuffix); err == nil {
+		log.Fatal("The manifest is signed; give --kms-key to sign the rewritten one, or its signature won't verify")
+	}
+	u, err := manifest.NewUploader(ctx, opts...)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if err := u.WriteManifest(ctx, dst, manifest.Name, rest); err != nil {
+		log.Fatalf("Failed to rewrite the manifest: %v", err)
+	}
+	fmt.Fprintf(os.Stderr, "Rewrote the manifest with %d files.\n", len(rest.Files))
+
+	// Under the content-addressed layout an expired file's object may still
+	// hold a file that hasn't expired, and is then no longer stale.
+	all, err := manifest.Stale(ctx, client, dst, rest)
+	if err != nil {
+		log.Fatal(err)
+	}
+	var stale []manifest.StaleObject
+	for _, s := range all {
+		if objects[s.Path] {
+			stale = append(stale, s)
+		}
+	}
+	failed := manifest.Prune(ctx, client, dst, stale, pruneOptions()...)
+	for _, f := range failed {
+		fmt.Fprintf(os.Stderr, "Failed to delete %s: %v\n", f.Path, f.Err)
+	}
+	fmt.Fprintf(os.Stderr, "Deleted %d objects.\n", len(stale)-len(failed))
+	if len(failed) > 0 {
+		os.Exit(1)
+	}
+}
+
+// kept reports whether --keep protects the object at p.
+func kept(p string) bool {
+	for _, pattern := range keep {
+		if ok, _ := path.Match(pattern, p); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// confirm asks a yes/no question on stderr and reads the answer from
+// stdin; anything but yes, including no terminal to ask, is a no.
+func confirm(question string) bool {
+	fmt.Fprintf(os.Stderr, "%s [y/N] ", question)
+	answer, err := bufio.NewReader(os.Stdin).ReadString('\n')
+	if err != nil {
+		fmt.Fprintln(os.Stderr)
+		return false
+	}
+	switch strings.ToLower(strings.TrimSpace(answer)) {
+	case "y", "yes":
+		return true
+	}
+	return false
+}
@@ -0,0 +1,132 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"cloud.google.com/go/storage"
+	"github.com/dlorenc/gcs-manifest/pkg/manifest"
+)
+
+var (
+	manifestPath = flag.String("manifest", "manifest.json", "local manifest the repaired files must match")
+	paths        = flag.String("paths", "", "comma-separated manifest paths to repair")
+	src          = flag.String("src", "", "local directory to re-upload the files from")
+	from         = flag.String("from", "", "GCS path of a replica to re-copy the files from, instead of --src")
+	dst          = flag.String("dst", "", "GCS path the manifest was published to")
+
+	useProfile = manifest.ProfileFlag(flag.CommandLine)
+)
+
+func main() {
+	flag.Parse()
+	if err := useProfile(); err != nil {
+		log.Fatal(err)
+	}
+	if *paths == "" || *dst == "" {
+		log.Fatal("--paths and --dst are required")
+	}
+	if (*src == "") == (*from == "") {
+		log.Fatal("exactly one of --src or --from is required")
+	}
+
+	mfst, err := manifest.Read(context.Background(), nil, *manifestPath)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	dstBucket, dstPath, err := manifest.ParseURI(*dst)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	ctx := context.Background()
+	client, err := storage.NewClient(ctx)
+	if err != nil {
+		log.Fatalf("Failed to create new GCS client: %v", err)
+	}
+
+	for _, p := range strings.Split(*paths, ",") {
+		e, ok := mfst.Files[p]
+		if !ok {
+			log.Fatalf("%s is not in the manifest", p)
+		}
+		if e.Link != "" {
+			log.Fatalf("%s is a symlink; nothing is stored for it to repair", p)
+		}
+		want := e.Digest
+		obj := client.Bucket(dstBucket).Object(path.Join(dstPath, e.ObjectName()))
+
+		fmt.Fprintln(os.Stderr, "Repairing:", p)
+		if *src != "" {
+			err = reupload(ctx, filepath.Join(*src, p), want, obj)
+		} else {
+			err = recopy(ctx, client, e.ObjectName(), obj)
+		}
+		if err != nil {
+			log.Fatalf("Failed to repair %s: %v", p, err)
+		}
+
+		// Read back what's now stored rather than trusting the write.
+		got, err := hashObject(ctx, obj)
+		if err != nil {
+			log.Fatalf("Failed to re-verify %s: %v", p, err)
+		}
+		if got != want {
+			log.Fatalf("%s still doesn't match the manifest: want %s, got %s", p, want, got)
+		}
+		fmt.Fprintln(os.Stderr, "Repaired:", p)
+	}
+}
+
+// reupload uploads a local file, refusing to if it doesn't match the
+// manifest: repairing with the wrong bytes is worse than not repairing.
+func reupload(ctx context.Context, file, want string, obj *storage.ObjectHandle) error {
+	sha, err := manifest.DigestFile(file)
+	if err != nil {
+		return err
+	}
+	if sha != want {
+		return fmt.Errorf("local copy %s has digest %s, manifest has %s", file, sha, want)
+	}
+
+	f, err := os.Open(file)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	w := obj.NewWriter(ctx)
+	if _, err := io.Copy(w, f); err != nil {
+		w.Close()
+		return err
+	}
+	return w.Close()
+}
+
+// recopy copies the object named name, relative to --from, over obj.
+func recopy(ctx context.Context, client *storage.Client, name string, obj *storage.ObjectHandle) error {
+	bucketName, gcsPath, err := manifest.ParseURI(*from)
+	if err != nil {
+		return err
+	}
+	replica := client.Bucket(bucketName).Object(path.Join(gcsPath, name))
+	_, err = obj.CopierFrom(replica).Run(ctx)
+	return err
+}
+
+func hashObject(ctx context.Context, obj *storage.ObjectHandle) (string, error) {
+	r, err := obj.NewReader(ctx)
+	if err != nil {
+		return "", err
+	}
+	defer r.Close()
+	return manifest.Digest(r)
+}
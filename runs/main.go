@@ -0,0 +1,145 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"text/tabwriter"
+	"time"
+
+	"cloud.google.com/go/storage"
+	"github.com/dlorenc/gcs-manifest/pkg/manifest"
+)
+
+var (
+	dst      = flag.String("dst", "", "destination whose runs to compare; defaults to that of the latest run in the log")
+	runID    = flag.String("run-id", "", "run to compare with the one before it; defaults to the latest")
+	maxRatio = flag.Float64("max-ratio", 0, "exit 1 if the run uploaded more than this many times the files, bytes or time of the one before it; 0 disables")
+
+	useProfile = manifest.ProfileFlag(flag.CommandLine)
+)
+
+func main() {
+	flag.Usage = func() {
+		fmt.Fprintf(os.Stderr, "usage: %s [flags] diff gs://bucket/events.ndjson\n", os.Args[0])
+		fmt.Fprintf(os.Stderr, "\nCompares a publish recorded by upload --event-log with the previous one to the same destination.\n\n")
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+	if err := useProfile(); err != nil {
+		log.Fatal(err)
+	}
+	if flag.NArg() != 2 || flag.Arg(0) != "diff" {
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	ctx := context.Background()
+	client, err := storage.NewClient(ctx)
+	if err != nil {
+		log.Fatalf("Failed to create new GCS client: %v", err)
+	}
+	events, err := manifest.ReadEvents(ctx, client, flag.Arg(1))
+	if err != nil {
+		log.Fatal(err)
+	}
+	prev, cur, err := pick(events)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if n := printDiff(prev, cur); n > 0 {
+		fmt.Fprintf(os.Stderr, "%d measures grew more than %gx.\n", n, *maxRatio)
+		os.Exit(1)
+	}
+}
+
+// pick returns the run to compare, per --dst and --run-id, and the publish
+// to the same destination before it.
+func pick(events []manifest.Event) (prev, cur manifest.Event, err error) {
+	i := len(events) - 1
+	for ; i >= 0; i-- {
+		e := events[i]
+		if e.Action != "publish" || (*dst != "" && e.Dst != *dst) {
+			continue
+		}
+		if *runID == "" || e.RunID == *runID {
+			break
+		}
+	}
+	if i < 0 {
+		return prev, cur, fmt.Errorf("no matching publish in the log")
+	}
+	cur = events[i]
+	for i--; i >= 0; i-- {
+		if e := events[i]; e.Action == "publish" && e.Dst == cur.Dst {
+			return e, cur, nil
+		}
+	}
+	return prev, cur, fmt.Errorf("no publish to %s before run %s", cur.Dst, cur.RunID)
+}
+
+// printDiff writes a table comparing the two runs and returns how many of
+// the measures checked by --max-ratio exceeded it.
+func printDiff(prev, cur manifest.Event) int {
+	fmt.Printf("Destination: %s\n", cur.Dst)
+	fmt.Printf("Previous: run %s at %s by %s (%s)\n", prev.RunID, prev.Time.Format(time.RFC3339), prev.Actor, prev.Outcome)
+	fmt.Printf("Current:  run %s at %s by %s (%s)\n\n", cur.RunID, cur.Time.Format(time.RFC3339), cur.Actor, cur.Outcome)
+
+	tw := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+	defer tw.Flush()
+	fmt.Fprintln(tw, "\tprevious\tcurrent\tchange\t")
+	row := func(name string, p, c float64, format func(float64) string, checked bool) int {
+		change := format(c - p)
+		if c > p {
+			change = "+" + change
+		}
+		if p > 0 {
+			change += fmt.Sprintf(" (%.1fx)", c/p)
+		}
+		flagged := checked && *maxRatio > 0 && c > p**maxRatio
+		if flagged {
+			change += " !"
+		}
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t\n", name, format(p), format(c), change)
+		if flagged {
+			return 1
+		}
+		return 0
+	}
+
+	n := 0
+	row("files", float64(prev.Files), float64(cur.Files), formatCount, false)
+	n += row("uploaded", float64(prev.Uploaded), float64(cur.Uploaded), formatCount, true)
+	n += row("bytes", float64(prev.Bytes), float64(cur.Bytes), formatBytes, true)
+	row("failed", float64(prev.Failed), float64(cur.Failed), formatCount, false)
+	n += row("duration", prev.Seconds, cur.Seconds, formatSeconds, true)
+	row("warnings", float64(len(prev.Warnings)), float64(len(cur.Warnings)), formatCount, false)
+	return n
+}
+
+func formatCount(n float64) string {
+	return fmt.Sprint(int64(n))
+}
+
+func formatSeconds(s float64) string {
+	return time.Duration(s * float64(time.Second)).Round(time.Millisecond).String()
+}
+
+func formatBytes(f float64) string {
+	const unit = 1024
+	n := int64(f)
+	if n < 0 {
+		return "-" + formatBytes(-f)
+	}
+	if n < unit {
+		return fmt.Sprintf("%d B", n)
+	}
+	div, exp := int64(unit), 0
+	for m := n / unit; m >= unit; m /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f %ciB", float64(n)/float64(div), "KMGTPE"[exp])
+}
@@ -0,0 +1,69 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"sync"
+
+	"github.com/dlorenc/gcs-manifest/pkg/manifest"
+	"github.com/dlorenc/gcs-manifest/pkg/server"
+)
+
+var (
+	addr               = flag.String("addr", ":"+port(), "address to listen on")
+	singleShot         = flag.Bool("single-shot", false, "exit after answering one publish request, e.g. as a Cloud Run job")
+	defaultCredentials = flag.Bool("allow-default-credentials", false, "upload with the server's own credentials when a request has no "+server.AuthHeader+" header")
+
+	useProfile = manifest.ProfileFlag(flag.CommandLine)
+)
+
+// port is where Cloud Run expects us to listen.
+func port() string {
+	if p := os.Getenv("PORT"); p != "" {
+		return p
+	}
+	return "8080"
+}
+
+func main() {
+	flag.Parse()
+	if err := useProfile(); err != nil {
+		log.Fatal(err)
+	}
+
+	h := &server.Handler{
+		AllowDefaultCredentials: *defaultCredentials,
+		Options:                 []manifest.Option{manifest.WithLog(os.Stderr)},
+	}
+	srv := &http.Server{Addr: *addr, Handler: h}
+
+	shutdown := make(chan struct{})
+	if *singleShot {
+		var once sync.Once
+		srv.Handler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			h.ServeHTTP(w, r)
+			if r.Method == http.MethodPost {
+				// Shut down from another goroutine: Shutdown waits for this
+				// request to finish.
+				once.Do(func() {
+					go func() {
+						srv.Shutdown(context.Background())
+						close(shutdown)
+					}()
+				})
+			}
+		})
+	}
+
+	fmt.Fprintln(os.Stderr, "Listening on", *addr)
+	if err := srv.ListenAndServe(); err != http.ErrServerClosed {
+		log.Fatal(err)
+	}
+	// ListenAndServe returns as soon as Shutdown starts; wait for the reply
+	// to finish going out.
+	<-shutdown
+}
@@ -0,0 +1,89 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"path"
+	"time"
+
+	"cloud.google.com/go/storage"
+	"github.com/dlorenc/gcs-manifest/pkg/manifest"
+)
+
+var (
+	manifestPath   = flag.String("manifest", "", "manifest to sign URLs for, gs:// or local; defaults to manifest.json under the prefix")
+	ttl            = flag.Duration("ttl", 24*time.Hour, "how long the URLs are valid for; at most 168h")
+	keyFile        = flag.String("key-file", "", "service account JSON key to sign with; defaults to the active service account")
+	serviceAccount = flag.String("service-account", "", "service account email to sign as through the IAM Credentials API, instead of the active one")
+
+	useProfile = manifest.ProfileFlag(flag.CommandLine)
+)
+
+func main() {
+	flag.Usage = func() {
+		fmt.Fprintf(os.Stderr, "usage: %s [flags] gs://bucket/path\n", os.Args[0])
+		fmt.Fprintf(os.Stderr, "\nPrints a JSON object mapping each path in the manifest to a V4 signed URL for its object, so it can be fetched without GCS credentials.\n\n")
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+	if err := useProfile(); err != nil {
+		log.Fatal(err)
+	}
+	if flag.NArg() != 1 {
+		flag.Usage()
+		os.Exit(2)
+	}
+	if *ttl <= 0 || *ttl > 7*24*time.Hour {
+		log.Fatal("--ttl must be positive and at most 168h, the longest GCS allows")
+	}
+	if *keyFile != "" && *serviceAccount != "" {
+		log.Fatal("--key-file and --service-account can't both be given")
+	}
+	dst := flag.Arg(0)
+	uri := *manifestPath
+	if uri == "" {
+		bucketName, prefix := manifest.ParsePrefix(dst)
+		uri = "gs://" + path.Join(bucketName, prefix, manifest.Name)
+	}
+
+	ctx := context.Background()
+	client, err := storage.NewClient(ctx)
+	if err != nil {
+		log.Fatalf("Failed to create new GCS client: %v", err)
+	}
+	m, err := manifest.Read(ctx, client, uri)
+	if err != nil {
+		log.Fatalf("Failed to read manifest: %v", err)
+	}
+	if m.Partial() {
+		fmt.Fprintf(os.Stderr, "WARNING: %s is PARTIAL: %d files failed to upload and have no URL\n", uri, len(m.Missing))
+	}
+	for _, p := range m.Paths() {
+		if e := m.Files[p]; e.Encryption != nil && e.Encryption.CustomerKeySHA256 != "" {
+			fmt.Fprintf(os.Stderr, "WARNING: %s is encrypted with a customer-supplied key, which fetching its URL needs too\n", p)
+		}
+	}
+
+	var signer *manifest.URLSigner
+	if *keyFile != "" {
+		signer, err = manifest.LoadURLSigner(*keyFile)
+	} else {
+		signer, err = manifest.NewIAMURLSigner(ctx, *serviceAccount)
+	}
+	if err != nil {
+		log.Fatalf("Failed to set up signing: %v", err)
+	}
+	urls, err := manifest.SignedURLs(m, dst, *ttl, signer)
+	if err != nil {
+		log.Fatal(err)
+	}
+	enc := json.NewEncoder(os.Stdout)
+	enc.SetIndent("", "  ")
+	if err := enc.Encode(urls); err != nil {
+		log.Fatal(err)
+	}
+}
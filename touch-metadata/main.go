@@ -0,0 +1,97 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"path"
+	"sort"
+	"strings"
+
+	"cloud.google.com/go/storage"
+	"github.com/dlorenc/gcs-manifest/pkg/manifest"
+)
+
+// metadataFlag collects repeated --metadata key=value flags.
+type metadataFlag map[string]string
+
+func (m metadataFlag) String() string {
+	var kvs []string
+	for k, v := range m {
+		kvs = append(kvs, k+"="+v)
+	}
+	sort.Strings(kvs)
+	return strings.Join(kvs, ",")
+}
+
+func (m metadataFlag) Set(s string) error {
+	split := strings.SplitN(s, "=", 2)
+	if len(split) != 2 || split[0] == "" {
+		return fmt.Errorf("expected key=value, got %q", s)
+	}
+	m[split[0]] = split[1]
+	return nil
+}
+
+var (
+	dst          = flag.String("dst", "", "GCS path the manifest's files were uploaded to")
+	manifestPath = flag.String("manifest", "", "local manifest to read; defaults to manifest.json under --dst")
+	cacheControl = flag.String("cache-control", "", "Cache-Control to set on every object")
+	contentType  = flag.String("content-type", "", "Content-Type to set on every object")
+	metadata     = metadataFlag{}
+
+	useProfile = manifest.ProfileFlag(flag.CommandLine)
+)
+
+func main() {
+	flag.Var(metadata, "metadata", "custom metadata key=value to set on every object (repeatable)")
+	flag.Parse()
+	if err := useProfile(); err != nil {
+		log.Fatal(err)
+	}
+
+	bucketName, gcsPath, err := manifest.ParseURI(*dst)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	var uattrs storage.ObjectAttrsToUpdate
+	if *cacheControl != "" {
+		uattrs.CacheControl = *cacheControl
+	}
+	if *contentType != "" {
+		uattrs.ContentType = *contentType
+	}
+	if len(metadata) > 0 {
+		uattrs.Metadata = metadata
+	}
+	if uattrs.CacheControl == nil && uattrs.ContentType == nil && uattrs.Metadata == nil {
+		log.Fatal("nothing to update: set --cache-control, --content-type or --metadata")
+	}
+
+	ctx := context.Background()
+	client, err := storage.NewClient(ctx)
+	if err != nil {
+		log.Fatalf("Failed to create new GCS client: %v", err)
+	}
+	bucket := client.Bucket(bucketName)
+
+	uri := *manifestPath
+	if uri == "" {
+		uri = "gs://" + path.Join(bucketName, gcsPath, manifest.Name)
+	}
+	mfst, err := manifest.Read(ctx, client, uri)
+	if err != nil {
+		log.Fatalf("Failed to read manifest: %v", err)
+	}
+
+	for _, o := range mfst.ObjectNames() {
+		name := path.Join(gcsPath, o)
+		fmt.Fprintln(os.Stderr, "Updating:", name)
+		if _, err := bucket.Object(name).Update(ctx, uattrs); err != nil {
+			log.Fatalf("Failed to update %s: %v", name, err)
+		}
+	}
+}
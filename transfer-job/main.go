@@ -0,0 +1,209 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"path"
+	"strings"
+	"time"
+
+	"cloud.google.com/go/storage"
+	"github.com/dlorenc/gcs-manifest/pkg/manifest"
+	"google.golang.org/api/option"
+	htransport "google.golang.org/api/transport/http"
+)
+
+const transferJobsURL = "https://storagetransfer.googleapis.com/v1/transferJobs"
+
+var (
+	src          = flag.String("src", "", "GCS path the manifest's files are published under")
+	dst          = flag.String("dst", "", "GCS path to copy them to")
+	manifestPath = flag.String("manifest", "", "manifest listing the files to copy; defaults to manifest.json under --src")
+	listPath     = flag.String("list", "", "gs:// URI to write the job's object list to; the transfer service reads it from there")
+	project      = flag.String("project", "", "project to create the transfer job in")
+	submit       = flag.Bool("submit", false, "create the job instead of just printing it")
+
+	useProfile = manifest.ProfileFlag(flag.CommandLine)
+)
+
+// The types below are the parts of the Storage Transfer Service
+// TransferJob resource this command fills in.
+type transferJob struct {
+	Description  string       `json:"description"`
+	ProjectID    string       `json:"projectId"`
+	Status       string       `json:"status"`
+	TransferSpec transferSpec `json:"transferSpec"`
+	Schedule     schedule     `json:"schedule"`
+}
+
+type transferSpec struct {
+	GCSDataSource    gcsData          `json:"gcsDataSource"`
+	GCSDataSink      gcsData          `json:"gcsDataSink"`
+	TransferManifest transferManifest `json:"transferManifest"`
+}
+
+type gcsData struct {
+	BucketName string `json:"bucketName"`
+	Path       string `json:"path,omitempty"`
+}
+
+type transferManifest struct {
+	Location string `json:"location"`
+}
+
+type schedule struct {
+	ScheduleStartDate date `json:"scheduleStartDate"`
+	ScheduleEndDate   date `json:"scheduleEndDate"`
+}
+
+type date struct {
+	Year  int `json:"year"`
+	Month int `json:"month"`
+	Day   int `json:"day"`
+}
+
+func main() {
+	flag.Parse()
+	if err := useProfile(); err != nil {
+		log.Fatal(err)
+	}
+	if *src == "" || *dst == "" || *listPath == "" || *project == "" {
+		log.Fatal("--src, --dst, --list and --project are required")
+	}
+	srcBucket, srcPath, err := manifest.ParseURI(*src)
+	if err != nil {
+		log.Fatal(err)
+	}
+	dstBucket, dstPath, err := manifest.ParseURI(*dst)
+	if err != nil {
+		log.Fatal(err)
+	}
+	listBucket, listName, err := manifest.ParseURI(*listPath)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	ctx := context.Background()
+	client, err := storage.NewClient(ctx)
+	if err != nil {
+		log.Fatalf("Failed to create new GCS client: %v", err)
+	}
+
+	uri := *manifestPath
+	if uri == "" {
+		uri = "gs://" + path.Join(srcBucket, srcPath, manifest.Name)
+	}
+	mfst, err := manifest.Read(ctx, client, uri)
+	if err != nil {
+		log.Fatalf("Failed to read manifest: %v", err)
+	}
+
+	// The manifest itself is copied too, so the destination can be checked
+	// against it once the job has finished.
+	objects := append(mfst.ObjectNames(), manifest.Name)
+	list, err := objectList(objects)
+	if err != nil {
+		log.Fatal(err)
+	}
+	w := client.Bucket(listBucket).Object(listName).NewWriter(ctx)
+	w.ContentType = "text/csv"
+	if _, err := w.Write(list); err != nil {
+		w.Close()
+		log.Fatalf("Failed to write object list: %v", err)
+	}
+	if err := w.Close(); err != nil {
+		log.Fatalf("Failed to write object list: %v", err)
+	}
+	fmt.Fprintf(os.Stderr, "Wrote %d objects to %s\n", len(objects), *listPath)
+
+	// A job whose schedule starts and ends on the same day runs once.
+	now := time.Now().UTC()
+	today := date{Year: now.Year(), Month: int(now.Month()), Day: now.Day()}
+	job := transferJob{
+		Description: fmt.Sprintf("gcs-manifest copy of %s to %s", *src, *dst),
+		ProjectID:   *project,
+		Status:      "ENABLED",
+		TransferSpec: transferSpec{
+			GCSDataSource:    gcsData{BucketName: srcBucket, Path: dirPath(srcPath)},
+			GCSDataSink:      gcsData{BucketName: dstBucket, Path: dirPath(dstPath)},
+			TransferManifest: transferManifest{Location: *listPath},
+		},
+		Schedule: schedule{ScheduleStartDate: today, ScheduleEndDate: today},
+	}
+	b, err := json.MarshalIndent(job, "", "  ")
+	if err != nil {
+		log.Fatal(err)
+	}
+	if !*submit {
+		fmt.Println(string(b))
+		return
+	}
+
+	name, err := createJob(ctx, b)
+	if err != nil {
+		log.Fatalf("Failed to create transfer job: %v", err)
+	}
+	fmt.Println("Created transfer job:", name)
+}
+
+// objectList renders names as the single-column CSV the transfer service
+// expects, each relative to the job's source path.
+func objectList(names []string) ([]byte, error) {
+	var buf bytes.Buffer
+	w := csv.NewWriter(&buf)
+	for _, n := range names {
+		if err := w.Write([]string{n}); err != nil {
+			return nil, err
+		}
+	}
+	w.Flush()
+	return buf.Bytes(), w.Error()
+}
+
+// dirPath returns p with the trailing slash the transfer service requires
+// of source and sink paths.
+func dirPath(p string) string {
+	if p == "" || strings.HasSuffix(p, "/") {
+		return p
+	}
+	return p + "/"
+}
+
+func createJob(ctx context.Context, body []byte) (string, error) {
+	hc, _, err := htransport.NewClient(ctx, option.WithScopes("https://www.googleapis.com/auth/cloud-platform"))
+	if err != nil {
+		return "", err
+	}
+	req, err := http.NewRequest(http.MethodPost, transferJobsURL, bytes.NewReader(body))
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := hc.Do(req.WithContext(ctx))
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	b, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return "", err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("%s: %s", resp.Status, bytes.TrimSpace(b))
+	}
+	var created struct {
+		Name string `json:"name"`
+	}
+	if err := json.Unmarshal(b, &created); err != nil {
+		return "", err
+	}
+	return created.Name, nil
+}
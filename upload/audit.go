@@ -0,0 +1,45 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"net/http"
+
+	"cloud.google.com/go/storage"
+	"google.golang.org/api/option"
+	htransport "google.golang.org/api/transport/http"
+)
+
+// auditHeader is attached to every request; GCS copies x-goog-custom-audit-*
+// headers into Cloud Audit Logs entries, so a run's requests can be found
+// again by its ID.
+const auditHeader = "x-goog-custom-audit-run-id"
+
+type auditTransport struct {
+	runID string
+	base  http.RoundTripper
+}
+
+func (t *auditTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	req = req.Clone(req.Context())
+	req.Header.Set(auditHeader, t.runID)
+	return t.base.RoundTrip(req)
+}
+
+// newClient returns a GCS client that tags its requests with runID.
+func newClient(ctx context.Context, runID string) (*storage.Client, error) {
+	trans, err := htransport.NewTransport(ctx, &auditTransport{runID: runID, base: http.DefaultTransport}, option.WithScopes(storage.ScopeFullControl))
+	if err != nil {
+		return nil, err
+	}
+	return storage.NewClient(ctx, option.WithHTTPClient(&http.Client{Transport: trans}))
+}
+
+func newRunID() (string, error) {
+	b := make([]byte, 8)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
@@ -0,0 +1,51 @@
+package main
+
+import (
+	"context"
+	"fmt"
+
+	"cloud.google.com/go/storage"
+	"github.com/dlorenc/gcs-manifest/pkg/manifest"
+)
+
+// estimate reports what uploading sources is expected to cost and, under
+// --max-estimated-cost, fails if that is over budget. The storage class is
+// --estimate-storage-class or --storage-class, or else the bucket's if
+// client can read it.
+func estimate(ctx context.Context, client *storage.Client, sources []manifest.Source, opts []manifest.Option) error {
+	class := *estimateClass
+	if class == "" {
+		class = *storageClass
+	}
+	if class == "" && client != nil {
+		bucketName, _, err := manifest.ParseURI(*dst)
+		if err != nil {
+			return err
+		}
+		attrs, err := client.Bucket(bucketName).Attrs(ctx)
+		if err != nil {
+			fmt.Fprintf(info, "Can't read the storage class of %s, estimating for STANDARD: %v\n", bucketName, err)
+		} else {
+			class = attrs.StorageClass
+		}
+	}
+	if class == "" {
+		class = "STANDARD"
+	}
+	prices := manifest.DefaultPrices
+	if *pricesPath != "" {
+		var err error
+		if prices, err = manifest.LoadPrices(*pricesPath); err != nil {
+			return err
+		}
+	}
+	e, err := manifest.EstimateCost(sources, class, prices, *sync, opts...)
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(info, "Estimated cost: $%.4f: %d Class A and %d Class B operations for $%.4f, and %d bytes of %s storage for $%.4f a month\n", e.Cost(), e.ClassA, e.ClassB, e.OperationsCost, e.Bytes, e.StorageClass, e.StorageCost)
+	if *maxCost > 0 && e.Cost() > *maxCost {
+		return fmt.Errorf("estimated cost $%.4f is over --max-estimated-cost $%.4f; nothing was uploaded", e.Cost(), *maxCost)
+	}
+	return nil
+}
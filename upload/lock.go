@@ -0,0 +1,24 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+)
+
+// writeFileLocked writes data to path while holding an exclusive lock on a
+// sibling "<path>.lock" file, so concurrent invocations sharing a workspace
+// can't interleave their writes.
+func writeFileLocked(path string, data []byte, perm os.FileMode) error {
+	lf, err := os.OpenFile(path+".lock", os.O_CREATE|os.O_RDWR, 0644)
+	if err != nil {
+		return err
+	}
+	defer lf.Close()
+
+	if err := lockFile(lf); err != nil {
+		return err
+	}
+	defer unlockFile(lf)
+
+	return ioutil.WriteFile(path, data, perm)
+}
@@ -1,147 +1,931 @@
 package main
 
 import (
+	"bytes"
 	"context"
-	"crypto/sha256"
-	"encoding/hex"
 	"encoding/json"
+	"errors"
 	"flag"
 	"fmt"
-	"io"
 	"io/ioutil"
 	"log"
 	"os"
 	"path/filepath"
 	"strings"
-	"sync"
+	"time"
 
 	"cloud.google.com/go/storage"
+	"github.com/dlorenc/gcs-manifest/pkg/manifest"
 )
 
 var (
-	src          = flag.String("src", ".", "path to local directory or file to upload")
-	dst          = flag.String("dst", "", "path to upload to on GCS")
+	src          = flag.String("src", ".", "path to local directory or file to upload, a glob such as dist/*.tar.gz, or a gs:// prefix to copy from")
+	dst          = flag.String("dst", "", "path to upload to on GCS, or an s3://bucket/prefix or file://dir mirror")
 	manifestPath = flag.String("manifest", ".", "local path to write manifest to")
+	lockfilePath = flag.String("lockfile", "", "optional local path to write a lockfile pinning each object's generation")
+	deadline     = flag.Duration("deadline", 0, "optional time budget for the entire run, e.g. 45m; each file gets a share of the time left, and the run stops early, reporting what was uploaded, once a file overruns its share or the rate so far says the rest won't make it")
+	parallelism  = flag.Int("parallelism", manifest.DefaultParallelism(), "how many files to upload at once")
+
+	deadLetterPath = flag.String("dead-letter", "dead-letter.json", "where to record files that still fail after retrying")
+	retryFailed    = flag.String("retry-failed", "", "dead-letter file from a previous run; upload only its failed files and write the complete manifest")
+
+	checkpointPath = flag.String("checkpoint", "", "if set, where to save the files finished so far while uploading, every few seconds, for --resume; removed once the manifest is published")
+	resume         = flag.Bool("resume", false, "continue the interrupted upload saved in --checkpoint, skipping files it finished that haven't changed since")
+
+	stableOnly = flag.Bool("stable-only", false, "skip files whose size or modification time changes while being checked")
+	stableWait = flag.Duration("stable-wait", 2*time.Second, "how long --stable-only watches files for changes")
+
+	consistentSnapshot = flag.Bool("consistent-snapshot", false, "record the path, size and modification time of every file under --src before uploading, and fail without publishing a manifest if any file was added, removed or changed by the end")
+
+	dryRun = flag.Bool("dry-run", false, "hash --src and print what would be uploaded and the manifest, without contacting GCS")
+
+	sync       = flag.Bool("sync", false, "only upload files that are new or changed since the manifest already at --dst")
+	onConflict = flag.String("on-conflict", string(manifest.LocalWins), "with --sync, what to do with a file whose object was written by someone else after the file was last modified: local-wins, remote-wins, fail or skip")
+
+	watch         = flag.Bool("watch", false, "after uploading, keep polling --src and publish added, changed and removed files until interrupted")
+	watchInterval = flag.Duration("watch-interval", 2*time.Second, "how often --watch checks --src for changes")
+
+	retryUnstable = flag.Bool("retry-unstable", false, "treat files modified during upload as failed so they are retried")
+
+	retries         = flag.Int("retries", 3, "how many times to retry each failed file upload, with exponential backoff")
+	continueOnError = flag.Bool("continue-on-error", false, "keep uploading the other files when one fails even after --retries, instead of stopping at the first, and publish a manifest marked partial if any still fail")
+	chunkSize       = flag.Int("chunk-size", 16<<20, "chunk size in bytes for resumable file uploads; 0 uploads each file in one request")
+	partSize        = flag.Int64("composite-part-size", 0, "upload files larger than this many bytes as up to 32 parts, each checked by GCS, composed into one object, recording each part's digest in the manifest; 0 disables composite uploads")
+	spoolMax        = flag.Int64("spool-max-size", 0, "copy each source file of at most this many bytes to local disk before hashing and uploading it, retrying reads that fail, so a slow or flaky source filesystem can't break an upload in progress; 0 disables spooling")
+	spoolDir        = flag.String("spool-dir", "", "directory to spool files to with --spool-max-size, which needs room for --parallelism of them; defaults to the system temporary directory")
+
+	maxBandwidth   = flag.String("max-bandwidth", "", "cap on the upload rate across all files, e.g. 50MiB/s; unlimited if unset")
+	maxRequestRate = flag.Float64("max-requests-per-second", 0, "cap on object operations started a second across all files; 0 means no limit")
+
+	maxCost       = flag.Float64("max-estimated-cost", 0, "abort before uploading anything if the estimated cost in USD, of operations plus a month's storage, is over this; 0 means no limit")
+	estimateClass = flag.String("estimate-storage-class", "", "storage class to estimate costs for; defaults to --storage-class, or else the bucket's, or STANDARD if it can't be read")
+	pricesPath    = flag.String("prices", "", "JSON file mapping storage classes to {storageGBMonth, classA, classB} prices in USD to estimate costs with, instead of US multi-region list prices")
+
+	manifestRetries   = flag.Int("manifest-retries", 5, "how many times to retry uploading the manifest")
+	manifestChunkSize = flag.Int("manifest-chunk-size", 16<<20, "chunk size in bytes for the resumable manifest upload")
+
+	runID = flag.String("run-id", "", "ID sent with every request for correlating audit logs; generated if unset")
+
+	maxDepth = flag.Int("max-depth", 0, "fail if --src has directories nested deeper than this; 0 means no limit")
+	maxFiles = flag.Int("max-files", 0, "fail if --src contains more than this many files; 0 means no limit")
+
+	strict = flag.Bool("strict", false, "fail instead of leaving any file under --src out of the manifest: named pipes, sockets and devices, symlinks without --preserve-links, files --include, --exclude or --gcsignore filter out, unstable or changing files, and conflicts --on-conflict=skip would skip; can't be used with --continue-on-error")
+
+	oneFileSystem = flag.Bool("one-file-system", false, "don't descend into directories on other filesystems than --src")
+	preserveLinks = flag.Bool("preserve-links", false, "record symlinks within --src, with their targets, instead of skipping them")
+	preserveMode  = flag.Bool("preserve-mode", false, "record each file's permission bits so that download restores them")
+
+	ignoreFile = flag.Bool("gcsignore", false, "skip files matched by a .gcsignore file, in .gitignore syntax, at the root of --src")
+	include    = stringsFlag{}
+	exclude    = stringsFlag{}
+
+	eventLog = flag.String("event-log", "", "optional gs:// URI of an append-only NDJSON log object to record this publish in")
+	actor    = flag.String("actor", manifest.DefaultActor(), "who to record as publishing in --event-log")
+
+	notifyWebhooks = stringsFlag{}
+	notifyTopics   = stringsFlag{}
+
+	signManifest = flag.Bool("sign", false, "write a detached signature next to the manifest, as manifest.json.sig, and a bundle naming the signing key, as manifest.json.bundle")
+	kmsKey       = flag.String("kms-key", "", "Cloud KMS key version to sign with, projects/*/locations/*/keyRings/*/cryptoKeys/*/cryptoKeyVersions/*")
+	certChain    = flag.String("cert-chain", "", "optional PEM file of the signing key's certificate and its chain, leaf first, to record in the signature bundle")
+
+	publicManifest = flag.String("public-manifest", "", "optional name of a second, reduced manifest to upload next to manifest.json")
+	publicInclude  = stringsFlag{}
+
+	ociRef = flag.String("oci-ref", "", "optional registry reference, e.g. ghcr.io/org/artifacts:v1.2.3, to push the manifest to as an OCI artifact")
+
+	hashedManifest = flag.Bool("hashed-manifest", false, "also publish the manifest by its digest, as "+manifest.HashedDir+"/sha256-<hex>.json under --dst, never overwriting it, and point --channel at that copy")
+
+	channel     = flag.String("channel", "", "optional channel, such as beta, to point at the published manifest")
+	channelsDir = flag.String("channels", "", "gs:// directory --channel is kept in; defaults to gs://<bucket>/"+manifest.ChannelDir)
+
+	cacheControl = flag.String("cache-control", "", "Cache-Control to set on every uploaded file, e.g. public, max-age=3600")
+	metadata     = stringsFlag{}
+	expire       = stringsFlag{}
+	routes       = stringsFlag{}
+	languages    = stringsFlag{}
+	charsets     = stringsFlag{}
+
+	failOnWarn = flag.Bool("fail-on-warn", false, "exit with status 1 if anything is warned about, such as a skipped symlink; warnings found while walking --src stop the run before anything is uploaded")
+
+	cas      = flag.Bool("cas", false, "store files under blobs/sha256/<digest>, each distinct content once, with the manifest mapping paths to them; files already stored aren't uploaded again")
+	compress = flag.String("compress", "", "compress each file before uploading it and store it with that Content-Encoding; only gzip is supported")
+
+	storageClass = flag.String("storage-class", "", "storage class, such as NEARLINE or ARCHIVE, to store every uploaded file in instead of the bucket's default; gs:// only")
+
+	bucketConfig = flag.String("bucket-config", "", "JSON file mapping bucket names to the defaults, by flag name, to use when --dst is in that bucket, e.g. {\"archive-bucket\": {\"storage-class\": \"ARCHIVE\", \"parallelism\": 4}}; only transfer and object settings such as these can be set, and flags given explicitly win; defaults to gcs-manifest/buckets.json in the user config dir, if it exists")
+
+	encryptionKMSKey = flag.String("encryption-kms-key", "", "Cloud KMS key (CMEK) to encrypt every object with, projects/*/locations/*/keyRings/*/cryptoKeys/*; gs:// only")
+	encryptionKey    = flag.String("encryption-key", "", "base64 AES-256 customer-supplied key (CSEK) to encrypt every file with; download and verify need it too; gs:// only")
+
+	digestFile = flag.String("digests", "", "file of precomputed sha256 digests of the files in --src, in sha256sum format, to record instead of hashing them")
+	spotCheck  = flag.Float64("spot-check", 0, "fraction of the files in --digests to hash anyway, failing any whose digest is wrong")
+
+	progress = flag.String("progress", "", "report overall progress to stderr instead of a line per file: plain, bar or json")
+
+	output   = flag.String("output", "manifest", "what to print on stdout: manifest, the manifest JSON, or json, one JSON object describing the run with the manifest's location, each file's status, bytes uploaded, duration, errors and the process's peak memory, CPU time, open files and goroutines")
+	logLevel = flag.String("log-level", "info", "what to log to stderr: info, warn or error")
+	quiet    = flag.Bool("quiet", false, "only log errors, like --log-level=error")
+
+	useProfile = manifest.ProfileFlag(flag.CommandLine)
+
+	replicas = stringsFlag{}
+	quorum   = flag.Int("quorum", 0, "how many destinations, --dst included, must have a file before it is recorded in the manifest, with --replica; 0 means all of them")
 )
 
-type uploaded struct {
-	sha  string
-	path string
+// stringsFlag collects a repeatable string flag.
+type stringsFlag []string
+
+func (s *stringsFlag) String() string { return strings.Join(*s, ",") }
+
+func (s *stringsFlag) Set(v string) error {
+	*s = append(*s, v)
+	return nil
+}
+
+// deadLetter is written when files still fail after the retry pass. It
+// carries everything needed for a follow-up --retry-failed run to finish
+// the job and write the complete manifest.
+type deadLetter struct {
+	Dst      string            `json:"dst"`
+	Uploaded []deadLetterEntry `json:"uploaded"`
+	Failed   []deadLetterEntry `json:"failed"`
+}
+
+// deadLetterEntry is a file of a deadLetter: its manifest entry, or just
+// its path and any link target if it failed, plus what the manifest doesn't
+// record.
+type deadLetterEntry struct {
+	manifest.Entry
+	Source     string `json:"source,omitempty"`
+	Generation int64  `json:"generation,omitempty"`
+	Error      string `json:"error,omitempty"`
 }
 
 func main() {
+	flag.Var(&include, "include", "only upload files matching this pattern (repeatable)")
+	flag.Var(&exclude, "exclude", "skip files and directories matching this .gitignore-style pattern (repeatable)")
+	flag.Var(&metadata, "metadata", "custom key=value metadata to set on every uploaded file (repeatable)")
+	flag.Var(&expire, "expire", "pattern=ttl, such as nightly/**=720h, recording in the manifest that files matching pattern expire ttl after upload, for prune --expired; the first matching rule applies (repeatable)")
+	flag.Var(&languages, "content-language", "pattern=language, such as fr/**=fr, setting the Content-Language of files matching pattern; the first matching rule applies (repeatable)")
+	flag.Var(&charsets, "charset", "pattern=charset, such as **/*.txt=utf-8, setting the charset parameter of the Content-Type of files matching pattern; the first matching rule applies (repeatable)")
+	flag.Var(&routes, "route", "from=to, such as bin=releases, storing the files under the directory from of --src under the prefix to of --dst instead, with each file's object recorded in the one manifest; the first matching route applies (repeatable)")
+	flag.Var(&notifyWebhooks, "notify-webhook", "URL to POST a JSON notification to when the run starts and when it completes or fails; gs:// --dst only (repeatable)")
+	flag.Var(&notifyTopics, "notify-pubsub", "Pub/Sub topic, projects/<project>/topics/<topic>, to publish a JSON notification to when the run starts and when it completes or fails; gs:// --dst only (repeatable)")
+	flag.Var(&publicInclude, "public-include", "glob of paths to keep in --public-manifest (repeatable); all paths are kept if unset")
+	flag.Var(&replicas, "replica", "gs:// path, such as a bucket in another region, to also copy every object and the manifest to before the run succeeds; see --quorum (repeatable)")
 	flag.Parse()
-	bucketName, gcsPath, err := parseUri(*dst)
-	if err != nil {
+	if err := useProfile(); err != nil {
+		log.Fatal(err)
+	}
+	var (
+		sources []manifest.Source
+		prior   []manifest.File
+	)
+	if *sync && *retryFailed != "" {
+		log.Fatal("--sync and --retry-failed can't be used together")
+	}
+	if *onConflict != string(manifest.LocalWins) && !*sync {
+		log.Fatal("--on-conflict needs --sync")
+	}
+	if *resume && (*sync || *retryFailed != "" || *dryRun || *checkpointPath == "") {
+		log.Fatal("--resume needs --checkpoint, and can't be used with --sync, --retry-failed or --dry-run")
+	}
+	var checkpoint *manifest.Checkpoint
+	if *resume {
+		var err error
+		if checkpoint, err = manifest.LoadCheckpoint(*checkpointPath); err != nil {
+			log.Fatalf("Failed to read checkpoint: %v", err)
+		}
+		if *dst == "" {
+			*dst = checkpoint.Dst
+		}
+		if *dst != checkpoint.Dst {
+			log.Fatalf("--checkpoint %s is of an upload to %s, not %s", *checkpointPath, checkpoint.Dst, *dst)
+		}
+	}
+	if *retryFailed != "" {
+		dl, err := readDeadLetter(*retryFailed)
+		if err != nil {
+			log.Fatal(err)
+		}
+		if *dst == "" {
+			*dst = dl.Dst
+		}
+		for _, e := range dl.Uploaded {
+			prior = append(prior, manifest.File{
+				Path:            e.Path,
+				Source:          e.Source,
+				Digest:          e.Digest,
+				Size:            e.Size,
+				ContentType:     e.ContentType,
+				CRC32C:          e.CRC32C,
+				ModTime:         e.ModTime,
+				Generation:      e.Generation,
+				Encryption:      e.Encryption,
+				ContentEncoding: e.ContentEncoding,
+				StoredSize:      e.StoredSize,
+				StoredDigest:    e.StoredDigest,
+				Object:          e.Object,
+				Mode:            e.Mode,
+				Link:            e.Link,
+				Parts:           e.Parts,
+				Expires:         e.Expires,
+			})
+		}
+		for _, e := range dl.Failed {
+			sources = append(sources, manifest.Source{Path: e.Source, RelPath: e.Path, Link: e.Link})
+		}
+	}
+	// Only now is the destination known for --resume and --retry-failed.
+	if err := applyBucketDefaults(); err != nil {
 		log.Fatal(err)
 	}
+	if *watch && (*retryFailed != "" || *dryRun || manifest.IsStorageURI(*dst)) {
+		log.Fatal("--watch can't be used with --retry-failed, --dry-run or a non-GCS --dst")
+	}
+	if (len(notifyWebhooks) > 0 || len(notifyTopics) > 0) && manifest.IsStorageURI(*dst) {
+		log.Fatal("--notify-webhook and --notify-pubsub need a gs:// --dst")
+	}
+	if len(routes) > 0 && manifest.IsStorageURI(*dst) {
+		log.Fatal("--route needs a gs:// --dst")
+	}
+	if *consistentSnapshot && (*retryFailed != "" || manifest.IsStorageURI(*dst) || strings.HasPrefix(*src, "gs://")) {
+		log.Fatal("--consistent-snapshot needs a local --src and a gs:// --dst, and can't be used with --retry-failed")
+	}
+	if !manifest.IsStorageURI(*dst) {
+		if _, _, err := manifest.ParseURI(*dst); err != nil {
+			log.Fatal(err)
+		}
+	}
+	if len(replicas) > 0 && manifest.IsStorageURI(*dst) {
+		log.Fatal("--replica needs a gs:// --dst")
+	}
+	if *quorum != 0 && len(replicas) == 0 {
+		log.Fatal("--quorum needs --replica")
+	}
 
 	ctx := context.Background()
-	client, err := storage.NewClient(ctx)
-	if err != nil {
-		log.Fatalf("Failed to create new GCS client: %v", err)
+	if *deadline > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, *deadline)
+		defer cancel()
 	}
-
-	absRoot, err := filepath.Abs(*src)
+	if *output != "manifest" && *output != "json" {
+		log.Fatalf("--output must be manifest or json, not %q", *output)
+	}
+	if *output == "json" {
+		go sampleUsage()
+	}
+	logw, err := setLogLevel()
 	if err != nil {
 		log.Fatal(err)
 	}
+	var reporter *progressReporter
+	if *progress != "" {
+		if reporter, err = newProgressReporter(*progress, os.Stderr); err != nil {
+			log.Fatal(err)
+		}
+		if logw == os.Stderr {
+			logw = reporter
+		}
+	}
+	opts := []manifest.Option{
+		manifest.WithLog(logw),
+		manifest.WithManifestRetries(*manifestRetries),
+		manifest.WithManifestChunkSize(*manifestChunkSize),
+		manifest.WithMaxDepth(*maxDepth),
+		manifest.WithMaxFiles(*maxFiles),
+		manifest.WithParallelism(*parallelism),
+		manifest.WithRetries(*retries),
+		manifest.WithChunkSize(*chunkSize),
+		manifest.WithInclude(include...),
+		manifest.WithExclude(exclude...),
+	}
+	if *maxBandwidth != "" {
+		bps, err := parseBandwidth(*maxBandwidth)
+		if err != nil {
+			log.Fatal(err)
+		}
+		opts = append(opts, manifest.WithMaxBandwidth(bps))
+	}
+	if *partSize > 0 {
+		opts = append(opts, manifest.WithCompositeUpload(*partSize))
+	}
+	if *spoolMax > 0 {
+		opts = append(opts, manifest.WithSpool(*spoolDir, *spoolMax))
+	}
+	if *maxRequestRate > 0 {
+		opts = append(opts, manifest.WithMaxRequestRate(*maxRequestRate))
+	}
+	if *stableOnly {
+		opts = append(opts, manifest.WithStableOnly(*stableWait))
+	}
+	if *retryUnstable {
+		opts = append(opts, manifest.WithRetryUnstable())
+	}
+	if *consistentSnapshot {
+		opts = append(opts, manifest.WithConsistentSnapshot(*src))
+	}
+	if *continueOnError {
+		opts = append(opts, manifest.WithContinueOnError())
+	}
+	if d, ok := ctx.Deadline(); ok {
+		opts = append(opts, manifest.WithDeadline(d))
+	}
+	if *checkpointPath != "" {
+		opts = append(opts, manifest.WithCheckpoint(*checkpointPath))
+	}
+	if *oneFileSystem {
+		opts = append(opts, manifest.WithOneFileSystem())
+	}
+	if *preserveLinks {
+		opts = append(opts, manifest.WithPreserveLinks())
+	}
+	if *preserveMode {
+		opts = append(opts, manifest.WithPreserveMode())
+	}
+	if *strict {
+		if *continueOnError {
+			log.Fatal("--strict can't be used with --continue-on-error, which publishes partial manifests")
+		}
+		opts = append(opts, manifest.WithStrict())
+	}
+	if *ignoreFile {
+		opts = append(opts, manifest.WithIgnoreFile())
+	}
+	for _, e := range expire {
+		r, err := manifest.ParseExpiryRule(e)
+		if err != nil {
+			log.Fatal(err)
+		}
+		opts = append(opts, manifest.WithExpiry(r))
+	}
+	for _, l := range languages {
+		pattern, language, err := splitRule(l)
+		if err != nil {
+			log.Fatal(err)
+		}
+		opts = append(opts, manifest.WithMetadataRules(manifest.MetadataRule{Pattern: pattern, Language: language}))
+	}
+	for _, c := range charsets {
+		pattern, charset, err := splitRule(c)
+		if err != nil {
+			log.Fatal(err)
+		}
+		opts = append(opts, manifest.WithMetadataRules(manifest.MetadataRule{Pattern: pattern, Charset: charset}))
+	}
+	for _, rt := range routes {
+		r, err := manifest.ParseRoute(rt)
+		if err != nil {
+			log.Fatal(err)
+		}
+		opts = append(opts, manifest.WithRoutes(r))
+	}
+	if reporter != nil {
+		opts = append(opts, manifest.WithProgress(reporter.report))
+	}
+	if *cas {
+		opts = append(opts, manifest.WithContentAddressed())
+	}
+	if *sync {
+		p, err := manifest.ParseConflictPolicy(*onConflict)
+		if err != nil {
+			log.Fatal(err)
+		}
+		opts = append(opts, manifest.WithConflictPolicy(p))
+	}
+	if *compress != "" {
+		opts = append(opts, manifest.WithCompression(*compress))
+	}
+	if *encryptionKMSKey != "" {
+		opts = append(opts, manifest.WithKMSKey(*encryptionKMSKey))
+	}
+	if *storageClass != "" {
+		opts = append(opts, manifest.WithStorageClass(*storageClass))
+	}
+	if *encryptionKey != "" {
+		key, err := manifest.ParseEncryptionKey(*encryptionKey)
+		if err != nil {
+			log.Fatal(err)
+		}
+		opts = append(opts, manifest.WithEncryptionKey(key))
+	}
+	if *spotCheck < 0 || *spotCheck > 1 {
+		log.Fatal("--spot-check must be between 0 and 1")
+	}
+	if *spotCheck > 0 && *digestFile == "" {
+		log.Fatal("--spot-check needs --digests")
+	}
+	if *digestFile != "" {
+		digests, err := manifest.LoadDigests(*digestFile)
+		if err != nil {
+			log.Fatal(err)
+		}
+		opts = append(opts, manifest.WithDigests(digests), manifest.WithSpotCheck(*spotCheck))
+	}
+	if *cacheControl != "" {
+		opts = append(opts, manifest.WithCacheControl(*cacheControl))
+	}
+	if len(metadata) > 0 {
+		md := map[string]string{}
+		for _, kv := range metadata {
+			i := strings.Index(kv, "=")
+			if i <= 0 {
+				log.Fatalf("--metadata %q: want key=value", kv)
+			}
+			md[kv[:i]] = kv[i+1:]
+		}
+		opts = append(opts, manifest.WithMetadata(md))
+	}
+	opts = append(opts, manifest.WithWarnings(runWarnings.add))
 
-	bucket := client.Bucket(bucketName)
-	mfst := map[string]string{}
-	wg := sync.WaitGroup{}
+	if *dryRun {
+		if *retryFailed == "" {
+			var err error
+			if sources, err = manifest.Expand(*src, opts...); err != nil {
+				log.Fatal(err)
+			}
+		}
+		if err := plan(sources, opts); err != nil {
+			fatal(err)
+		}
+		runWarnings.check("this was a dry run")
+		return
+	}
 
-	shaCh := make(chan uploaded)
+	if manifest.IsStorageURI(*dst) {
+		if err := uploadToStorage(ctx, opts); err != nil {
+			fatal(err)
+		}
+		return
+	}
 
-	if err := filepath.Walk(absRoot, func(path string, fi os.FileInfo, err error) error {
-		fmt.Fprintln(os.Stderr, "Uploading:", path)
-		if !fi.Mode().IsRegular() {
-			return nil
+	if *runID == "" {
+		var err error
+		if *runID, err = newRunID(); err != nil {
+			log.Fatal(err)
 		}
-		// We might start with a file, not a directory.
-		var relPath string
-		if absRoot == path {
-			relPath = path
-		} else {
-			relPath, err = filepath.Rel(absRoot, path)
-			if err != nil {
-				return err
-			}
+	}
+	fmt.Fprintln(info, "Run ID:", *runID)
+	client, err := newClient(ctx, *runID)
+	if err != nil {
+		printResult(failureResult(err))
+		log.Fatalf("Failed to create new GCS client: %v", err)
+	}
+	opts = append(opts, manifest.WithClient(client), manifest.WithRunID(*runID))
+	for _, url := range notifyWebhooks {
+		opts = append(opts, manifest.WithNotifier(manifest.NewWebhookNotifier(url)))
+	}
+	for _, topic := range notifyTopics {
+		n, err := manifest.NewPubSubNotifier(ctx, topic)
+		if err != nil {
+			log.Fatal(err)
 		}
-
-		wg.Add(1)
-		go func() {
-			defer wg.Done()
-			sha, err := uploadFile(ctx, relPath, gcsPath, bucket)
+		opts = append(opts, manifest.WithNotifier(n))
+	}
+	if *signManifest {
+		if *kmsKey == "" {
+			log.Fatal("--sign needs --kms-key; keyless signing isn't supported")
+		}
+		signer, err := manifest.NewKMSSigner(ctx, *kmsKey)
+		if err != nil {
+			log.Fatal(err)
+		}
+		opts = append(opts, manifest.WithSigner(signer))
+		if *certChain != "" {
+			b, err := ioutil.ReadFile(*certChain)
 			if err != nil {
 				log.Fatal(err)
 			}
-			shaCh <- uploaded{
-				sha:  sha,
-				path: relPath,
+			certs, err := manifest.ParseCertChain(b)
+			if err != nil {
+				log.Fatalf("--cert-chain %s: %v", *certChain, err)
 			}
-			fmt.Fprintln(os.Stderr, "Uploaded:", path)
-		}()
-		return nil
-	}); err != nil {
-		log.Fatal(err)
+			opts = append(opts, manifest.WithCertChain(certs))
+		}
+	}
+	if len(replicas) > 0 {
+		opts = append(opts, manifest.WithReplicas(*quorum, replicas...))
+	}
+	u, err := manifest.NewUploader(ctx, opts...)
+	if err != nil {
+		fatal(err)
+	}
+
+	if *retryFailed == "" {
+		sources, err = u.Expand(ctx, *src)
+		if err != nil {
+			fatal(err)
+		}
+	}
+	if sources, err = excludeOwnFiles(sources); err != nil {
+		fatal(err)
+	}
+	if checkpoint != nil {
+		sources, prior = u.Resume(sources, checkpoint)
+		fmt.Fprintf(info, "Resuming: %d files already uploaded, %d to go\n", len(prior), len(sources))
+	}
+	runWarnings.check("nothing was uploaded")
+	if *maxCost > 0 {
+		if err := estimate(ctx, client, sources, opts); err != nil {
+			fatal(err)
+		}
 	}
 
-	// Close the channel when everything is written.
-	go func() {
-		wg.Wait()
-		close(shaCh)
-	}()
-	for f := range shaCh {
-		mfst[f.path] = f.sha
+	var res *manifest.Result
+	if *sync {
+		res, err = u.Sync(ctx, sources, *dst)
+	} else {
+		res, err = u.UploadSources(ctx, sources, *dst, prior)
+	}
+	var uerr *manifest.UploadError
+	if errors.As(err, &uerr) {
+		if ctx.Err() != nil {
+			fmt.Fprintf(os.Stderr, "Deadline of %v exceeded.\n", *deadline)
+		}
+		reportFailures(uerr)
+		if err := writeDeadLetter(*deadLetterPath, uerr); err != nil {
+			log.Fatal(err)
+		}
+		outcome := "failure"
+		if uerr.Manifest != nil {
+			outcome = "partial"
+		}
+		recordEvent(client, manifest.Event{Files: len(uerr.Uploaded) + len(uerr.Failed), Uploaded: len(uerr.Uploaded), Failed: len(uerr.Failed), Outcome: outcome, Error: uerr.Error()})
+		fmt.Fprintln(os.Stderr, "Finish with: upload --retry-failed", *deadLetterPath)
+		printResult(uploadResult(uerr))
+		os.Exit(1)
+	}
+	if err != nil {
+		recordEvent(client, manifest.Event{Outcome: "failure", Error: err.Error()})
+		fatal(err)
 	}
 
-	m, err := json.Marshal(mfst)
+	m, err := json.Marshal(res.Manifest)
+	if err != nil {
+		log.Fatal(err)
+	}
+	digest, err := manifest.Digest(bytes.NewReader(m))
 	if err != nil {
 		log.Fatal(err)
 	}
-	mfstObj := bucket.Object(filepath.Join(gcsPath, "manifest.json")).NewWriter(ctx)
-	defer mfstObj.Close()
-	if _, err := mfstObj.Write(m); err != nil {
+	recordEvent(client, manifest.Event{ManifestDigest: digest, Files: len(res.Files), Uploaded: res.Uploaded, Bytes: res.Bytes, Outcome: "success"})
+	if err := writeFileLocked(filepath.Join(*manifestPath, manifest.Name), m, 0644); err != nil {
 		log.Fatal(err)
 	}
+	writeExtras(ctx, client, u, res)
+	if !printResult(successResult(res, digest)) {
+		fmt.Print(string(m))
+	}
+	runWarnings.check("the manifest was still published")
+	if *watch {
+		watchSrc(ctx, client, u, res)
+	}
+}
+
+// writeExtras uploads --public-manifest, writes --lockfile and pushes
+// --oci-ref and --channel for res.
+func writeExtras(ctx context.Context, client *storage.Client, u *manifest.Uploader, res *manifest.Result) {
+	if *publicManifest != "" {
+		pub, err := res.Manifest.Filter(publicInclude)
+		if err != nil {
+			log.Fatal(err)
+		}
+		if err := u.WriteManifest(ctx, *dst, *publicManifest, pub); err != nil {
+			log.Fatalf("Failed to upload public manifest: %v", err)
+		}
+	}
+	if *lockfilePath != "" {
+		entries, err := manifest.LockEntries(*dst, res.Files)
+		if err != nil {
+			log.Fatal(err)
+		}
+		if err := writeFileLocked(*lockfilePath, manifest.FormatLockfile(entries), 0644); err != nil {
+			log.Fatal(err)
+		}
+	}
+	if *ociRef != "" {
+		digest, err := manifest.PushOCI(ctx, *ociRef, res.Manifest, *dst)
+		if err != nil {
+			log.Fatalf("Failed to push %s: %v", *ociRef, err)
+		}
+		fmt.Fprintf(info, "Pushed %s@%s\n", *ociRef, digest)
+	}
+	published := *dst
+	if *hashedManifest {
+		uri, err := u.WriteHashedManifest(ctx, *dst, res.Manifest)
+		if err != nil {
+			log.Fatalf("Failed to publish the manifest by digest: %v", err)
+		}
+		fmt.Fprintln(info, "Published", uri)
+		published = uri
+	}
+	if *channel != "" {
+		dir := *channelsDir
+		if dir == "" {
+			var err error
+			if dir, err = manifest.DefaultChannelDir(*dst); err != nil {
+				log.Fatal(err)
+			}
+		}
+		c, err := manifest.PublishChannel(ctx, client, manifest.ChannelURI(dir, *channel), published)
+		if err != nil {
+			log.Fatalf("Failed to publish to channel %s: %v", *channel, err)
+		}
+		fmt.Fprintf(info, "Pointed channel %s at %s#%d\n", *channel, c.Manifest, c.Generation)
+	}
+}
 
-	if err := ioutil.WriteFile(filepath.Join(*manifestPath, "manifest.json"), m, 0644); err != nil {
+// watchSrc republishes --src whenever it changes, for --watch, until ctx
+// is done.
+func watchSrc(ctx context.Context, client *storage.Client, u *manifest.Uploader, res *manifest.Result) {
+	fmt.Fprintf(info, "Watching %s for changes\n", *src)
+	expand := func(ctx context.Context) ([]manifest.Source, error) {
+		sources, err := u.Expand(ctx, *src)
+		if err != nil {
+			return nil, err
+		}
+		return excludeOwnFiles(sources)
+	}
+	err := u.Watch(ctx, expand, *dst, res.Files, *watchInterval, func(res *manifest.Result, err error) {
+		var uerr *manifest.UploadError
+		switch {
+		case errors.As(err, &uerr):
+			reportFailures(uerr)
+			recordEvent(client, manifest.Event{Files: len(uerr.Uploaded) + len(uerr.Failed), Uploaded: len(uerr.Uploaded), Failed: len(uerr.Failed), Outcome: "failure", Error: uerr.Error()})
+			printResult(uploadResult(uerr))
+			return
+		case err != nil:
+			fmt.Fprintf(os.Stderr, "Failed to publish changes: %v\n", err)
+			printResult(failureResult(err))
+			return
+		}
+		m, err := json.Marshal(res.Manifest)
+		if err != nil {
+			log.Fatal(err)
+		}
+		digest, err := manifest.Digest(bytes.NewReader(m))
+		if err != nil {
+			log.Fatal(err)
+		}
+		recordEvent(client, manifest.Event{ManifestDigest: digest, Files: len(res.Files), Uploaded: res.Uploaded, Bytes: res.Bytes, Outcome: "success"})
+		if err := writeFileLocked(filepath.Join(*manifestPath, manifest.Name), m, 0644); err != nil {
+			log.Fatal(err)
+		}
+		writeExtras(ctx, client, u, res)
+		fmt.Fprintf(info, "Published %s: %d files, %d uploaded\n", digest, len(res.Files), res.Uploaded)
+		printResult(successResult(res, digest))
+	})
+	if err != nil && ctx.Err() == nil {
 		log.Fatal(err)
 	}
-	fmt.Print(string(m))
 }
 
-func uploadFile(ctx context.Context, relPath string, gcsPath string, bucket *storage.BucketHandle) (string, error) {
-	gcsObj := bucket.Object(filepath.Join(gcsPath, relPath)).NewWriter(ctx)
-	defer gcsObj.Close()
+// plan prints what uploading sources would do and the manifest that would
+// be written, for --dry-run.
+func plan(sources []manifest.Source, opts []manifest.Option) error {
+	sources, err := excludeOwnFiles(sources)
+	if err != nil {
+		return err
+	}
+	planned, m, err := manifest.Plan(sources, *dst, opts...)
+	if err != nil {
+		return err
+	}
+	var total int64
+	for _, p := range planned {
+		fmt.Fprintf(info, "Would upload: %s -> %s (%d bytes)\n", p.Source, p.Object, p.Size)
+		total += p.Size
+	}
+	fmt.Fprintf(info, "Would upload %d files, %d bytes, and write %s\n", len(planned), total, manifest.Name)
+	if !manifest.IsStorageURI(*dst) {
+		if err := estimate(context.Background(), nil, sources, opts); err != nil {
+			return err
+		}
+	}
+	if printResult(planResult(planned, m)) {
+		return nil
+	}
+	b, err := json.Marshal(m)
+	if err != nil {
+		return err
+	}
+	fmt.Print(string(b))
+	return nil
+}
 
-	fmt.Fprintln(os.Stderr, "reading:", relPath)
-	f, err := os.Open(relPath)
+// uploadToStorage uploads --src to a non-GCS --dst. Only the core upload
+// is supported there; the flags that rely on GCS features are refused.
+func uploadToStorage(ctx context.Context, opts []manifest.Option) error {
+	if *sync || *retryFailed != "" || *resume || *lockfilePath != "" || *eventLog != "" || *publicManifest != "" || *signManifest || *ociRef != "" || *channel != "" || *hashedManifest {
+		return fmt.Errorf("--sync, --retry-failed, --resume, --lockfile, --event-log, --public-manifest, --sign, --oci-ref, --channel and --hashed-manifest need a gs:// --dst")
+	}
+	st, err := manifest.OpenStorage(ctx, *dst, nil)
+	if err != nil {
+		return err
+	}
+	sources, err := manifest.Expand(*src, opts...)
+	if err != nil {
+		return err
+	}
+	if sources, err = excludeOwnFiles(sources); err != nil {
+		return err
+	}
+	runWarnings.check("nothing was uploaded")
+	res, err := manifest.UploadTo(ctx, st, sources, opts...)
+	var uerr *manifest.UploadError
+	if errors.As(err, &uerr) {
+		reportFailures(uerr)
+		printResult(uploadResult(uerr))
+		os.Exit(1)
+	}
+	if err != nil {
+		return err
+	}
+	m, err := json.Marshal(res.Manifest)
+	if err != nil {
+		return err
+	}
+	if err := writeFileLocked(filepath.Join(*manifestPath, manifest.Name), m, 0644); err != nil {
+		return err
+	}
+	digest, err := manifest.Digest(bytes.NewReader(m))
 	if err != nil {
-		return "", err
+		return err
 	}
-	defer f.Close()
+	if !printResult(successResult(res, digest)) {
+		fmt.Print(string(m))
+	}
+	runWarnings.check("the manifest was still published")
+	return nil
+}
+
+// reportFailures summarizes a failed upload on stderr. Files that were
+// only stopped because another failed are counted rather than listed.
+func reportFailures(uerr *manifest.UploadError) {
+	if uerr.Manifest != nil {
+		fmt.Fprintf(os.Stderr, "%d files uploaded, %d failed; the manifest written is PARTIAL and lists them as missing.\n", len(uerr.Uploaded), len(uerr.Failed))
+	} else {
+		fmt.Fprintf(os.Stderr, "%d files uploaded, %d failed; no manifest written.\n", len(uerr.Uploaded), len(uerr.Failed))
+	}
+	stopped, late := 0, 0
+	for _, f := range uerr.Failed {
+		if errors.Is(f.Err, manifest.ErrStopped) {
+			stopped++
+			continue
+		}
+		if f.Err == manifest.ErrDeadline {
+			late++
+			continue
+		}
+		switch {
+		case manifest.IsPermanentFSError(f.Err):
+			fmt.Fprintf(os.Stderr, "  failed: %s: %v (won't succeed until the file is fixed)\n", f.Path, f.Err)
+		case manifest.IsTransientFSError(f.Err):
+			fmt.Fprintf(os.Stderr, "  failed: %s: %v (transient, still failing after retries)\n", f.Path, f.Err)
+		default:
+			fmt.Fprintf(os.Stderr, "  failed: %s: %v\n", f.Path, f.Err)
+		}
+	}
+	if stopped > 0 {
+		fmt.Fprintf(os.Stderr, "  %d more stopped after the first failure; see --continue-on-error\n", stopped)
+	}
+	if late > 0 {
+		fmt.Fprintf(os.Stderr, "  %d more stopped because the run couldn't finish within --deadline\n", late)
+	}
+}
 
-	// Get the hash
-	h := sha256.New()
-	// Setup a tee to write to GCS and the hash at the same time.
-	tee := io.TeeReader(f, gcsObj)
+// bucketFlags are the flags --bucket-config may set: how to write to a
+// bucket and what to store in it, but never what to upload or where.
+var bucketFlags = []string{
+	"parallelism", "retries", "chunk-size", "composite-part-size",
+	"max-bandwidth", "max-requests-per-second", "manifest-retries", "manifest-chunk-size",
+	"storage-class", "cache-control", "compress", "encryption-kms-key",
+	"metadata", "expire", "content-language", "charset", "kms-key", "cert-chain",
+}
 
-	if _, err := io.Copy(h, tee); err != nil {
-		return "", err
+// applyBucketDefaults applies the defaults --bucket-config has for the
+// bucket of --dst, if it is a gs:// one.
+func applyBucketDefaults() error {
+	path := *bucketConfig
+	if path == "" {
+		var err error
+		if path, err = manifest.BucketConfigPath(); err != nil {
+			return nil
+		}
+		if _, err := os.Stat(path); os.IsNotExist(err) {
+			return nil
+		}
 	}
+	config, err := manifest.LoadBucketConfig(path)
+	if err != nil {
+		return err
+	}
+	if manifest.IsStorageURI(*dst) {
+		return nil
+	}
+	bucketName, _, err := manifest.ParseURI(*dst)
+	if err != nil {
+		return nil
+	}
+	defaults, ok := config[bucketName]
+	if !ok {
+		return nil
+	}
+	if err := defaults.Apply(flag.CommandLine, bucketFlags); err != nil {
+		return fmt.Errorf("%s: defaults for %s: %v", path, bucketName, err)
+	}
+	fmt.Fprintf(os.Stderr, "Using the defaults in %s for %s\n", path, bucketName)
+	return nil
+}
 
-	return "sha256:" + hex.EncodeToString(h.Sum(nil)), nil
+// splitRule splits a --content-language or --charset rule into its
+// pattern and value.
+func splitRule(s string) (string, string, error) {
+	i := strings.LastIndex(s, "=")
+	if i <= 0 || i == len(s)-1 {
+		return "", "", fmt.Errorf("invalid rule %q: want pattern=value", s)
+	}
+	return s[:i], s[i+1:], nil
 }
 
-func parseUri(uri string) (string, string, error) {
-	if strings.HasPrefix(uri, "gs://") {
-		uri = strings.TrimPrefix(uri, "gs://")
+// started is when the run started, for the duration recorded in
+// --event-log.
+var started = time.Now()
+
+// recordEvent records a publish in --event-log, if set. Failing to record
+// it is reported but doesn't fail the run: the upload itself is done. It
+// has its own timeout so failures are recorded even after --deadline.
+func recordEvent(client *storage.Client, e manifest.Event) {
+	if *eventLog == "" {
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+	e.Action = "publish"
+	e.Actor = *actor
+	e.RunID = *runID
+	e.Dst = *dst
+	e.Warnings = runWarnings.all()
+	e.Seconds = time.Since(started).Seconds()
+	if err := manifest.RecordEvent(ctx, client, *eventLog, e); err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to record event in %s: %v\n", *eventLog, err)
 	}
-	split := strings.SplitN(uri, "/", 2)
-	if len(split) != 2 {
-		return "", "", fmt.Errorf("invalid uri: %s", uri)
+}
+
+// excludeOwnFiles drops the files this command writes itself, which end up
+// inside --src when --manifest, --lockfile, --dead-letter or --checkpoint
+// point there, along with the "<path>.lock" files writeFileLocked leaves
+// next to them, as well as anything that would collide with
+// --public-manifest.
+func excludeOwnFiles(sources []manifest.Source) ([]manifest.Source, error) {
+	own := map[string]bool{}
+	for _, p := range []string{filepath.Join(*manifestPath, manifest.Name), *lockfilePath, *deadLetterPath, *checkpointPath} {
+		if p == "" {
+			continue
+		}
+		abs, err := filepath.Abs(p)
+		if err != nil {
+			return nil, err
+		}
+		own[abs] = true
+		own[abs+".lock"] = true
+	}
+	var kept []manifest.Source
+	for _, s := range sources {
+		if own[s.Path] || (*publicManifest != "" && (s.RelPath == *publicManifest || s.RelPath == *publicManifest+manifest.SignatureSuffix || s.RelPath == *publicManifest+manifest.BundleSuffix)) {
+			fmt.Fprintln(info, "Skipping output file:", s.Path)
+			continue
+		}
+		kept = append(kept, s)
+	}
+	return kept, nil
+}
+
+func readDeadLetter(path string) (*deadLetter, error) {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	dl := &deadLetter{}
+	if err := json.Unmarshal(b, dl); err != nil {
+		return nil, fmt.Errorf("parsing %s: %v", path, err)
+	}
+	return dl, nil
+}
+
+func writeDeadLetter(path string, uerr *manifest.UploadError) error {
+	dl := deadLetter{Dst: *dst}
+	for _, f := range uerr.Uploaded {
+		dl.Uploaded = append(dl.Uploaded, deadLetterEntry{Entry: f.Entry(), Source: f.Source, Generation: f.Generation})
+	}
+	for _, f := range uerr.Failed {
+		dl.Failed = append(dl.Failed, deadLetterEntry{Entry: manifest.Entry{Path: f.Path, Link: f.Link}, Source: f.Source, Error: f.Err.Error()})
+	}
+	b, err := json.MarshalIndent(dl, "", "  ")
+	if err != nil {
+		return err
 	}
-	return split[0], split[1], nil
+	return writeFileLocked(path, b, 0644)
 }
@@ -0,0 +1,187 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/dlorenc/gcs-manifest/pkg/manifest"
+)
+
+// info is where progress messages go: stderr, unless --log-level or
+// --quiet turned them off.
+var info io.Writer = os.Stderr
+
+// logWarnings is set when warnings are logged by themselves, because
+// --log-level=warn turned off the uploader's log they are otherwise part
+// of.
+var logWarnings bool
+
+// setLogLevel applies --log-level and --quiet, returning the writer the
+// uploader should log to.
+func setLogLevel() (io.Writer, error) {
+	level := *logLevel
+	if *quiet {
+		level = "error"
+	}
+	switch level {
+	case "info":
+		return os.Stderr, nil
+	case "warn":
+		logWarnings = true
+	case "error":
+	default:
+		return nil, fmt.Errorf("--log-level must be info, warn or error, not %q", level)
+	}
+	info = ioutil.Discard
+	return ioutil.Discard, nil
+}
+
+// runResult is what --output=json prints for a run.
+type runResult struct {
+	// Outcome is success, partial, failure or dry-run.
+	Outcome        string             `json:"outcome"`
+	Manifest       string             `json:"manifest,omitempty"`
+	ManifestDigest string             `json:"manifestDigest,omitempty"`
+	Files          []fileResult       `json:"files"`
+	Uploaded       int                `json:"uploaded"`
+	Bytes          int64              `json:"bytes"`
+	Seconds        float64            `json:"seconds"`
+	Warnings       []manifest.Warning `json:"warnings,omitempty"`
+	Errors         []string           `json:"errors,omitempty"`
+	Resources      resourceUsage      `json:"resources"`
+}
+
+// fileResult is one file of a runResult.
+type fileResult struct {
+	Path string `json:"path"`
+	// Status is uploaded, unchanged (carried over from an earlier run),
+	// existing (already stored under --cas), linked, failed or planned.
+	Status string `json:"status"`
+	Size   int64  `json:"size"`
+	Error  string `json:"error,omitempty"`
+}
+
+// fileResults describes files, the first prior of which were carried over,
+// and failed.
+func fileResults(files []manifest.File, prior int, failed []manifest.Failure) []fileResult {
+	results := []fileResult{}
+	for i, f := range files {
+		status := "uploaded"
+		switch {
+		case i < prior:
+			status = "unchanged"
+		case f.Link != "":
+			status = "linked"
+		case f.Existing:
+			status = "existing"
+		}
+		results = append(results, fileResult{Path: f.Path, Status: status, Size: f.Size})
+	}
+	for _, f := range failed {
+		results = append(results, fileResult{Path: f.Path, Status: "failed", Error: f.Err.Error()})
+	}
+	return results
+}
+
+// printResult prints r on stdout for --output=json, filling in what every
+// run has in common. It returns false, printing nothing, otherwise.
+func printResult(r runResult) bool {
+	if *output != "json" {
+		return false
+	}
+	if r.Files == nil {
+		r.Files = []fileResult{}
+	}
+	r.Seconds = time.Since(started).Seconds()
+	r.Warnings = runWarnings.all()
+	r.Resources = resources()
+	if err := json.NewEncoder(os.Stdout).Encode(r); err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to print result: %v\n", err)
+	}
+	return true
+}
+
+// failureResult is the runResult of a run that failed with err before or
+// instead of uploading anything.
+func failureResult(err error) runResult {
+	return runResult{Outcome: "failure", Errors: []string{err.Error()}}
+}
+
+// fatal reports err as the outcome of the run for --output=json, and exits
+// with it.
+func fatal(err error) {
+	printResult(failureResult(err))
+	log.Fatal(err)
+}
+
+// uploadResult is the runResult of a run that ended with uerr.
+func uploadResult(uerr *manifest.UploadError) runResult {
+	r := runResult{
+		Outcome: "failure",
+		Files:   fileResults(uerr.Uploaded, uerr.Prior, uerr.Failed),
+	}
+	if uerr.Manifest != nil {
+		r.Outcome = "partial"
+		r.Manifest = manifestURI()
+	}
+	for _, f := range uerr.Uploaded[uerr.Prior:] {
+		if f.Existing || f.Link != "" {
+			continue
+		}
+		r.Uploaded++
+		if f.ContentEncoding != "" {
+			r.Bytes += f.StoredSize
+		} else {
+			r.Bytes += f.Size
+		}
+	}
+	for _, f := range uerr.Failed {
+		r.Errors = append(r.Errors, fmt.Sprintf("%s: %v", f.Path, f.Err))
+	}
+	return r
+}
+
+// successResult is the runResult of a run that published res, whose
+// manifest has the given digest.
+func successResult(res *manifest.Result, digest string) runResult {
+	return runResult{
+		Outcome:        "success",
+		Manifest:       manifestURI(),
+		ManifestDigest: digest,
+		Files:          fileResults(res.Files, res.Prior, nil),
+		Uploaded:       res.Uploaded,
+		Bytes:          res.Bytes,
+	}
+}
+
+// planResult is the runResult of a --dry-run that planned to upload
+// planned.
+func planResult(planned []manifest.PlannedFile, m *manifest.Manifest) runResult {
+	r := runResult{Outcome: "dry-run", Files: []fileResult{}}
+	for _, p := range m.Paths() {
+		r.Files = append(r.Files, fileResult{Path: p, Status: "planned", Size: m.Files[p].Size})
+	}
+	for _, p := range planned {
+		r.Bytes += p.Size
+	}
+	return r
+}
+
+// manifestURI is where the manifest a run publishes to --dst goes.
+func manifestURI() string {
+	if manifest.IsStorageURI(*dst) {
+		return strings.TrimSuffix(*dst, "/") + "/" + manifest.Name
+	}
+	bucketName, gcsPath, err := manifest.ParseURI(*dst)
+	if err != nil {
+		return ""
+	}
+	return "gs://" + path.Join(bucketName, gcsPath, manifest.Name)
+}
@@ -0,0 +1,132 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"strings"
+	gosync "sync" // sync is the --sync flag in this package
+	"time"
+
+	"github.com/dlorenc/gcs-manifest/pkg/manifest"
+)
+
+// plainInterval is how often --progress=plain prints a line; every second
+// would drown out everything else in a CI log.
+const plainInterval = 10 * time.Second
+
+const barWidth = 30
+
+// progressReporter renders upload progress to w in one of the --progress
+// modes. It is also the uploader's log writer, so that in bar mode log
+// lines are printed above the bar instead of through it.
+type progressReporter struct {
+	mode string
+	w    io.Writer
+
+	mu      gosync.Mutex
+	bar     string
+	printed time.Time
+}
+
+func newProgressReporter(mode string, w io.Writer) (*progressReporter, error) {
+	switch mode {
+	case "plain", "bar", "json":
+		return &progressReporter{mode: mode, w: w}, nil
+	}
+	return nil, fmt.Errorf("--progress must be plain, bar or json, not %q", mode)
+}
+
+func (r *progressReporter) Write(b []byte) (int, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.bar == "" {
+		return r.w.Write(b)
+	}
+	if _, err := io.WriteString(r.w, "\r\033[K"); err != nil {
+		return 0, err
+	}
+	n, err := r.w.Write(b)
+	if err != nil {
+		return n, err
+	}
+	_, err = io.WriteString(r.w, r.bar)
+	return n, err
+}
+
+func (r *progressReporter) report(p manifest.Progress) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	switch r.mode {
+	case "plain":
+		if !p.Done && time.Since(r.printed) < plainInterval {
+			return
+		}
+		r.printed = time.Now()
+		fmt.Fprintln(r.w, summary(p))
+	case "bar":
+		done := 0
+		if p.TotalBytes > 0 {
+			done = int(int64(barWidth) * p.Bytes / p.TotalBytes)
+		}
+		if done > barWidth {
+			done = barWidth
+		}
+		r.bar = fmt.Sprintf("[%s%s] %s", strings.Repeat("=", done), strings.Repeat(" ", barWidth-done), summary(p))
+		fmt.Fprint(r.w, "\r\033[K", r.bar)
+		if p.Done {
+			fmt.Fprintln(r.w)
+			r.bar = ""
+		}
+	case "json":
+		b, _ := json.Marshal(struct {
+			Files          int     `json:"files"`
+			TotalFiles     int     `json:"totalFiles"`
+			Failed         int     `json:"failed"`
+			Bytes          int64   `json:"bytes"`
+			TotalBytes     int64   `json:"totalBytes"`
+			ElapsedSeconds float64 `json:"elapsedSeconds"`
+			BytesPerSecond float64 `json:"bytesPerSecond"`
+			ETASeconds     float64 `json:"etaSeconds"`
+			Done           bool    `json:"done"`
+		}{
+			Files:          p.Files,
+			TotalFiles:     p.TotalFiles,
+			Failed:         p.Failed,
+			Bytes:          p.Bytes,
+			TotalBytes:     p.TotalBytes,
+			ElapsedSeconds: p.Elapsed.Seconds(),
+			BytesPerSecond: p.Rate(),
+			ETASeconds:     p.ETA().Seconds(),
+			Done:           p.Done,
+		})
+		fmt.Fprintln(r.w, string(b))
+	}
+}
+
+func summary(p manifest.Progress) string {
+	s := fmt.Sprintf("%d/%d files, %s/%s, %s/s", p.Files, p.TotalFiles, formatBytes(p.Bytes), formatBytes(p.TotalBytes), formatBytes(int64(p.Rate())))
+	if p.Failed > 0 {
+		s += fmt.Sprintf(", %d failed", p.Failed)
+	}
+	if p.Done {
+		return s + fmt.Sprintf(", done in %v", p.Elapsed.Round(time.Second))
+	}
+	if eta := p.ETA(); eta > 0 {
+		s += fmt.Sprintf(", ETA %v", eta.Round(time.Second))
+	}
+	return s
+}
+
+func formatBytes(n int64) string {
+	const unit = 1024
+	if n < unit {
+		return fmt.Sprintf("%d B", n)
+	}
+	div, exp := int64(unit), 0
+	for m := n / unit; m >= unit; m /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f %ciB", float64(n)/float64(div), "KMGTPE"[exp])
+}
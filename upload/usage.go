@@ -0,0 +1,74 @@
+package main
+
+import (
+	"io/ioutil"
+	"runtime"
+	gosync "sync" // sync is the --sync flag in this package
+	"time"
+)
+
+// sampleInterval is how often the high-water marks of open files and
+// goroutines are sampled; both can spike and fall back between samples,
+// so the marks are a floor.
+const sampleInterval = 250 * time.Millisecond
+
+// resourceUsage is the process's use of resources over a run, as
+// --output=json reports it, to see how an upload behaves on a runner with
+// little memory or a low file limit. Figures the platform can't provide
+// are left out.
+type resourceUsage struct {
+	PeakRSSBytes     int64   `json:"peakRSSBytes,omitempty"`
+	UserCPUSeconds   float64 `json:"userCPUSeconds"`
+	SystemCPUSeconds float64 `json:"systemCPUSeconds"`
+	MaxOpenFiles     int     `json:"maxOpenFiles,omitempty"`
+	MaxGoroutines    int     `json:"maxGoroutines"`
+}
+
+// usage tracks the high-water marks of the run that can only be sampled.
+var usage struct {
+	mu         gosync.Mutex
+	files      int
+	goroutines int
+}
+
+// sampleUsage samples open files and goroutines until the process exits.
+func sampleUsage() {
+	for {
+		sample()
+		time.Sleep(sampleInterval)
+	}
+}
+
+func sample() {
+	files := openFiles()
+	goroutines := runtime.NumGoroutine()
+	usage.mu.Lock()
+	defer usage.mu.Unlock()
+	if files > usage.files {
+		usage.files = files
+	}
+	if goroutines > usage.goroutines {
+		usage.goroutines = goroutines
+	}
+}
+
+// resources returns the resources used so far.
+func resources() resourceUsage {
+	sample()
+	usage.mu.Lock()
+	r := resourceUsage{MaxOpenFiles: usage.files, MaxGoroutines: usage.goroutines}
+	usage.mu.Unlock()
+	r.PeakRSSBytes, r.UserCPUSeconds, r.SystemCPUSeconds = rusage()
+	return r
+}
+
+// openFiles returns the number of files the process has open, or 0 where
+// there's no way to list them.
+func openFiles() int {
+	for _, dir := range []string{"/proc/self/fd", "/dev/fd"} {
+		if fds, err := ioutil.ReadDir(dir); err == nil {
+			return len(fds)
+		}
+	}
+	return 0
+}
@@ -0,0 +1,7 @@
+//go:build !darwin && !dragonfly && !freebsd && !linux && !netbsd && !openbsd
+// +build !darwin,!dragonfly,!freebsd,!linux,!netbsd,!openbsd
+
+package main
+
+// Resource usage isn't available here; it is reported as none.
+func rusage() (int64, float64, float64) { return 0, 0, 0 }
@@ -0,0 +1,29 @@
+//go:build darwin || dragonfly || freebsd || linux || netbsd || openbsd
+// +build darwin dragonfly freebsd linux netbsd openbsd
+
+package main
+
+import (
+	"runtime"
+	"syscall"
+	"time"
+)
+
+// rusage returns the peak resident set size of the process in bytes and
+// the CPU time it has used.
+func rusage() (int64, float64, float64) {
+	var ru syscall.Rusage
+	if err := syscall.Getrusage(syscall.RUSAGE_SELF, &ru); err != nil {
+		return 0, 0, 0
+	}
+	// Everywhere but on Darwin, the peak RSS is in kilobytes.
+	rss := int64(ru.Maxrss)
+	if runtime.GOOS != "darwin" {
+		rss *= 1024
+	}
+	return rss, seconds(ru.Utime), seconds(ru.Stime)
+}
+
+func seconds(tv syscall.Timeval) float64 {
+	return time.Duration(tv.Nano()).Seconds()
+}
@@ -0,0 +1,44 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	gosync "sync" // sync is the --sync flag in this package
+
+	"github.com/dlorenc/gcs-manifest/pkg/manifest"
+)
+
+// runWarnings collects the run's warnings for --fail-on-warn and
+// --event-log.
+var runWarnings = &warnings{}
+
+type warnings struct {
+	mu   gosync.Mutex
+	list []manifest.Warning
+}
+
+func (w *warnings) add(x manifest.Warning) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.list = append(w.list, x)
+	if logWarnings {
+		fmt.Fprintln(os.Stderr, "WARNING:", x)
+	}
+}
+
+func (w *warnings) all() []manifest.Warning {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return append([]manifest.Warning(nil), w.list...)
+}
+
+// check exits if --fail-on-warn was given and anything has been warned
+// about. done says how far the run got, for the message.
+func (w *warnings) check(done string) {
+	list := w.all()
+	if !*failOnWarn || len(list) == 0 {
+		return
+	}
+	fmt.Fprintf(os.Stderr, "%d warnings with --fail-on-warn; %s.\n", len(list), done)
+	os.Exit(1)
+}
@@ -0,0 +1,201 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"time"
+
+	"github.com/dlorenc/gcs-manifest/pkg/manifest"
+)
+
+var (
+	manifestURL = flag.String("manifest", "", "URL of the manifest to verify against")
+	baseURL     = flag.String("base-url", "", "URL the manifest paths are served under")
+
+	checkpointPath     = flag.String("checkpoint", "", "optional local file to record progress in, so an interrupted run resumes where it left off")
+	checkpointInterval = flag.Duration("checkpoint-interval", 10*time.Second, "how often to update --checkpoint")
+)
+
+// checkpoint records how far a run got. Paths are verified in sorted
+// order, so everything up to and including Last has been checked.
+type checkpoint struct {
+	// Manifest is the digest of the manifest being verified; a checkpoint
+	// for any other manifest is ignored.
+	Manifest string   `json:"manifest"`
+	Last     string   `json:"last"`
+	Checked  int      `json:"checked"`
+	Failed   []string `json:"failed,omitempty"`
+}
+
+func main() {
+	flag.Parse()
+	if *manifestURL == "" || *baseURL == "" {
+		log.Fatal("both --manifest and --base-url are required")
+	}
+	base, err := url.Parse(*baseURL)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	mfst, digest, err := fetchManifest(*manifestURL)
+	if err != nil {
+		log.Fatalf("Failed to fetch manifest: %v", err)
+	}
+
+	cp := checkpoint{Manifest: digest}
+	if *checkpointPath != "" {
+		prev, err := readCheckpoint(*checkpointPath)
+		if err != nil {
+			log.Fatal(err)
+		}
+		if prev != nil && prev.Manifest == digest {
+			fmt.Fprintf(os.Stderr, "Resuming after %s, %d files already checked\n", prev.Last, prev.Checked)
+			cp = *prev
+		}
+	}
+
+	// Walk the manifest in a stable order so reports are comparable, and so
+	// a checkpoint only needs the last path checked.
+	paths := mfst.Paths()
+	saved := time.Now()
+	for _, p := range paths {
+		if cp.Checked > 0 && p <= cp.Last {
+			continue
+		}
+		// A symlink has nothing stored to check.
+		if mfst.Files[p].Link != "" {
+			continue
+		}
+		u := fileURL(base, mfst.Files[p].ObjectName())
+		fmt.Fprintln(os.Stderr, "Verifying:", u)
+		sha, err := hashURL(u)
+		switch {
+		case err != nil:
+			fmt.Fprintf(os.Stderr, "FAILED: %s: %v\n", p, err)
+			cp.Failed = append(cp.Failed, p)
+		case sha != mfst.Files[p].Digest:
+			fmt.Fprintf(os.Stderr, "MISMATCH: %s: manifest has %s, got %s\n", p, mfst.Files[p].Digest, sha)
+			cp.Failed = append(cp.Failed, p)
+		default:
+			fmt.Println("OK:", p)
+		}
+		cp.Last = p
+		cp.Checked++
+
+		if *checkpointPath != "" && time.Since(saved) >= *checkpointInterval {
+			if err := writeCheckpoint(*checkpointPath, cp); err != nil {
+				log.Fatalf("Failed to write checkpoint: %v", err)
+			}
+			saved = time.Now()
+		}
+	}
+	// The run is complete, so there's nothing left to resume.
+	if *checkpointPath != "" {
+		if err := os.Remove(*checkpointPath); err != nil && !os.IsNotExist(err) {
+			log.Fatal(err)
+		}
+	}
+	if len(cp.Failed) > 0 {
+		log.Fatalf("%d of %d files failed verification", len(cp.Failed), len(paths))
+	}
+}
+
+// readCheckpoint returns nil if there is no checkpoint at p.
+func readCheckpoint(p string) (*checkpoint, error) {
+	b, err := ioutil.ReadFile(p)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var cp checkpoint
+	if err := json.Unmarshal(b, &cp); err != nil {
+		return nil, fmt.Errorf("parsing checkpoint %s: %v", p, err)
+	}
+	return &cp, nil
+}
+
+// writeCheckpoint replaces the checkpoint at p by renaming a temporary file
+// over it, so an interruption never leaves a truncated one behind.
+func writeCheckpoint(p string, cp checkpoint) error {
+	b, err := json.Marshal(cp)
+	if err != nil {
+		return err
+	}
+	tmp, err := ioutil.TempFile(filepath.Dir(p), ".checkpoint-")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(b); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), p)
+}
+
+// fetchManifest returns the manifest at u and the digest of its bytes.
+func fetchManifest(u string) (*manifest.Manifest, string, error) {
+	resp, err := get(u)
+	if err != nil {
+		return nil, "", err
+	}
+	defer resp.Body.Close()
+
+	b, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, "", err
+	}
+	m, err := manifest.Parse(b)
+	if err != nil {
+		return nil, "", err
+	}
+	digest, err := manifest.Digest(bytes.NewReader(b))
+	if err != nil {
+		return nil, "", err
+	}
+	return m, digest, nil
+}
+
+func hashURL(u string) (string, error) {
+	resp, err := get(u)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	return manifest.Digest(resp.Body)
+}
+
+func get(u string) (*http.Response, error) {
+	resp, err := http.Get(u)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		resp.Body.Close()
+		return nil, fmt.Errorf("GET %s: %s", u, resp.Status)
+	}
+	return resp, nil
+}
+
+// fileURL resolves an object name, relative to the manifest, against the
+// base URL.
+func fileURL(base *url.URL, p string) string {
+	u := *base
+	u.Path = path.Join(base.Path, p)
+	u.RawPath = ""
+	return u.String()
+}
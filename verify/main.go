@@ -0,0 +1,232 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"path"
+	"strings"
+	"time"
+
+	"cloud.google.com/go/storage"
+	"github.com/dlorenc/gcs-manifest/pkg/manifest"
+)
+
+var (
+	manifestPath = flag.String("manifest", "", "manifest to check against, gs:// or local; defaults to manifest.json under the prefix")
+	strict       = flag.Bool("strict", false, "hold the prefix to exactly what the manifest describes: report every other object under it, directory placeholders included, and the object count")
+	fullHash     = flag.Bool("sha256", false, "stream every object and compare its sha256, even where a CRC32C is recorded")
+	publicKeys   = stringsFlag{}
+	policyPath   = flag.String("policy", "", "verification policy file the manifest must satisfy")
+	maxAge       = flag.Duration("max-age", 0, "fail if the manifest was published longer ago than this, e.g. 24h")
+	parallelism  = flag.Int("parallelism", manifest.DefaultParallelism(), "how many objects to check at once")
+	archive      = flag.String("archive", "", "tar archive, optionally gzipped, or - for stdin, to check against the manifest instead of a destination, streaming it without extracting anything")
+	gsutilHashes = flag.String("gsutil-hashes", "", "output of gsutil hash for the published files, whose CRC32C and MD5 each object must also match; gs:// only")
+
+	encryptionKMSKey = flag.String("encryption-kms-key", "", "Cloud KMS key (CMEK) every object must be encrypted with; gs:// only")
+	encryptionKey    = flag.String("encryption-key", "", "base64 AES-256 customer-supplied key (CSEK) the files were uploaded with; gs:// only")
+
+	useProfile = manifest.ProfileFlag(flag.CommandLine)
+)
+
+// stringsFlag collects a repeatable string flag.
+type stringsFlag []string
+
+func (s *stringsFlag) String() string { return strings.Join(*s, ",") }
+
+func (s *stringsFlag) Set(v string) error {
+	*s = append(*s, v)
+	return nil
+}
+
+func main() {
+	flag.Var(&publicKeys, "verify-signature", "PEM public key the manifest's detached signature must verify with (repeatable, e.g. the old and new keys during a rotation)")
+	flag.Usage = func() {
+		fmt.Fprintf(os.Stderr, "usage: %s [flags] gs://bucket/path|s3://bucket/path|file://dir\n", os.Args[0])
+		fmt.Fprintf(os.Stderr, "       %s [flags] --archive bundle.tar.gz --manifest manifest.json\n", os.Args[0])
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+	if err := useProfile(); err != nil {
+		log.Fatal(err)
+	}
+	if *archive != "" && (flag.NArg() != 0 || *manifestPath == "") || *archive == "" && flag.NArg() != 1 {
+		flag.Usage()
+		os.Exit(2)
+	}
+	dst := flag.Arg(0)
+	if *archive != "" && (*gsutilHashes != "" || *encryptionKMSKey != "" || *encryptionKey != "" || *strict) {
+		log.Fatal("--gsutil-hashes, --encryption-kms-key, --encryption-key and --strict don't apply to --archive")
+	}
+
+	opts := []manifest.Option{
+		manifest.WithLog(os.Stderr),
+		manifest.WithParallelism(*parallelism),
+	}
+	if *fullHash {
+		opts = append(opts, manifest.WithFullHash())
+	}
+	if *strict {
+		opts = append(opts, manifest.WithStrictPrefix())
+	}
+	if (*encryptionKMSKey != "" || *encryptionKey != "") && manifest.IsStorageURI(dst) {
+		log.Fatal("--encryption-kms-key and --encryption-key are only supported for gs:// destinations")
+	}
+	if *encryptionKMSKey != "" {
+		opts = append(opts, manifest.WithKMSKey(*encryptionKMSKey))
+	}
+	if *encryptionKey != "" {
+		key, err := manifest.ParseEncryptionKey(*encryptionKey)
+		if err != nil {
+			log.Fatal(err)
+		}
+		opts = append(opts, manifest.WithEncryptionKey(key))
+	}
+	for _, k := range publicKeys {
+		pub, err := manifest.LoadPublicKey(k)
+		if err != nil {
+			log.Fatal(err)
+		}
+		opts = append(opts, manifest.WithPublicKey(pub))
+	}
+	if *policyPath != "" {
+		p, err := manifest.LoadPolicy(*policyPath)
+		if err != nil {
+			log.Fatal(err)
+		}
+		popts, err := p.Options()
+		if err != nil {
+			log.Fatal(err)
+		}
+		opts = append(opts, popts...)
+	}
+	if *gsutilHashes != "" {
+		// gsutil's checksums are compared with the ones GCS reports,
+		// which the other backends don't have.
+		if manifest.IsStorageURI(dst) {
+			log.Fatal("--gsutil-hashes is only supported for gs:// destinations")
+		}
+		hashes, err := readGsutilHashes(*gsutilHashes)
+		if err != nil {
+			log.Fatal(err)
+		}
+		opts = append(opts, manifest.WithGsutilHashes(hashes))
+	}
+	ctx := context.Background()
+	var (
+		uri          = *manifestPath
+		readManifest func(string) (*manifest.Manifest, error)
+		publishedAt  func(string) (time.Time, error)
+		verify       func(*manifest.Manifest) (*manifest.Report, error)
+	)
+	switch {
+	case *archive != "":
+		if strings.HasPrefix(uri, "gs://") {
+			client, err := storage.NewClient(ctx)
+			if err != nil {
+				log.Fatalf("Failed to create new GCS client: %v", err)
+			}
+			opts = append(opts, manifest.WithClient(client))
+		}
+		readManifest = func(uri string) (*manifest.Manifest, error) { return manifest.ReadManifest(ctx, uri, opts...) }
+		publishedAt = func(uri string) (time.Time, error) { return manifest.Published(ctx, uri, opts...) }
+		verify = func(m *manifest.Manifest) (*manifest.Report, error) {
+			if *archive == "-" {
+				return manifest.VerifyTar(os.Stdin, m)
+			}
+			f, err := os.Open(*archive)
+			if err != nil {
+				return nil, err
+			}
+			defer f.Close()
+			return manifest.VerifyTar(f, m)
+		}
+	case manifest.IsStorageURI(dst):
+		st, err := manifest.OpenStorage(ctx, dst, nil)
+		if err != nil {
+			log.Fatal(err)
+		}
+		if uri == "" {
+			uri = strings.TrimSuffix(dst, "/") + "/" + manifest.Name
+		}
+		readManifest = func(uri string) (*manifest.Manifest, error) { return manifest.ReadManifest(ctx, uri, opts...) }
+		publishedAt = func(uri string) (time.Time, error) { return manifest.Published(ctx, uri, opts...) }
+		verify = func(m *manifest.Manifest) (*manifest.Report, error) {
+			return manifest.VerifyStorage(ctx, st, m, opts...)
+		}
+	default:
+		v, err := manifest.NewVerifier(ctx, opts...)
+		if err != nil {
+			log.Fatal(err)
+		}
+		if uri == "" {
+			bucketName, prefix := manifest.ParsePrefix(dst)
+			uri = "gs://" + path.Join(bucketName, prefix, manifest.Name)
+		}
+		readManifest = func(uri string) (*manifest.Manifest, error) { return v.ReadManifest(ctx, uri) }
+		publishedAt = func(uri string) (time.Time, error) { return v.Published(ctx, uri) }
+		verify = func(m *manifest.Manifest) (*manifest.Report, error) { return v.Verify(ctx, m, dst) }
+	}
+
+	mfst, err := readManifest(uri)
+	if err != nil {
+		log.Fatalf("Failed to read manifest: %v", err)
+	}
+
+	stale := false
+	if *maxAge > 0 {
+		published, err := publishedAt(uri)
+		if err != nil {
+			log.Fatalf("Failed to check manifest age: %v", err)
+		}
+		if age := time.Since(published); age > *maxAge {
+			fmt.Printf("STALE: %s was published %v ago, at %s; the limit is %v\n", uri, age.Round(time.Second), published.UTC().Format(time.RFC3339), *maxAge)
+			stale = true
+		}
+	}
+
+	r, err := verify(mfst)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if len(r.Partial) > 0 {
+		fmt.Printf("PARTIAL: %s lists %d files that failed to upload\n", uri, len(r.Partial))
+		for _, p := range r.Partial {
+			fmt.Println("NOT UPLOADED:", p)
+		}
+	}
+	for _, p := range r.Missing {
+		fmt.Println("MISSING:", p)
+	}
+	for _, f := range r.Corrupted {
+		fmt.Printf("CORRUPTED: %s: %v\n", f.Path, f.Err)
+	}
+	for _, p := range r.Extra {
+		fmt.Println("EXTRA:", p)
+	}
+	for _, n := range r.Unmatched {
+		fmt.Println("NOT IN MANIFEST:", n)
+	}
+	if *strict {
+		fmt.Fprintf(os.Stderr, "Found %d objects under the prefix besides the manifest, expected %d\n", r.Objects, r.Expected)
+	}
+	fmt.Fprintf(os.Stderr, "Checked %d files: %d missing, %d corrupted, %d extra, %d not uploaded\n", r.Checked, len(r.Missing), len(r.Corrupted), len(r.Extra), len(r.Partial))
+	if !r.OK() || stale {
+		os.Exit(1)
+	}
+}
+
+func readGsutilHashes(p string) ([]manifest.GsutilHash, error) {
+	f, err := os.Open(p)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	hashes, err := manifest.ParseGsutilHashes(f)
+	if err != nil {
+		return nil, fmt.Errorf("reading %s: %v", p, err)
+	}
+	return hashes, nil
+}